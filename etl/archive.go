@@ -0,0 +1,199 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Archive of collector: tar stream, first entry is ArchiveManifestName, then one entry per spill file (spill-file format).
+const (
+	ArchiveManifestName = "MANIFEST"
+	ArchiveVersion      = 1
+
+	ArchiveComparatorBytewise = "bytewise"
+	ArchiveComparatorCustom   = "custom" // spill files are sorted by comparator of buffer, LoadFromArchive needs same args.Comparator
+)
+
+type archiveManifest struct {
+	Version     int      `json:"version"`
+	Compression string   `json:"compression"`
+	Comparator  string   `json:"comparator"`
+	BufferType  int      `json:"bufferType"`
+	Files       []string `json:"files"`
+}
+
+func (c *Collector) comparatorID() string {
+	if c.bufferComparator() != nil {
+		return ArchiveComparatorCustom
+	}
+	return ArchiveComparatorBytewise
+}
+
+// ArchiveTo - writes everything collected (spill files and buffer) to `w` as tar stream, to be loaded on other node by LoadFromArchive.
+// Collector stays usable: it can be loaded or archived again.
+func (c *Collector) ArchiveTo(w io.Writer) error {
+	if c.keyring != nil {
+		return fmt.Errorf("%s: etl: ArchiveTo doesn't support encrypted spill files", c.logPrefix)
+	}
+	if c.codec != nil {
+		return fmt.Errorf("%s: etl: ArchiveTo doesn't support spill files of custom EntryCodec", c.logPrefix)
+	}
+	if !c.allFlushed {
+		if err := c.flushBuffer(nil, true); err != nil {
+			return err
+		}
+	}
+	manifest := archiveManifest{Version: ArchiveVersion, Compression: c.compression.String(), Comparator: c.comparatorID(), BufferType: c.bufType}
+	for i := range c.dataProviders {
+		manifest.Files = append(manifest.Files, fmt.Sprintf("spill-%06d", i))
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeArchiveEntry(tw, ArchiveManifestName, manifestBytes); err != nil {
+		return err
+	}
+	for i, p := range c.dataProviders {
+		if err := c.archiveProvider(tw, manifest.Files[i], p); err != nil {
+			return fmt.Errorf("%s: etl: ArchiveTo %s: %w", c.logPrefix, p, err)
+		}
+	}
+	return tw.Close()
+}
+
+func (c *Collector) archiveProvider(tw *tar.Writer, name string, p dataProvider) error {
+	if p, ok := p.(*fileDataProvider); ok {
+		info, err := p.file.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		p.rewind()
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size()}); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, p.file)
+		return err
+	}
+
+	// kept in RAM: serialise it as spill file (with spill compression - manifest has one for all entries)
+	var buf bytes.Buffer
+	cw, err := c.compression.compressingWriter(&buf)
+	if err != nil {
+		return err
+	}
+	var numBuf [binary.MaxVarintLen64]byte
+	var k, v []byte
+	for {
+		k, v, err = p.Next(k[:0], v[:0])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeElement(cw, numBuf[:], k, v); err != nil {
+			return err
+		}
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if m, ok := p.(*memoryDataProvider); ok {
+		m.currentIndex = 0
+	}
+	return writeArchiveEntry(tw, name, buf.Bytes())
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// LoadFromArchive - loads archive written by Collector.ArchiveTo into `toBucket`.
+// Spill files are extracted into temporary directory (os.TempDir), which is removed when loading is done.
+// If collector was sorting by custom comparator, same args.Comparator must be passed.
+func LoadFromArchive(r io.Reader, db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
+	logPrefix := "archive"
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("%s: etl: reading manifest: %w", logPrefix, err)
+	}
+	if hdr.Name != ArchiveManifestName {
+		return fmt.Errorf("%s: etl: first archive entry must be %s, got %s", logPrefix, ArchiveManifestName, hdr.Name)
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("%s: etl: decoding manifest: %w", logPrefix, err)
+	}
+	if manifest.Version != ArchiveVersion {
+		return fmt.Errorf("%s: etl: unsupported archive version %d", logPrefix, manifest.Version)
+	}
+	compression, err := ParseCompression(manifest.Compression)
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if (manifest.Comparator == ArchiveComparatorCustom) != (args.Comparator != nil) {
+		return fmt.Errorf("%s: etl: archive sorted by %s comparator, args.Comparator set: %t", logPrefix, manifest.Comparator, args.Comparator != nil)
+	}
+
+	dir, err := os.MkdirTemp("", "etl-archive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	providers := make([]dataProvider, 0, len(manifest.Files))
+	defer func() {
+		for _, p := range providers {
+			p.Dispose()
+		}
+	}()
+	for range manifest.Files {
+		hdr, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("%s: etl: reading archive: %w", logPrefix, err)
+		}
+		f, err := os.Create(filepath.Join(dir, filepath.Base(hdr.Name)))
+		if err != nil {
+			return err
+		}
+		providers = append(providers, &fileDataProvider{file: f, compression: compression})
+		if _, err := io.Copy(f, tr); err != nil {
+			return fmt.Errorf("%s: etl: extracting %s: %w", logPrefix, hdr.Name, err)
+		}
+	}
+	return loadFilesIntoBucket(logPrefix, db, toBucket, manifest.BufferType, providers, loadFunc, args)
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+type TransformResult struct {
+	Stats TransformStats
+	Err   error
+}
+
+// TransformAsync - runs Transform in own RwTx of `db` in background, result is delivered to returned channel (buffered - can be ignored).
+// Cancellation of ctx (or closing of args.Quit) stops transform and rolls back tx, see TransformCtx.
+func TransformAsync(
+	ctx context.Context,
+	logPrefix string,
+	db kv.RwDB,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) <-chan TransformResult {
+	resCh := make(chan TransformResult, 1)
+	go func() {
+		args, stop := quitOnDone(ctx, args)
+		defer stop()
+		var res TransformResult
+		userStats := args.Stats
+		args.Stats = &res.Stats
+		res.Err = ctxErr(ctx, db.Update(ctx, func(tx kv.RwTx) error {
+			return Transform(logPrefix, tx, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args)
+		}))
+		if userStats != nil {
+			*userStats = res.Stats
+		}
+		resCh <- res
+	}()
+	return resCh
+}
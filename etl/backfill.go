@@ -0,0 +1,113 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// BackfillWindows - transform of `fromBucket` by windows [window[0], window[1]) (nil bound is unbounded):
+// up to `concurrency` windows are extracted at the same time, each in own read tx and collector.
+// args.BufferSize (default BufferOptimalSize) is shared memory budget: each extract worker has buffer of BufferSize/concurrency,
+// extracted window is spilled to disk. When all windows are extracted, they are loaded into `toBucket` in one write tx,
+// in order of `windows` - windows must not overlap.
+// First error cancels other windows. extractFunc is called concurrently. If args.Stats is set, it gets sums of CollectorStats.
+func BackfillWindows(
+	ctx context.Context,
+	logPrefix string,
+	db kv.RwDB,
+	fromBucket, toBucket, tmpdir string,
+	windows [][2][]byte,
+	concurrency int,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) error {
+	if fromBucket == toBucket {
+		return fmt.Errorf("%s: %w: %s", logPrefix, ErrSameBucket, fromBucket)
+	}
+	if concurrency <= 0 {
+		return fmt.Errorf("%s: etl: BackfillWindows requires concurrency > 0, got %d", logPrefix, concurrency)
+	}
+	budget := BufferOptimalSize
+	if args.BufferSize > 0 {
+		budget = datasize.ByteSize(args.BufferSize)
+	}
+	bufType, err := args.bufferType()
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	// buffer is owned by worker: it's empty after window is spilled, next window of worker reuses it
+	buffers := make(chan Buffer, concurrency)
+	for i := 0; i < concurrency; i++ {
+		b := getBufferByType(bufType, budget/datasize.ByteSize(concurrency))
+		if cmp := args.sortComparator(); cmp != nil {
+			b.SetComparator(cmp)
+		}
+		buffers <- b
+	}
+
+	collectors := make([]*Collector, len(windows))
+	defer func() {
+		for _, c := range collectors {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i := range windows {
+		i := i
+		g.Go(func() error {
+			buffer := <-buffers
+			defer func() { buffers <- buffer }()
+			c := NewCollector(fmt.Sprintf("%s/%d", logPrefix, i), tmpdir, buffer)
+			collectors[i] = c
+			windowArgs, stop := quitOnDone(gctx, args)
+			defer stop()
+			windowArgs.ExtractStartKey, windowArgs.ExtractEndKey = windows[i][0], windows[i][1]
+			if err := db.View(gctx, func(tx kv.Tx) error {
+				return extractBucket(logPrefix, tx, fromBucket, c, extractFunc, windowArgs)
+			}); err != nil {
+				return ctxErr(gctx, fmt.Errorf("%s: window %d: %w", logPrefix, i, err))
+			}
+			return c.flushBuffer(nil, false) // to disk: buffer goes to next window
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	return db.Update(ctx, func(tx kv.RwTx) error {
+		for i, c := range collectors {
+			if err := c.Load(tx, toBucket, loadFunc, args); err != nil {
+				return fmt.Errorf("%s: window %d: %w", logPrefix, i, err)
+			}
+			if args.Stats != nil {
+				args.Stats.CollectorStats.add(c.Stats())
+			}
+		}
+		return nil
+	})
+}
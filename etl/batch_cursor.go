@@ -0,0 +1,89 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import "github.com/ledgerwatch/erigon-lib/kv"
+
+// CursorBatchSize - amount of records requested per round-trip from BatchCursor
+var CursorBatchSize = 1024
+
+// BatchCursor - optional extension of kv.Cursor for remote backends, where each Next is a round-trip.
+// Extract detects it and reads table by batches, other cursors are read by Next. Cursors of kv/remotedb implement it.
+// Batch shorter than `limit` means end of table. Returned slices are valid until next call.
+type BatchCursor interface {
+	SeekBatch(seek []byte, limit int) (keys, vals [][]byte, err error)
+	NextBatch(limit int) (keys, vals [][]byte, err error) // continues after last record of previous batch
+}
+
+type keyValueIter interface {
+	Seek(seek []byte) ([]byte, []byte, error)
+	Next() ([]byte, []byte, error)
+}
+
+// batchedCursor - Seek/Next over batches of BatchCursor
+type batchedCursor struct {
+	c          BatchCursor
+	keys, vals [][]byte
+	i          int
+}
+
+func (c *batchedCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	return c.reset(c.c.SeekBatch(seek, CursorBatchSize))
+}
+
+func (c *batchedCursor) Next() ([]byte, []byte, error) {
+	c.i++
+	if c.i < len(c.keys) {
+		return c.keys[c.i], c.vals[c.i], nil
+	}
+	if len(c.keys) < CursorBatchSize {
+		return nil, nil, nil
+	}
+	return c.reset(c.c.NextBatch(CursorBatchSize))
+}
+
+func (c *batchedCursor) reset(keys, vals [][]byte, err error) ([]byte, []byte, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	c.keys, c.vals, c.i = keys, vals, 0
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	return keys[0], vals[0], nil
+}
+
+// reverseCursor - walks cursor backwards: Seek(endKey) positions at last key < endKey (nil endKey: last key), Next is Prev
+type reverseCursor struct {
+	c kv.Cursor
+}
+
+func (c *reverseCursor) Seek(endKey []byte) ([]byte, []byte, error) {
+	if endKey == nil {
+		return c.c.Last()
+	}
+	k, _, err := c.c.Seek(endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k == nil {
+		return c.c.Last()
+	}
+	return c.c.Prev()
+}
+
+func (c *reverseCursor) Next() ([]byte, []byte, error) { return c.c.Prev() }
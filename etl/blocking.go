@@ -0,0 +1,134 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// BlockingCollector - Collector for fast producers: full buffers are spilled in background while producer fills next one,
+// and Collect blocks producer while not spilled in-memory data exceeds `budget`. Safe for concurrent Collect.
+// Budget smaller than 2*bufferSize serializes producer and spills.
+type BlockingCollector struct {
+	logPrefix  string
+	tmpdir     string
+	bufferSize datasize.ByteSize
+	budget     int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	buf         *sortableBuffer
+	inMemory    int // active buffer + buffers being spilled
+	maxInMemory int
+	spilling    int
+	providers   []dataProvider // in order of spills - slot is reserved when spill starts
+	err         error
+}
+
+func NewBlockingCollector(logPrefix, tmpdir string, bufferSize, budget datasize.ByteSize) *BlockingCollector {
+	c := &BlockingCollector{logPrefix: logPrefix, tmpdir: tmpdir, bufferSize: bufferSize, budget: int(budget.Bytes()), buf: NewSortableBuffer(bufferSize)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *BlockingCollector) Collect(k, v []byte) error {
+	recordSize := len(k) + len(v) + 32 // same accounting as sortableBuffer.Size
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.err == nil && c.spilling > 0 && c.inMemory+recordSize > c.budget {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	c.buf.Put(k, v)
+	c.inMemory += recordSize
+	if c.inMemory > c.maxInMemory {
+		c.maxInMemory = c.inMemory
+	}
+	if c.buf.CheckFlushSize() {
+		c.spill()
+	}
+	return nil
+}
+
+// spill - hands off full buffer to background goroutine, must be called under lock
+func (c *BlockingCollector) spill() {
+	b, slot := c.buf, len(c.providers)
+	c.buf = NewSortableBuffer(c.bufferSize)
+	c.providers = append(c.providers, nil)
+	c.spilling++
+	go func() {
+		size := b.Size()
+		b.Sort()
+		provider, err := FlushToDisk(c.logPrefix, b, c.tmpdir, false, log.LvlTrace)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		c.providers[slot] = provider
+		c.inMemory -= size
+		c.spilling--
+		c.cond.Broadcast()
+	}()
+}
+
+// MaxInMemory - high-water mark of not spilled data, bytes
+func (c *BlockingCollector) MaxInMemory() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxInMemory
+}
+
+func (c *BlockingCollector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
+	c.mu.Lock()
+	for c.spilling > 0 {
+		c.cond.Wait()
+	}
+	err := c.err
+	if err == nil && c.buf.Len() > 0 {
+		c.buf.Sort()
+		c.providers = append(c.providers, KeepInRAM(c.buf))
+	}
+	providers := c.providers
+	c.mu.Unlock()
+	defer c.Close()
+	if err != nil {
+		return err
+	}
+	return loadFilesIntoBucket(c.logPrefix, db, toBucket, SortableSliceBuffer, providers, loadFunc, args)
+}
+
+func (c *BlockingCollector) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.spilling > 0 {
+		c.cond.Wait()
+	}
+	for _, p := range c.providers {
+		if p != nil {
+			p.Dispose()
+		}
+	}
+	c.providers = nil
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// Blocked (SST-like) export format. Integers are uvarint unless noted:
+//
+//	data block:  entries..., restart offsets (uint32 BE, relative to block start)..., uint32 BE amount of restarts
+//	entry:       shared key len, unshared key len, value len, unshared key bytes, value
+//	index block: per data block: len(lastKey), lastKey, block offset, block size
+//	footer:      uint64 BE index offset, uint64 BE index size, uint64 BE BlockFileMagic
+//
+// Every BlockRestartInterval-th entry of block (and first one) stores full key: shared == 0.
+const (
+	BlockFileMagic       uint64 = 0x65746c626c6b7331 // "etlblks1"
+	BlockFooterSize             = 24
+	BlockRestartInterval        = 16
+	DefaultBlockSize            = 4 * 1024
+)
+
+type blockWriter struct {
+	w         *bufio.Writer
+	blockSize int
+	offset    uint64 // of current block in file
+
+	block    []byte
+	restarts []uint32
+	entries  int
+	prevKey  []byte
+	index    []byte
+	numBuf   [binary.MaxVarintLen64]byte
+}
+
+func (bw *blockWriter) appendUvarint(buf []byte, x uint64) []byte {
+	n := binary.PutUvarint(bw.numBuf[:], x)
+	return append(buf, bw.numBuf[:n]...)
+}
+
+func (bw *blockWriter) add(k, v []byte) error {
+	shared := 0
+	if bw.entries%BlockRestartInterval == 0 {
+		bw.restarts = append(bw.restarts, uint32(len(bw.block)))
+	} else {
+		for shared < len(k) && shared < len(bw.prevKey) && k[shared] == bw.prevKey[shared] {
+			shared++
+		}
+	}
+	bw.block = bw.appendUvarint(bw.block, uint64(shared))
+	bw.block = bw.appendUvarint(bw.block, uint64(len(k)-shared))
+	bw.block = bw.appendUvarint(bw.block, uint64(len(v)))
+	bw.block = append(bw.block, k[shared:]...)
+	bw.block = append(bw.block, v...)
+	bw.prevKey = append(bw.prevKey[:0], k...)
+	bw.entries++
+	if len(bw.block)+4*(len(bw.restarts)+1) >= bw.blockSize {
+		return bw.finishBlock()
+	}
+	return nil
+}
+
+func (bw *blockWriter) finishBlock() error {
+	if bw.entries == 0 {
+		return nil
+	}
+	var u32 [4]byte
+	for _, r := range bw.restarts {
+		binary.BigEndian.PutUint32(u32[:], r)
+		bw.block = append(bw.block, u32[:]...)
+	}
+	binary.BigEndian.PutUint32(u32[:], uint32(len(bw.restarts)))
+	bw.block = append(bw.block, u32[:]...)
+	if _, err := bw.w.Write(bw.block); err != nil {
+		return err
+	}
+
+	bw.index = bw.appendUvarint(bw.index, uint64(len(bw.prevKey)))
+	bw.index = append(bw.index, bw.prevKey...)
+	bw.index = bw.appendUvarint(bw.index, bw.offset)
+	bw.index = bw.appendUvarint(bw.index, uint64(len(bw.block)))
+
+	bw.offset += uint64(len(bw.block))
+	bw.block, bw.restarts, bw.entries = bw.block[:0], bw.restarts[:0], 0
+	return nil
+}
+
+func (bw *blockWriter) finish() error {
+	if err := bw.finishBlock(); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(bw.index); err != nil {
+		return err
+	}
+	var footer [BlockFooterSize]byte
+	binary.BigEndian.PutUint64(footer[:], bw.offset)
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(bw.index)))
+	binary.BigEndian.PutUint64(footer[16:], BlockFileMagic)
+	if _, err := bw.w.Write(footer[:]); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+// WriteBlocks - writes merged stream of collector to `w` in blocked format (see BlockFileMagic), for stores which ingest
+// SST-like files. Block is finished when it reaches `blockSize` bytes (0 means DefaultBlockSize).
+// Keys are strictly increasing in output: of equal keys first one is written (as SortableOldestAppearedBuffer does).
+// Empty value is written as is - it's not a deletion marker in this format.
+func (c *Collector) WriteBlocks(w io.Writer, blockSize int, args TransformArgs) error {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	it, err := c.Iter(args)
+	if err != nil {
+		return err
+	}
+	bw := &blockWriter{w: bufio.NewWriterSize(w, BufIOSize), blockSize: blockSize}
+	first := true
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if !first {
+			if cmp := bytes.Compare(k, bw.prevKey); cmp == 0 {
+				continue
+			} else if cmp < 0 {
+				return fmt.Errorf("%s: etl: WriteBlocks requires bytewise key order, got %x after %x", c.logPrefix, k, bw.prevKey)
+			}
+		}
+		first = false
+		if err := bw.add(k, v); err != nil {
+			return err
+		}
+	}
+	return bw.finish()
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"math"
+)
+
+// Bloom - probabilistic set of keys: MayContain never returns false for added key,
+// but may return true for not added key with probability ~fpRate.
+type Bloom struct {
+	bits   []uint64
+	m      uint64 // amount of bits
+	hashes uint64
+}
+
+// NewBloom - sized for `expectedItems` keys with false-positive rate `fpRate`
+func NewBloom(expectedItems uint64, fpRate float64) *Bloom {
+	if expectedItems == 0 {
+		expectedItems = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(expectedItems) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Round(float64(m) / float64(expectedItems) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	m = (m + 63) / 64 * 64
+	return &Bloom{bits: make([]uint64, m/64), m: m, hashes: hashes}
+}
+
+func (b *Bloom) Add(k []byte) {
+	h1, h2 := bloomHashes(k)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *Bloom) MayContain(k []byte) bool {
+	h1, h2 := bloomHashes(k)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes - double hashing (Kirsch-Mitzenmacher): i-th hash is h1 + i*h2
+func bloomHashes(k []byte) (h1, h2 uint64) {
+	h := hashKey(k)
+	h1, h2 = h, h>>32|h<<32|1
+	return h1, h2
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// budgetChunk - collector reserves budget by chunks (less contention), and keeps one chunk until Close:
+// so collector which got no budget still can collect something between spills
+const budgetChunk = 1 << 20
+
+// BufferBudget - limit of total size of buffers of all collectors which share it (concurrent stages, etc.), see
+// Collector.BufferBudget. Safe for concurrent use. Limit is soft: each collector may get its first chunk (1MB) over it.
+type BufferBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+func NewBufferBudget(limit datasize.ByteSize) *BufferBudget {
+	return &BufferBudget{limit: int(limit.Bytes())}
+}
+
+// Used - bytes reserved by collectors now
+func (b *BufferBudget) Used() datasize.ByteSize {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return datasize.ByteSize(b.used)
+}
+
+func (b *BufferBudget) tryAcquire(n int, force bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !force && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *BufferBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// reserveBuffer - acquires budget for data of buffer, false means budget is exhausted: buffer must be flushed
+func (c *Collector) reserveBuffer() bool {
+	if c.budget == nil {
+		return true
+	}
+	sized, ok := c.buf.(interface{ Size() int })
+	if !ok {
+		return true
+	}
+	need := sized.Size() - c.reserved
+	if need <= 0 {
+		return true
+	}
+	if need < budgetChunk {
+		need = budgetChunk
+	}
+	if !c.budget.tryAcquire(need, c.reserved == 0) {
+		return false
+	}
+	c.reserved += need
+	return true
+}
+
+// releaseBuffer - after spill (`all` = false) collector keeps one chunk, Close releases everything
+func (c *Collector) releaseBuffer(all bool) {
+	if c.budget == nil {
+		return
+	}
+	keep := budgetChunk
+	if all || c.reserved < keep {
+		keep = 0
+	}
+	c.budget.release(c.reserved - keep)
+	c.reserved = keep
+}
@@ -18,11 +18,15 @@ package etl
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strconv"
+	"sync"
+	"unsafe"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/erigon-lib/common"
@@ -37,6 +41,10 @@ const (
 	// SortableOldestAppearedBuffer - buffer that keeps only the oldest entries.
 	// if first v1 was added under key K, then v2; only v1 will stay
 	SortableOldestAppearedBuffer
+	// SortableTopNBuffer - keeps only N smallest (or largest) entries, see NewTopNBuffer
+	SortableTopNBuffer
+	// SortableHeapBuffer - spills only lower half of records, continuing sorted runs in spill files, see NewHeapBuffer
+	SortableHeapBuffer
 
 	//BufIOSize - 128 pages | default is 1 page | increasing over `64 * 4096` doesn't show speedup on SSD/NVMe, but show speedup in cloud drives
 	BufIOSize = 128 * 4096
@@ -44,6 +52,29 @@ const (
 
 var BufferOptimalSize = 256 * datasize.MB /*  var because we want to sometimes change it from tests or command-line flags */
 
+// bounds of BufferSizeForSpillTarget
+var (
+	MinBufferSize = 1 * datasize.MB
+	MaxBufferSize = 4 * datasize.GB
+)
+
+// BufferSizeForSpillTarget - buffer size which will produce about `targetSpills` spill files for `totalBytes` of collected data.
+// `totalBytes` is size as accounted by Buffer.Size() - for sortableBuffer it's len(k)+len(v)+32 per entry.
+// Result is clamped to [MinBufferSize, MaxBufferSize], targetSpills <= 0 means BufferOptimalSize.
+func BufferSizeForSpillTarget(totalBytes uint64, targetSpills int) datasize.ByteSize {
+	if targetSpills <= 0 {
+		return BufferOptimalSize
+	}
+	size := datasize.ByteSize((totalBytes + uint64(targetSpills) - 1) / uint64(targetSpills))
+	if size < MinBufferSize {
+		return MinBufferSize
+	}
+	if size > MaxBufferSize {
+		return MaxBufferSize
+	}
+	return size
+}
+
 type Buffer interface {
 	Put(k, v []byte)
 	Get(i int, keyBuf, valBuf []byte) ([]byte, []byte)
@@ -55,6 +86,19 @@ type Buffer interface {
 	SetComparator(cmp kv.CmpFunc)
 }
 
+// growableBuffer - buffers whose flush size can be changed during collection, see Collector.MaxSpills
+type growableBuffer interface {
+	flushSize() int
+	setFlushSize(n int)
+}
+
+// Allocator - provides backing memory for buffer's data, for example huge-page or mmap-backed.
+// Default is Go's allocator.
+type Allocator interface {
+	Alloc(size int) []byte // must return slice of len=size
+	Free(b []byte)
+}
+
 type sortableBufferEntry struct {
 	key   []byte
 	value []byte
@@ -64,25 +108,82 @@ var (
 	_ Buffer = &sortableBuffer{}
 	_ Buffer = &appendSortableBuffer{}
 	_ Buffer = &oldestEntrySortableBuffer{}
+	_ Buffer = &topNBuffer{}
 )
 
+// noCopyPutter - buffers which can keep references to collected slices instead of copying them.
+// sortableBuffer doesn't need it: it copies into one growing slice, without allocation per record.
+type noCopyPutter interface {
+	PutNoCopy(k, v []byte)
+}
+
+// unsafeString - string referencing memory of `b`, `b` must not change while string is used
+func unsafeString(b []byte) string { return *(*string)(unsafe.Pointer(&b)) }
+
 func NewSortableBuffer(bufferOptimalSize datasize.ByteSize) *sortableBuffer {
 	return &sortableBuffer{
 		optimalSize: int(bufferOptimalSize.Bytes()),
 	}
 }
 
+// NewSortableBufferWithAllocator - data of buffer will be allocated by `alloc`: first allocation is of bufferOptimalSize
+// (buffer is flushed after reaching it), grows if needed. Memory is returned to `alloc` by Collector.Close.
+func NewSortableBufferWithAllocator(bufferOptimalSize datasize.ByteSize, alloc Allocator) *sortableBuffer {
+	return &sortableBuffer{
+		optimalSize: int(bufferOptimalSize.Bytes()),
+		alloc:       alloc,
+	}
+}
+
 type sortableBuffer struct {
 	comparator  kv.CmpFunc
+	alloc       Allocator
 	offsets     []int
 	lens        []int
 	data        []byte
 	optimalSize int
+	shrinkTo    int
+}
+
+// ShrinkAfterSpill - after each spill buffer releases memory above `baseline` bytes: transient spike of big records
+// doesn't pin memory for the rest of the run. By default buffer keeps memory of its biggest size.
+func (b *sortableBuffer) ShrinkAfterSpill(baseline datasize.ByteSize) {
+	b.shrinkTo = int(baseline.Bytes())
+}
+
+// grow - makes sure `data` has space for n more bytes, if allocator is set
+func (b *sortableBuffer) grow(n int) {
+	if b.alloc == nil || len(b.data)+n <= cap(b.data) {
+		return
+	}
+	newCap := 2 * cap(b.data)
+	if newCap < b.optimalSize {
+		newCap = b.optimalSize
+	}
+	if newCap < len(b.data)+n {
+		newCap = len(b.data) + n
+	}
+	newData := b.alloc.Alloc(newCap)[:len(b.data)]
+	copy(newData, b.data)
+	if cap(b.data) > 0 {
+		b.alloc.Free(b.data[:cap(b.data)])
+	}
+	b.data = newData
+}
+
+// release - returns data to allocator, buffer is empty after it
+func (b *sortableBuffer) release() {
+	if b.alloc == nil || cap(b.data) == 0 {
+		return
+	}
+	b.alloc.Free(b.data[:cap(b.data)])
+	b.data, b.offsets, b.lens = nil, nil, nil
 }
 
 // Put adds key and value to the buffer. These slices will not be accessed later,
 // so no copying is necessary
 func (b *sortableBuffer) Put(k, v []byte) {
+	b.grow(len(k) + len(v))
 	b.offsets = append(b.offsets, len(b.data))
 	b.lens = append(b.lens, len(k))
 	if len(k) > 0 {
@@ -144,14 +245,36 @@ func (b *sortableBuffer) Reset() {
 	b.offsets = b.offsets[:0]
 	b.lens = b.lens[:0]
 	b.data = b.data[:0]
+	if b.shrinkTo > 0 {
+		b.shrink()
+	}
+}
+
+func (b *sortableBuffer) shrink() {
+	if cap(b.data) > b.shrinkTo {
+		if b.alloc != nil {
+			b.alloc.Free(b.data[:cap(b.data)])
+			b.data = b.alloc.Alloc(b.shrinkTo)[:0]
+		} else {
+			b.data = make([]byte, 0, b.shrinkTo)
+		}
+	}
+	if 8*cap(b.offsets) > b.shrinkTo {
+		b.offsets, b.lens = nil, nil
+	}
 }
-func (b *sortableBuffer) Sort() {
+func (b *sortableBuffer) Sort() { _ = b.SortCancel(nil) }
+
+func (b *sortableBuffer) SortCancel(quit <-chan struct{}) error {
 	if sort.IsSorted(b) {
-		return
+		return nil
 	}
-	sort.Stable(b)
+	return stableSort(b, quit)
 }
 
+func (b *sortableBuffer) flushSize() int     { return b.optimalSize }
+func (b *sortableBuffer) setFlushSize(n int) { b.optimalSize = n }
+
 func (b *sortableBuffer) CheckFlushSize() bool {
 	return b.Size() >= b.optimalSize
 }
@@ -187,6 +310,16 @@ type appendSortableBuffer struct {
 	optimalSize int
 }
 
+// PutNoCopy - as Put, but keeps references to `k` and `v` of new key, see Collector.CollectNoCopy
+func (b *appendSortableBuffer) PutNoCopy(k, v []byte) {
+	if _, ok := b.entries[string(k)]; ok {
+		b.Put(k, v) // appending to stored value copies anyway
+		return
+	}
+	b.size += len(k) + len(v)
+	b.entries[unsafeString(k)] = v[:len(v):len(v)] // no spare capacity: next Put reallocates instead of writing into caller's memory
+}
+
 func (b *appendSortableBuffer) Put(k, v []byte) {
 	stored, ok := b.entries[string(k)]
 	if !ok {
@@ -208,11 +341,13 @@ func (b *appendSortableBuffer) Size() int {
 func (b *appendSortableBuffer) Len() int {
 	return len(b.entries)
 }
-func (b *appendSortableBuffer) Sort() {
+func (b *appendSortableBuffer) Sort() { _ = b.SortCancel(nil) }
+
+func (b *appendSortableBuffer) SortCancel(quit <-chan struct{}) error {
 	for i := range b.entries {
 		b.sortedBuf = append(b.sortedBuf, sortableBufferEntry{key: []byte(i), value: b.entries[i]})
 	}
-	sort.Stable(b)
+	return stableSort(b, quit)
 }
 
 func (b *appendSortableBuffer) Less(i, j int) bool {
@@ -259,6 +394,9 @@ func (b *appendSortableBuffer) Write(w io.Writer) error {
 	return nil
 }
 
+func (b *appendSortableBuffer) flushSize() int     { return b.optimalSize }
+func (b *appendSortableBuffer) setFlushSize(n int) { b.optimalSize = n }
+
 func (b *appendSortableBuffer) CheckFlushSize() bool {
 	return b.size >= b.optimalSize
 }
@@ -273,6 +411,7 @@ func NewOldestEntryBuffer(bufferOptimalSize datasize.ByteSize) *oldestEntrySorta
 
 type oldestEntrySortableBuffer struct {
 	entries     map[string][]byte
+	arena       byteArena // values and sorted keys - they are not referenced after Reset
 	comparator  kv.CmpFunc
 	sortedBuf   []sortableBufferEntry
 	size        int
@@ -291,7 +430,16 @@ func (b *oldestEntrySortableBuffer) Put(k, v []byte) {
 	}
 
 	b.size += len(k)*2 + len(v)
-	b.entries[string(k)] = common.Copy(v)
+	b.entries[string(k)] = b.arena.copy(v)
+}
+
+// PutNoCopy - as Put, but keeps references to `k` and `v`, see Collector.CollectNoCopy
+func (b *oldestEntrySortableBuffer) PutNoCopy(k, v []byte) {
+	if _, ok := b.entries[string(k)]; ok {
+		return
+	}
+	b.size += len(k)*2 + len(v)
+	b.entries[unsafeString(k)] = v
 }
 
 func (b *oldestEntrySortableBuffer) Size() int {
@@ -302,11 +450,13 @@ func (b *oldestEntrySortableBuffer) Len() int {
 	return len(b.entries)
 }
 
-func (b *oldestEntrySortableBuffer) Sort() {
+func (b *oldestEntrySortableBuffer) Sort() { _ = b.SortCancel(nil) }
+
+func (b *oldestEntrySortableBuffer) SortCancel(quit <-chan struct{}) error {
 	for k, v := range b.entries {
-		b.sortedBuf = append(b.sortedBuf, sortableBufferEntry{key: []byte(k), value: v})
+		b.sortedBuf = append(b.sortedBuf, sortableBufferEntry{key: b.arena.copyString(k), value: v})
 	}
-	sort.Stable(b)
+	return stableSort(b, quit)
 }
 
 func (b *oldestEntrySortableBuffer) Less(i, j int) bool {
@@ -329,6 +479,7 @@ func (b *oldestEntrySortableBuffer) Reset() {
 	b.sortedBuf = nil
 	b.entries = make(map[string][]byte)
 	b.size = 0
+	b.arena.reset()
 }
 
 func (b *oldestEntrySortableBuffer) Write(w io.Writer) error {
@@ -352,21 +503,227 @@ func (b *oldestEntrySortableBuffer) Write(w io.Writer) error {
 	}
 	return nil
 }
+func (b *oldestEntrySortableBuffer) flushSize() int     { return b.optimalSize }
+func (b *oldestEntrySortableBuffer) setFlushSize(n int) { b.optimalSize = n }
+
 func (b *oldestEntrySortableBuffer) CheckFlushSize() bool {
 	return b.size >= b.optimalSize
 }
 
+const arenaChunkSize = 64 * 1024
+
+var arenaChunks = sync.Pool{New: func() interface{} { b := make([]byte, 0, arenaChunkSize); return &b }}
+
+// byteArena - bump allocator over pooled chunks: 1 allocation per chunk instead of 1 per record.
+// Chunks go back to pool only on reset - caller must guarantee that nothing references them.
+type byteArena struct {
+	chunks []*[]byte
+	cur    []byte
+}
+
+func (a *byteArena) copy(b []byte) []byte {
+	if len(b) > arenaChunkSize/4 { // big records don't benefit from arena
+		return common.Copy(b)
+	}
+	a.ensure(len(b))
+	start := len(a.cur)
+	a.cur = append(a.cur, b...)
+	return a.cur[start:len(a.cur):len(a.cur)]
+}
+
+func (a *byteArena) copyString(s string) []byte {
+	if len(s) > arenaChunkSize/4 {
+		return []byte(s)
+	}
+	a.ensure(len(s))
+	start := len(a.cur)
+	a.cur = append(a.cur, s...)
+	return a.cur[start:len(a.cur):len(a.cur)]
+}
+
+func (a *byteArena) ensure(n int) {
+	if cap(a.cur)-len(a.cur) >= n {
+		return
+	}
+	chunk := arenaChunks.Get().(*[]byte)
+	a.chunks = append(a.chunks, chunk)
+	a.cur = (*chunk)[:0]
+}
+
+func (a *byteArena) reset() {
+	for _, chunk := range a.chunks {
+		arenaChunks.Put(chunk)
+	}
+	a.chunks, a.cur = nil, nil
+}
+
+// NewTopNBuffer - keeps only `n` smallest (or largest) entries by key in bounded heap:
+// no full sort, never spills. Load emits them in usual (ascending) order.
+func NewTopNBuffer(n int, largest bool) *topNBuffer {
+	return &topNBuffer{n: n, largest: largest}
+}
+
+type topNBuffer struct {
+	comparator kv.CmpFunc
+	entries    []sortableBufferEntry // heap, root is worst of kept entries - candidate for eviction
+	n          int
+	size       int
+	largest    bool
+	sorted     bool // entries are sorted (by Sort), not heap
+}
+
+func (b *topNBuffer) cmp(i, j int) int {
+	if b.comparator != nil {
+		return b.comparator(b.entries[i].key, b.entries[j].key, b.entries[i].value, b.entries[j].value)
+	}
+	return bytes.Compare(b.entries[i].key, b.entries[j].key)
+}
+
+// topNHeap - heap.Interface of topNBuffer: root is worst entry
+type topNHeap struct{ *topNBuffer }
+
+func (h topNHeap) Less(i, j int) bool {
+	if h.largest {
+		return h.cmp(i, j) < 0
+	}
+	return h.cmp(i, j) > 0
+}
+func (h topNHeap) Push(x interface{}) { h.entries = append(h.entries, x.(sortableBufferEntry)) }
+func (h topNHeap) Pop() interface{} {
+	x := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return x
+}
+
+func (b *topNBuffer) Put(k, v []byte) {
+	if b.n <= 0 {
+		return
+	}
+	if b.sorted {
+		heap.Init(topNHeap{b})
+		b.sorted = false
+	}
+	if len(b.entries) < b.n {
+		heap.Push(topNHeap{b}, sortableBufferEntry{key: common.Copy(k), value: common.Copy(v)})
+		b.size += len(k) + len(v)
+		return
+	}
+	// compare with root by temporary entry at the end
+	b.entries = append(b.entries, sortableBufferEntry{key: k, value: v})
+	better := topNHeap{b}.Less(0, len(b.entries)-1)
+	b.entries = b.entries[:len(b.entries)-1]
+	if !better {
+		return
+	}
+	root := &b.entries[0]
+	b.size += len(k) + len(v) - len(root.key) - len(root.value)
+	root.key, root.value = append(root.key[:0], k...), append(root.value[:0], v...)
+	heap.Fix(topNHeap{b}, 0)
+}
+
+func (b *topNBuffer) Get(i int, keyBuf, valBuf []byte) ([]byte, []byte) {
+	keyBuf = append(keyBuf, b.entries[i].key...)
+	valBuf = append(valBuf, b.entries[i].value...)
+	return keyBuf, valBuf
+}
+
+func (b *topNBuffer) Len() int                     { return len(b.entries) }
+func (b *topNBuffer) Swap(i, j int)                { b.entries[i], b.entries[j] = b.entries[j], b.entries[i] }
+func (b *topNBuffer) Less(i, j int) bool           { return b.cmp(i, j) < 0 }
+func (b *topNBuffer) SetComparator(cmp kv.CmpFunc) { b.comparator = cmp }
+func (b *topNBuffer) CheckFlushSize() bool         { return false }
+func (b *topNBuffer) Size() int                    { return b.size }
+
+func (b *topNBuffer) Reset() {
+	b.entries, b.size, b.sorted = nil, 0, false
+}
+
+func (b *topNBuffer) Sort() {
+	sort.Sort(b)
+	b.sorted = true
+}
+
+func (b *topNBuffer) Write(w io.Writer) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	for _, e := range b.entries {
+		if err := writeElement(w, numBuf[:], e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BufferFactory - creates buffer of given size, see RegisterBuffer
+type BufferFactory func(size datasize.ByteSize) Buffer
+
+// firstCustomBufferType - ids of RegisterBuffer, after space for built-in types
+const firstCustomBufferType = 64
+
+var (
+	buffersLock     sync.RWMutex
+	bufferTypeNames = map[string]int{"slice": SortableSliceBuffer, "append": SortableAppendBuffer, "oldest": SortableOldestAppearedBuffer, "heap": SortableHeapBuffer}
+	bufferFactories = map[int]BufferFactory{
+		SortableSliceBuffer:          func(size datasize.ByteSize) Buffer { return NewSortableBuffer(size) },
+		SortableAppendBuffer:         func(size datasize.ByteSize) Buffer { return NewAppendBuffer(size) },
+		SortableOldestAppearedBuffer: func(size datasize.ByteSize) Buffer { return NewOldestEntryBuffer(size) },
+		SortableHeapBuffer:           func(size datasize.ByteSize) Buffer { return NewHeapBuffer(size) },
+	}
+	nextBufferType = firstCustomBufferType
+)
+
+// RegisterBuffer - adds buffer type, which Transform creates by TransformArgs.BufferName (or by returned id as
+// TransformArgs.BufferType). Built-in types are pre-registered as "slice", "append", "oldest" and "heap".
+// Load of custom buffer is as of SortableSliceBuffer: all records are loaded, in bytewise order or by TransformArgs.Comparator.
+// Panics if name is already registered: call it from init.
+func RegisterBuffer(name string, factory BufferFactory) int {
+	buffersLock.Lock()
+	defer buffersLock.Unlock()
+	if _, ok := bufferTypeNames[name]; ok {
+		panic("etl: buffer type " + name + " is already registered")
+	}
+	tp := nextBufferType
+	nextBufferType++
+	bufferTypeNames[name], bufferFactories[tp] = tp, factory
+	return tp
+}
+
+// ErrUnknownBufferName - TransformArgs.BufferName is not registered, see RegisterBuffer
+var ErrUnknownBufferName = errors.New("etl: unknown buffer type name")
+
+// ErrTopNBufferType - SortableTopNBuffer can't be created by TransformArgs.BufferType: it needs N and comparator
+var ErrTopNBufferType = errors.New("etl: SortableTopNBuffer requires NewTopNBuffer")
+
+// bufferType - id of args.BufferName if set, else args.BufferType. Returned type can be created by getBufferByType.
+func (args TransformArgs) bufferType() (int, error) {
+	if args.BufferType == SortableTopNBuffer && args.BufferName == "" {
+		return 0, ErrTopNBufferType
+	}
+	buffersLock.RLock()
+	defer buffersLock.RUnlock()
+	tp := args.BufferType
+	if args.BufferName != "" {
+		var ok bool
+		if tp, ok = bufferTypeNames[args.BufferName]; !ok {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownBufferName, args.BufferName)
+		}
+	}
+	if _, ok := bufferFactories[tp]; !ok {
+		return 0, fmt.Errorf("etl: unknown buffer type %d", tp)
+	}
+	return tp, nil
+}
+
 func getBufferByType(tp int, size datasize.ByteSize) Buffer {
-	switch tp {
-	case SortableSliceBuffer:
-		return NewSortableBuffer(size)
-	case SortableAppendBuffer:
-		return NewAppendBuffer(size)
-	case SortableOldestAppearedBuffer:
-		return NewOldestEntryBuffer(size)
-	default:
+	if tp == SortableTopNBuffer {
+		panic("etl: size is not enough to create TopN buffer, use NewTopNBuffer")
+	}
+	buffersLock.RLock()
+	factory, ok := bufferFactories[tp]
+	buffersLock.RUnlock()
+	if !ok {
 		panic("unknown buffer type " + strconv.Itoa(tp))
 	}
+	return factory(size)
 }
 
 func getTypeByBuffer(b Buffer) int {
@@ -377,7 +734,11 @@ func getTypeByBuffer(b Buffer) int {
 		return SortableAppendBuffer
 	case *oldestEntrySortableBuffer:
 		return SortableOldestAppearedBuffer
-	default:
-		panic(fmt.Sprintf("unknown buffer type: %T ", b))
+	case *topNBuffer:
+		return SortableTopNBuffer
+	case *heapBuffer:
+		return SortableHeapBuffer
+	default: // see RegisterBuffer
+		return SortableSliceBuffer
 	}
 }
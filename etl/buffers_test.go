@@ -0,0 +1,350 @@
+/*
+Copyright 2022 Erigon contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingAllocator struct {
+	allocs, frees int
+	live          [][]byte
+}
+
+func (a *countingAllocator) Alloc(size int) []byte {
+	a.allocs++
+	b := make([]byte, size)
+	a.live = append(a.live, b)
+	return b
+}
+
+func (a *countingAllocator) Free(b []byte) {
+	a.frees++
+	for i := range a.live {
+		if &a.live[i][0] == &b[0] {
+			a.live = append(a.live[:i], a.live[i+1:]...)
+			return
+		}
+	}
+	panic("free of unknown memory")
+}
+
+func TestSortableBufferAllocator(t *testing.T) {
+	alloc := &countingAllocator{}
+	b := NewSortableBufferWithAllocator(1024, alloc)
+	c := NewCollector(t.Name(), t.TempDir(), b)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i))))
+	}
+	assert.Equal(t, 1, alloc.allocs) // flushed before outgrowing first allocation
+	require.Len(t, alloc.live, 1)
+	assert.True(t, &alloc.live[0][0] == &b.data[:1][0], "buffer must be backed by allocator")
+
+	b.Put(make([]byte, 2048), nil) // bigger than first allocation
+	assert.Equal(t, 2, alloc.allocs)
+	assert.Equal(t, 1, alloc.frees)
+
+	c.Close()
+	assert.Equal(t, 2, alloc.frees)
+	assert.Empty(t, alloc.live)
+}
+
+func TestBufferSizeForSpillTarget(t *testing.T) {
+	assert.Equal(t, BufferOptimalSize, BufferSizeForSpillTarget(1<<30, 0))
+	assert.Equal(t, MinBufferSize, BufferSizeForSpillTarget(1024, 4))
+	assert.Equal(t, MaxBufferSize, BufferSizeForSpillTarget(1<<40, 2))
+
+	const n, target = 100_000, 4
+	var total uint64
+	k, v := make([]byte, 20), make([]byte, 60)
+	for i := 0; i < n; i++ {
+		total += uint64(len(k) + len(v) + 32)
+	}
+	size := BufferSizeForSpillTarget(total, target)
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(size))
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(k, uint64(i))
+		require.NoError(t, c.Collect(k, v))
+	}
+	require.NoError(t, c.flushBuffer(nil, true))
+	assert.InDelta(t, target, len(c.dataProviders), 1)
+}
+
+func TestStableSort(t *testing.T) {
+	for _, n := range []int{0, 1, 19, 20, 21, 1000, 12345} {
+		rnd := rand.New(rand.NewSource(int64(n)))
+		b, expect := NewSortableBuffer(BufferOptimalSize), NewSortableBuffer(BufferOptimalSize)
+		for i := 0; i < n; i++ {
+			k := []byte{byte(rnd.Intn(64))} // many duplicates - checks stability
+			v := []byte(fmt.Sprintf("%d", i))
+			b.Put(k, v)
+			expect.Put(k, v)
+		}
+		require.NoError(t, stableSort(b, nil))
+		sort.Stable(expect)
+		for i := 0; i < n; i++ {
+			k1, v1 := b.Get(i, nil, nil)
+			k2, v2 := expect.Get(i, nil, nil)
+			require.Equal(t, k2, k1)
+			require.Equal(t, v2, v1)
+		}
+	}
+}
+
+func TestSortCancel(t *testing.T) {
+	b := NewSortableBuffer(BufferOptimalSize)
+	rnd := rand.New(rand.NewSource(1))
+	k := make([]byte, 8)
+	for i := 0; i < 2_000_000; i++ {
+		binary.BigEndian.PutUint64(k, rnd.Uint64())
+		b.Put(k, nil)
+	}
+	quit := make(chan struct{})
+	started := make(chan struct{})
+	var once sync.Once
+	b.SetComparator(func(k1, k2, _, _ []byte) int {
+		once.Do(func() { close(started) })
+		return bytes.Compare(k1, k2)
+	})
+	go func() {
+		<-started
+		close(quit)
+	}()
+	c := NewCollector(t.Name(), t.TempDir(), b)
+	defer c.Close()
+	c.quit = quit
+	start := time.Now()
+	err := c.flushBuffer(nil, false)
+	require.ErrorIs(t, err, common.ErrStopped)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Empty(t, c.dataProviders)
+}
+
+// quitOnSwap - sorted runs, only merge moves elements: quit is closed on first move
+type quitOnSwap struct {
+	vals  []int
+	swaps int
+	quit  chan struct{}
+}
+
+func (s *quitOnSwap) Len() int           { return len(s.vals) }
+func (s *quitOnSwap) Less(i, j int) bool { return s.vals[i] < s.vals[j] }
+func (s *quitOnSwap) Swap(i, j int) {
+	if s.swaps++; s.swaps == 1 {
+		close(s.quit)
+	}
+	s.vals[i], s.vals[j] = s.vals[j], s.vals[i]
+}
+
+func TestSortCancelFinalMerge(t *testing.T) {
+	// data[:head] and data[head:] are sorted, head is block size of last pass: all moves are in final merge
+	const head, tail = 20 << 13, 5000
+	s := &quitOnSwap{quit: make(chan struct{})}
+	for i := 0; i < head; i++ {
+		s.vals = append(s.vals, tail+i)
+	}
+	for i := 0; i < tail; i++ {
+		s.vals = append(s.vals, i)
+	}
+	require.ErrorIs(t, stableSort(s, s.quit), common.ErrStopped)
+	require.LessOrEqual(t, s.swaps, sortCheckQuitEvery)
+
+	s = &quitOnSwap{vals: s.vals[:0], quit: make(chan struct{})}
+	for i := 0; i < head+tail; i++ {
+		s.vals = append(s.vals, (i+tail)%(head+tail))
+	}
+	require.NoError(t, stableSort(s, nil))
+	require.True(t, sort.IntsAreSorted(s.vals))
+}
+
+func TestSortableBufferShrinkAfterSpill(t *testing.T) {
+	const baseline = 4 * 1024
+	b := NewSortableBuffer(8 * 1024)
+	b.ShrinkAfterSpill(baseline)
+	c := NewCollector(t.Name(), t.TempDir(), b)
+	defer c.Close()
+	require.NoError(t, c.Collect([]byte("key"), make([]byte, 1024*1024))) // spike
+	require.Equal(t, 1, len(c.dataProviders), "spike must be spilled")
+	assert.Equal(t, baseline, cap(b.data))
+	assert.LessOrEqual(t, 8*cap(b.offsets), baseline)
+
+	require.NoError(t, c.Collect([]byte("key2"), []byte("value")))
+	assert.Equal(t, baseline, cap(b.data), "small records don't grow buffer")
+
+	// default policy keeps memory
+	b = NewSortableBuffer(8 * 1024)
+	c2 := NewCollector(t.Name(), t.TempDir(), b)
+	defer c2.Close()
+	require.NoError(t, c2.Collect([]byte("key"), make([]byte, 1024*1024)))
+	assert.GreaterOrEqual(t, cap(b.data), 1024*1024)
+}
+
+func TestTopNBuffer(t *testing.T) {
+	const n, total = 10, 100_000
+	rnd := rand.New(rand.NewSource(1))
+	var all [][]byte
+	for i := 0; i < total; i++ {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, rnd.Uint64())
+		all = append(all, k)
+	}
+	sort.Slice(all, func(i, j int) bool { return bytes.Compare(all[i], all[j]) < 0 })
+
+	for _, largest := range []bool{false, true} {
+		c := NewCollector(t.Name(), t.TempDir(), NewTopNBuffer(n, largest))
+		for _, i := range rnd.Perm(total) {
+			require.NoError(t, c.Collect(all[i], all[i]))
+		}
+		var loaded [][]byte
+		require.NoError(t, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			assert.Equal(t, k, v)
+			loaded = append(loaded, common.Copy(k))
+			return nil
+		}, TransformArgs{}))
+		expect := all[:n]
+		if largest {
+			expect = all[total-n:]
+		}
+		assert.Equal(t, expect, loaded, "largest=%t", largest)
+	}
+}
+
+func putOldestEntries(b Buffer, n int) {
+	k, v := make([]byte, 8), make([]byte, 32)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(k, uint64(i*7919%n))
+		b.Put(k, v)
+	}
+}
+
+func TestOldestEntryBufferArena(t *testing.T) {
+	const n = 1000
+	b := NewOldestEntryBuffer(BufferOptimalSize)
+	putOldestEntries(b, n)
+	b.Put([]byte{0, 0, 0, 0, 0, 0, 0, 1}, []byte("newer")) // oldest stays
+	b.Sort()
+	require.Equal(t, n, b.Len())
+	for i := 0; i < n; i++ {
+		k, v := b.Get(i, nil, nil)
+		require.Equal(t, uint64(i), binary.BigEndian.Uint64(k))
+		require.Equal(t, make([]byte, 32), v)
+	}
+
+	b.Reset()
+	allocs := testing.AllocsPerRun(10, func() {
+		putOldestEntries(b, n)
+		b.Sort()
+		b.Reset()
+	})
+	// without arena: map key + value copy + sorted key copy = 3 allocations per record
+	assert.Less(t, allocs/n, 1.5)
+}
+
+func BenchmarkOldestEntryBuffer(b *testing.B) {
+	b.ReportAllocs()
+	buf := NewOldestEntryBuffer(BufferOptimalSize)
+	for i := 0; i < b.N; i++ {
+		putOldestEntries(buf, 10_000)
+		buf.Sort()
+		buf.Reset()
+	}
+}
+
+// nearlySortedKeys - increasing keys, every 10th is carried back by up to `jitter`
+func nearlySortedKeys(n, jitter int) [][]byte {
+	rnd := rand.New(rand.NewSource(42))
+	keys := make([][]byte, n)
+	for i := range keys {
+		j := i
+		if i%10 == 0 {
+			j -= rnd.Intn(jitter + 1)
+		}
+		keys[i] = []byte(fmt.Sprintf("key-%08d", j))
+	}
+	return keys
+}
+
+func collectMerged(tb testing.TB, buf Buffer, keys [][]byte, compression Compression) (merged []string, files int) {
+	c := NewCollector(tb.Name(), tb.TempDir(), buf)
+	defer c.Close()
+	c.SpillCompression(compression)
+	for i, k := range keys {
+		require.NoError(tb, c.Collect(k, []byte(fmt.Sprintf("v%d", i))))
+	}
+	it, err := c.Iter(TransformArgs{})
+	require.NoError(tb, err)
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		merged = append(merged, string(k)+"="+string(v))
+	}
+	require.NoError(tb, it.Err())
+	return merged, c.Stats().FilesSpilled
+}
+
+func TestHeapBuffer(t *testing.T) {
+	random := make([][]byte, 5000)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range random {
+		random[i] = []byte(fmt.Sprintf("key-%04d", rnd.Intn(1000))) // with duplicates
+	}
+	for name, keys := range map[string][][]byte{"nearly sorted": nearlySortedKeys(5000, 50), "random": random} {
+		expected, sliceFiles := collectMerged(t, NewSortableBuffer(8*1024), keys, CompressionNone)
+		got, heapFiles := collectMerged(t, NewHeapBuffer(8*1024), keys, CompressionNone)
+		require.Equal(t, expected, got, name) // equal keys in order of collection too
+		require.Greater(t, sliceFiles, 1, name)
+		if name == "nearly sorted" {
+			require.Less(t, heapFiles, sliceFiles/4, name)
+		}
+		got, _ = collectMerged(t, NewHeapBuffer(8*1024), keys, CompressionSnappy) // runs are not continued
+		require.Equal(t, expected, got, name)
+	}
+
+	// kept in RAM without spill
+	got, files := collectMerged(t, NewHeapBuffer(1024*1024), random[:100], CompressionNone)
+	expected, _ := collectMerged(t, NewSortableBuffer(1024*1024), random[:100], CompressionNone)
+	require.Equal(t, expected, got)
+	require.Zero(t, files)
+	require.Equal(t, SortableHeapBuffer, getTypeByBuffer(getBufferByType(SortableHeapBuffer, 1024)))
+}
+
+// BenchmarkHeapBufferSpills - spill files of nearly-sorted input: heap buffer continues runs instead of file per buffer
+func BenchmarkHeapBufferSpills(b *testing.B) {
+	keys := nearlySortedKeys(200_000, 100)
+	for name, newBuf := range map[string]func() Buffer{
+		"slice": func() Buffer { return NewSortableBuffer(256 * 1024) },
+		"heap":  func() Buffer { return NewHeapBuffer(256 * 1024) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			files := 0
+			for i := 0; i < b.N; i++ {
+				_, files = collectMerged(b, newBuf(), keys, CompressionNone)
+			}
+			b.ReportMetric(float64(files), "files")
+		})
+	}
+}
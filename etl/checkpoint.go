@@ -0,0 +1,107 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Checkpoint - persists last committed source key of stage between runs (node restarts), see TransformArgs.Checkpoint.
+// Save with nil key clears checkpoint, Load returns nil if there is no checkpoint. Key passed to Save is valid only during call.
+// To be consistent with data, implementation should write checkpoint into same tx (for example, by db.Put in the commit handler).
+type Checkpoint interface {
+	Save(stage string, key []byte) error
+	Load(stage string) ([]byte, error)
+}
+
+func checkpointStage(fromBucket string, args TransformArgs) string {
+	if args.CheckpointStage != "" {
+		return args.CheckpointStage
+	}
+	return fromBucket
+}
+
+// resumeFromCheckpoint - extract starts from NextKey of saved key. Extract seeks to it,
+// so it continues from next existing key even if saved key was deleted from source.
+func resumeFromCheckpoint(stage string, args TransformArgs) (TransformArgs, error) {
+	if args.Reverse {
+		return args, fmt.Errorf("etl: Checkpoint is not compatible with Reverse extract")
+	}
+	key, err := args.Checkpoint.Load(stage)
+	if err != nil {
+		return args, fmt.Errorf("etl: loading checkpoint of %s: %w", stage, err)
+	}
+	if key == nil {
+		return args, nil
+	}
+	start, err := NextKey(key)
+	if err != nil { // key is 0xFF..FF: only longer keys can be after it
+		start = append(common.Copy(key), 0)
+	}
+	if bytes.Compare(start, args.ExtractStartKey) > 0 {
+		args.ExtractStartKey = start
+	}
+	return args, nil
+}
+
+// checkpointCommitHandler - persists key of each commit of `next` (may be nil), clears checkpoint when everything is processed
+func checkpointCommitHandler(checkpoint Checkpoint, stage string, next LoadCommitHandler) LoadCommitHandler {
+	return func(db kv.Putter, key []byte, isDone bool) error {
+		if next != nil {
+			if err := next(db, key, isDone); err != nil {
+				return err
+			}
+		}
+		if isDone {
+			key = nil
+		}
+		if err := checkpoint.Save(stage, key); err != nil {
+			return fmt.Errorf("etl: saving checkpoint of %s: %w", stage, err)
+		}
+		return nil
+	}
+}
+
+// transformWithCheckpoint - one batch of Transform: extract resumes after checkpoint, stops after args.MaxExtractRecords
+// and, when batch is loaded, its last source key is saved as checkpoint (or checkpoint is cleared if extract completed)
+func transformWithCheckpoint(
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) error {
+	stage := checkpointStage(fromBucket, args)
+	args, err := resumeFromCheckpoint(stage, args)
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	commit := checkpointCommitHandler(args.Checkpoint, stage, nil)
+	var lastExtracted []byte
+	args.Checkpoint, args.lastExtracted = nil, &lastExtracted
+	if err := Transform(logPrefix, db, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args); err != nil {
+		return err
+	}
+	return commit(db, lastExtracted, lastExtracted == nil)
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+)
+
+// BatchChecksum - checksum of batch written by Load (see TransformArgs.BatchChecksumBucket):
+// sha256 of batch records in spill-file format: uvarint(len(k)), k, uvarint(len(v)), v. Deletes have empty v.
+func BatchChecksum(keys, vals [][]byte) []byte {
+	c := newBatchChecksum()
+	for i := range keys {
+		_ = c.add(keys[i], vals[i])
+	}
+	return c.sum()
+}
+
+type batchChecksum struct {
+	h       hash.Hash
+	numBuf  [binary.MaxVarintLen64]byte
+	lastKey []byte
+	records int
+}
+
+func newBatchChecksum() *batchChecksum { return &batchChecksum{h: sha256.New()} }
+
+func (c *batchChecksum) add(k, v []byte) error {
+	c.lastKey = append(c.lastKey[:0], k...)
+	c.records++
+	return writeElement(c.h, c.numBuf[:], k, v)
+}
+
+func (c *batchChecksum) sum() []byte { return c.h.Sum(nil) }
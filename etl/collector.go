@@ -17,16 +17,20 @@
 package etl
 
 import (
+	"bufio"
 	"bytes"
-	"container/heap"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/log/v3"
 
 	"github.com/ledgerwatch/erigon-lib/common"
@@ -39,14 +43,35 @@ type LoadFunc func(k, v []byte, table CurrentTableReader, next LoadNextFunc) err
 // Collector performs the job of ETL Transform, but can also be used without "E" (Extract) part
 // as a Collect Transform Load
 type Collector struct {
+	buf             Buffer
 	extractNextFunc ExtractNextFunc
 	flushBuffer     func([]byte, bool) error
 	logPrefix       string
 	dataProviders   []dataProvider
+	quit            <-chan struct{}
+	valueFilter     func(v []byte) bool
 	logLvl          log.Lvl
 	bufType         int
 	allFlushed      bool
 	autoClean       bool
+	provenance      bool
+	maxSpills       int
+	spillCeiling    int
+	baseFlushSize   int   // of buffer before MaxSpills growth, restored by Reset
+	streamErr       error // see StreamBatches
+	compression     Compression
+	keyring         *Keyring
+	maxTempBytes    uint64
+	metrics         Metrics
+	codec           EntryCodec
+	run             *fileDataProvider // spill file of current run of SortableHeapBuffer
+	tmpdir          string
+	noTempFiles     bool
+	keepOnError     bool
+	failed          bool // Load (or Transform) returned error, see KeepFilesOnError
+	budget          *BufferBudget
+	reserved        int // bytes of budget
+	stats           CollectorStats
 }
 
 // NewCollectorFromFiles creates collector from existing files (left over from previous unsuccessful loading)
@@ -74,7 +99,7 @@ func NewCollectorFromFiles(logPrefix, tmpdir string) (*Collector, error) {
 		}
 		dataProviders[i] = &dataProvider
 	}
-	return &Collector{dataProviders: dataProviders, allFlushed: true, autoClean: false, logPrefix: logPrefix}, nil
+	return &Collector{dataProviders: dataProviders, allFlushed: true, autoClean: false, logPrefix: logPrefix, tmpdir: tmpdir}, nil
 }
 
 // NewCriticalCollector does not clean up temporary files if loading has failed
@@ -85,34 +110,67 @@ func NewCriticalCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Coll
 }
 
 func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
-	c := &Collector{autoClean: true, bufType: getTypeByBuffer(sortableBuffer), logPrefix: logPrefix, logLvl: log.LvlInfo}
+	c := &Collector{buf: sortableBuffer, autoClean: true, bufType: getTypeByBuffer(sortableBuffer), logPrefix: logPrefix, tmpdir: tmpdir, logLvl: log.LvlInfo, metrics: NoopMetrics{}}
 
 	c.flushBuffer = func(currentKey []byte, canStoreInRam bool) error {
 		if sortableBuffer.Len() == 0 {
 			return nil
 		}
+		if !canStoreInRam && c.growInsteadOfSpill() {
+			return nil
+		}
+		if c.noTempFiles && (!canStoreInRam || c.spilled()) {
+			return fmt.Errorf("%s: %w: buffer is full with %d records, increase its size", logPrefix, ErrTempFilesDisabled, sortableBuffer.Len())
+		}
 		var provider dataProvider
 		var err error
-		sortableBuffer.Sort()
-		if canStoreInRam && len(c.dataProviders) == 0 {
+		records := sortableBuffer.Len()
+		if err = sortBuffer(sortableBuffer, c.quit); err != nil {
+			return err
+		}
+		if canStoreInRam && !c.spilled() {
 			provider = KeepInRAM(sortableBuffer)
 			c.allFlushed = true
+			if b, ok := sortableBuffer.(interface{ Size() int }); ok {
+				c.stats.BytesInMemory = uint64(b.Size())
+			}
 		} else {
+			if err = c.checkTempSpace(sortableBuffer); err != nil {
+				return err
+			}
 			doFsync := !c.autoClean /* is critical collector */
-			provider, err = FlushToDisk(logPrefix, sortableBuffer, tmpdir, doFsync, c.logLvl)
+			if hb, ok := sortableBuffer.(*heapBuffer); ok {
+				provider, records, err = c.spillRun(hb, tmpdir, canStoreInRam)
+			} else {
+				provider, err = flushToDisk(logPrefix, sortableBuffer, tmpdir, doFsync, c.logLvl, c.compression, c.keyring, c.codec)
+			}
 		}
 		if err != nil {
 			return err
 		}
+		if p, ok := provider.(*fileDataProvider); ok {
+			c.releaseBuffer(false)
+			c.stats.FilesSpilled++
+			if size := providerSize(p); size > 0 {
+				c.stats.BytesOnDisk += uint64(size)
+			}
+			c.metrics.IncSpilledFiles(logPrefix)
+		}
 		if provider != nil {
 			c.dataProviders = append(c.dataProviders, provider)
 		}
+		c.metrics.ObserveBatchSize(logPrefix, records)
+		if c.maxTempBytes > 0 && c.stats.BytesOnDisk > c.maxTempBytes { // estimate was too low: file is removed by Close
+			return fmt.Errorf("%s: %w: spill files use %s, max %s", logPrefix, ErrTempSpaceExceeded,
+				common.ByteCount(c.stats.BytesOnDisk), common.ByteCount(c.maxTempBytes))
+		}
 		return nil
 	}
 
 	c.extractNextFunc = func(originalK, k []byte, v []byte) error {
+		c.stats.EntriesCollected++
 		sortableBuffer.Put(k, v)
-		if sortableBuffer.CheckFlushSize() {
+		if sortableBuffer.CheckFlushSize() || !c.reserveBuffer() {
 			if err := c.flushBuffer(originalK, false); err != nil {
 				return err
 			}
@@ -123,29 +181,364 @@ func NewCollector(logPrefix, tmpdir string, sortableBuffer Buffer) *Collector {
 }
 
 func (c *Collector) Collect(k, v []byte) error {
+	if c.valueFilter != nil && !c.valueFilter(v) {
+		return nil
+	}
+	return c.extractNextFunc(k, k, v)
+}
+
+// CollectKeyLazy - for keys which are expensive to compute from value (hashes):
+// `keyFn` is called only if value passed ValueFilter
+func (c *Collector) CollectKeyLazy(keyFn func(v []byte) []byte, v []byte) error {
+	if c.valueFilter != nil && !c.valueFilter(v) {
+		return nil
+	}
+	k := keyFn(v)
 	return c.extractNextFunc(k, k, v)
 }
 
+// CollectNoCopy - as Collect, but buffer may keep references to `k` and `v` instead of copying them (saves allocations
+// of SortableAppendBuffer and SortableOldestAppearedBuffer). Contract: caller never modifies or reuses memory of `k` and `v`
+// after this call - when they stop being referenced is not defined.
+func (c *Collector) CollectNoCopy(k, v []byte) error {
+	b, ok := c.buf.(noCopyPutter)
+	if !ok {
+		return c.Collect(k, v)
+	}
+	if c.valueFilter != nil && !c.valueFilter(v) {
+		return nil
+	}
+	c.stats.EntriesCollected++
+	b.PutNoCopy(k, v)
+	if c.buf.CheckFlushSize() || !c.reserveBuffer() {
+		return c.flushBuffer(k, false)
+	}
+	return nil
+}
+
 func (c *Collector) LogLvl(v log.Lvl) { c.logLvl = v }
 
-func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
+// MaxSpills - when amount of spill files reaches half of `n`, buffer doubles its size (up to `ceiling`) instead of spilling:
+// keeps merge fan-in low. Spills continue when ceiling is reached, so `n` is a target, not guarantee.
+// Works with SortableSliceBuffer, SortableAppendBuffer and SortableOldestAppearedBuffer.
+func (c *Collector) MaxSpills(n int, ceiling datasize.ByteSize) {
+	c.maxSpills, c.spillCeiling = n, int(ceiling.Bytes())
+}
+
+func (c *Collector) growInsteadOfSpill() bool {
+	if c.maxSpills <= 0 || len(c.dataProviders) < c.maxSpills/2 {
+		return false
+	}
+	b, ok := c.buf.(growableBuffer)
+	if !ok || b.flushSize() >= c.spillCeiling || !c.reserveBuffer() {
+		return false
+	}
+	if c.baseFlushSize == 0 {
+		c.baseFlushSize = b.flushSize()
+	}
+	size := 2 * b.flushSize()
+	if size > c.spillCeiling {
+		size = c.spillCeiling
+	}
+	b.setFlushSize(size)
+	log.Debug(fmt.Sprintf("[%s] etl: buffer grows instead of spill", c.logPrefix), "spills", len(c.dataProviders), "size", common.ByteCount(uint64(size)))
+	return true
+}
+
+// Metrics - receives spill metrics of collector (nil - none)
+func (c *Collector) Metrics(m Metrics) {
+	if m == nil {
+		m = NoopMetrics{}
+	}
+	c.metrics = m
+}
+
+// ErrTempSpaceExceeded - spill would make spill files of collector larger than Collector.MaxTempBytes
+var ErrTempSpaceExceeded = errors.New("etl: temp space budget exceeded")
+
+// MaxTempBytes - budget of spill files (0 - unlimited): spill which would exceed it fails with ErrTempSpaceExceeded
+// (nothing is written, collected data stays in buffer). Size of spill is estimated by size of buffer before writing
+// (upper bound for SortableSliceBuffer and compressed spills), and checked after. File of consolidation is not counted.
+func (c *Collector) MaxTempBytes(n uint64) { c.maxTempBytes = n }
+
+// ErrTempFilesDisabled - buffer overflowed while spill files are disabled by NoTempFiles
+var ErrTempFilesDisabled = errors.New("etl: buffer overflow, temp files are disabled")
+
+// NoTempFiles - collector never touches tmpdir: Load reads buffer kept in RAM, and spill fails with ErrTempFilesDisabled
+// (collected data stays in buffer). Without it collector which never overflowed buffer doesn't touch tmpdir too -
+// option makes overflow an error instead of silent spill.
+func (c *Collector) NoTempFiles(v bool) { c.noTempFiles = v }
+
+// BufferBudget - collector reserves size of collected data in `b` shared with other collectors (nil - no limit),
+// and spills early when it's exhausted: instead of growing buffer up to its flush size (or by MaxSpills).
+// Reservation is released by spill and Close (and Reset).
+func (c *Collector) BufferBudget(b *BufferBudget) { c.budget = b }
+
+// KeepFilesOnError - if Load (or Transform) failed, Close leaves spill files in tmpdir for post-mortem and logs their
+// paths (buffer kept in RAM is lost). Reset removes them anyway.
+func (c *Collector) KeepFilesOnError(v bool) { c.keepOnError = v }
+
+// spilled - collector has spill files, files of AddSortedFile don't count: buffer can be kept in RAM along with them
+func (c *Collector) spilled() bool {
+	for _, p := range c.dataProviders {
+		if f, ok := p.(*fileDataProvider); !ok || !f.keep {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Collector) checkTempSpace(b Buffer) error {
+	if c.maxTempBytes == 0 {
+		return nil
+	}
+	var estimate uint64
+	if sb, ok := b.(interface{ Size() int }); ok {
+		estimate = uint64(sb.Size())
+	}
+	if c.stats.BytesOnDisk+estimate > c.maxTempBytes {
+		return fmt.Errorf("%s: %w: spill files use %s, spilling ~%s more, max %s", c.logPrefix, ErrTempSpaceExceeded,
+			common.ByteCount(c.stats.BytesOnDisk), common.ByteCount(estimate), common.ByteCount(c.maxTempBytes))
+	}
+	return nil
+}
+
+// SpillCompression - compresses spill files written after this call (see Compression)
+func (c *Collector) SpillCompression(v Compression) { c.compression = v }
+
+// SpillEncryption - encrypts spill files written after this call (and file of consolidation) by current key of keyring.
+// Merge decrypts each file by key it was written with: rotate keys by Keyring.Rotate, not by new keyring.
+func (c *Collector) SpillEncryption(keyring *Keyring) { c.keyring = keyring }
+
+// SpillEntryCodec - format of records of spill files written after this call and of FlushToFile (nil - default format).
+// Files of custom format can't be archived by ArchiveTo and read by NewCollectorFromFiles.
+func (c *Collector) SpillEntryCodec(codec EntryCodec) { c.codec = codec }
+
+// ValueFilter - Collect drops records whose value doesn't pass `f`
+func (c *Collector) ValueFilter(f func(v []byte) bool) { c.valueFilter = f }
+
+// WithProvenance - enables provenance mode: ExtractBuckets will prefix each collected value by provenance header
+func (c *Collector) WithProvenance(v bool) { c.provenance = v }
+
+func (c *Collector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) (err error) {
 	defer func() {
+		if err != nil {
+			c.failed = true
+		}
 		if c.autoClean {
 			c.Close()
 		}
 	}()
+	if args.Quit != nil {
+		c.quit = args.Quit
+	}
 	if !c.allFlushed {
 		if e := c.flushBuffer(nil, true); e != nil {
 			return e
 		}
 	}
+	args.loadedRecords, args.loadTotal = &c.stats.EntriesLoaded, c.stats.EntriesCollected
+	var committed []byte
+	args.lastCommitted = &committed
+	if args.OnLoadCommitTx != nil && args.needsCommitTimer() {
+		args.OnLoadCommitTx = timedCommitTxHandler(c.logPrefix, toBucket, args.OnLoadCommitTx, args)
+	}
 	if err := loadFilesIntoBucket(c.logPrefix, db, toBucket, c.bufType, c.dataProviders, loadFunc, args); err != nil {
+		var deadlineErr *LoadDeadlineError
+		if errors.As(err, &deadlineErr) {
+			return err
+		}
+		return &LoadError{Bucket: toBucket, LastCommittedKey: committed, Err: err}
+	}
+	return nil
+}
+
+// LoadError - Collector.Load failed. LastCommittedKey - `key` of last successful OnLoadCommitTx with isDone=false
+// (nil if there was none): records up to it are committed, after fixing cause load can be repeated from
+// NextKey(LastCommittedKey) - for example by Transform with ExtractStartKey.
+type LoadError struct {
+	Bucket           string
+	LastCommittedKey []byte
+	Err              error
+}
+
+func (e *LoadError) Error() string {
+	if e.LastCommittedKey == nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (bucket %s, last committed key %x)", e.Err, e.Bucket, e.LastCommittedKey)
+}
+
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// CollectorStats - see Collector.Stats
+type CollectorStats struct {
+	EntriesCollected uint64 // records passed to buffer by Collect (and by extract)
+	EntriesLoaded    uint64 // merged records read by Load (before LoadFunc)
+	FilesSpilled     int
+	BytesOnDisk      uint64 // total size of spill files
+	BytesInMemory    uint64 // size of buffer kept in RAM instead of last spill, if any
+}
+
+func (s *CollectorStats) add(o CollectorStats) {
+	s.EntriesCollected += o.EntriesCollected
+	s.EntriesLoaded += o.EntriesLoaded
+	s.FilesSpilled += o.FilesSpilled
+	s.BytesOnDisk += o.BytesOnDisk
+	s.BytesInMemory += o.BytesInMemory
+}
+
+// Stats - accumulated by collect, spills and Load. Stays valid after Load and Close.
+func (c *Collector) Stats() CollectorStats { return c.stats }
+
+// Iter - iterates collected data in merged order instead of Load. Collector still must be closed after use.
+func (c *Collector) Iter(args TransformArgs) (*PeekIter, error) {
+	if !c.allFlushed {
+		if err := c.flushBuffer(nil, true); err != nil {
+			return nil, err
+		}
+	}
+	return &PeekIter{it: newMergeIter(c.logPrefix, c.dataProviders, args)}, nil
+}
+
+// WriteMergedTo - writes merged stream to `w`, each record encoded by `encode` (format is up to caller).
+// Output is buffered by BufIOSize and flushed before return, write errors of `w` are returned.
+func (c *Collector) WriteMergedTo(w io.Writer, encode func(k, v []byte) []byte) error {
+	return c.writeMerged(w, func(k, v []byte) ([]byte, error) { return encode(k, v), nil }, false, nil)
+}
+
+// LoadStream - as Load, but each merged record is encoded by `encode` and written to `w` instead of db.
+// Order is same as of Load: comparator of buffer, only first of equal keys of SortableOldestAppearedBuffer.
+// Collector is cleaned up after it as after Load.
+func (c *Collector) LoadStream(w io.Writer, encode func(k, v []byte) ([]byte, error)) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	return c.writeMerged(w, encode, c.bufType == SortableOldestAppearedBuffer, &c.stats.EntriesLoaded)
+}
+
+func (c *Collector) writeMerged(w io.Writer, encode func(k, v []byte) ([]byte, error), dedup bool, loaded *uint64) error {
+	bw := bufio.NewWriterSize(w, BufIOSize)
+	if err := c.forEachMerged(c.quit, dedup, loaded, func(k, v []byte) error {
+		encoded, err := encode(k, v)
+		if err != nil {
+			return fmt.Errorf("%s: etl: encoding record %x: %w", c.logPrefix, k, err)
+		}
+		if _, err := bw.Write(encoded); err != nil {
+			return fmt.Errorf("%s: etl: writing merged stream: %w", c.logPrefix, err)
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("%s: etl: writing merged stream: %w", c.logPrefix, err)
+	}
+	return nil
+}
+
+// forEachMerged - calls walker for merged records in order of buffer comparator, `dedup` - only first of equal keys.
+// Stops with common.ErrStopped when `quit` is closed.
+func (c *Collector) forEachMerged(quit <-chan struct{}, dedup bool, loaded *uint64, walker func(k, v []byte) error) error {
+	if !c.allFlushed {
+		if err := c.flushBuffer(nil, true); err != nil {
+			return err
+		}
+	}
+	it := newMergeIter(c.logPrefix, c.dataProviders, TransformArgs{Quit: quit, Comparator: c.bufferComparator()})
+	var prevK []byte
+	for i := 0; ; i++ {
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if dedup {
+			if i > 0 && bytes.Equal(prevK, k) {
+				continue
+			}
+			prevK = append(prevK[:0], k...)
+		}
+		if loaded != nil {
+			*loaded++
+		}
+		if err := walker(k, v); err != nil {
+			return err
+		}
+	}
+}
+
+// bufferComparator - runs are sorted by it, so merge must use it too. nil means bytewise order.
+func (c *Collector) bufferComparator() kv.CmpFunc {
+	switch b := c.buf.(type) {
+	case *sortableBuffer:
+		return b.comparator
+	case *appendSortableBuffer:
+		return b.comparator
+	case *oldestEntrySortableBuffer:
+		return b.comparator
+	case *topNBuffer:
+		return b.comparator
+	}
 	return nil
 }
 
 func (c *Collector) Close() {
+	if c.keepOnError && c.failed {
+		c.keepFiles()
+	}
+	c.disposeProviders()
+	c.releaseBuffer(true)
+	switch b := c.buf.(type) {
+	case *sortableBuffer:
+		b.release()
+	case *oldestEntrySortableBuffer:
+		b.arena.reset() // buffer could be kept in RAM for Load
+	}
+}
+
+// Reset - empties collector to be fed by next extraction: spill files are removed (also if Load failed in the middle),
+// buffer is reset keeping its memory (MaxSpills growth is undone), stats are zeroed. Settings of collector are kept.
+// Close is still required when collector isn't needed anymore.
+func (c *Collector) Reset() {
+	c.disposeProviders()
+	c.releaseBuffer(true)
+	for i := range c.dataProviders {
+		c.dataProviders[i] = nil
+	}
+	c.dataProviders = c.dataProviders[:0]
+	c.buf.Reset()
+	if b, ok := c.buf.(growableBuffer); ok && c.baseFlushSize > 0 {
+		b.setFlushSize(c.baseFlushSize)
+		c.baseFlushSize = 0
+	}
+	c.allFlushed, c.streamErr, c.stats, c.failed = false, nil, CollectorStats{}, false
+}
+
+// keepFiles - spill files will be closed by Close but stay in tmpdir
+func (c *Collector) keepFiles() {
+	var files []string
+	for _, p := range c.dataProviders {
+		if f, ok := p.(*fileDataProvider); ok && !f.keep {
+			f.keep = true
+			files = append(files, f.file.Name())
+		}
+	}
+	if len(files) > 0 {
+		log.Warn(fmt.Sprintf("[%s] etl: load failed, temp files are kept", c.logPrefix), "files", strings.Join(files, ","))
+	}
+}
+
+// disposeProviders - removes spill files, safe for repeated call
+func (c *Collector) disposeProviders() {
+	c.run = nil
 	totalSize := uint64(0)
 	for _, p := range c.dataProviders {
 		totalSize += p.Dispose()
@@ -155,6 +548,28 @@ func (c *Collector) Close() {
 	}
 }
 
+// SeenSet - keys loaded by previous runs of incremental build (bucket, growable bloom, etc.), see TransformArgs.SeenSet.
+// `k` passed to Add is valid only during call.
+type SeenSet interface {
+	Has(k []byte) (bool, error)
+	Add(k []byte) error
+}
+
+// BucketReserver - optional extension of kv.RwTx: backends which benefit from size hint before big load
+type BucketReserver interface {
+	Reserve(bucket string, bytes uint64) error
+}
+
+// estimateLoadSize - size of providers data (spill format), providers of unknown size are ignored
+func estimateLoadSize(providers []dataProvider) (total uint64) {
+	for _, p := range providers {
+		if size := providerSize(p); size > 0 {
+			total += uint64(size)
+		}
+	}
+	return total
+}
+
 // loadFilesIntoBucket uses merge-sort to order the elements stored within the slice of providers,
 // regardless of ordering within the files the elements will be processed in order.
 // The first pass reads the first element from each of the providers and populates a heap with the key/value/provider index.
@@ -163,23 +578,36 @@ func (c *Collector) Close() {
 // The subsequent iterations pop the heap again and load up the provider associated with it to get the next element after processing LoadFunc.
 // this continues until all providers have reached their EOF.
 func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType int, providers []dataProvider, loadFunc LoadFunc, args TransformArgs) error {
-
-	h := &Heap{comparator: args.Comparator}
-	heap.Init(h)
-	for i, provider := range providers {
-		if key, value, err := provider.Next(nil, nil); err == nil {
-			he := HeapElem{key, value, i}
-			heap.Push(h, he)
-		} else /* we must have at least one entry per file */ {
-			eee := fmt.Errorf("%s: error reading first readers: n=%d current=%d provider=%s err=%w",
-				logPrefix, len(providers), i, provider, err)
-			panic(eee)
+	if args.VerifyAgainst != nil {
+		return verifyLoad(logPrefix, args.VerifyAgainst, bucket, bufType, providers, loadFunc, args)
+	}
+	if args.DeltaDryRun {
+		return deltaLoad(logPrefix, db, bucket, bufType, providers, loadFunc, args)
+	}
+	if r, ok := db.(BucketReserver); ok && bucket != "" {
+		if estimate := estimateLoadSize(providers); estimate > 0 {
+			if err := r.Reserve(bucket, estimate); err != nil {
+				return fmt.Errorf("%s: reserving %s for bucket %s: %w", logPrefix, common.ByteCount(estimate), bucket, err)
+			}
 		}
 	}
+	if args.MergeConcurrency > 1 {
+		var stop func()
+		providers, stop = parallelMerge(logPrefix, providers, args.MergeConcurrency, args)
+		defer stop()
+		args.SpillCorruptionPolicy = SpillCorruptionAbort // corrupted records are skipped by merges of groups
+	}
+	it, err := newLoadStream(logPrefix, providers, bufType, args)
+	if err != nil {
+		return err
+	}
 	var c kv.RwCursor
 
-	currentTable := &currentTableReader{db, bucket}
+	currentTable := &currentTableReader{getter: db, bucket: bucket, canonicalKey: args.CanonicalKey}
 	haveSortingGuaranties := isIdentityLoadFunc(loadFunc) // user-defined loadFunc may change ordering
+	if args.RetryPolicy.MaxAttempts > 1 && !haveSortingGuaranties {
+		loadFunc = args.RetryPolicy.wrapLoad(logPrefix, loadFunc, args.Quit)
+	}
 	var lastKey []byte
 	if bucket != "" { // passing empty bucket name is valid case for etl when DB modification is not expected
 		var err error
@@ -194,17 +622,96 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 		}
 	}
 	var canUseAppend bool
-	isDupSort := kv.ChaindataTablesCfg[bucket].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[bucket].AutoDupSortKeysConversion
+	isDupSort := args.DupSort || kv.ChaindataTablesCfg[bucket].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[bucket].AutoDupSortKeysConversion
 
-	logEvery := time.NewTicker(30 * time.Second)
-	defer logEvery.Stop()
+	logEvery, stopLog := args.logTicker()
+	defer stopLog()
+
+	var wal *walWriter
+	if args.WALWriter != nil && bucket != "" {
+		wal = newWALWriter(args.WALWriter)
+	}
+	var fc *frontCoder
+	if args.FrontCodeKeys > 0 && bucket != "" {
+		if wal != nil || isDupSort {
+			return fmt.Errorf("%s: etl: FrontCodeKeys is not compatible with WALWriter and dup-sorted buckets", logPrefix)
+		}
+		fc = &frontCoder{groupSize: args.FrontCodeKeys, put: c.Put}
+		var err error
+		if fc.prevKey, err = lastFrontCodedKey(c); err != nil {
+			return fmt.Errorf("%s: etl: bucket %s: %w", logPrefix, bucket, err)
+		}
+	}
+	var checksum *batchChecksum
+	if args.BatchChecksumBucket != "" && bucket != "" {
+		checksum = newBatchChecksum()
+	}
+	// AppendDup needs values of key in sorted order, but merge keeps order of collecting for equal keys
+	// (and values of one key may be spread over several files): values of key are buffered and appended sorted.
+	// AppendDup cursor: Put works with any cursor, so it's checked when load decides to append. Cursor changes on tx switch.
+	dupCursor := func() (kv.RwCursorDupSort, error) {
+		dc, ok := c.(kv.RwCursorDupSort)
+		if !ok {
+			return nil, fmt.Errorf("%s: etl: DupSort requires a dup-sorted table, bucket %s", logPrefix, bucket)
+		}
+		return dc, nil
+	}
+	var dupKey []byte
+	var dupVals [][]byte
+	flushDups := func() error {
+		dc, err := dupCursor()
+		if err != nil {
+			return err
+		}
+		sort.Slice(dupVals, func(i, j int) bool { return bytes.Compare(dupVals[i], dupVals[j]) < 0 })
+		for i, v := range dupVals {
+			if i > 0 && bytes.Equal(dupVals[i-1], v) {
+				continue // dup-sorted bucket keeps unique values
+			}
+			if err := dc.AppendDup(dupKey, v); err != nil {
+				return fmt.Errorf("%s: bucket: %s, appendDup: k=%x, %w", logPrefix, bucket, dupKey, err)
+			}
+		}
+		dupVals = dupVals[:0]
+		return nil
+	}
+	write := func(k, v []byte) error {
+		if len(v) == 0 {
+			return c.Delete(k)
+		}
+		if canUseAppend {
+			if isDupSort {
+				if len(dupVals) > 0 && !bytes.Equal(dupKey, k) {
+					if err := flushDups(); err != nil {
+						return err
+					}
+				}
+				dupKey = append(dupKey[:0], k...)
+				dupVals = append(dupVals, common.Copy(v))
+			} else {
+				if err := c.Append(k, v); err != nil {
+					return fmt.Errorf("%s: bucket: %s, append: k=%x, v=%x, %w", logPrefix, bucket, k, v, err)
+				}
+			}
+			return nil
+		}
+		if err := c.Put(k, v); err != nil { // of dup-sorted bucket: adds value to key
+			return fmt.Errorf("%s: put: k=%x, %w", logPrefix, k, err)
+		}
+		return nil
+	}
 
 	i := 0
-	var prevK []byte
+	var prevK, lastWritten []byte
 	loadNextFunc := func(originalK, k, v []byte) error {
 		if i == 0 {
 			isEndOfBucket := lastKey == nil || bytes.Compare(lastKey, k) == -1
 			canUseAppend = haveSortingGuaranties && isEndOfBucket
+			if canUseAppend && isDupSort && c != nil {
+				if _, err := dupCursor(); err != nil {
+					return err
+				}
+			}
 		}
 		i++
 
@@ -222,7 +729,11 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 
 		select {
 		default:
-		case <-logEvery.C:
+		case <-logEvery:
+			if args.unified != nil {
+				args.unified.log(logPrefix, args.logLevel(), k)
+				break
+			}
 			logArs := []interface{}{"into", bucket}
 			if args.LogDetailsLoad != nil {
 				logArs = append(logArs, args.LogDetailsLoad(k, v)...)
@@ -230,60 +741,188 @@ func loadFilesIntoBucket(logPrefix string, db kv.RwTx, bucket string, bufType in
 				logArs = append(logArs, "current_prefix", makeCurrentKeyStr(k))
 			}
 
-			log.Info(fmt.Sprintf("[%s] ETL [2/2] Loading", logPrefix), logArs...)
+			log.Log(args.logLevel(), fmt.Sprintf("[%s] ETL [2/2] Loading", logPrefix), logArs...)
 		}
 
-		if canUseAppend && len(v) == 0 {
+		if fc != nil {
+			if err := fc.add(k, v); err != nil {
+				return fmt.Errorf("%s: bucket %s: %w", logPrefix, bucket, err)
+			}
+		} else if canUseAppend && len(v) == 0 {
 			return nil // nothing to delete after end of bucket
+		} else if err := write(k, v); err != nil {
+			return err
 		}
-		if len(v) == 0 {
-			if err := c.Delete(k); err != nil {
+		if !args.LoadDeadline.IsZero() {
+			lastWritten = append(lastWritten[:0], k...)
+		}
+		if checksum != nil {
+			if err := checksum.add(k, v); err != nil {
 				return err
 			}
-			return nil
 		}
-		if canUseAppend {
-			if isDupSort {
-				if err := c.(kv.RwCursorDupSort).AppendDup(k, v); err != nil {
-					return fmt.Errorf("%s: bucket: %s, appendDup: k=%x, %w", logPrefix, bucket, k, err)
-				}
-			} else {
-				if err := c.Append(k, v); err != nil {
-					return fmt.Errorf("%s: bucket: %s, append: k=%x, v=%x, %w", logPrefix, bucket, k, v, err)
-				}
+		if wal != nil {
+			return wal.record(k, v)
+		}
+		return nil
+	}
+	// flushBatch - writes pending state of batch: before switch of tx and at the end
+	flushBatch := func() error {
+		if len(dupVals) > 0 {
+			if err := flushDups(); err != nil {
+				return err
 			}
-
-			return nil
 		}
-		if err := c.Put(k, v); err != nil {
-			return fmt.Errorf("%s: put: k=%x, %w", logPrefix, k, err)
+		if fc != nil {
+			if err := fc.flush(); err != nil {
+				return err
+			}
+		}
+		if checksum != nil && checksum.records > 0 {
+			if err := db.Put(args.BatchChecksumBucket, checksum.lastKey, checksum.sum()); err != nil {
+				return fmt.Errorf("%s: writing batch checksum: %w", logPrefix, err)
+			}
+			checksum = newBatchChecksum()
+		}
+		if wal != nil {
+			if err := wal.endBatch(); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
+	var committedKey []byte // OnLoadCommitTx, TransformWithProgress: last key passed to loadFunc
+	if args.lastLoaded != nil {
+		defer func() { *args.lastLoaded = committedKey }()
+	}
+	sinceCommit := 0
+	switchTx := func() error {
+		if err := flushBatch(); err != nil {
+			return err
+		}
+		if c != nil {
+			c.Close()
+		}
+		tx, err := args.OnLoadCommitTx(db, committedKey, false)
+		if err != nil {
+			return err
+		}
+		if tx == nil {
+			return fmt.Errorf("%s: etl: OnLoadCommitTx returned nil tx", logPrefix)
+		}
+		if args.lastCommitted != nil {
+			*args.lastCommitted = append((*args.lastCommitted)[:0], committedKey...)
+		}
+		db, currentTable.getter, sinceCommit = tx, tx, 0
+		if bucket != "" {
+			if c, err = db.RwCursor(bucket); err != nil {
+				return err
+			}
+			if fc != nil {
+				fc.put = c.Put
+			}
+		}
+		return nil
+	}
+	var order *orderVerifier
+	if args.VerifyOrder {
+		order = newOrderVerifier(args)
+	}
+	progress := newProgressReporter(args.ProgressCh, ProgressLoad)
+	var loadedKeys uint64 // for LoadProgress
+	var deadlineErr error
 	// Main loading loop
-	for h.Len() > 0 {
+	for {
 		if err := common.Stopped(args.Quit); err != nil {
 			return err
 		}
-
-		element := (heap.Pop(h)).(HeapElem)
-		provider := providers[element.TimeIdx]
-		err := loadFunc(element.Key, element.Value, currentTable, loadNextFunc)
+		if !args.LoadDeadline.IsZero() && time.Now().After(args.LoadDeadline) {
+			deadlineErr = &LoadDeadlineError{Bucket: bucket, LastKey: common.Copy(lastWritten)}
+			break // finish batch as usual: written records stay in tx
+		}
+		k, v, ok, err := it.next()
 		if err != nil {
 			return err
 		}
-		if element.Key, element.Value, err = provider.Next(element.Key[:0], element.Value[:0]); err == nil {
-			heap.Push(h, element)
-		} else if !errors.Is(err, io.EOF) {
-			return fmt.Errorf("%s: error while reading next element from disk: %w", logPrefix, err)
+		if !ok {
+			break
+		}
+		if order != nil {
+			if err := order.check(k, v); err != nil {
+				return fmt.Errorf("%s: bucket %s: %w", logPrefix, bucket, err)
+			}
+		}
+		if args.WantKeysBloom != nil && (!args.WantKeysBloom.MayContain(k) || (args.WantKeysExact != nil && !args.WantKeysExact(k))) {
+			continue
+		}
+		if args.SeenSet != nil {
+			seen, err := args.SeenSet.Has(k)
+			if err != nil {
+				return err
+			}
+			if seen {
+				continue
+			}
+			if err := args.SeenSet.Add(k); err != nil {
+				return err
+			}
+		}
+		if args.OnLoadCommitTx != nil && args.CommitEvery > 0 && sinceCommit >= args.CommitEvery && !bytes.Equal(k, committedKey) {
+			if err := switchTx(); err != nil {
+				return err
+			}
+		}
+		if args.loadedRecords != nil {
+			*args.loadedRecords++
+		}
+		if args.unified != nil {
+			args.unified.loaded++
+		}
+		if err := loadFunc(k, v, currentTable, loadNextFunc); err != nil {
+			return err
+		}
+		if args.OnLoadCommitTx != nil || args.lastLoaded != nil {
+			committedKey = append(committedKey[:0], k...)
+			sinceCommit++
+		}
+		progress.add(k, v, len(providers))
+		if args.LoadProgress != nil {
+			if loadedKeys++; loadedKeys%progressEventEvery == 0 {
+				args.LoadProgress(loadedKeys, args.loadTotal)
+			}
+		}
+	}
+	progress.done(len(providers))
+	if args.LoadProgress != nil {
+		args.LoadProgress(loadedKeys, args.loadTotal)
+	}
+	if err := flushBatch(); err != nil {
+		return err
+	}
+	if args.OnLoadCommitTx != nil && deadlineErr == nil {
+		if _, err := args.OnLoadCommitTx(db, committedKey, true); err != nil {
+			return err
 		}
 	}
 
 	log.Trace(fmt.Sprintf("[%s] ETL Load done", logPrefix), "bucket", bucket, "records", i)
 
-	return nil
+	return deadlineErr
+}
+
+// LoadDeadlineError - TransformArgs.LoadDeadline exceeded. Records up to LastKey (nil if none) are written into tx:
+// commit it and continue from NextKey(LastKey), or roll back.
+type LoadDeadlineError struct {
+	Bucket  string
+	LastKey []byte
+}
+
+func (e *LoadDeadlineError) Error() string {
+	return fmt.Sprintf("etl: load deadline exceeded: bucket %s, last written key %x", e.Bucket, e.LastKey)
 }
 
+func (e *LoadDeadlineError) Unwrap() error { return context.DeadlineExceeded }
+
 func makeCurrentKeyStr(k []byte) string {
 	var currentKeyStr string
 	if k == nil {
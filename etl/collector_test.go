@@ -0,0 +1,2131 @@
+/*
+Copyright 2022 Erigon contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPartitioner(t *testing.T) {
+	const shards, n = 8, 80_000
+	partition := HashPartitioner(shards)
+	counts := make([]int, shards)
+	for i := 0; i < n; i++ {
+		counts[partition([]byte(fmt.Sprintf("%10d-key-%010d", i, i)))]++
+	}
+	for i, cnt := range counts {
+		assert.InDelta(t, n/shards, cnt, n/shards/10, "shard %d", i)
+	}
+	assert.Equal(t, partition([]byte("abc")), partition([]byte("abc")))
+}
+
+func TestShardedCollector(t *testing.T) {
+	const shards, n = 4, 1000
+	partition := HashPartitioner(shards)
+	c := NewShardedCollector(t.Name(), t.TempDir(), shards, partition, func() Buffer { return NewSortableBuffer(4 * 1024) })
+	defer c.Close()
+	for i := n - 1; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("%10d-key-%010d", i, i))
+		require.NoError(t, c.Collect(k, k))
+	}
+	total := 0
+	for i, shard := range c.Shards() {
+		var prev []byte
+		err := shard.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			assert.Equal(t, i, partition(k))
+			assert.Equal(t, k, v)
+			assert.True(t, bytes.Compare(prev, k) < 0, "shard must be sorted")
+			prev = append(prev[:0], k...)
+			total++
+			return nil
+		}, TransformArgs{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, n, total)
+}
+
+func varintCmp(k1, k2, _, _ []byte) int {
+	a, _ := binary.Uvarint(k1)
+	b, _ := binary.Uvarint(k2)
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func collectVarintKeys(tb testing.TB, n int) *Collector {
+	tb.Helper()
+	buf := NewSortableBuffer(4 * 1024)
+	buf.SetComparator(varintCmp)
+	c := NewCollector(tb.Name(), tb.TempDir(), buf)
+	var numBuf [binary.MaxVarintLen64]byte
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		l := binary.PutUvarint(numBuf[:], uint64(i)*1000)
+		require.NoError(tb, c.Collect(numBuf[:l], []byte{1}))
+	}
+	return c
+}
+
+func TestCollectorKeyDecoder(t *testing.T) {
+	const n = 10_000
+	c := collectVarintKeys(t, n)
+	defer c.Close()
+	decodes := 0
+	args := TransformArgs{
+		KeyDecoder: func(k, _ []byte) interface{} {
+			decodes++
+			v, _ := binary.Uvarint(k)
+			return v
+		},
+		DecodedComparator: func(a, b interface{}) int {
+			switch {
+			case a.(uint64) < b.(uint64):
+				return -1
+			case a.(uint64) > b.(uint64):
+				return 1
+			}
+			return 0
+		},
+	}
+	expect := uint64(0)
+	err := c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		got, _ := binary.Uvarint(k)
+		require.Equal(t, expect, got)
+		expect += 1000
+		return nil
+	}, args)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(n*1000), expect)
+	assert.Equal(t, n, decodes, "each key must be decoded exactly once")
+}
+
+func BenchmarkCollectorLoadComparator(b *testing.B) {
+	slowDecode := func(k []byte) uint64 { // simulates expensive key parsing
+		var v uint64
+		for i := 0; i < 50; i++ {
+			v, _ = binary.Uvarint(k)
+		}
+		return v
+	}
+	slowCmp := func(k1, k2, _, _ []byte) int {
+		a, b := slowDecode(k1), slowDecode(k2)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	noop := func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error { return nil }
+	b.Run("comparator", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			c := collectVarintKeys(b, 20_000)
+			b.StartTimer()
+			require.NoError(b, c.Load(nil, "", noop, TransformArgs{Comparator: slowCmp}))
+		}
+	})
+	b.Run("decoder", func(b *testing.B) {
+		args := TransformArgs{
+			KeyDecoder: func(k, _ []byte) interface{} { return slowDecode(k) },
+			DecodedComparator: func(a, b interface{}) int {
+				switch {
+				case a.(uint64) < b.(uint64):
+					return -1
+				case a.(uint64) > b.(uint64):
+					return 1
+				}
+				return 0
+			},
+		}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			c := collectVarintKeys(b, 20_000)
+			b.StartTimer()
+			require.NoError(b, c.Load(nil, "", noop, args))
+		}
+	})
+}
+
+func TestSpillCorruptionPolicy(t *testing.T) {
+	const files, perFile = 3, 10
+	collectWith := func(t *testing.T, garbage []byte) *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		for f := 0; f < files; f++ {
+			for i := 0; i < perFile; i++ {
+				k := []byte(fmt.Sprintf("key-%03d", i*files+f))
+				require.NoError(t, c.Collect(k, k))
+			}
+			require.NoError(t, c.flushBuffer(nil, false))
+		}
+		// inject garbage after first record of first file
+		name := c.dataProviders[0].(*fileDataProvider).file.Name()
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		recLen := 2 * (1 + len("key-000"))
+		corrupted := append(append(append([]byte{}, data[:recLen]...), garbage...), data[recLen:]...)
+		require.NoError(t, os.WriteFile(name, corrupted, 0600))
+		return c
+	}
+	// undecodable varint
+	collect := func(t *testing.T) *Collector { return collectWith(t, bytes.Repeat([]byte{0x80}, 10)) }
+	load := func(c *Collector, policy SpillCorruptionPolicy) (int, error) {
+		loaded := 0
+		err := c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			loaded++
+			return nil
+		}, TransformArgs{SpillCorruptionPolicy: policy})
+		return loaded, err
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		_, err := load(collect(t), SpillCorruptionAbort)
+		require.Error(t, err)
+	})
+	t.Run("skip record", func(t *testing.T) {
+		loaded, err := load(collect(t), SpillCorruptionSkipRecord)
+		require.NoError(t, err)
+		assert.Equal(t, files*perFile, loaded)
+	})
+	t.Run("skip file", func(t *testing.T) {
+		loaded, err := load(collect(t), SpillCorruptionSkipFile)
+		require.NoError(t, err)
+		assert.Equal(t, files*perFile-(perFile-1), loaded)
+	})
+
+	// plausible but wrong length: can't be allocated, and next record can't be found after it
+	uvarint := func(n uint64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, n)]
+	}
+	badLength := uvarint(0xFFFFFFFF)
+	t.Run("bad length abort", func(t *testing.T) {
+		_, err := load(collectWith(t, badLength), SpillCorruptionAbort)
+		require.ErrorIs(t, err, ErrSpillRecordLength)
+	})
+	t.Run("bad length skip record", func(t *testing.T) {
+		loaded, err := load(collectWith(t, badLength), SpillCorruptionSkipRecord)
+		require.NoError(t, err)
+		assert.Equal(t, files*perFile-(perFile-1), loaded)
+	})
+	t.Run("bad value length", func(t *testing.T) {
+		// valid key, value length is bigger than file
+		garbage := append(append([]byte{3}, "abc"...), uvarint(1<<20)...)
+		_, err := load(collectWith(t, garbage), SpillCorruptionAbort)
+		require.ErrorIs(t, err, ErrSpillRecordLength)
+	})
+
+	// decompressor error is sticky: SkipRecord must not retry same error forever
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		compression := compression
+		t.Run("compressed "+compression.String(), func(t *testing.T) {
+			c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+			c.SpillCompression(compression)
+			for f := 0; f < files; f++ {
+				for i := 0; i < perFile; i++ {
+					k := []byte(fmt.Sprintf("key-%03d", i*files+f))
+					require.NoError(t, c.Collect(k, k))
+				}
+				require.NoError(t, c.flushBuffer(nil, false))
+			}
+			name := c.dataProviders[0].(*fileDataProvider).file.Name()
+			data, err := os.ReadFile(name)
+			require.NoError(t, err)
+			for i := len(data) / 2; i < len(data); i++ {
+				data[i] ^= 0xFF
+			}
+			require.NoError(t, os.WriteFile(name, data, 0600))
+			done := make(chan struct{})
+			var loaded int
+			go func() {
+				defer close(done)
+				loaded, err = load(c, SpillCorruptionSkipRecord)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Load didn't finish")
+			}
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, loaded, (files-1)*perFile)
+			assert.Less(t, loaded, files*perFile)
+		})
+	}
+}
+
+func TestCollectKeyLazy(t *testing.T) {
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	defer c.Close()
+	c.ValueFilter(func(v []byte) bool { return v[0]%2 == 0 })
+	keyFnCalls := 0
+	keyFn := func(v []byte) []byte {
+		keyFnCalls++
+		require.Zero(t, v[0]%2, "keyFn called for filtered value")
+		return []byte{v[0], v[0]}
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.CollectKeyLazy(keyFn, []byte{byte(i)}))
+	}
+	require.NoError(t, c.Collect([]byte{1, 1}, []byte{1})) // filter applies to Collect too
+	assert.Equal(t, 5, keyFnCalls)
+
+	var keys [][]byte
+	require.NoError(t, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		keys = append(keys, common.Copy(k))
+		return nil
+	}, TransformArgs{}))
+	assert.Equal(t, [][]byte{{0, 0}, {2, 2}, {4, 4}, {6, 6}, {8, 8}}, keys)
+}
+
+func BenchmarkSizeOrderedMerge(b *testing.B) {
+	// skewed: 1 big file and many small ones
+	collect := func(b *testing.B) *Collector {
+		c := NewCollector(b.Name(), b.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		k := make([]byte, 8)
+		for f := 0; f < 20; f++ {
+			for i := 0; i < 500; i++ {
+				binary.BigEndian.PutUint64(k, uint64(i*21+f))
+				require.NoError(b, c.Collect(k, nil))
+			}
+			require.NoError(b, c.flushBuffer(nil, false))
+		}
+		for i := 0; i < 50_000; i++ {
+			binary.BigEndian.PutUint64(k, uint64(i*21+20))
+			require.NoError(b, c.Collect(k, nil))
+		}
+		require.NoError(b, c.flushBuffer(nil, false))
+		return c
+	}
+	noop := func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error { return nil }
+	for _, sizeOrdered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("size ordered=%t", sizeOrdered), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := collect(b)
+				b.StartTimer()
+				require.NoError(b, c.Load(nil, "", noop, TransformArgs{SizeOrderedMerge: sizeOrdered}))
+			}
+		})
+	}
+}
+
+func TestBatchChecksumBucket(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	checksumBucket := kv.ChaindataTables[2]
+	expectSums := map[string][]byte{}
+	for batch := 0; batch < 3; batch++ {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		var keys, vals [][]byte
+		for i := 0; i < 10; i++ {
+			k := []byte(fmt.Sprintf("key-%02d-%02d", batch, i))
+			v := []byte(fmt.Sprintf("value-%d", i))
+			require.NoError(t, c.Collect(k, v))
+			keys, vals = append(keys, k), append(vals, v)
+		}
+		require.NoError(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{BatchChecksumBucket: checksumBucket}))
+		expectSums[string(keys[len(keys)-1])] = BatchChecksum(keys, vals)
+	}
+
+	sums := map[string][]byte{}
+	require.NoError(t, tx.ForEach(checksumBucket, nil, func(k, v []byte) error {
+		sums[string(k)] = common.Copy(v)
+		return nil
+	}))
+	assert.Equal(t, expectSums, sums)
+}
+
+type reservingTx struct {
+	kv.RwTx
+	reserved map[string]uint64
+}
+
+func (tx *reservingTx) Reserve(bucket string, bytes uint64) error {
+	tx.reserved[bucket] += bytes
+	return nil
+}
+
+func TestLoadReserve(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key-%03d", i))
+		require.NoError(t, c.Collect(k, k))
+		if i == 50 {
+			require.NoError(t, c.flushBuffer(nil, false))
+		}
+	}
+	require.NoError(t, c.flushBuffer(nil, false))
+	estimate := estimateLoadSize(c.dataProviders)
+	assert.Equal(t, uint64(100*2*(1+len("key-000"))), estimate)
+
+	rtx := &reservingTx{RwTx: tx, reserved: map[string]uint64{}}
+	require.NoError(t, c.Load(rtx, kv.ChaindataTables[0], IdentityLoadFunc, TransformArgs{}))
+	assert.Equal(t, map[string]uint64{kv.ChaindataTables[0]: estimate}, rtx.reserved)
+}
+
+func TestCollectorPeekIter(t *testing.T) {
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	defer c.Close()
+	const n = 20
+	for i := n - 1; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("key-%03d", i))
+		require.NoError(t, c.Collect(k, k))
+		if i%7 == 0 {
+			require.NoError(t, c.flushBuffer(nil, false))
+		}
+	}
+	it, err := c.Iter(TransformArgs{})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		pk, pv, ok := it.Peek()
+		require.True(t, ok)
+		pk, pv = common.Copy(pk), common.Copy(pv)
+		pk2, _, _ := it.Peek() // repeated Peek doesn't consume
+		require.Equal(t, pk, pk2)
+
+		k, v, ok := it.Next()
+		require.True(t, ok)
+		require.Equal(t, pk, k)
+		require.Equal(t, pv, v)
+		require.Equal(t, []byte(fmt.Sprintf("key-%03d", i)), k)
+		if i+1 < n {
+			nk, _, ok := it.Peek()
+			require.True(t, ok)
+			require.Equal(t, []byte(fmt.Sprintf("key-%03d", i+1)), nk)
+			require.Equal(t, []byte(fmt.Sprintf("key-%03d", i)), k, "Peek must not invalidate record of Next")
+		}
+	}
+	_, _, ok := it.Peek()
+	require.False(t, ok)
+	_, _, ok = it.Next()
+	require.False(t, ok)
+	require.NoError(t, it.Err())
+}
+
+type writeLogTx struct {
+	kv.RwTx
+	log []string
+}
+
+func (tx *writeLogTx) RwCursor(bucket string) (kv.RwCursor, error) {
+	c, err := tx.RwTx.RwCursor(bucket)
+	return &writeLogCursor{RwCursor: c, tx: tx}, err
+}
+
+type writeLogCursor struct {
+	kv.RwCursor
+	tx *writeLogTx
+}
+
+func (c *writeLogCursor) Put(k, v []byte) error {
+	c.tx.log = append(c.tx.log, fmt.Sprintf("put %s=%s", k, v))
+	return c.RwCursor.Put(k, v)
+}
+
+func (c *writeLogCursor) Delete(k []byte) error {
+	c.tx.log = append(c.tx.log, fmt.Sprintf("delete %s", k))
+	return c.RwCursor.Delete(k)
+}
+
+func TestOrderedCollector(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.ChaindataTables[0]
+	c := NewOrderedCollector(t.Name(), t.TempDir(), 1) // spill after each record
+	defer c.Close()
+	var expect []string
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		k := []byte(fmt.Sprintf("key-%02d", rnd.Intn(30)))
+		if rnd.Intn(4) == 0 {
+			require.NoError(t, c.Collect(k, nil))
+			expect = append(expect, fmt.Sprintf("delete %s", k))
+			continue
+		}
+		v := []byte(fmt.Sprintf("value-%d", i))
+		require.NoError(t, c.Collect(k, v))
+		expect = append(expect, fmt.Sprintf("put %s=%s", k, v))
+	}
+	require.Greater(t, len(c.c.dataProviders), 1)
+	ltx := &writeLogTx{RwTx: tx}
+	require.NoError(t, c.Load(ltx, bucket, TransformArgs{}))
+	assert.Equal(t, expect, ltx.log)
+}
+
+func TestSpillFileFormat(t *testing.T) {
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	defer c.Close()
+	expectSize := 0
+	for i := 0; i < 300; i++ {
+		k := []byte(fmt.Sprintf("k%03d", i))
+		v := make([]byte, i%200) // lengths >= 128 need 2 bytes of varint
+		require.NoError(t, c.Collect(k, v))
+		expectSize += 1 + len(k) + len(v) + 1
+		if len(v) >= 128 {
+			expectSize++
+		}
+	}
+	require.NoError(t, c.flushBuffer(nil, false))
+	require.Len(t, c.dataProviders, 1)
+	assert.Equal(t, int64(expectSize), providerSize(c.dataProviders[0]))
+
+	i := 0
+	require.NoError(t, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		assert.Equal(t, []byte(fmt.Sprintf("k%03d", i)), k)
+		assert.Len(t, v, i%200)
+		i++
+		return nil
+	}, TransformArgs{}))
+	assert.Equal(t, 300, i)
+}
+
+// linearQueue - MergeQueue with O(n) PopMin
+type linearQueue struct {
+	less  func(a, b HeapElem) bool
+	elems []HeapElem
+}
+
+func (q *linearQueue) Push(e HeapElem) { q.elems = append(q.elems, e) }
+func (q *linearQueue) Len() int        { return len(q.elems) }
+func (q *linearQueue) PopMin() HeapElem {
+	minI := 0
+	for i := range q.elems {
+		if q.less(q.elems[i], q.elems[minI]) {
+			minI = i
+		}
+	}
+	e := q.elems[minI]
+	q.elems = append(q.elems[:minI], q.elems[minI+1:]...)
+	return e
+}
+
+func TestMergeQueue(t *testing.T) {
+	load := func(args TransformArgs) []string {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key-%03d", rnd.Intn(300))) // duplicates: order of equal keys matters too
+			require.NoError(t, c.Collect(k, []byte(fmt.Sprintf("%d", i))))
+			if i%97 == 0 {
+				require.NoError(t, c.flushBuffer(nil, false))
+			}
+		}
+		var out []string
+		require.NoError(t, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			out = append(out, string(k)+"="+string(v))
+			return nil
+		}, args))
+		return out
+	}
+	expect := load(TransformArgs{})
+	require.Len(t, expect, 1000)
+	got := load(TransformArgs{NewMergeQueue: func(less func(a, b HeapElem) bool) MergeQueue {
+		return &linearQueue{less: less}
+	}})
+	assert.Equal(t, expect, got)
+}
+
+func TestBlockingCollector(t *testing.T) {
+	const budget, bufferSize = 64 * 1024, 16 * 1024
+	c := NewBlockingCollector(t.Name(), t.TempDir(), bufferSize, budget)
+	defer c.Close()
+	const producers, perProducer = 4, 20_000
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				k := []byte(fmt.Sprintf("key-%d-%06d", p, i))
+				if err := c.Collect(k, make([]byte, 64)); err != nil {
+					panic(err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	recordSize := len("key-0-000000") + 64 + 32
+	assert.LessOrEqual(t, c.MaxInMemory(), budget+recordSize)
+
+	loaded := 0
+	var prev []byte
+	require.NoError(t, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		require.True(t, bytes.Compare(prev, k) < 0)
+		prev = append(prev[:0], k...)
+		loaded++
+		return nil
+	}, TransformArgs{}))
+	assert.Equal(t, producers*perProducer, loaded)
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	tmpdir := t.TempDir()
+	spill := func(logPrefix string) string {
+		c := NewCriticalCollector(logPrefix, tmpdir, NewSortableBuffer(BufferOptimalSize))
+		require.NoError(t, c.Collect([]byte("k"), []byte("v")))
+		require.NoError(t, c.flushBuffer(nil, false))
+		return c.dataProviders[0].(*fileDataProvider).file.Name()
+	}
+	defer func(runID string) { RunID = runID }(RunID)
+	RunID = "dead_run"
+	deadJob := spill("[1/2 Job]")
+	deadOther := spill("[2/2 Other]")
+	RunID = "live_run"
+	liveJob := spill("[1/2 Job]")
+	untagged := filepath.Join(tmpdir, "erigon-sortable-buf-123456")
+	require.NoError(t, os.WriteFile(untagged, nil, 0600))
+
+	removed, err := CleanupOrphans(tmpdir, "[1/2 Job]")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, deadJob)
+	assert.FileExists(t, deadOther)
+	assert.FileExists(t, liveJob)
+	assert.FileExists(t, untagged)
+}
+
+// readBlocks - reference reader of WriteBlocks format: validates footer, index and restart points, returns all entries
+func readBlocks(t *testing.T, file []byte, blockSize int) (keys, values [][]byte, blocks int) {
+	t.Helper()
+	require.GreaterOrEqual(t, len(file), BlockFooterSize)
+	footer := file[len(file)-BlockFooterSize:]
+	require.Equal(t, BlockFileMagic, binary.BigEndian.Uint64(footer[16:]))
+	indexOffset, indexSize := binary.BigEndian.Uint64(footer), binary.BigEndian.Uint64(footer[8:])
+	require.Equal(t, uint64(len(file)-BlockFooterSize), indexOffset+indexSize)
+
+	uvarint := func(b []byte) (uint64, []byte) {
+		x, n := binary.Uvarint(b)
+		require.Greater(t, n, 0)
+		return x, b[n:]
+	}
+	index := file[indexOffset : indexOffset+indexSize]
+	var expectOffset uint64
+	for len(index) > 0 {
+		var l, offset, size uint64
+		l, index = uvarint(index)
+		lastKey := index[:l]
+		index = index[l:]
+		offset, index = uvarint(index)
+		size, index = uvarint(index)
+		require.Equal(t, expectOffset, offset, "blocks must be contiguous")
+		expectOffset += size
+		block := file[offset : offset+size]
+		blocks++
+
+		nRestarts := int(binary.BigEndian.Uint32(block[len(block)-4:]))
+		restartsStart := len(block) - 4 - 4*nRestarts
+		restarts := map[int]bool{}
+		for i := 0; i < nRestarts; i++ {
+			restarts[int(binary.BigEndian.Uint32(block[restartsStart+4*i:]))] = true
+		}
+		data := block[:restartsStart]
+		var prev []byte
+		for i := 0; len(data) > 0; i++ {
+			pos := restartsStart - len(data)
+			var shared, unshared, vlen uint64
+			shared, data = uvarint(data)
+			unshared, data = uvarint(data)
+			vlen, data = uvarint(data)
+			isRestart := i%BlockRestartInterval == 0
+			require.Equal(t, isRestart, restarts[pos], "restart point at entry %d", i)
+			if isRestart {
+				require.Zero(t, shared)
+			}
+			k := append(common.Copy(prev[:shared]), data[:unshared]...)
+			data = data[unshared:]
+			keys, values = append(keys, k), append(values, common.Copy(data[:vlen]))
+			data = data[vlen:]
+			prev = k
+		}
+		require.Equal(t, lastKey, prev, "index must point to last key of block")
+		if len(index) > 0 { // all but last block are full
+			require.GreaterOrEqual(t, len(block), blockSize)
+		}
+	}
+	require.Equal(t, indexOffset, expectOffset)
+	return keys, values, blocks
+}
+
+func TestWriteBlocks(t *testing.T) {
+	const n, blockSize = 1000, 512
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024)) // several spill files
+	defer c.Close()
+	for i := n - 1; i >= 0; i-- {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", 1, i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", 1, 5)), []byte("dup"))) // duplicate is dropped
+	require.Greater(t, len(c.dataProviders), 1)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.WriteBlocks(&buf, blockSize, TransformArgs{}))
+	keys, values, blocks := readBlocks(t, buf.Bytes(), blockSize)
+	require.Equal(t, n, len(keys))
+	require.Greater(t, blocks, 1)
+	for i := range keys {
+		require.Equal(t, fmt.Sprintf("%10d-key-%010d", 1, i), string(keys[i]))
+		require.Equal(t, fmt.Sprintf("value-%d", i), string(values[i]))
+	}
+	// prefix compression: keys share 20 bytes prefix, so file is much smaller than raw data
+	require.Less(t, buf.Len(), n*(25+len("value-000")))
+}
+
+func TestFlushToFile(t *testing.T) {
+	spillDir, outDir := t.TempDir(), t.TempDir()
+	c := NewCollector(t.Name(), spillDir, NewSortableBuffer(1))
+	for i := 9; i >= 0; i-- {
+		require.NoError(t, c.Collect([]byte{byte(i)}, []byte{byte(i)}))
+	}
+	path, err := c.FlushToFile(outDir, TransformArgs{})
+	require.NoError(t, err)
+	require.Equal(t, outDir, filepath.Dir(path))
+	entries, err := os.ReadDir(spillDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	c.Close() // file belongs to caller
+	require.FileExists(t, path)
+
+	loaded, err := NewCollectorFromFiles(t.Name(), outDir)
+	require.NoError(t, err)
+	defer loaded.Close()
+	require.Equal(t, 1, len(loaded.dataProviders))
+	it, err := loaded.Iter(TransformArgs{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		k, _, ok := it.Next()
+		require.True(t, ok)
+		require.Equal(t, []byte{byte(i)}, k)
+	}
+	_, _, ok := it.Next()
+	require.False(t, ok)
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestWriteMergedTo(t *testing.T) {
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(1))
+	defer c.Close()
+	for i := 9; i >= 0; i-- {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	encode := func(k, v []byte) []byte { return []byte(fmt.Sprintf("%s=%s\n", k, v)) }
+
+	var buf bytes.Buffer
+	require.NoError(t, c.WriteMergedTo(&buf, encode))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Equal(t, 10, len(lines))
+	for i, line := range lines {
+		k, v, ok := strings.Cut(line, "=")
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("k%d", i), k)
+		require.Equal(t, fmt.Sprintf("v%d", i), v)
+	}
+
+	c2 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(1))
+	defer c2.Close()
+	require.NoError(t, c2.Collect([]byte("k"), []byte("v")))
+	writeErr := errors.New("pipe closed")
+	require.ErrorIs(t, c2.WriteMergedTo(failingWriter{writeErr}, encode), writeErr)
+}
+
+func TestLoadParallel(t *testing.T) {
+	const n = 1000
+	collect := func() *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(8*1024))
+		for i := n - 1; i >= 0; i-- {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		return c
+	}
+	readAll := func(tx kv.Tx) (keys, values []string) {
+		require.NoError(t, tx.ForEach(kv.ChaindataTables[0], nil, func(k, v []byte) error {
+			keys, values = append(keys, string(k)), append(values, string(v))
+			return nil
+		}))
+		return keys, values
+	}
+
+	_, serialTx := memdb.NewTestTx(t)
+	require.NoError(t, collect().Load(serialTx, kv.ChaindataTables[0], IdentityLoadFunc, TransformArgs{}))
+	serialKeys, serialValues := readAll(serialTx)
+
+	boundaries := [][]byte{[]byte(fmt.Sprintf("%10d", 100)), []byte(fmt.Sprintf("%10d", 500)), []byte(fmt.Sprintf("%10d", 501))}
+	dbs := make([]kv.RwDB, len(boundaries)+1)
+	for i := range dbs {
+		dbs[i] = memdb.NewTestDB(t)
+	}
+	err := collect().LoadParallel(func(partition int) (kv.RwTx, error) {
+		return dbs[partition].BeginRw(context.Background())
+	}, kv.ChaindataTables[0], boundaries, IdentityLoadFunc, TransformArgs{})
+	require.NoError(t, err)
+
+	var parallelKeys, parallelValues []string
+	for i, db := range dbs {
+		require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+			keys, values := readAll(tx)
+			require.NotEmpty(t, keys)
+			for _, k := range keys { // partition must have only keys of [boundaries[i-1], boundaries[i])
+				if i > 0 {
+					require.GreaterOrEqual(t, k, string(boundaries[i-1]))
+				}
+				if i < len(boundaries) {
+					require.Less(t, k, string(boundaries[i]))
+				}
+			}
+			parallelKeys, parallelValues = append(parallelKeys, keys...), append(parallelValues, values...)
+			return nil
+		}))
+	}
+	require.Equal(t, serialKeys, parallelKeys)
+	require.Equal(t, serialValues, parallelValues)
+
+	err = collect().LoadParallel(nil, kv.ChaindataTables[0], [][]byte{[]byte("b"), []byte("a")}, IdentityLoadFunc, TransformArgs{})
+	require.ErrorContains(t, err, "strictly increasing")
+
+	// failure of one partition rolls back all of them
+	failErr := errors.New("fail")
+	for i := range dbs {
+		dbs[i] = memdb.NewTestDB(t)
+	}
+	err = collect().LoadParallel(func(partition int) (kv.RwTx, error) {
+		return dbs[partition].BeginRw(context.Background())
+	}, kv.ChaindataTables[0], boundaries, func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		if bytes.HasPrefix(k, boundaries[1]) {
+			return failErr
+		}
+		return next(k, k, v)
+	}, TransformArgs{})
+	require.ErrorIs(t, err, failErr)
+	for _, db := range dbs {
+		require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+			keys, _ := readAll(tx)
+			require.Empty(t, keys)
+			return nil
+		}))
+	}
+}
+
+func TestFlushToFileOnConsolidated(t *testing.T) {
+	outDir := t.TempDir()
+	collect := func() *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(1))
+		require.NoError(t, c.Collect([]byte("k"), []byte("v")))
+		return c
+	}
+	final := filepath.Join(outDir, "final.dat")
+	var got string
+	path, err := collect().FlushToFile(outDir, TransformArgs{OnConsolidated: func(path string) error {
+		got = path
+		require.FileExists(t, path)
+		return os.Rename(path, final)
+	}})
+	require.NoError(t, err)
+	require.Equal(t, path, got)
+	require.FileExists(t, final)
+
+	hookErr := errors.New("downstream job failed")
+	path, err = collect().FlushToFile(outDir, TransformArgs{OnConsolidated: func(string) error { return hookErr }})
+	require.ErrorIs(t, err, hookErr)
+	require.FileExists(t, path)
+}
+
+func stableRecords(n int) (keys, values [][]byte) {
+	for i := 0; i < n; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%10d-key-%010d", i*7919%n, i)))
+		values = append(values, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	return keys, values
+}
+
+func TestCollectNoCopy(t *testing.T) {
+	keys, values := stableRecords(1000)
+	for _, bufType := range []int{SortableSliceBuffer, SortableAppendBuffer, SortableOldestAppearedBuffer} {
+		load := func(collect func(c *Collector, k, v []byte) error) (res []string) {
+			c := NewCollector(t.Name(), t.TempDir(), getBufferByType(bufType, 4*1024))
+			defer c.Close()
+			for i := range keys {
+				require.NoError(t, collect(c, keys[i], values[i]))
+				require.NoError(t, collect(c, keys[i], values[(i+1)%len(values)])) // duplicate key
+			}
+			it, err := c.Iter(TransformArgs{})
+			require.NoError(t, err)
+			for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+				res = append(res, string(k)+"="+string(v))
+			}
+			require.NoError(t, it.Err())
+			return res
+		}
+		expected := load((*Collector).Collect)
+		require.NotEmpty(t, expected)
+		require.Equal(t, expected, load((*Collector).CollectNoCopy), "buffer type %d", bufType)
+	}
+}
+
+func BenchmarkCollectNoCopy(b *testing.B) {
+	keys, values := stableRecords(10_000)
+	for _, bb := range []struct {
+		name    string
+		collect func(c *Collector, k, v []byte) error
+	}{{"copy", (*Collector).Collect}, {"nocopy", (*Collector).CollectNoCopy}} {
+		b.Run(bb.name, func(b *testing.B) {
+			buf := NewOldestEntryBuffer(datasize.GB) // no spills
+			c := NewCollector(b.Name(), b.TempDir(), buf)
+			defer c.Close()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := range keys {
+					_ = bb.collect(c, keys[j], values[j])
+				}
+				buf.Reset()
+			}
+		})
+	}
+}
+
+func TestCollectorMaxSpills(t *testing.T) {
+	const n, bufSize, maxSpills = 5000, 4 * 1024, 8
+	collect := func(maxSpills int) (*Collector, *sortableBuffer) {
+		buf := NewSortableBuffer(bufSize)
+		c := NewCollector(t.Name(), t.TempDir(), buf)
+		c.MaxSpills(maxSpills, datasize.MB)
+		for i := n - 1; i >= 0; i-- {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte("value")))
+		}
+		require.NoError(t, c.flushBuffer(nil, true))
+		return c, buf
+	}
+
+	unlimited, _ := collect(0)
+	defer unlimited.Close()
+	require.Greater(t, len(unlimited.dataProviders), 5*maxSpills)
+
+	c, buf := collect(maxSpills)
+	defer c.Close()
+	require.Greater(t, buf.flushSize(), bufSize)
+	require.LessOrEqual(t, len(c.dataProviders), maxSpills)
+	it, err := c.Iter(TransformArgs{})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		k, _, ok := it.Next()
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("%10d-key-%010d", i, i), string(k))
+	}
+}
+
+func TestLoadTyped(t *testing.T) {
+	const accounts, storage = byte(1), byte(2)
+	_, tx := memdb.NewTestTx(t)
+	accountsBucket, storageBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	c := NewCollector(t.Name(), t.TempDir(), NewOldestEntryBuffer(1))
+	for i := 9; i >= 0; i-- {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		require.NoError(t, c.CollectTyped(storage, k, []byte("s")))
+		require.NoError(t, c.CollectTyped(accounts, k, []byte("a")))
+		require.NoError(t, c.CollectTyped(accounts, k, []byte("dup"))) // dedup is per (type, key)
+	}
+	storageCalls := 0
+	err := c.LoadTyped(tx, map[byte]TypedLoad{
+		accounts: {Bucket: accountsBucket, LoadFunc: IdentityLoadFunc},
+		storage: {Bucket: storageBucket, LoadFunc: func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			storageCalls++
+			return next(k, k, append(common.Copy(v), '!'))
+		}},
+	}, TransformArgs{})
+	require.NoError(t, err)
+	require.Equal(t, 10, storageCalls)
+
+	for bucket, expected := range map[string]string{accountsBucket: "a", storageBucket: "s!"} {
+		i := 0
+		require.NoError(t, tx.ForEach(bucket, nil, func(k, v []byte) error {
+			require.Equal(t, fmt.Sprintf("key-%d", i), string(k))
+			require.Equal(t, expected, string(v))
+			i++
+			return nil
+		}))
+		require.Equal(t, 10, i)
+	}
+
+	c = NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(1))
+	require.NoError(t, c.CollectTyped(3, []byte("k"), []byte("v")))
+	require.ErrorContains(t, c.LoadTyped(tx, map[byte]TypedLoad{}, TransformArgs{}), "no handler for record type 3")
+}
+
+func TestStreamBatches(t *testing.T) {
+	const n, batchSize = 1000, 64
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	defer c.Close()
+	for i := n - 1; i >= 0; i-- {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	var batches [][]KV
+	for batch := range c.StreamBatches(context.Background(), batchSize) {
+		batches = append(batches, batch)
+	}
+	require.NoError(t, c.StreamErr())
+	require.Equal(t, (n+batchSize-1)/batchSize, len(batches))
+	i := 0
+	for bi, batch := range batches {
+		if bi < len(batches)-1 {
+			require.Equal(t, batchSize, len(batch))
+		} else {
+			require.Equal(t, n%batchSize, len(batch))
+		}
+		for _, kv := range batch {
+			require.Equal(t, fmt.Sprintf("%10d-key-%010d", i, i), string(kv.K))
+			require.Equal(t, fmt.Sprintf("value-%d", i), string(kv.V))
+			i++
+		}
+	}
+
+	c2 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	defer c2.Close()
+	for i := 0; i < n; i++ {
+		require.NoError(t, c2.Collect([]byte(fmt.Sprintf("%10d", i)), nil))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := c2.StreamBatches(ctx, 1)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	require.ErrorIs(t, c2.StreamErr(), context.Canceled)
+	require.Nil(t, c2.quit, "ctx of stream must not stay as quit of collector")
+
+	// same records as Load: only oldest of equal keys spread over spill files
+	c3 := NewCollector(t.Name(), t.TempDir(), NewOldestEntryBuffer(BufferOptimalSize))
+	defer c3.Close()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, c3.Collect([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("round-%d", round))))
+		}
+		require.NoError(t, c3.flushBuffer(nil, false))
+	}
+	var streamed []string
+	for batch := range c3.StreamBatches(context.Background(), 4) {
+		for _, kv := range batch {
+			streamed = append(streamed, string(kv.K)+" "+string(kv.V))
+		}
+	}
+	require.NoError(t, c3.StreamErr())
+	require.Len(t, streamed, 10)
+	for i, s := range streamed {
+		require.Equal(t, fmt.Sprintf("key-%02d round-0", i), s)
+	}
+}
+
+func TestCollectorStats(t *testing.T) {
+	const n = 1000
+	_, tx := memdb.NewTestTx(t)
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	for i := 0; i < n; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte("value")))
+	}
+	require.NoError(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+	stats := c.Stats()
+	require.Equal(t, uint64(n), stats.EntriesCollected)
+	require.Equal(t, uint64(n), stats.EntriesLoaded)
+	require.Greater(t, stats.FilesSpilled, 1)
+	require.Greater(t, stats.BytesOnDisk, uint64(n*(25+5)))
+	require.Zero(t, stats.BytesInMemory)
+
+	small := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	require.NoError(t, small.Collect([]byte("k"), []byte("v")))
+	require.NoError(t, small.Load(tx, kv.ChaindataTables[2], IdentityLoadFunc, TransformArgs{}))
+	require.Zero(t, small.Stats().FilesSpilled)
+	require.Greater(t, small.Stats().BytesInMemory, uint64(0))
+
+	var ts TransformStats
+	require.NoError(t, Transform("logPrefix", tx, kv.ChaindataTables[1], kv.ChaindataTables[3], t.TempDir(),
+		func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) }, IdentityLoadFunc, TransformArgs{Stats: &ts, BufferSize: 4 * 1024}))
+	require.Equal(t, uint64(n), ts.EntriesLoaded)
+	require.Greater(t, ts.FilesSpilled, 1)
+}
+
+func TestArchiveTo(t *testing.T) {
+	const n = 1000
+	_, tx := memdb.NewTestTx(t)
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	defer c.Close()
+	for i := n - 1; i >= 0; i-- {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	var archive bytes.Buffer
+	require.NoError(t, c.ArchiveTo(&archive))
+	require.NoError(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+
+	_, fresh := memdb.NewTestTx(t)
+	require.NoError(t, LoadFromArchive(&archive, fresh, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+	count := 0
+	require.NoError(t, tx.ForEach(kv.ChaindataTables[1], nil, func(k, v []byte) error {
+		got, err := fresh.GetOne(kv.ChaindataTables[1], k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+		count++
+		return nil
+	}))
+	require.Equal(t, n, count)
+	freshCount := 0
+	require.NoError(t, fresh.ForEach(kv.ChaindataTables[1], nil, func(k, v []byte) error { freshCount++; return nil }))
+	require.Equal(t, n, freshCount)
+
+	inRAM := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	defer inRAM.Close()
+	require.NoError(t, inRAM.Collect([]byte("k"), []byte("v")))
+	archive.Reset()
+	require.NoError(t, inRAM.ArchiveTo(&archive))
+	require.NoError(t, LoadFromArchive(&archive, fresh, kv.ChaindataTables[3], IdentityLoadFunc, TransformArgs{}))
+	v, err := fresh.GetOne(kv.ChaindataTables[3], []byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+
+	custom := NewSortableBuffer(BufferOptimalSize)
+	custom.SetComparator(func(k1, k2, v1, v2 []byte) int { return bytes.Compare(k2, k1) })
+	reversed := NewCollector(t.Name(), t.TempDir(), custom)
+	defer reversed.Close()
+	require.NoError(t, reversed.Collect([]byte("k"), []byte("v")))
+	archive.Reset()
+	require.NoError(t, reversed.ArchiveTo(&archive))
+	require.Error(t, LoadFromArchive(&archive, fresh, kv.ChaindataTables[3], IdentityLoadFunc, TransformArgs{}))
+}
+
+func TestLoadDupSort(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.AccountChangeSet
+	// values of each key are collected out of order and spread over several spill files
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(64))
+	defer c.Close()
+	for round := 3; round >= 0; round-- {
+		for key := 0; key < 5; key++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%02d", key)), []byte(fmt.Sprintf("value-%d", round))))
+		}
+	}
+	require.NoError(t, c.Collect([]byte("key-00"), []byte("value-2"))) // same value again
+	require.Greater(t, len(c.dataProviders), 1)
+	require.NoError(t, c.Load(tx, bucket, IdentityLoadFunc, TransformArgs{}))
+
+	expect := func(key int, values ...string) {
+		t.Helper()
+		cur, err := tx.CursorDupSort(bucket)
+		require.NoError(t, err)
+		defer cur.Close()
+		var got []string
+		k := []byte(fmt.Sprintf("key-%02d", key))
+		for _, v, err := cur.SeekExact(k); v != nil; _, v, err = cur.NextDup() {
+			require.NoError(t, err)
+			got = append(got, string(v))
+		}
+		require.Equal(t, values, got)
+	}
+	for key := 0; key < 5; key++ {
+		expect(key, "value-0", "value-1", "value-2", "value-3")
+	}
+
+	// not at end of bucket: Put adds values to existing keys
+	c2 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(64))
+	defer c2.Close()
+	require.NoError(t, c2.Collect([]byte("key-01"), []byte("value-9")))
+	require.NoError(t, c2.Collect([]byte("key-01"), []byte("value-4")))
+	require.NoError(t, c2.Load(tx, bucket, IdentityLoadFunc, TransformArgs{DupSort: true}))
+	expect(1, "value-0", "value-1", "value-2", "value-3", "value-4", "value-9")
+
+	// table is not dup-sorted: error, not panic of AppendDup
+	c3 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(64))
+	defer c3.Close()
+	require.NoError(t, c3.Collect([]byte("key-01"), []byte("value-0")))
+	err := c3.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{DupSort: true})
+	require.ErrorContains(t, err, "DupSort requires a dup-sorted table")
+}
+
+func TestSpillCompression(t *testing.T) {
+	const n = 5000
+	load := func(compression Compression) (kv.RwTx, CollectorStats) {
+		_, tx := memdb.NewTestTx(t)
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(16*1024))
+		defer c.Close()
+		c.SpillCompression(compression)
+		for i := n - 1; i >= 0; i-- {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte(fmt.Sprintf("val-%099d", i))))
+		}
+		require.NoError(t, c.flushBuffer(nil, false))
+		require.Greater(t, len(c.dataProviders), 1)
+		require.NoError(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+		return tx, c.Stats()
+	}
+	plain, plainStats := load(CompressionNone)
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		tx, stats := load(compression)
+		require.Less(t, stats.BytesOnDisk, plainStats.BytesOnDisk/2, compression.String())
+		count := 0
+		require.NoError(t, plain.ForEach(kv.ChaindataTables[1], nil, func(k, v []byte) error {
+			got, err := tx.GetOne(kv.ChaindataTables[1], k)
+			require.NoError(t, err)
+			require.Equal(t, v, got)
+			count++
+			return nil
+		}))
+		require.Equal(t, n, count)
+	}
+
+	// archive keeps compression of spill files
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(16*1024))
+	defer c.Close()
+	c.SpillCompression(CompressionZstd)
+	for i := 0; i < n; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte(fmt.Sprintf("val-%099d", i))))
+	}
+	var archive bytes.Buffer
+	require.NoError(t, c.ArchiveTo(&archive))
+	_, fresh := memdb.NewTestTx(t)
+	require.NoError(t, LoadFromArchive(&archive, fresh, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+	v, err := fresh.GetOne(kv.ChaindataTables[1], []byte(fmt.Sprintf("%10d-key-%010d", n-1, n-1)))
+	require.NoError(t, err)
+	require.Equal(t, []byte(fmt.Sprintf("val-%099d", n-1)), v)
+}
+
+func BenchmarkSpillCompression(b *testing.B) {
+	for _, compression := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		b.Run(compression.String(), func(b *testing.B) {
+			tmpdir := b.TempDir()
+			var onDisk uint64
+			for i := 0; i < b.N; i++ {
+				c := NewCollector(b.Name(), tmpdir, NewSortableBuffer(256*1024))
+				c.SpillCompression(compression)
+				for j := 0; j < 50_000; j++ {
+					if err := c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", j, j)), []byte(fmt.Sprintf("val-%099d", j))); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := c.flushBuffer(nil, false); err != nil {
+					b.Fatal(err)
+				}
+				onDisk = c.Stats().BytesOnDisk
+				it, err := c.Iter(TransformArgs{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+				}
+				c.Close()
+			}
+			b.ReportMetric(float64(onDisk), "spill-bytes")
+		})
+	}
+}
+
+func TestLoadFrontCoded(t *testing.T) {
+	const n = 1000
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.ChaindataTables[1]
+	key := func(i int) []byte { return []byte(fmt.Sprintf("long-shared-prefix-of-keys/%010d", i)) }
+	collect := func(from, to int) *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+		for i := to - 1; i >= from; i-- {
+			v := []byte(fmt.Sprintf("value-%d", i))
+			if i%100 == 0 {
+				v = nil // stored as is
+			}
+			require.NoError(t, c.Collect(key(i), v))
+		}
+		return c
+	}
+	require.NoError(t, collect(0, n/2).Load(tx, bucket, IdentityLoadFunc, TransformArgs{FrontCodeKeys: 16}))
+	require.NoError(t, collect(n/2, n).Load(tx, bucket, IdentityLoadFunc, TransformArgs{FrontCodeKeys: 16}))
+
+	groups, storedKeyBytes := 0, 0
+	require.NoError(t, tx.ForEach(bucket, nil, func(k, v []byte) error {
+		groups++
+		storedKeyBytes += len(k)
+		return nil
+	}))
+	require.Equal(t, 2*((n/2+15)/16), groups)
+	require.Less(t, storedKeyBytes, n*len(key(0))/10)
+
+	i := 0
+	require.NoError(t, ForEachFrontCoded(tx, bucket, func(k, v []byte) error {
+		require.Equal(t, key(i), k)
+		if i%100 == 0 {
+			require.Empty(t, v)
+		} else {
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), v)
+		}
+		i++
+		return nil
+	}))
+	require.Equal(t, n, i)
+
+	// keys must go after keys of bucket
+	require.Error(t, collect(10, 20).Load(tx, bucket, IdentityLoadFunc, TransformArgs{FrontCodeKeys: 16}))
+}
+
+func TestLoadStream(t *testing.T) {
+	const n = 500
+	encode := func(k, v []byte) ([]byte, error) { return []byte(fmt.Sprintf("%s=%s\n", k, v)), nil }
+	reverse := func(k1, k2, v1, v2 []byte) int { return bytes.Compare(k2, k1) }
+	newCollector := func(buf Buffer) *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), buf)
+		for i := 0; i < n; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d", i%(n/2))), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		require.NoError(t, c.flushBuffer(nil, false))
+		require.Greater(t, len(c.dataProviders), 1)
+		return c
+	}
+
+	// comparator of buffer is used by merge: same order as Load with same Comparator
+	buf := NewSortableBuffer(2 * 1024)
+	buf.SetComparator(reverse)
+	c := newCollector(buf)
+	var out bytes.Buffer
+	require.NoError(t, c.LoadStream(&out, encode))
+	require.Equal(t, uint64(n), c.Stats().EntriesLoaded)
+
+	buf = NewSortableBuffer(2 * 1024)
+	buf.SetComparator(reverse)
+	it, err := newCollector(buf).Iter(TransformArgs{Comparator: reverse})
+	require.NoError(t, err)
+	var expected bytes.Buffer
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		e, _ := encode(k, v)
+		expected.Write(e)
+	}
+	require.Equal(t, expected.String(), out.String())
+
+	// SortableOldestAppearedBuffer: same records as in db after Load
+	_, tx := memdb.NewTestTx(t)
+	require.NoError(t, newCollector(NewOldestEntryBuffer(2*1024)).Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+	expected.Reset()
+	require.NoError(t, tx.ForEach(kv.ChaindataTables[1], nil, func(k, v []byte) error {
+		e, _ := encode(k, v)
+		expected.Write(e)
+		return nil
+	}))
+	out.Reset()
+	require.NoError(t, newCollector(NewOldestEntryBuffer(2*1024)).LoadStream(&out, encode))
+	require.Equal(t, expected.String(), out.String())
+	require.Equal(t, n/2, strings.Count(out.String(), "\n"))
+
+	encodeErr := errors.New("bad record")
+	require.ErrorIs(t, newCollector(NewSortableBuffer(2*1024)).LoadStream(&out, func(k, v []byte) ([]byte, error) { return nil, encodeErr }), encodeErr)
+}
+
+func TestLoadProgress(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	n := 3*progressEventEvery + 10
+	collector := NewCollector(t.Name(), "", NewSortableBuffer(16*1024))
+	defer collector.Close()
+	for i := 0; i < n; i++ {
+		require.NoError(t, collector.Collect([]byte(fmt.Sprintf("key-%08d", i)), []byte("v")))
+	}
+
+	type call struct{ loaded, total uint64 }
+	var calls []call
+	require.NoError(t, collector.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{
+		LoadProgress: func(loadedKeys, totalKeys uint64) { calls = append(calls, call{loadedKeys, totalKeys}) },
+	}))
+	require.Equal(t, []call{{progressEventEvery, uint64(n)}, {2 * progressEventEvery, uint64(n)}, {3 * progressEventEvery, uint64(n)}, {uint64(n), uint64(n)}}, calls)
+
+	// total is unknown for collector from spill files
+	dir := t.TempDir()
+	collector = NewCollector(t.Name(), dir, NewSortableBuffer(1024))
+	collector.autoClean = false
+	for i := 0; i < 100; i++ {
+		require.NoError(t, collector.Collect([]byte(fmt.Sprintf("key-%08d", i)), []byte("v")))
+	}
+	require.NoError(t, collector.flushBuffer(nil, true))
+	fromFiles, err := NewCollectorFromFiles(t.Name(), dir)
+	require.NoError(t, err)
+	defer fromFiles.Close()
+	calls = calls[:0]
+	require.NoError(t, fromFiles.Load(tx, kv.ChaindataTables[3], IdentityLoadFunc, TransformArgs{
+		LoadProgress: func(loadedKeys, totalKeys uint64) { calls = append(calls, call{loadedKeys, totalKeys}) },
+	}))
+	require.Equal(t, []call{{100, 0}}, calls)
+}
+
+func TestSpillEncryption(t *testing.T) {
+	const n = 2000
+	key1, key2 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)
+	newCollector := func(compression Compression) (*Collector, *Keyring) {
+		keyring, err := NewKeyring(1, key1)
+		require.NoError(t, err)
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(16*1024))
+		c.SpillCompression(compression)
+		c.SpillEncryption(keyring)
+		// half of records before rotation and half after: merge reads files of both keys
+		for i := 0; i < n; i++ {
+			if i == n/2 {
+				require.NoError(t, c.flushBuffer(nil, false))
+				require.NoError(t, keyring.Rotate(2, key2))
+			}
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("%10d-key-%010d", i%7, i)), []byte(fmt.Sprintf("val-%099d", i))))
+		}
+		require.NoError(t, c.flushBuffer(nil, false))
+		return c, keyring
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionZstd} {
+		c, _ := newCollector(compression)
+		keyIDs := map[uint32]bool{}
+		for _, p := range c.dataProviders {
+			content, err := os.ReadFile(p.(*fileDataProvider).file.Name())
+			require.NoError(t, err)
+			require.NotContains(t, string(content), "-key-")
+			keyIDs[binary.BigEndian.Uint32(content[:4])] = true
+		}
+		require.Equal(t, map[uint32]bool{1: true, 2: true}, keyIDs)
+
+		_, tx := memdb.NewTestTx(t)
+		require.NoError(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}))
+		count := 0
+		var prev []byte
+		require.NoError(t, tx.ForEach(kv.ChaindataTables[1], nil, func(k, v []byte) error {
+			require.Less(t, string(prev), string(k))
+			prev = common.Copy(k)
+			count++
+			return nil
+		}))
+		require.Equal(t, n, count, compression.String())
+	}
+
+	// file of removed key can't be read
+	c, keyring := newCollector(CompressionNone)
+	require.NoError(t, keyring.Remove(1))
+	_, tx := memdb.NewTestTx(t)
+	require.ErrorContains(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{}), "not in keyring")
+	// skip policies don't parse ciphertext as records: missing key fails load
+	for _, policy := range []SpillCorruptionPolicy{SpillCorruptionSkipRecord, SpillCorruptionSkipFile} {
+		c, keyring := newCollector(CompressionNone)
+		require.NoError(t, keyring.Remove(1))
+		loaded := 0
+		err := c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			loaded++
+			return nil
+		}, TransformArgs{SpillCorruptionPolicy: policy})
+		require.ErrorIs(t, err, ErrSpillOpen)
+		require.Zero(t, loaded)
+	}
+	require.Error(t, keyring.Remove(2))
+	require.Error(t, keyring.Rotate(2, key1))
+	_, err := NewKeyring(1, []byte("short"))
+	require.Error(t, err)
+}
+
+func TestLoadColumns(t *testing.T) {
+	const n = 2500
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(8*1024))
+	for _, i := range rand.Perm(n) {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%08d", i)), []byte(fmt.Sprintf("%d", i))))
+	}
+	require.Greater(t, len(c.dataProviders), 1)
+
+	var keys, values, derived []string
+	var chunks []int
+	parity := func(k, v []byte) ([]byte, error) { return []byte{v[len(v)-1] % 2}, nil }
+	require.NoError(t, c.LoadColumns(func(columns []Column) error {
+		require.Len(t, columns, 3)
+		chunks = append(chunks, columns[0].Len())
+		for i := 0; i < columns[0].Len(); i++ {
+			require.Equal(t, columns[0].Len(), columns[1].Len())
+			keys = append(keys, string(columns[0].Value(i)))
+			values = append(values, string(columns[1].Value(i)))
+			derived = append(derived, string(columns[2].Value(i)))
+		}
+		return nil
+	}, 1000, parity))
+	require.Equal(t, []int{1000, 1000, 500}, chunks)
+	require.True(t, sort.StringsAreSorted(keys))
+	for i := range keys {
+		require.Equal(t, fmt.Sprintf("key-%08d", i), keys[i])
+		require.Equal(t, fmt.Sprintf("%d", i), values[i])
+		require.Equal(t, string([]byte{byte('0'+i%10) % 2}), derived[i])
+	}
+	require.Equal(t, uint64(n), c.Stats().EntriesLoaded)
+}
+
+func TestMaxTempBytes(t *testing.T) {
+	collect := func(c *Collector) error {
+		for i := 0; i < 1000; i++ {
+			if err := c.Collect([]byte(fmt.Sprintf("key-%08d", i)), []byte(fmt.Sprintf("val-%099d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(16*1024))
+	defer c.Close()
+	c.MaxTempBytes(64 * 1024)
+	err := collect(c)
+	require.ErrorIs(t, err, ErrTempSpaceExceeded)
+	require.Contains(t, err.Error(), "spill files use ")
+	require.LessOrEqual(t, c.Stats().BytesOnDisk, uint64(64*1024))
+	require.NotZero(t, c.Stats().BytesOnDisk)
+
+	// Transform
+	_, tx := memdb.NewTestTx(t)
+	generateTestData(t, tx, kv.ChaindataTables[1], 1000)
+	err = Transform("logPrefix", tx, kv.ChaindataTables[1], kv.ChaindataTables[3], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{BufferSize: 16 * 1024, MaxTempBytes: 64 * 1024})
+	require.ErrorIs(t, err, ErrTempSpaceExceeded)
+
+	// enough budget
+	c = NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(16*1024))
+	c.MaxTempBytes(1024 * 1024)
+	require.NoError(t, collect(c))
+	require.NoError(t, c.Load(tx, kv.ChaindataTables[4], IdentityLoadFunc, TransformArgs{}))
+}
+
+// newSpilledCollector - `files` spill files of records in random (seeded) order, with equal keys in different files
+func newSpilledCollector(tb testing.TB, files, perFile int) *Collector {
+	c := NewCollector(tb.Name(), tb.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	rnd := rand.New(rand.NewSource(42))
+	for f := 0; f < files; f++ {
+		for i := 0; i < perFile; i++ {
+			k := []byte(fmt.Sprintf("key-%08d", rnd.Intn(files*perFile/2)))
+			require.NoError(tb, c.Collect(k, []byte(fmt.Sprintf("file-%d-%d", f, i))))
+		}
+		require.NoError(tb, c.flushBuffer(nil, false))
+	}
+	require.Equal(tb, files, len(c.dataProviders))
+	return c
+}
+
+func TestLoadMergeConcurrency(t *testing.T) {
+	load := func(files, concurrency int) []string {
+		var loaded []string
+		_, tx := memdb.NewTestTx(t)
+		require.NoError(t, newSpilledCollector(t, files, 100).Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			loaded = append(loaded, string(k)+"="+string(v))
+			return next(k, k, v)
+		}, TransformArgs{MergeConcurrency: concurrency}))
+		return loaded
+	}
+	for _, files := range []int{3, 17, 40} {
+		serial := load(files, 0)
+		require.Len(t, serial, files*100)
+		for _, concurrency := range []int{2, 4, 64} {
+			require.Equal(t, serial, load(files, concurrency), "files=%d concurrency=%d", files, concurrency)
+		}
+	}
+}
+
+func BenchmarkLoadMergeConcurrency(b *testing.B) {
+	for _, concurrency := range []int{0, 4, 8} {
+		concurrency := concurrency
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := newSpilledCollector(b, 64, 5000)
+				b.StartTimer()
+				var n int
+				require.NoError(b, c.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+					n++
+					return nil
+				}, TransformArgs{MergeConcurrency: concurrency}))
+				require.Equal(b, 64*5000, n)
+			}
+		})
+	}
+}
+
+func TestCollectorReset(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	tmpdir := t.TempDir()
+	buf := NewSortableBuffer(4 * 1024)
+	c := NewCollector(t.Name(), tmpdir, buf)
+	defer c.Close()
+	c.autoClean = false // Load doesn't remove files: Reset must do it
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("first-%08d", i)), []byte("v")))
+	}
+	require.NoError(t, c.flushBuffer(nil, false))
+	files, err := os.ReadDir(tmpdir)
+	require.NoError(t, err)
+	require.Greater(t, len(files), 1)
+
+	// Load fails in the middle
+	loadErr := errors.New("load failed")
+	loaded := 0
+	require.ErrorIs(t, c.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		if loaded++; loaded == 100 {
+			return loadErr
+		}
+		return next(k, k, v)
+	}, TransformArgs{}), loadErr)
+
+	c.Reset()
+	files, err = os.ReadDir(tmpdir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+	require.Equal(t, CollectorStats{}, c.Stats())
+	require.Same(t, buf, c.buf)
+
+	// next extraction
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("second-%08d", i)), []byte("v")))
+	}
+	require.NoError(t, c.Load(tx, kv.ChaindataTables[3], IdentityLoadFunc, TransformArgs{}))
+	count := 0
+	require.NoError(t, tx.ForEach(kv.ChaindataTables[3], nil, func(k, v []byte) error {
+		require.True(t, strings.HasPrefix(string(k), "second-"), string(k))
+		count++
+		return nil
+	}))
+	require.Equal(t, 1000, count)
+	require.Equal(t, uint64(1000), c.Stats().EntriesLoaded)
+}
+
+func TestLoadDedup(t *testing.T) {
+	const keys, rounds = 50, 6
+	// each round writes all keys: duplicates inside buffer (2 rounds per spill) and across spill files
+	load := func(dedup Dedup) (map[string]string, int) {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		for r := 0; r < rounds; r++ {
+			for _, i := range rand.Perm(keys) {
+				require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("round-%d", r))))
+			}
+			if r%2 == 1 {
+				require.NoError(t, c.flushBuffer(nil, false))
+			}
+		}
+		require.Equal(t, rounds/2, len(c.dataProviders))
+		got, calls := map[string]string{}, 0
+		_, tx := memdb.NewTestTx(t)
+		require.NoError(t, c.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			if _, ok := got[string(k)]; !ok || dedup == DedupNone {
+				got[string(k)] = string(v)
+			}
+			calls++
+			return nil
+		}, TransformArgs{Dedup: dedup}))
+		return got, calls
+	}
+	for _, tc := range []struct {
+		dedup    Dedup
+		expected string
+		calls    int
+	}{
+		{DedupNone, fmt.Sprintf("round-%d", rounds-1), keys * rounds},
+		{DedupKeepFirst, "round-0", keys},
+		{DedupKeepLast, fmt.Sprintf("round-%d", rounds-1), keys},
+	} {
+		got, calls := load(tc.dedup)
+		require.Equal(t, tc.calls, calls, tc.dedup)
+		require.Len(t, got, keys)
+		for k, v := range got {
+			require.Equal(t, tc.expected, v, "dedup %d, key %s", tc.dedup, k)
+		}
+	}
+
+	c := NewCollector(t.Name(), "", NewOldestEntryBuffer(BufferOptimalSize))
+	require.NoError(t, c.Collect([]byte("k"), []byte("v")))
+	_, tx := memdb.NewTestTx(t)
+	require.Error(t, c.Load(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{Dedup: DedupKeepLast}))
+}
+
+func TestLoadCommitTx(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	bucket := kv.ChaindataTables[1]
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer func() { tx.Rollback() }()
+
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%08d", i)), []byte(fmt.Sprintf("val-%d", i))))
+	}
+	var commits []string
+	require.NoError(t, c.Load(tx, bucket, IdentityLoadFunc, TransformArgs{CommitEvery: 300,
+		OnLoadCommitTx: func(cur kv.RwTx, key []byte, isDone bool) (kv.RwTx, error) {
+			commits = append(commits, fmt.Sprintf("%s %t", key, isDone))
+			if isDone {
+				return nil, nil
+			}
+			if err := cur.Commit(); err != nil {
+				return nil, err
+			}
+			// committed tx has all records up to key and nothing after it
+			require.NoError(t, db.View(context.Background(), func(ro kv.Tx) error {
+				count := 0
+				require.NoError(t, ro.ForAmount(bucket, nil, 1<<30, func(k, _ []byte) error {
+					require.LessOrEqual(t, string(k), string(key))
+					count++
+					return nil
+				}))
+				require.Equal(t, len(commits)*300, count)
+				return nil
+			}))
+			var err error
+			tx, err = db.BeginRw(context.Background())
+			return tx, err
+		}}))
+	require.Equal(t, []string{"key-00000299 false", "key-00000599 false", "key-00000899 false", "key-00000999 true"}, commits)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, db.View(context.Background(), func(ro kv.Tx) error {
+		c, err := ro.Cursor(bucket)
+		require.NoError(t, err)
+		defer c.Close()
+		count, err := c.Count()
+		require.Equal(t, uint64(1000), count)
+		return err
+	}))
+}
+
+func TestLoadDupSortCommitTx(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	bucket := kv.AccountChangeSet
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer func() { tx.Rollback() }()
+
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(1024))
+	defer c.Close()
+	for round := 2; round >= 0; round-- {
+		for key := 0; key < 50; key++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%02d", key)), []byte(fmt.Sprintf("value-%d", round))))
+		}
+	}
+	commits := 0
+	require.NoError(t, c.Load(tx, bucket, IdentityLoadFunc, TransformArgs{CommitEvery: 10,
+		OnLoadCommitTx: func(cur kv.RwTx, _ []byte, isDone bool) (kv.RwTx, error) {
+			if isDone {
+				return nil, nil
+			}
+			commits++
+			if err := cur.Commit(); err != nil {
+				return nil, err
+			}
+			var err error
+			tx, err = db.BeginRw(context.Background())
+			return tx, err
+		}}))
+	require.Greater(t, commits, 1)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, db.View(context.Background(), func(ro kv.Tx) error {
+		cur, err := ro.CursorDupSort(bucket)
+		require.NoError(t, err)
+		defer cur.Close()
+		for key := 0; key < 50; key++ {
+			var got []string
+			k := []byte(fmt.Sprintf("key-%02d", key))
+			for _, v, err := cur.SeekExact(k); v != nil; _, v, err = cur.NextDup() {
+				require.NoError(t, err)
+				got = append(got, string(v))
+			}
+			require.Equal(t, []string{"value-0", "value-1", "value-2"}, got)
+		}
+		return nil
+	}))
+}
+
+// fixedLenCodec - records as 4-byte big-endian lengths and bytes
+type fixedLenCodec struct{}
+
+func (fixedLenCodec) WriteEntry(w io.Writer, k, v []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(k)))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(v)))
+	for _, b := range [][]byte{hdr[:], k, v} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fixedLenCodec) ReadEntry(r io.Reader) ([]byte, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	kv := make([]byte, binary.BigEndian.Uint32(hdr[:4])+binary.BigEndian.Uint32(hdr[4:]))
+	if _, err := io.ReadFull(r, kv); err != nil {
+		return nil, nil, err
+	}
+	kLen := binary.BigEndian.Uint32(hdr[:4])
+	return kv[:kLen], kv[kLen:], nil
+}
+
+func TestSpillEntryCodec(t *testing.T) {
+	collect := func(codec EntryCodec, compression Compression) *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+		c.SpillEntryCodec(codec)
+		c.SpillCompression(compression)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%08d", 999-i)), []byte(fmt.Sprintf("val-%d", i))))
+		}
+		require.NoError(t, c.flushBuffer(nil, false))
+		require.Greater(t, len(c.dataProviders), 1)
+		return c
+	}
+	load := func(c *Collector) (loaded []string) {
+		_, tx := memdb.NewTestTx(t)
+		require.NoError(t, c.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			loaded = append(loaded, string(k)+"="+string(v))
+			return next(k, k, v)
+		}, TransformArgs{}))
+		return loaded
+	}
+	expected := load(collect(nil, CompressionNone))
+	require.Equal(t, 1000, len(expected))
+
+	// spill file is readable by codec
+	c := collect(fixedLenCodec{}, CompressionNone)
+	f, err := os.Open(c.dataProviders[0].(*fileDataProvider).file.Name())
+	require.NoError(t, err)
+	k, v, err := fixedLenCodec{}.ReadEntry(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	var n int
+	_, err = fmt.Sscanf(string(k), "key-%08d", &n)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("val-%d", 999-n), string(v))
+	require.Equal(t, expected, load(c))
+	require.Equal(t, expected, load(collect(fixedLenCodec{}, CompressionZstd)))
+
+	// VarintEntryCodec writes default format
+	def, varint := collect(nil, CompressionNone), collect(VarintEntryCodec{}, CompressionNone)
+	defer def.Close()
+	defer varint.Close()
+	for i := range def.dataProviders {
+		a, err := os.ReadFile(def.dataProviders[i].(*fileDataProvider).file.Name())
+		require.NoError(t, err)
+		b, err := os.ReadFile(varint.dataProviders[i].(*fileDataProvider).file.Name())
+		require.NoError(t, err)
+		require.Equal(t, a, b)
+	}
+	require.Equal(t, expected, load(varint))
+
+	// consolidated file keeps codec
+	c = collect(fixedLenCodec{}, CompressionNone)
+	require.NoError(t, c.consolidate(t.TempDir(), TransformArgs{}))
+	require.Equal(t, expected, load(c))
+	c = collect(fixedLenCodec{}, CompressionNone)
+	defer c.Close()
+	require.Error(t, c.ArchiveTo(io.Discard))
+}
+
+type recordingPutter struct{ puts []string }
+
+func (p *recordingPutter) Put(table string, k, v []byte) error {
+	p.puts = append(p.puts, string(k)+"="+string(v))
+	return nil
+}
+
+func TestLoadReverse(t *testing.T) {
+	collect := func(bufSize datasize.ByteSize) *Collector {
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(bufSize))
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", (i*7)%500)), []byte(fmt.Sprintf("val-%d", i))))
+		}
+		return c
+	}
+	for _, bufSize := range []datasize.ByteSize{4 * 1024, BufferOptimalSize} {
+		var forward []string
+		require.NoError(t, collect(bufSize).Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			forward = append(forward, string(k)+"="+string(v))
+			return nil
+		}, TransformArgs{}))
+		require.Equal(t, 1000, len(forward))
+
+		var commits []string
+		p := &recordingPutter{}
+		c := collect(bufSize)
+		if bufSize == BufferOptimalSize {
+			require.NoError(t, c.flushBuffer(nil, true))
+			require.IsType(t, &memoryDataProvider{}, c.dataProviders[0])
+		}
+		require.NoError(t, c.LoadReverse(p, "bucket", IdentityLoadFunc, TransformArgs{CommitEvery: 400,
+			OnLoadCommit: func(_ kv.Putter, key []byte, isDone bool) error {
+				commits = append(commits, fmt.Sprintf("%s %t", key, isDone))
+				return nil
+			}}))
+		require.Equal(t, 1000, len(p.puts))
+		for i := range forward {
+			require.Equal(t, forward[len(forward)-1-i], p.puts[i])
+		}
+		require.Equal(t, []string{"key-0300 false", "key-0100 false", "key-0000 true"}, commits)
+		require.Equal(t, uint64(1000), c.Stats().EntriesLoaded)
+	}
+
+	// into db
+	_, tx := memdb.NewTestTx(t)
+	require.NoError(t, collect(4*1024).LoadReverse(tx, kv.ChaindataTables[1], func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		if prev, err := table.Get(k); err != nil || prev != nil {
+			return err // first value in reverse order is last collected one
+		}
+		return next(k, k, v)
+	}, TransformArgs{}))
+	v, err := tx.GetOne(kv.ChaindataTables[1], []byte("key-0000"))
+	require.NoError(t, err)
+	require.Equal(t, "val-500", string(v))
+
+	// nothing collected
+	c := NewCollector(t.Name(), filepath.Join(t.TempDir(), "missing"), NewSortableBuffer(4*1024))
+	require.NoError(t, c.flushBuffer(nil, true))
+	require.NoError(t, c.LoadReverse(&recordingPutter{}, "bucket", nil, TransformArgs{}))
+
+	// temp file would be plaintext copy of encrypted spills
+	keyring, err := NewKeyring(1, bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	c = NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(4*1024))
+	c.SpillEncryption(keyring)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", i)), []byte("v")))
+	}
+	require.ErrorIs(t, c.LoadReverse(&recordingPutter{}, "bucket", nil, TransformArgs{}), ErrReverseEncrypted)
+
+	// temp file is counted by MaxTempBytes
+	c = collect(4 * 1024)
+	require.NoError(t, c.flushBuffer(nil, true))
+	c.MaxTempBytes(c.Stats().BytesOnDisk + 1024)
+	require.ErrorIs(t, c.LoadReverse(&recordingPutter{}, "bucket", nil, TransformArgs{}), ErrTempSpaceExceeded)
+}
+
+func TestAddSortedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeSorted := func(name string, compression Compression, keys []int, val string) string {
+		f, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		defer f.Close()
+		w, err := compression.compressingWriter(f)
+		require.NoError(t, err)
+		numBuf := make([]byte, binary.MaxVarintLen64)
+		for _, i := range keys {
+			require.NoError(t, writeElement(w, numBuf, []byte(fmt.Sprintf("key-%04d", i)), []byte(val)))
+		}
+		require.NoError(t, w.Close())
+		return f.Name()
+	}
+	var plain, gz, zst []int
+	for i := 0; i < 100; i++ {
+		if i%3 == 0 {
+			plain = append(plain, i)
+		}
+		if i%5 == 0 {
+			gz = append(gz, i)
+		}
+	}
+	zst = []int{7, 8, 99}
+
+	c := NewCollector(t.Name(), dir, NewSortableBuffer(64))
+	defer c.Close()
+	var expect []string
+	collect := func(from, to int) {
+		for i := from; i < to; i += 2 {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", i)), []byte("collected")))
+		}
+	}
+	collect(0, 50)
+	require.NoError(t, c.flushBuffer(nil, false))
+	require.NoError(t, c.AddSortedFile(writeSorted("plain", CompressionNone, plain, "plain")))
+	collect(50, 100)
+	require.NoError(t, c.AddSortedFile(writeSorted("gz", CompressionGzip, gz, "gzip")))
+	require.NoError(t, c.AddSortedFile(writeSorted("zst", CompressionZstd, zst, "zstd")))
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		if i%2 == 0 {
+			expect = append(expect, key+" collected")
+		}
+		if i%3 == 0 {
+			expect = append(expect, key+" plain")
+		}
+		if i%5 == 0 {
+			expect = append(expect, key+" gzip")
+		}
+		if i == 7 || i == 8 || i == 99 {
+			expect = append(expect, key+" zstd")
+		}
+	}
+	// equal keys: spilled before file, then file, later collected
+	require.Equal(t, []string{"key-0000 collected", "key-0000 plain", "key-0000 gzip"}, expect[:3])
+
+	var loaded []string
+	_, tx := memdb.NewTestTx(t)
+	require.NoError(t, c.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		loaded = append(loaded, string(k)+" "+string(v))
+		return next(k, k, v)
+	}, TransformArgs{}))
+	require.Equal(t, len(expect), len(loaded))
+	require.Equal(t, expect[:3], loaded[:3])
+	i60 := -1
+	for i, r := range loaded {
+		if strings.HasPrefix(r, "key-0060") {
+			i60 = i
+			break
+		}
+	}
+	require.Equal(t, []string{"key-0060 plain", "key-0060 collected", "key-0060 gzip"}, loaded[i60:i60+3])
+	sorted := append([]string{}, loaded...)
+	sort.Strings(expect)
+	sort.Strings(sorted)
+	require.Equal(t, expect, sorted)
+
+	// files of caller stay
+	for _, name := range []string{"plain", "gz", "zst"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+	}
+
+	// unsorted file, and file of records with comparator order which isn't bytewise
+	b := NewSortableBuffer(64)
+	c2 := NewCollector(t.Name(), dir, b)
+	defer c2.Close()
+	err := c2.AddSortedFile(writeSorted("unsorted", CompressionZstd, []int{1, 3, 2}, ""))
+	require.ErrorIs(t, err, ErrOrderViolation)
+	require.Empty(t, c2.dataProviders)
+	_, err = os.Stat(filepath.Join(dir, "unsorted"))
+	require.NoError(t, err)
+	b.SetComparator(func(k1, k2, _, _ []byte) int { return -bytes.Compare(k1, k2) })
+	require.NoError(t, c2.AddSortedFile(writeSorted("reverse", CompressionNone, []int{3, 2, 1}, "")))
+}
+
+// failingPutTx - writes of cursors fail after `left` records
+type failingPutTx struct {
+	kv.RwTx
+	left int
+}
+
+func (tx *failingPutTx) RwCursor(bucket string) (kv.RwCursor, error) {
+	c, err := tx.RwTx.RwCursor(bucket)
+	return &failingPutCursor{RwCursor: c, tx: tx}, err
+}
+
+type failingPutCursor struct {
+	kv.RwCursor
+	tx *failingPutTx
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (c *failingPutCursor) Put(k, v []byte) error {
+	if c.tx.left--; c.tx.left < 0 {
+		return errDiskFull
+	}
+	return c.RwCursor.Put(k, v)
+}
+
+func TestLoadErrorLastCommittedKey(t *testing.T) {
+	load := func(failAfter int, args TransformArgs) (*failingPutTx, error) {
+		_, tx := memdb.NewTestTx(t)
+		c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", i)), []byte("v")))
+		}
+		ftx := &failingPutTx{RwTx: tx, left: failAfter}
+		return ftx, c.Load(ftx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			return next(k, k, v)
+		}, args)
+	}
+
+	var committed []string
+	args := TransformArgs{CommitEvery: 100, OnLoadCommitTx: func(tx kv.RwTx, key []byte, isDone bool) (kv.RwTx, error) {
+		committed = append(committed, string(key))
+		return tx, nil
+	}}
+	ftx, err := load(450, args)
+	require.ErrorIs(t, err, errDiskFull)
+	var loadErr *LoadError
+	require.True(t, errors.As(err, &loadErr))
+	require.Equal(t, kv.ChaindataTables[1], loadErr.Bucket)
+	require.Equal(t, []string{"key-0099", "key-0199", "key-0299", "key-0399"}, committed)
+	require.Equal(t, "key-0399", string(loadErr.LastCommittedKey))
+	next, err := NextKey(loadErr.LastCommittedKey)
+	require.NoError(t, err)
+	require.Equal(t, "key-039:", string(next)) // resume bound: key-0399 < next <= key-0400
+	v, err := ftx.GetOne(kv.ChaindataTables[1], loadErr.LastCommittedKey)
+	require.NoError(t, err)
+	require.Equal(t, "v", string(v))
+
+	// failing commit handler: key of previous commit
+	committed = nil
+	args.OnLoadCommitTx = func(tx kv.RwTx, key []byte, isDone bool) (kv.RwTx, error) {
+		if len(committed) == 2 {
+			return nil, errDiskFull
+		}
+		committed = append(committed, string(key))
+		return tx, nil
+	}
+	_, err = load(1000, args)
+	require.True(t, errors.As(err, &loadErr))
+	require.Equal(t, "key-0199", string(loadErr.LastCommittedKey))
+
+	// no commits
+	_, err = load(10, TransformArgs{})
+	require.True(t, errors.As(err, &loadErr))
+	require.Nil(t, loadErr.LastCommittedKey)
+	require.ErrorIs(t, err, errDiskFull)
+	require.NotContains(t, err.Error(), "last committed key")
+}
+
+func TestCollectorBufferBudget(t *testing.T) {
+	budget := NewBufferBudget(4 * datasize.MB)
+	value := make([]byte, 1000)
+	collect := func(c *Collector, from, n int) {
+		for i := from; i < from+n; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%06d", i)), value))
+		}
+	}
+	c1 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	c1.BufferBudget(budget)
+	collect(c1, 0, 3000) // ~3MB
+	require.Zero(t, c1.Stats().FilesSpilled)
+
+	c2 := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	c2.BufferBudget(budget)
+	c2.MaxSpills(2, BufferOptimalSize) // buffer doesn't grow instead of spill when budget is exhausted
+	collect(c2, 0, 3000)
+	require.Greater(t, c2.Stats().FilesSpilled, 1)
+	require.LessOrEqual(t, budget.Used(), 4*datasize.MB+budgetChunk)
+
+	// spills of c2 released its reservation, c1 takes it
+	c2.Close()
+	require.Equal(t, c1.reserved, int(budget.Used()))
+	collect(c1, 3000, 500)
+	require.Zero(t, c1.Stats().FilesSpilled)
+
+	var loaded int
+	_, tx := memdb.NewTestTx(t)
+	require.NoError(t, c1.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		loaded++
+		return nil
+	}, TransformArgs{}))
+	require.Equal(t, 3500, loaded)
+	require.Zero(t, budget.Used())
+}
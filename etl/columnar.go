@@ -0,0 +1,105 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import "fmt"
+
+// Column - vector of variable-length values in layout of Arrow binary column: value `i` is Data[Offsets[i]:Offsets[i+1]]
+type Column struct {
+	Data    []byte
+	Offsets []uint32 // Len()+1 offsets, first is 0
+}
+
+func (c *Column) Len() int { return len(c.Offsets) - 1 }
+
+func (c *Column) Value(i int) []byte { return c.Data[c.Offsets[i]:c.Offsets[i+1]] }
+
+func (c *Column) append(v []byte) error {
+	if uint64(len(c.Data))+uint64(len(v)) > uint64(^uint32(0)) {
+		return fmt.Errorf("etl: column chunk is larger than 4GB, use less rows per chunk")
+	}
+	c.Data = append(c.Data, v...)
+	c.Offsets = append(c.Offsets, uint32(len(c.Data)))
+	return nil
+}
+
+func (c *Column) reset() {
+	c.Data, c.Offsets = c.Data[:0], append(c.Offsets[:0], 0)
+}
+
+// ColumnFunc - value of derived column for record
+type ColumnFunc func(k, v []byte) ([]byte, error)
+
+// ColumnSink - receives chunks of records in key order as columns: keys, values, then derived columns (all of same Len).
+// Columns are reused for next chunk: they are valid only during call.
+type ColumnSink func(columns []Column) error
+
+// LoadColumns - as LoadStream, but merged records are materialized as columns (for export to columnar formats as
+// Parquet/Arrow): each chunk of up to `rowsPerChunk` records is passed to `sink` as key column, value column and
+// one column per `derived` func. Records come in same order as of Load. Collector is cleaned up after it as after Load.
+func (c *Collector) LoadColumns(sink ColumnSink, rowsPerChunk int, derived ...ColumnFunc) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	if rowsPerChunk <= 0 {
+		return fmt.Errorf("%s: etl: LoadColumns requires rowsPerChunk > 0, got %d", c.logPrefix, rowsPerChunk)
+	}
+	columns := make([]Column, 2+len(derived))
+	for i := range columns {
+		columns[i].reset()
+	}
+	rows := 0
+	emit := func() error {
+		if rows == 0 {
+			return nil
+		}
+		if err := sink(columns); err != nil {
+			return err
+		}
+		for i := range columns {
+			columns[i].reset()
+		}
+		rows = 0
+		return nil
+	}
+	if err := c.forEachMerged(c.quit, c.bufType == SortableOldestAppearedBuffer, &c.stats.EntriesLoaded, func(k, v []byte) error {
+		if err := columns[0].append(k); err != nil {
+			return err
+		}
+		if err := columns[1].append(v); err != nil {
+			return err
+		}
+		for i, f := range derived {
+			d, err := f(k, v)
+			if err != nil {
+				return fmt.Errorf("%s: etl: derived column %d of record %x: %w", c.logPrefix, i, k, err)
+			}
+			if err := columns[2+i].append(d); err != nil {
+				return err
+			}
+		}
+		if rows++; rows == rowsPerChunk {
+			return emit()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return emit()
+}
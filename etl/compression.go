@@ -0,0 +1,132 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression - of spill files. Compressed spill is a stream (snappy framing format or zstd frame) of spill-file format,
+// it's decompressed on the fly by merge of Load: CPU for less scratch space and IO.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+	CompressionGzip // for files produced by other tools (see Collector.AddSortedFile): slower than others for spill
+)
+
+// zstdWindowSize - small window: merge keeps decoder per spill file open
+const zstdWindowSize = 1 << 20
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// ParseCompression - reverse of Compression.String
+func ParseCompression(s string) (Compression, error) {
+	for c := CompressionNone; c <= CompressionGzip; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("etl: unknown compression %q", s)
+}
+
+// compressingWriter - Close flushes compressor, but doesn't close underlying writer
+func (c Compression) compressingWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	default:
+		return nil, fmt.Errorf("etl: unknown compression %d", int(c))
+	}
+}
+
+// decompressingReader - streams: memory doesn't depend on size of file. Returned func releases decoder.
+func (c Compression) decompressingReader(r io.Reader) (io.Reader, func(), error) {
+	switch c {
+	case CompressionNone:
+		return r, func() {}, nil
+	case CompressionSnappy:
+		return snappy.NewReader(r), func() {}, nil
+	case CompressionZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, d.Close, nil
+	case CompressionGzip:
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, func() { _ = d.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("etl: unknown compression %d", int(c))
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// magic bytes of compressed streams, see detectCompression
+var (
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic   = []byte{0x1f, 0x8b, 0x08} // with deflate method
+)
+
+// detectCompression - by magic bytes at start of stream (`head`). Uncompressed spill file is recognized as compressed
+// only if its first record starts as magic: uvarint key length 40 and key 0xb5 0x2f 0xfd.. (zstd), 31 and 0x8b 0x08.. (gzip).
+func detectCompression(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, snappyMagic):
+		return CompressionSnappy
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip
+	default:
+		return CompressionNone
+	}
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// FlushToFile - merges everything collected into one sorted, fsynced file in `dir` (spill-file format, records of SpillEntryCodec)
+// and returns its path. File belongs to caller (it is not encrypted by SpillEncryption): Close doesn't remove it,
+// it can be loaded later by NewCollectorFromFiles (if it has default format).
+// Spill files of collector are removed, collector is empty after this call.
+// args.OnConsolidated is called when file is complete, its error is returned together with path of (kept) file.
+func (c *Collector) FlushToFile(dir string, args TransformArgs) (string, error) {
+	path, err := c.mergeIntoFile(dir, args, nil)
+	if err != nil {
+		return "", err
+	}
+	c.Close()
+	c.dataProviders = nil
+	if args.OnConsolidated != nil {
+		if err := args.OnConsolidated(path); err != nil {
+			return path, fmt.Errorf("%s: etl: OnConsolidated: %w", c.logPrefix, err)
+		}
+	}
+	return path, nil
+}
+
+// consolidate - as FlushToFile, but collector continues with consolidated file (and removes it on Close)
+func (c *Collector) consolidate(dir string, args TransformArgs) error {
+	path, err := c.mergeIntoFile(dir, args, c.keyring)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	c.Close()
+	c.dataProviders = []dataProvider{&fileDataProvider{file: f, keyring: c.keyring, codec: c.codec}}
+	return nil
+}
+
+// mergeIntoFile - file is encrypted if keyring is set
+func (c *Collector) mergeIntoFile(dir string, args TransformArgs, keyring *Keyring) (string, error) {
+	if args.Quit != nil {
+		c.quit = args.Quit
+	}
+	if !c.allFlushed {
+		if err := c.flushBuffer(nil, true); err != nil {
+			return "", err
+		}
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	f, err := os.CreateTemp(dir, spillFilePattern(c.logPrefix))
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	fw := bufio.NewWriterSize(f, BufIOSize)
+	w := fw
+	if keyring != nil {
+		ew, err := keyring.encryptingWriter(fw)
+		if err != nil {
+			return "", err
+		}
+		w = bufio.NewWriterSize(ew, BufIOSize)
+	}
+	var numBuf [binary.MaxVarintLen64]byte
+	it := newMergeIter(c.logPrefix, c.dataProviders, args)
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return "", err
+		}
+		k, v, more, err := it.next()
+		if err != nil {
+			return "", err
+		}
+		if !more {
+			break
+		}
+		if c.codec != nil {
+			err = c.codec.WriteEntry(w, k, v)
+		} else {
+			err = writeElement(w, numBuf[:], k, v)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	if err := fw.Flush(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	ok = true
+	log.Log(c.logLvl, fmt.Sprintf("[%s] etl: consolidated into file", c.logPrefix), "name", f.Name())
+	return f.Name(), nil
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// TransformCtx - Transform which stops when ctx is done and returns ctx.Err(). Cancellation is checked for each record
+// of extract and load, not by log ticks. args.Quit still works too (returns common.ErrStopped).
+func TransformCtx(
+	ctx context.Context,
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) error {
+	args, stop := quitOnDone(ctx, args)
+	defer stop()
+	return ctxErr(ctx, Transform(logPrefix, db, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args))
+}
+
+// ExtractBucketCtx - extracts [args.ExtractStartKey, args.ExtractEndKey) of bucket into collector, see TransformCtx
+func ExtractBucketCtx(ctx context.Context, logPrefix string, db kv.Tx, bucket string, collector *Collector, extractFunc ExtractFunc, args TransformArgs) error {
+	args, stop := quitOnDone(ctx, args)
+	defer stop()
+	return ctxErr(ctx, extractIntoFiles(logPrefix, db, bucket, collector, extractFunc, args))
+}
+
+// quitOnDone - replaces args.Quit by channel which is closed when ctx is done or original Quit is closed
+func quitOnDone(ctx context.Context, args TransformArgs) (TransformArgs, func()) {
+	if args.Quit == nil {
+		args.Quit = ctx.Done()
+		return args, func() {}
+	}
+	derived, cancel := context.WithCancel(ctx)
+	go func(quit <-chan struct{}) {
+		select {
+		case <-quit:
+			cancel()
+		case <-derived.Done():
+		}
+	}(args.Quit)
+	args.Quit = derived.Done()
+	return args, cancel
+}
+
+// ctxErr - stop caused by ctx is reported as ctx.Err()
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && errors.Is(err, common.ErrStopped) && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -19,9 +19,14 @@ package etl
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ledgerwatch/log/v3"
 )
@@ -32,13 +37,28 @@ type dataProvider interface {
 }
 
 type fileDataProvider struct {
-	file       *os.File
-	reader     io.Reader
-	byteReader io.ByteReader // Different interface to the same object as reader
+	file         *os.File
+	reader       io.Reader
+	byteReader   io.ByteReader // Different interface to the same object as reader
+	compression  Compression
+	keyring      *Keyring   // nil if file isn't encrypted
+	codec        EntryCodec // nil - default format
+	keep         bool       // Dispose only closes file: of caller (AddSortedFile) or kept by KeepFilesOnError
+	maxLen       uint64     // of key and value of record, see readElementLimited
+	closeDecoder func()
 }
 
+// Spill file format: sequence of records uvarint(len(k)), k, uvarint(len(v)), v. No header:
+// length prefixes are varints, so tiny records cost 1 byte of overhead per key and per value.
+// Compressed and encrypted files have this format after decryption and decompression (see Compression, Keyring).
+// Collector.SpillEntryCodec replaces format of records.
+
 // FlushToDisk - `doFsync` is true only for 'critical' collectors (which should not loose).
 func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl log.Lvl) (dataProvider, error) {
+	return flushToDisk(logPrefix, b, tmpdir, doFsync, lvl, CompressionNone, nil, nil)
+}
+
+func flushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl log.Lvl, compression Compression, keyring *Keyring, codec EntryCodec) (dataProvider, error) {
 	if b.Len() == 0 {
 		return nil, nil
 	}
@@ -50,7 +70,7 @@ func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl lo
 		}
 	}
 
-	bufferFile, err := os.CreateTemp(tmpdir, "erigon-sortable-buf-")
+	bufferFile, err := os.CreateTemp(tmpdir, spillFilePattern(logPrefix))
 	if err != nil {
 		return nil, err
 	}
@@ -66,30 +86,199 @@ func FlushToDisk(logPrefix string, b Buffer, tmpdir string, doFsync bool, lvl lo
 		log.Log(lvl, fmt.Sprintf("[%s] Flushed buffer file", logPrefix), "name", bufferFile.Name())
 	}()
 
-	if err = b.Write(w); err != nil {
+	if compression == CompressionNone && keyring == nil {
+		if err = writeBuffer(b, w, codec); err != nil {
+			return nil, fmt.Errorf("error writing entries to disk: %w", err)
+		}
+		return &fileDataProvider{file: bufferFile, reader: nil, codec: codec}, nil
+	}
+
+	// buffer -> compression -> encryption -> file
+	var sw io.Writer = w
+	if keyring != nil {
+		if sw, err = keyring.encryptingWriter(w); err != nil {
+			return nil, err
+		}
+	}
+	cw, err := compression.compressingWriter(sw)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriterSize(cw, BufIOSize) // Buffer.Write does small writes
+	if err = writeBuffer(b, bw, codec); err != nil {
 		return nil, fmt.Errorf("error writing entries to disk: %w", err)
 	}
+	if err = bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err = cw.Close(); err != nil {
+		return nil, err
+	}
+	return &fileDataProvider{file: bufferFile, reader: nil, compression: compression, keyring: keyring, codec: codec}, nil
+}
+
+// RunID - identifies spill files of this process (with logPrefix they are part of file name), see CleanupOrphans
+var RunID = strconv.Itoa(os.Getpid()) + "_" + strconv.FormatInt(time.Now().UnixNano(), 36)
 
-	return &fileDataProvider{file: bufferFile, reader: nil}, nil
+const spillFilePrefix = "erigon-sortable-buf-"
+
+// spillFilePattern - erigon-sortable-buf-<logPrefix>.<RunID>-<random>, logPrefix has only [A-Za-z0-9_]
+func spillFilePattern(logPrefix string) string {
+	return spillFilePrefix + sanitizeLogPrefix(logPrefix) + "." + RunID + "-"
+}
+
+func sanitizeLogPrefix(logPrefix string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, logPrefix)
+}
+
+// CleanupOrphans - removes spill files of `logPrefix` left in tmpdir by other (dead) runs.
+// Files of current run (RunID) and untagged files are not touched. Returns amount of removed files.
+func CleanupOrphans(tmpdir, logPrefix string) (int, error) {
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil {
+		return 0, err
+	}
+	tag := spillFilePrefix + sanitizeLogPrefix(logPrefix) + "."
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, tag) {
+			continue
+		}
+		runID, _, ok := strings.Cut(name[len(tag):], "-")
+		if !ok || runID == RunID {
+			continue
+		}
+		if err := os.Remove(filepath.Join(tmpdir, name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
 }
 
 func (p *fileDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
 	if p.reader == nil {
-		_, err := p.file.Seek(0, 0)
+		if err := p.openReader(); err != nil {
+			return nil, nil, &spillOpenError{err}
+		}
+	}
+	if p.codec != nil {
+		k, v, err := p.codec.ReadEntry(p.reader)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, streamError(err)
+		}
+		return append(keyBuf, k...), append(valBuf, v...), nil
+	}
+	k, v, err := readElementLimited(p.reader, p.byteReader, keyBuf, valBuf, p.maxLen)
+	if err != nil && (p.compression != CompressionNone || p.keyring != nil) {
+		return nil, nil, streamError(err)
+	}
+	return k, v, err
+}
+
+// ErrSpillStream - record of compressed, encrypted or codec-encoded spill file can't be read. Such reader can't find
+// next record after it (decompressor error is sticky), so SpillCorruptionSkipRecord skips rest of file.
+var ErrSpillStream = errors.New("etl: spill stream corrupted")
+
+type spillStreamError struct{ err error }
+
+func (e *spillStreamError) Error() string        { return ErrSpillStream.Error() + ": " + e.err.Error() }
+func (e *spillStreamError) Unwrap() error        { return e.err }
+func (e *spillStreamError) Is(target error) bool { return target == ErrSpillStream }
+
+// streamError - marks error of stream reader by ErrSpillStream, EOF (end of file) is returned as is
+func streamError(err error) error {
+	if err == io.EOF {
+		return err
+	}
+	return &spillStreamError{err}
+}
+
+// openReader - reader chain of file (decrypting, decompressing), p.reader is set only if whole chain is built:
+// raw bytes of encrypted or compressed file must never be parsed as records
+func (p *fileDataProvider) openReader() error {
+	if _, err := p.file.Seek(0, 0); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(p.file, BufIOSize)
+	var closeDecoder func()
+	if p.compression != CompressionNone || p.keyring != nil {
+		var sr io.Reader = r
+		if p.keyring != nil {
+			var err error
+			if sr, err = p.keyring.decryptingReader(r); err != nil {
+				return err
+			}
+		}
+		dr, closeDr, err := p.compression.decompressingReader(sr)
+		if err != nil {
+			return err
 		}
-		r := bufio.NewReaderSize(p.file, BufIOSize)
-		p.reader = r
-		p.byteReader = r
+		r, closeDecoder = bufio.NewReaderSize(dr, BufIOSize), closeDr
+	}
+	p.reader, p.byteReader, p.closeDecoder = r, r, closeDecoder
+	p.maxLen = p.maxRecordLen()
+	return nil
+}
 
+// ErrSpillOpen - reader of spill file can't be set up (seek failed, key of encrypted file is not in Keyring, bad
+// compression header): file can't be read at all, merge fails under any SpillCorruptionPolicy
+var ErrSpillOpen = errors.New("etl: can't open spill file")
+
+type spillOpenError struct{ err error }
+
+func (e *spillOpenError) Error() string        { return ErrSpillOpen.Error() + ": " + e.err.Error() }
+func (e *spillOpenError) Unwrap() error        { return e.err }
+func (e *spillOpenError) Is(target error) bool { return target == ErrSpillOpen }
+
+// maxRecordLen - record of plain file can't be longer than file
+func (p *fileDataProvider) maxRecordLen() uint64 {
+	if p.compression != CompressionNone || p.keyring != nil {
+		return maxSpillRecordLen
+	}
+	if size := providerSize(p); size >= 0 && size < maxSpillRecordLen {
+		return uint64(size)
+	}
+	return maxSpillRecordLen
+}
+
+// rewind - next call of Next reads file from beginning
+func (p *fileDataProvider) rewind() {
+	if p.closeDecoder != nil {
+		p.closeDecoder()
+		p.closeDecoder = nil
 	}
-	return readElementFromDisk(p.reader, p.byteReader, keyBuf, valBuf)
+	p.reader, p.byteReader = nil, nil
+}
+
+// offset - in file, -1 if unknown (in compressed or encrypted file record has no offset)
+func (p *fileDataProvider) offset() int64 {
+	if p.compression != CompressionNone || p.keyring != nil {
+		return -1
+	}
+	pos, err := p.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	if r, ok := p.reader.(*bufio.Reader); ok {
+		pos -= int64(r.Buffered())
+	}
+	return pos
 }
 
 func (p *fileDataProvider) Dispose() uint64 {
+	p.rewind()
 	info, _ := os.Stat(p.file.Name())
 	_ = p.file.Close()
+	if p.keep {
+		return 0
+	}
 	_ = os.Remove(p.file.Name())
 	if info == nil {
 		return 0
@@ -101,11 +290,49 @@ func (p *fileDataProvider) String() string {
 	return fmt.Sprintf("%T(file: %s)", p, p.file.Name())
 }
 
-func readElementFromDisk(r io.Reader, br io.ByteReader, keyBuf, valBuf []byte) ([]byte, []byte, error) {
+// writeElement - writes record in spill-file format, `numBuf` must have len >= binary.MaxVarintLen64
+func writeElement(w io.Writer, numBuf []byte, k, v []byte) error {
+	n := binary.PutUvarint(numBuf, uint64(len(k)))
+	if _, err := w.Write(numBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(k); err != nil {
+		return err
+	}
+	n = binary.PutUvarint(numBuf, uint64(len(v)))
+	if _, err := w.Write(numBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(v)
+	return err
+}
+
+// maxSpillRecordLen - limit of key or value length of spill-file record: larger length is corruption, not allocation
+const maxSpillRecordLen = 1 << 30
+
+// ErrSpillRecordLength - length prefix of spill-file record is out of range (corrupted file). Position of next record
+// is unknown after it, so SpillCorruptionSkipRecord skips rest of file.
+var ErrSpillRecordLength = errors.New("etl: spill record length out of range")
+
+func readElementFromDisk(r io.Reader, br io.ByteReader, keyBuf, valBuf []byte) (_, _ []byte, err error) {
+	return readElementLimited(r, br, keyBuf, valBuf, maxSpillRecordLen)
+}
+
+// readElementLimited - readElementFromDisk with limit of key and value length (for example size of file)
+func readElementLimited(r io.Reader, br io.ByteReader, keyBuf, valBuf []byte, maxLen uint64) (_, _ []byte, err error) {
 	n, err := binary.ReadUvarint(br)
 	if err != nil {
 		return nil, nil, err
 	}
+	// record started: EOF from here means truncated file
+	defer func() {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	if n > maxLen {
+		return nil, nil, fmt.Errorf("%w: key length %d, max %d", ErrSpillRecordLength, n, maxLen)
+	}
 	if n > 0 {
 		// Reallocate the slice or extend it if there is enough capacity
 		if len(keyBuf)+int(n) > cap(keyBuf) {
@@ -122,6 +349,9 @@ func readElementFromDisk(r io.Reader, br io.ByteReader, keyBuf, valBuf []byte) (
 	if n, err = binary.ReadUvarint(br); err != nil {
 		return nil, nil, err
 	}
+	if n > maxLen {
+		return nil, nil, fmt.Errorf("%w: value length %d, max %d", ErrSpillRecordLength, n, maxLen)
+	}
 	if n > 0 {
 		// Reallocate the slice or extend it if there is enough capacity
 		if len(valBuf)+int(n) > cap(valBuf) {
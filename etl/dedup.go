@@ -0,0 +1,108 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Dedup - which of collected records with equal keys Load passes to LoadFunc, see TransformArgs.Dedup.
+// Merge returns equal keys in order of collection: buffer is sorted by stable sort and spill files are merged in order
+// of spill - so records with equal keys inside one buffer and in different spill files obey same policy.
+type Dedup int
+
+const (
+	DedupNone      Dedup = iota // all records
+	DedupKeepFirst              // first collected record of key
+	DedupKeepLast               // last collected record of key
+)
+
+// recordStream - merged records, returned key/value are valid until next call of `next`
+type recordStream interface {
+	next() (k, v []byte, ok bool, err error)
+}
+
+// newLoadStream - merge of providers with args.Dedup applied
+func newLoadStream(logPrefix string, providers []dataProvider, bufType int, args TransformArgs) (recordStream, error) {
+	if args.Dedup == DedupKeepLast && bufType == SortableOldestAppearedBuffer {
+		return nil, fmt.Errorf("%s: etl: DedupKeepLast is not compatible with SortableOldestAppearedBuffer", logPrefix)
+	}
+	it := newMergeIter(logPrefix, providers, args)
+	if args.Dedup == DedupNone {
+		return it, nil
+	}
+	return &dedupStream{in: it, keepLast: args.Dedup == DedupKeepLast}, nil
+}
+
+type dedupStream struct {
+	in       recordStream
+	keepLast bool
+
+	k, v    []byte // returned record
+	pk, pv  []byte // DedupKeepFirst: previous key; DedupKeepLast: pending record
+	pending bool
+	done    bool
+}
+
+func (s *dedupStream) next() ([]byte, []byte, bool, error) {
+	if s.keepLast {
+		return s.nextLast()
+	}
+	for {
+		k, v, ok, err := s.in.next()
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+		if s.pending && bytes.Equal(k, s.pk) {
+			continue
+		}
+		s.pk, s.pending = append(s.pk[:0], k...), true
+		return k, v, true, nil
+	}
+}
+
+// nextLast - record is returned when next key differs: until then later values of same key replace pending one
+func (s *dedupStream) nextLast() ([]byte, []byte, bool, error) {
+	if s.done {
+		return nil, nil, false, nil
+	}
+	if !s.pending {
+		k, v, ok, err := s.in.next()
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+		s.pk, s.pv, s.pending = append(s.pk[:0], k...), append(s.pv[:0], v...), true
+	}
+	for {
+		k, v, ok, err := s.in.next()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !ok {
+			s.done = true
+			return s.pk, s.pv, true, nil
+		}
+		if bytes.Equal(k, s.pk) {
+			s.pv = append(s.pv[:0], v...)
+			continue
+		}
+		s.k, s.pk = s.pk, append(s.k[:0], k...)
+		s.v, s.pv = s.pv, append(s.v[:0], v...)
+		return s.k, s.v, true, nil
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// deltaLoad - Load in TransformArgs.DeltaDryRun mode: nothing is written, every record emitted by loadFunc is compared with
+// existing content of bucket and counted into args.Stats:
+//
+//	new key:           len(k)+len(v) into DeltaNewBytes
+//	changed value:     len(v) into DeltaOverwrittenBytes
+//	same value:        len(v) into DeltaUnchangedBytes
+//	deletion of key:   len(old value) into DeltaOverwrittenBytes
+func deltaLoad(logPrefix string, db kv.Tx, bucket string, bufType int, providers []dataProvider, loadFunc LoadFunc, args TransformArgs) error {
+	if args.Stats == nil {
+		return fmt.Errorf("%s: etl: DeltaDryRun requires Stats", logPrefix)
+	}
+	stats := args.Stats
+	var prevK []byte
+	tally := func(_, k, v []byte) error {
+		if bufType == SortableOldestAppearedBuffer { // see loadFilesIntoBucket
+			if bytes.Equal(prevK, k) {
+				return nil
+			}
+			prevK = common.Copy(k)
+		}
+		existing, err := db.GetOne(bucket, k)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(v) == 0:
+			stats.DeltaOverwrittenBytes += uint64(len(existing))
+		case existing == nil:
+			stats.DeltaNewBytes += uint64(len(k) + len(v))
+		case bytes.Equal(existing, v):
+			stats.DeltaUnchangedBytes += uint64(len(v))
+		default:
+			stats.DeltaOverwrittenBytes += uint64(len(v))
+		}
+		return nil
+	}
+
+	currentTable := &currentTableReader{getter: db, bucket: bucket, canonicalKey: args.CanonicalKey}
+	it, err := newLoadStream(logPrefix, providers, bufType, args)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := loadFunc(k, v, currentTable, tally); err != nil {
+			return err
+		}
+	}
+}
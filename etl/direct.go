@@ -0,0 +1,114 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// ErrIncompatibleOrder - DirectCopySorted can't stream source in order of destination
+var ErrIncompatibleOrder = errors.New("etl: source order is not compatible with destination")
+
+// DirectCopySorted - copies [args.ExtractStartKey, args.ExtractEndKey) of `from` into `to` cursor-to-cursor, without collector
+// and temp files: for identity transforms where source is already in destination order.
+// Every args.CommitEvery records (and at the end) args.OnLoadCommit is called, and args.Checkpoint (if set) is saved.
+// Returns ErrIncompatibleOrder if destination order differs from bytewise (args.Comparator is set), if dup-sorted source
+// goes into not dup-sorted destination, or if destination has keys >= first copied key (Append is not possible).
+func DirectCopySorted(db kv.RwTx, from, to string, args TransformArgs) error {
+	if args.Comparator != nil || args.KeyDecoder != nil {
+		return fmt.Errorf("%w: custom comparator", ErrIncompatibleOrder)
+	}
+	if args.Checkpoint != nil {
+		stage := checkpointStage(from, args)
+		var err error
+		if args, err = resumeFromCheckpoint(stage, args); err != nil {
+			return err
+		}
+		args.OnLoadCommit = checkpointCommitHandler(args.Checkpoint, stage, args.OnLoadCommit)
+	}
+	if args.OnLoadCommit != nil && args.needsCommitTimer() {
+		args.OnLoadCommit = timedCommitHandler("DirectCopySorted", to, args.OnLoadCommit, args)
+	}
+	fromDupSort := kv.ChaindataTablesCfg[from].Flags&kv.DupSort != 0
+	isDupSort := kv.ChaindataTablesCfg[to].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[to].AutoDupSortKeysConversion
+	if fromDupSort && !isDupSort {
+		return fmt.Errorf("%w: dup-sorted %s into %s", ErrIncompatibleOrder, from, to)
+	}
+
+	c, err := db.Cursor(from)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var w kv.RwCursor
+	if isDupSort {
+		w, err = db.RwCursorDupSort(to)
+	} else {
+		w, err = db.RwCursor(to)
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	lastKey, _, err := w.Last()
+	if err != nil {
+		return err
+	}
+
+	var prevK []byte
+	records := 0
+	commit := func(isDone bool) error {
+		if args.OnLoadCommit == nil {
+			return nil
+		}
+		return args.OnLoadCommit(db, prevK, isDone)
+	}
+	for k, v, err := c.Seek(args.ExtractStartKey); k != nil || err != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		if args.ExtractEndKey != nil && bytes.Compare(k, args.ExtractEndKey) >= 0 {
+			break
+		}
+		if records == 0 && lastKey != nil && bytes.Compare(lastKey, k) >= 0 {
+			return fmt.Errorf("%w: %s already has key %x >= %x", ErrIncompatibleOrder, to, lastKey, k)
+		}
+		if isDupSort {
+			err = w.(kv.RwCursorDupSort).AppendDup(k, v)
+		} else {
+			err = w.Append(k, v)
+		}
+		if err != nil {
+			return fmt.Errorf("bucket: %s, append: k=%x, %w", to, k, err)
+		}
+		prevK = append(prevK[:0], k...)
+		if records++; args.CommitEvery > 0 && records%args.CommitEvery == 0 {
+			if err := commit(false); err != nil {
+				return err
+			}
+		}
+	}
+	return commit(true)
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Encrypted spill file: header uint32 BE key id, IV of aes.BlockSize; then AES-CTR of (compressed) spill-file stream.
+// It protects temp data at rest, it's not authenticated: spill files are not expected to be modified by others.
+const encryptionHeaderSize = 4 + aes.BlockSize
+
+// Keyring - AES keys (16, 24 or 32 bytes) of spill-file encryption by key id, see Collector.SpillEncryption.
+// New spill files are encrypted by current key. Key id is in header of file, so keys can be rotated while
+// collector has spill files: merge decrypts each file by its key, while key is in keyring. Safe for concurrent use.
+type Keyring struct {
+	lock    sync.RWMutex
+	blocks  map[uint32]cipher.Block
+	current uint32
+}
+
+// NewKeyring - with one key, which is current
+func NewKeyring(id uint32, key []byte) (*Keyring, error) {
+	k := &Keyring{blocks: map[uint32]cipher.Block{}}
+	if err := k.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate - adds key and makes it current. Previous keys stay valid for files written by them, until Remove.
+// Id of key which is in keyring can't be reused.
+func (k *Keyring) Rotate(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("etl: key %d: %w", id, err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.blocks[id]; ok {
+		return fmt.Errorf("etl: key %d is already in keyring", id)
+	}
+	k.blocks[id], k.current = block, id
+	return nil
+}
+
+// Remove - key can't decrypt files anymore. Current key can't be removed.
+func (k *Keyring) Remove(id uint32) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if id == k.current {
+		return fmt.Errorf("etl: can't remove current key %d", id)
+	}
+	delete(k.blocks, id)
+	return nil
+}
+
+// encryptingWriter - writes header into `w` and returns writer of encrypted stream into `w`
+func (k *Keyring) encryptingWriter(w io.Writer) (io.Writer, error) {
+	k.lock.RLock()
+	id, block := k.current, k.blocks[k.current]
+	k.lock.RUnlock()
+
+	var header [encryptionHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], id)
+	iv := header[4:]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}, nil
+}
+
+// decryptingReader - reads header from `r` and returns reader of decrypted stream of `r`
+func (k *Keyring) decryptingReader(r io.Reader) (io.Reader, error) {
+	var header [encryptionHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("etl: reading header of encrypted spill file: %w", err)
+	}
+	id := binary.BigEndian.Uint32(header[:4])
+	k.lock.RLock()
+	block, ok := k.blocks[id]
+	k.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("etl: spill file is encrypted by key %d, which is not in keyring", id)
+	}
+	return cipher.StreamReader{S: cipher.NewCTR(block, header[4:]), R: r}, nil
+}
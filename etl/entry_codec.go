@@ -0,0 +1,78 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// EntryCodec - format of records of spill files (see Collector.SpillEntryCodec), for files readable by other tools.
+// Records are written one after another, without header, in sorted order. ReadEntry must return io.EOF if `r` ends before
+// record (end of file) - other errors abort merge or are handled by SpillCorruptionPolicy. Returned k, v may be
+// memory of codec: they are copied before next call of ReadEntry. Must be safe for concurrent use (one codec reads all files).
+// Compression and encryption are applied to stream of codec.
+type EntryCodec interface {
+	WriteEntry(w io.Writer, k, v []byte) error
+	ReadEntry(r io.Reader) (k, v []byte, err error)
+}
+
+// VarintEntryCodec - default format: uvarint(len(k)), k, uvarint(len(v)), v.
+// Collector without codec uses same format, but without allocation per record.
+type VarintEntryCodec struct{}
+
+func (VarintEntryCodec) WriteEntry(w io.Writer, k, v []byte) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	return writeElement(w, numBuf[:], k, v)
+}
+
+func (VarintEntryCodec) ReadEntry(r io.Reader) ([]byte, []byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &oneByteReader{r: r} // without read-ahead: `r` must stay at end of record
+	}
+	return readElementFromDisk(r, br, nil, nil)
+}
+
+type oneByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (o *oneByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(o.r, o.buf[:])
+	return o.buf[0], err
+}
+
+// writeBuffer - writes sorted buffer by codec (nil - by Buffer.Write)
+func writeBuffer(b Buffer, w io.Writer, codec EntryCodec) error {
+	if codec == nil {
+		return b.Write(w)
+	}
+	from, to := 0, b.Len()
+	if hb, ok := b.(*heapBuffer); ok {
+		from, to = hb.spillWindow()
+	}
+	var k, v []byte
+	for i := from; i < to; i++ {
+		k, v = b.Get(i, k[:0], v[:0])
+		if err := codec.WriteEntry(w, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,7 +18,10 @@ package etl
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"reflect"
 	"time"
 
@@ -35,8 +38,12 @@ type CurrentTableReader interface {
 type ExtractNextFunc func(originalK, k []byte, v []byte) error
 type ExtractFunc func(k []byte, v []byte, next ExtractNextFunc) error
 
+// ErrNextKeyOverflow - key of all 0xFF bytes has no next key of same length, see NextKey
+var ErrNextKeyOverflow = errors.New("etl: key overflow")
+
 // NextKey generates the possible next key w/o changing the key length.
 // for [0x01, 0x01, 0x01] it will generate [0x01, 0x01, 0x02], etc
+// For key of all 0xFF bytes returns it unchanged and error wrapping ErrNextKeyOverflow.
 func NextKey(key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return key, fmt.Errorf("could not apply NextKey for the empty key")
@@ -52,7 +59,72 @@ func NextKey(key []byte) ([]byte, error) {
 			nextKey[i] = 0
 		}
 	}
-	return key, fmt.Errorf("overflow while applying NextKey")
+	return key, fmt.Errorf("%w while applying NextKey", ErrNextKeyOverflow)
+}
+
+// NextKeyFixed - NextKey for fixed-width keys (of index tables etc.): key of other length than `width` is an error,
+// so result always has `width` bytes. ErrNextKeyOverflow is returned only if all `width` bytes are 0xFF.
+func NextKeyFixed(key []byte, width int) ([]byte, error) {
+	if width <= 0 {
+		return key, fmt.Errorf("could not apply NextKeyFixed for width %d", width)
+	}
+	if len(key) != width {
+		return key, fmt.Errorf("could not apply NextKeyFixed: key %x has length %d, expected %d", key, len(key), width)
+	}
+	return NextKey(key)
+}
+
+// PrefixEnd - exclusive upper bound of keys with `prefix` (for ExtractEndKey of prefix scan): trailing 0xFF bytes
+// are trimmed, last byte is incremented, so result may be shorter than prefix: for [0x01, 0xFF] it's [0x02].
+// For empty or all-0xFF prefix there is no such bound: returns nil (unbounded end) and true.
+func PrefixEnd(prefix []byte) ([]byte, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xFF {
+			end := common.Copy(prefix[:i+1])
+			end[i]++
+			return end, false
+		}
+	}
+	return nil, true
+}
+
+// WithPrefix - copy of args which extracts exactly keys with `prefix`: ExtractStartKey is prefix, ExtractEndKey is
+// PrefixEnd(prefix) (nil for empty or all-0xFF prefix - keys after such prefix all have it too).
+func (args TransformArgs) WithPrefix(prefix []byte) TransformArgs {
+	args.ExtractStartKey = common.Copy(prefix)
+	args.ExtractEndKey, _ = PrefixEnd(prefix)
+	return args
+}
+
+// sortComparator - order of runs in sort buffer, must be merge order: Comparator, or DecodedComparator over KeyDecoder
+// (decodes on each comparison, decoded-key cache is merge-only), nil - bytewise
+func (args TransformArgs) sortComparator() kv.CmpFunc {
+	if args.Comparator != nil || args.KeyDecoder == nil || args.DecodedComparator == nil {
+		return args.Comparator
+	}
+	decode, cmp := args.KeyDecoder, args.DecodedComparator
+	return func(k1, k2, v1, v2 []byte) int { return cmp(decode(k1, v1), decode(k2, v2)) }
+}
+
+// ErrKeyDecoderComparator - TransformArgs.KeyDecoder is set without DecodedComparator
+var ErrKeyDecoderComparator = errors.New("etl: KeyDecoder requires DecodedComparator")
+
+// ErrComparatorAndKeyDecoder - TransformArgs.Comparator and KeyDecoder are both set: runs would be sorted by one
+// and merged by other
+var ErrComparatorAndKeyDecoder = errors.New("etl: Comparator and KeyDecoder are mutually exclusive")
+
+// checkMergeOrder - args define one merge order
+func (args TransformArgs) checkMergeOrder() error {
+	if args.KeyDecoder == nil {
+		return nil
+	}
+	if args.DecodedComparator == nil {
+		return ErrKeyDecoderComparator
+	}
+	if args.Comparator != nil {
+		return ErrComparatorAndKeyDecoder
+	}
+	return nil
 }
 
 // LoadCommitHandler is a callback called each time a new batch is being
@@ -60,6 +132,10 @@ func NextKey(key []byte) ([]byte, error) {
 // * `key`: last commited key to the database (use etl.NextKey helper to use in LoadStartKey)
 // * `isDone`: true, if everything is processed
 type LoadCommitHandler func(db kv.Putter, key []byte, isDone bool) error
+
+// LoadCommitTxHandler - as LoadCommitHandler, but can switch tx of load (see TransformArgs.OnLoadCommitTx):
+// when !isDone it commits `tx` and returns fresh one - load continues in it. When isDone returned tx is ignored.
+type LoadCommitTxHandler func(tx kv.RwTx, key []byte, isDone bool) (kv.RwTx, error)
 type AdditionalLogArguments func(k, v []byte) (additionalLogArguments []interface{})
 
 type TransformArgs struct {
@@ -67,11 +143,171 @@ type TransformArgs struct {
 	LogDetailsExtract AdditionalLogArguments
 	LogDetailsLoad    AdditionalLogArguments
 	Comparator        kv.CmpFunc
+	// NewMergeQueue - custom priority structure for merge phase (loser tree, etc.), default is binary heap.
+	// `less` defines merge order, queue must pop elements by it.
+	NewMergeQueue func(less func(a, b HeapElem) bool) MergeQueue
+	// SizeOrderedMerge - fill initial merge heap from biggest file to smallest.
+	// Measured by BenchmarkSizeOrderedMerge (1 big + 20 small files): no gain over insertion order, within noise -
+	// binary heap only affected by initial layout. Kept for experiments with other merge structures.
+	SizeOrderedMerge bool
+	// VerifyOrder - Load checks that each merged key is >= previous one by order of merge (Comparator, or DecodedComparator
+	// of KeyDecoder, or bytewise) and fails with ErrOrderViolation on first violation - catches broken comparators which
+	// otherwise silently corrupt indexes. Costs one comparison and copy of record per key: for tests and debugging.
+	VerifyOrder bool
+	// SpillCorruptionPolicy - how Load handles undecodable records of spill files (default: abort)
+	SpillCorruptionPolicy SpillCorruptionPolicy
+	// KeyDecoder + DecodedComparator - alternative to Comparator (can't be set together) for merge phase: each key decoded once (see KeyDecoder)
+	KeyDecoder        KeyDecoder
+	DecodedComparator DecodedCmpFunc
 	// [ExtractStartKey, ExtractEndKey)
 	ExtractStartKey []byte
 	ExtractEndKey   []byte
-	BufferType      int
-	BufferSize      int
+	// ExtractMaxPerPrefix - if > 0, extract passes to ExtractFunc at most this amount of records
+	// per key prefix of ExtractPrefixLen bytes (for sampling), rest of prefix is skipped by Seek
+	ExtractMaxPerPrefix int
+	ExtractPrefixLen    int
+	// ExtractFilter - if set, extract skips keys for which it returns false right after cursor move: value isn't
+	// copied or passed to ExtractFunc (cursor still advances over it: mdbx returns it as view of mmap, without read
+	// of overflow pages until accessed). Skipped records don't count in MaxExtractRecords and ExtractMaxPerPrefix.
+	ExtractFilter func(k []byte) bool
+	BufferType    int
+	BufferSize    int
+	// Metrics - if set, receives metrics of Transform and its collector
+	Metrics Metrics
+	// Dedup - which of records with equal keys Load keeps (default: all of them), see Dedup
+	Dedup Dedup
+	// BufferName - name of buffer type registered by RegisterBuffer, replaces BufferType if set
+	BufferName string
+	// WantKeysBloom - if set, Load skips keys which are not in bloom. Bloom has false-positives:
+	// set WantKeysExact to filter them out too.
+	WantKeysBloom *Bloom
+	WantKeysExact func(k []byte) bool
+	// InPlaceTempBucket - allows Transform with fromBucket == toBucket: loads into this bucket first,
+	// then replaces content of toBucket by it (result is same as Transform into empty bucket).
+	// Without it such Transform returns ErrSameBucket.
+	InPlaceTempBucket string
+	// VerifyAgainst - audit mode: Load doesn't write, but compares every loaded record with this (read-only) replica
+	// and returns *MismatchError on first difference. `db` of Load is not used.
+	VerifyAgainst kv.Tx
+	// Stats - if set, Transform fills it (DirectCopySorted - commit durations only)
+	Stats *TransformStats
+	// DeltaDryRun - Load doesn't write, but counts new/overwritten/unchanged bytes into Stats (required)
+	DeltaDryRun bool
+	// CountComparatorCalls - debug: Transform counts calls of Comparator into Stats.ComparatorCalls (costs atomic add per call)
+	CountComparatorCalls bool
+	// BatchChecksumBucket - if set, Load writes there lastKey -> BatchChecksum of records written by this Load (batch)
+	BatchChecksumBucket string
+	// WALWriter - if set, Load appends everything it writes into the bucket to this log (see LoadFromWAL)
+	WALWriter io.Writer
+	// ConsolidateTmpdir - if set, Transform merges spill files into one file in this dir before Load and
+	// removes spills: fast small disk for spills (tmpdir), bigger one for consolidated data
+	ConsolidateTmpdir string
+	// OnConsolidated - called by FlushToFile with path of written and fsynced file (to rename it, start post-processing, etc.)
+	OnConsolidated func(path string) error
+	// KeySizeExact, ValueSizeExact - if > 0, extract rejects records of other size with *RecordSizeError.
+	// Value size is checked for deletions (empty values) too.
+	KeySizeExact   int
+	ValueSizeExact int
+	// SeenSet - Load skips keys which are in set and adds rest of keys to it (before LoadFunc)
+	SeenSet SeenSet
+	// MaxExtractRecords - if > 0, extract stops after this amount of source records (for sampling/debugging),
+	// collected data is loaded as usual. ExtractBuckets applies it to each bucket. With Checkpoint it's size of batch.
+	MaxExtractRecords int
+	// SmallTransformThreshold - if source bucket has less records, Transform sorts extracted records as plain slice
+	// and loads them directly - without collector and sort buffer. Not used with Comparator, KeyDecoder,
+	// ConsolidateTmpdir and buffer types other than SortableSliceBuffer.
+	SmallTransformThreshold int
+	// FrontCodeKeys - if > 0, Load stores keys front-coded: groups of up to this amount of records per db record,
+	// each key as suffix after prefix shared with previous one (see DecodeFrontCoded, ForEachFrontCoded).
+	// Loaded keys must be strictly increasing and after keys already in bucket. Not for WALWriter and dup-sorted buckets.
+	FrontCodeKeys int
+	// Compression - of spill files (default: none), stream-decompressed by merge of Load
+	Compression Compression
+	// Encryption - if set, spill files are encrypted by current key of this keyring
+	Encryption *Keyring
+	// EntryCodec - format of records of spill files, see Collector.SpillEntryCodec
+	EntryCodec EntryCodec
+	// DupSort - destination bucket is dup-sorted (detected by kv.ChaindataTablesCfg too): all values collected for
+	// one key are loaded under it - by AppendDup in sorted order when appending, by Put otherwise
+	DupSort bool
+	// CanonicalKey - canonicalization of keys (e.g. lowercase hex component), applied to keys emitted by ExtractFunc
+	// before collect - so non-canonical duplicates are sorted (and deduplicated) as one key - and to keys of
+	// CurrentTableReader.Get of LoadFunc. Must not modify `k` in place: it may be memory of db cursor.
+	CanonicalKey func(k []byte) []byte
+	// Reverse - extract walks [ExtractStartKey, ExtractEndKey) from high keys to low: ExtractFunc sees them in this order,
+	// MaxExtractRecords takes highest ones. Collector sorts anyway - Load order doesn't depend on it.
+	// Not compatible with ExtractMaxPerPrefix.
+	Reverse bool
+	// LogUnified - Transform logs one progress line for both stages (with overall percent) instead of separate
+	// [1/2] Extracting and [2/2] Loading lines - less noise from many concurrent transforms
+	LogUnified bool
+	// LogInterval - of periodic progress lines of extract and load: nil - default (30s), 0 (or negative) - no progress lines
+	LogInterval *time.Duration
+	// LogLevel - of progress lines, zero value (log.LvlCrit) means default log.LvlInfo
+	LogLevel log.Lvl
+	// LoadProgress - called by Collector.Load every 4096 loaded records and at the end. totalKeys is amount of
+	// collected records (duplicates dropped by buffer included), 0 if unknown - for collector made by NewCollectorFromFiles.
+	LoadProgress func(loadedKeys, totalKeys uint64)
+	// ProgressCh - receives ProgressEvent of extract and load stages. Sends don't block: events are dropped if channel is full.
+	ProgressCh chan<- ProgressEvent
+	// MergeConcurrency - if > 1, Load merges groups of spill files in up to this amount of goroutines (2 files per group at least),
+	// then merges their outputs. Order of records is same as of serial merge.
+	MergeConcurrency int
+	// MaxTempBytes - budget of spill files of Transform, see Collector.MaxTempBytes
+	MaxTempBytes uint64
+	// NoTempFiles - Transform doesn't use tmpdir (it may be not writable): fails with ErrTempFilesDisabled if collected
+	// data doesn't fit into buffer, see Collector.NoTempFiles. Not compatible with ConsolidateTmpdir.
+	NoTempFiles bool
+	// ExtractWorkers - Transform runs ExtractFunc in this many goroutines (0, 1 - in caller's one), each on own subrange of
+	// [ExtractStartKey, ExtractEndKey) and into own buffer (of 1/ExtractWorkers size): result of load is same as of
+	// single-threaded extract. Source is still read by caller's goroutine (tx is bound to thread), so it helps when
+	// ExtractFunc is expensive. ExtractFunc and CanonicalKey must be safe for concurrent use.
+	// Only for SortableSliceBuffer, not compatible with Reverse, ExtractMaxPerPrefix, MaxExtractRecords, LogUnified, ProgressCh.
+	ExtractWorkers int
+	// ExtractSplitPoints - boundaries of subranges of ExtractWorkers (strictly increasing, inside of extract range).
+	// nil - by density of keys: ProfileRange costs one more scan of range.
+	ExtractSplitPoints [][]byte
+	// SharedBufferBudget - limit of total size of buffers of collectors sharing it, see Collector.BufferBudget
+	SharedBufferBudget *BufferBudget
+	// KeepTempOnError - if Transform fails, its spill files stay in tmpdir (paths are logged), see Collector.KeepFilesOnError
+	KeepTempOnError bool
+	// MaxSpills, MaxSpillsBufferCeiling - see Collector.MaxSpills. Ceiling defaults to MaxBufferSize.
+	MaxSpills              int
+	MaxSpillsBufferCeiling datasize.ByteSize
+	// PreflightSpaceCheck - Transform fails with ErrInsufficientTmpSpace before extract, if tmpdir has less free space
+	// than SpillSizeEstimate (default: size of fromBucket in db)
+	PreflightSpaceCheck bool
+	SpillSizeEstimate   uint64
+	// RetryPolicy - retries of record whose ExtractFunc or LoadFunc failed with transient error, see RetryPolicy
+	RetryPolicy RetryPolicy
+	// LoadDeadline - if set, Load stops at this time with *LoadDeadlineError (extract is not limited)
+	LoadDeadline time.Time
+	// OnLoadCommit - called every CommitEvery records and at the end, by loaders which support it (DirectCopySorted)
+	OnLoadCommit LoadCommitHandler
+	CommitEvery  int
+	// OnLoadCommitTx - Collector.Load (and Transform) calls it with isDone=false after every CommitEvery loaded records -
+	// at boundary of key, after pending writes (dup values, front-coded group, batch checksum, WAL batch) are written,
+	// so committed tx has all records of keys <= `key` and nothing after them - and continues in returned tx.
+	// At the end it's called with isDone=true and current tx (not called if LoadDeadline stopped load).
+	// Not compatible with Checkpoint and InPlaceTempBucket of Transform: they write into tx of Transform after load.
+	OnLoadCommitTx LoadCommitTxHandler
+	// MaxCommitDuration - OnLoadCommit (OnLoadCommitTx of Collector.Load) which takes longer is logged, or fails load with
+	// ErrSlowCommit if FailOnSlowCommit
+	MaxCommitDuration time.Duration
+	FailOnSlowCommit  bool
+	// Checkpoint - if set, Transform and DirectCopySorted resume extract after saved key (see NextKey: keys of source are
+	// expected to be of same length) and save last committed source key: DirectCopySorted - on each OnLoadCommit,
+	// Transform - at the end, extracting MaxExtractRecords per call (if set). Checkpoint is cleared when extract is complete.
+	Checkpoint Checkpoint
+	// CheckpointStage - name of checkpoint (default: source bucket)
+	CheckpointStage string
+
+	loadedRecords *uint64          // counter of Collector.Stats, set by Collector.Load
+	unified       *unifiedProgress // see LogUnified
+	loadTotal     uint64           // totalKeys of LoadProgress
+	lastExtracted *[]byte          // set by extract, if it was stopped by MaxExtractRecords
+	lastLoaded    *[]byte          // set by load: last key passed to LoadFunc, see TransformWithProgress
+	lastCommitted *[]byte          // set by load: last key of successful OnLoadCommitTx, see LoadError
 }
 
 func Transform(
@@ -83,25 +319,221 @@ func Transform(
 	extractFunc ExtractFunc,
 	loadFunc LoadFunc,
 	args TransformArgs,
-) error {
+) (err error) {
+	if args.NoTempFiles && args.ConsolidateTmpdir != "" {
+		return fmt.Errorf("%s: etl: NoTempFiles is not compatible with ConsolidateTmpdir", logPrefix)
+	}
+	if err := args.checkMergeOrder(); err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if args.OnLoadCommitTx != nil && (args.Checkpoint != nil || fromBucket == toBucket) {
+		return fmt.Errorf("%s: etl: OnLoadCommitTx is not compatible with Checkpoint and InPlaceTempBucket", logPrefix)
+	}
+	if fromBucket == toBucket {
+		if args.InPlaceTempBucket == "" {
+			return fmt.Errorf("%s: %w: %s", logPrefix, ErrSameBucket, fromBucket)
+		}
+		return transformInPlace(logPrefix, db, fromBucket, tmpdir, extractFunc, loadFunc, args)
+	}
+	if args.Checkpoint != nil {
+		return transformWithCheckpoint(logPrefix, db, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args)
+	}
+	if args.PreflightSpaceCheck {
+		if err := preflightSpaceCheck(logPrefix, db, fromBucket, tmpdir, args.SpillSizeEstimate); err != nil {
+			return err
+		}
+	}
+	if args.Stats != nil {
+		gcBefore := readGCSnapshot()
+		defer func() { args.Stats.addGCDelta(gcBefore, readGCSnapshot()) }()
+	}
+	if small, err := useSmallTransform(db, fromBucket, args); err != nil {
+		return err
+	} else if small {
+		return transformSmall(logPrefix, db, fromBucket, toBucket, extractFunc, loadFunc, args)
+	}
 	bufferSize := BufferOptimalSize
 	if args.BufferSize > 0 {
 		bufferSize = datasize.ByteSize(args.BufferSize)
 	}
-	buffer := getBufferByType(args.BufferType, bufferSize)
+	bufType, err := args.bufferType()
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	buffer := getBufferByType(bufType, bufferSize)
+	if args.Comparator != nil && args.CountComparatorCalls && args.Stats != nil {
+		args.Comparator = countingComparator(args.Comparator, &args.Stats.ComparatorCalls)
+	}
+	if cmp := args.sortComparator(); cmp != nil {
+		buffer.SetComparator(cmp) // runs must be sorted in merge order
+	}
 	collector := NewCollector(logPrefix, tmpdir, buffer)
-	defer collector.Close()
+	defer func() {
+		if err != nil {
+			collector.failed = true
+		}
+		collector.Close()
+	}()
+	collector.KeepFilesOnError(args.KeepTempOnError)
+	collector.BufferBudget(args.SharedBufferBudget)
+	collector.SpillCompression(args.Compression)
+	collector.SpillEncryption(args.Encryption)
+	collector.SpillEntryCodec(args.EntryCodec)
+	collector.MaxTempBytes(args.MaxTempBytes)
+	collector.Metrics(args.Metrics)
+	collector.NoTempFiles(args.NoTempFiles)
+	if args.Stats != nil {
+		defer func() { args.Stats.CollectorStats = collector.Stats() }()
+	}
+	if args.MaxSpills > 0 {
+		ceiling := args.MaxSpillsBufferCeiling
+		if ceiling == 0 {
+			ceiling = MaxBufferSize
+		}
+		collector.MaxSpills(args.MaxSpills, ceiling)
+	}
+
+	if args.LogUnified {
+		u, err := newUnifiedProgress(db, fromBucket, toBucket)
+		if err != nil {
+			return err
+		}
+		args.unified = u
+	}
 
 	t := time.Now()
-	if err := extractBucketIntoFiles(logPrefix, db, fromBucket, args.ExtractStartKey, args.ExtractEndKey, collector, extractFunc, args.Quit, args.LogDetailsExtract); err != nil {
+	if err := extractIntoFiles(logPrefix, db, fromBucket, collector, extractFunc, args); err != nil {
 		return err
 	}
+	args.metrics().ObserveExtractDuration(logPrefix, time.Since(t), collector.stats.EntriesCollected)
 	log.Trace(fmt.Sprintf("[%s] Extraction finished", logPrefix), "took", time.Since(t))
+	if args.ConsolidateTmpdir != "" {
+		if err := collector.consolidate(args.ConsolidateTmpdir, args); err != nil {
+			return err
+		}
+	}
 
 	defer func(t time.Time) {
 		log.Trace(fmt.Sprintf("[%s] Load finished", logPrefix), "took", time.Since(t))
 	}(time.Now())
-	return collector.Load(db, toBucket, loadFunc, args)
+	if args.unified != nil {
+		args.unified.stage, args.unified.loadTotal = ProgressLoad, collector.stats.EntriesCollected
+	}
+	loadStart := time.Now()
+	if err := collector.Load(db, toBucket, loadFunc, args); err != nil {
+		return err
+	}
+	args.metrics().ObserveLoadDuration(logPrefix, time.Since(loadStart), collector.stats.EntriesLoaded)
+	if args.unified != nil {
+		args.unified.stage = ""
+		args.unified.log(logPrefix, args.logLevel(), nil)
+	}
+	return nil
+}
+
+// TransformWithProgress - Transform which returns last loaded key (key of last record passed to loadFunc - as `key` of
+// commit handlers), nil if nothing was loaded. Next run can start from NextKey(lastKey).
+// On error lastKey is of records loaded before it (as LoadDeadlineError.LastKey).
+func TransformWithProgress(
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) (lastKey []byte, err error) {
+	args.lastLoaded = &lastKey
+	err = Transform(logPrefix, db, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args)
+	return lastKey, err
+}
+
+// ErrSameBucket - Transform reads and writes same bucket in one tx, see TransformArgs.InPlaceTempBucket
+var ErrSameBucket = errors.New("etl: extract and load bucket are the same")
+
+// ErrInsufficientTmpSpace - see TransformArgs.PreflightSpaceCheck
+var ErrInsufficientTmpSpace = errors.New("etl: not enough free space in tmpdir")
+
+// diskFreeSpace - replaced by tests
+var diskFreeSpace = freeSpace
+
+func preflightSpaceCheck(logPrefix string, db kv.Tx, fromBucket, tmpdir string, estimate uint64) error {
+	if estimate == 0 {
+		var err error
+		if estimate, err = db.BucketSize(fromBucket); err != nil {
+			return fmt.Errorf("%s: estimating spill size: %w", logPrefix, err)
+		}
+	}
+	if tmpdir == "" {
+		tmpdir = os.TempDir()
+	} else if err := os.MkdirAll(tmpdir, 0755); err != nil {
+		return err
+	}
+	free, err := diskFreeSpace(tmpdir)
+	if err != nil {
+		return fmt.Errorf("%s: checking free space of %s: %w", logPrefix, tmpdir, err)
+	}
+	if free < estimate {
+		return fmt.Errorf("%s: %w: %s has %s free, spills need about %s (short by %s)", logPrefix, ErrInsufficientTmpSpace,
+			tmpdir, common.ByteCount(free), common.ByteCount(estimate), common.ByteCount(estimate-free))
+	}
+	return nil
+}
+
+// transformInPlace - loads into temp bucket, then replaces content of bucket by it
+func transformInPlace(logPrefix string, db kv.RwTx, bucket, tmpdir string, extractFunc ExtractFunc, loadFunc LoadFunc, args TransformArgs) error {
+	tmpBucket := args.InPlaceTempBucket
+	if tmpBucket == bucket {
+		return fmt.Errorf("%s: %w: temp bucket %s", logPrefix, ErrSameBucket, tmpBucket)
+	}
+	if err := db.ClearBucket(tmpBucket); err != nil {
+		return err
+	}
+	if err := Transform(logPrefix, db, bucket, tmpBucket, tmpdir, extractFunc, loadFunc, args); err != nil {
+		return err
+	}
+	if err := db.ClearBucket(bucket); err != nil {
+		return err
+	}
+	if err := copyBucket(db, tmpBucket, bucket); err != nil {
+		return fmt.Errorf("%s: copying %s into %s: %w", logPrefix, tmpBucket, bucket, err)
+	}
+	return db.ClearBucket(tmpBucket)
+}
+
+// copyBucket - copies `from` into empty `to`
+func copyBucket(db kv.RwTx, from, to string) error {
+	c, err := db.Cursor(from)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	isDupSort := kv.ChaindataTablesCfg[to].Flags&kv.DupSort != 0 && !kv.ChaindataTablesCfg[to].AutoDupSortKeysConversion
+	var w kv.RwCursor
+	if isDupSort {
+		w, err = db.RwCursorDupSort(to)
+	} else {
+		w, err = db.RwCursor(to)
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for k, v, err := c.First(); k != nil || err != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if isDupSort {
+			err = w.(kv.RwCursorDupSort).AppendDup(k, v)
+		} else {
+			err = w.Append(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // extractBucketIntoFiles - [startkey, endkey)
@@ -116,38 +548,140 @@ func extractBucketIntoFiles(
 	quit <-chan struct{},
 	additionalLogArguments AdditionalLogArguments,
 ) error {
-	logEvery := time.NewTicker(30 * time.Second)
-	defer logEvery.Stop()
+	args := TransformArgs{ExtractStartKey: startkey, ExtractEndKey: endkey, Quit: quit, LogDetailsExtract: additionalLogArguments}
+	return extractIntoFiles(logPrefix, db, bucket, collector, extractFunc, args)
+}
+
+// extractIntoFiles - same as extractBucketIntoFiles, but with all extract options of args
+func extractIntoFiles(logPrefix string, db kv.Tx, bucket string, collector *Collector, extractFunc ExtractFunc, args TransformArgs) error {
+	extract := extractBucket
+	if args.ExtractWorkers > 1 {
+		collector.quit = args.Quit
+		extract = extractParallel
+	}
+	if err := extract(logPrefix, db, bucket, collector, extractFunc, args); err != nil {
+		return err
+	}
+	return collector.flushBuffer(nil, true)
+}
+
+// extractBucket - same as extractIntoFiles, but doesn't do final flush - to extract several buckets into one collector
+func extractBucket(logPrefix string, db kv.Tx, bucket string, collector *Collector, extractFunc ExtractFunc, args TransformArgs) error {
+	collector.quit = args.Quit // flushes sort buffer - it must be interruptible too
+	logEvery, stopLog := args.logTicker()
+	defer stopLog()
 
 	c, err := db.Cursor(bucket)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
-	for k, v, e := c.Seek(startkey); k != nil; k, v, e = c.Next() {
+	var it keyValueIter = c
+	if bc, ok := c.(BatchCursor); ok {
+		it = &batchedCursor{c: bc}
+	}
+	start := args.ExtractStartKey
+	if args.Reverse {
+		if args.ExtractMaxPerPrefix > 0 {
+			return fmt.Errorf("%s: etl: Reverse extract doesn't support ExtractMaxPerPrefix", logPrefix)
+		}
+		it, start = &reverseCursor{c: c}, args.ExtractEndKey
+	}
+
+	next := canonicalizeKeys(checkRecordSizes(collector.extractNextFunc, args), args)
+	if args.RetryPolicy.MaxAttempts > 1 {
+		extractFunc = args.RetryPolicy.wrapExtract(logPrefix, extractFunc, args.Quit)
+	}
+	progress := newProgressReporter(args.ProgressCh, ProgressExtract)
+	defer func() { progress.done(len(collector.dataProviders)) }()
+
+	// ExtractMaxPerPrefix: after cap reached - seek to next prefix instead of Next
+	var prefix, skipTo, prevK []byte
+	perPrefix, extracted := 0, 0
+	advance := func() ([]byte, []byte, error) {
+		if skipTo != nil {
+			seek := skipTo
+			skipTo = nil
+			return it.Seek(seek)
+		}
+		return it.Next()
+	}
+
+	for k, v, e := it.Seek(start); k != nil || e != nil; k, v, e = advance() {
 		if e != nil {
 			return e
 		}
-		if err := common.Stopped(quit); err != nil {
+		if err := common.Stopped(args.Quit); err != nil {
 			return err
 		}
 		select {
 		default:
-		case <-logEvery.C:
+		case <-logEvery:
+			if args.unified != nil {
+				args.unified.log(logPrefix, args.logLevel(), k)
+				break
+			}
 			logArs := []interface{}{"from", bucket}
-			if additionalLogArguments != nil {
-				logArs = append(logArs, additionalLogArguments(k, v)...)
+			if args.LogDetailsExtract != nil {
+				logArs = append(logArs, args.LogDetailsExtract(k, v)...)
 			} else {
 				logArs = append(logArs, "current_prefix", makeCurrentKeyStr(k))
 			}
 
-			log.Info(fmt.Sprintf("[%s] ETL [1/2] Extracting", logPrefix), logArs...)
+			log.Log(args.logLevel(), fmt.Sprintf("[%s] ETL [1/2] Extracting", logPrefix), logArs...)
 		}
-		if endkey != nil && bytes.Compare(k, endkey) >= 0 {
+		if args.ExtractEndKey != nil && bytes.Compare(k, args.ExtractEndKey) >= 0 {
 			// endKey is exclusive bound: [startkey, endkey)
 			return nil
 		}
-		if err := extractFunc(k, v, collector.extractNextFunc); err != nil {
+		if args.Reverse && bytes.Compare(k, args.ExtractStartKey) < 0 {
+			return nil
+		}
+		if args.ExtractFilter != nil && !args.ExtractFilter(k) {
+			continue
+		}
+		if args.MaxExtractRecords > 0 && extracted >= args.MaxExtractRecords {
+			if args.lastExtracted != nil {
+				*args.lastExtracted = prevK
+			}
+			return nil
+		}
+		if args.lastExtracted != nil {
+			prevK = append(prevK[:0], k...)
+		}
+		extracted++
+		if args.unified != nil {
+			args.unified.extracted++
+		}
+		if err := extractFunc(k, v, next); err != nil {
+			return err
+		}
+		progress.add(k, v, len(collector.dataProviders))
+		if args.ExtractMaxPerPrefix > 0 && len(k) >= args.ExtractPrefixLen {
+			if !bytes.Equal(prefix, k[:args.ExtractPrefixLen]) {
+				prefix = append(prefix[:0], k[:args.ExtractPrefixLen]...)
+				perPrefix = 0
+			}
+			if perPrefix++; perPrefix >= args.ExtractMaxPerPrefix {
+				if skipTo, err = NextKey(prefix); err != nil {
+					return nil // it was last possible prefix
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ExtractBuckets - extracts [args.ExtractStartKey, args.ExtractEndKey) of each bucket (one after another) into same collector.
+// If collector is in provenance mode (see Collector.WithProvenance) - each collected value gets provenance header
+// (source bucket and ordinal of source record in it), LoadFunc can read it by SplitProvenance.
+func ExtractBuckets(logPrefix string, db kv.Tx, buckets []string, collector *Collector, extractFunc ExtractFunc, args TransformArgs) error {
+	for _, bucket := range buckets {
+		f := extractFunc
+		if collector.provenance {
+			f = withProvenance(bucket, extractFunc)
+		}
+		if err := extractBucket(logPrefix, db, bucket, collector, f, args); err != nil {
 			return err
 		}
 	}
@@ -155,11 +689,15 @@ func extractBucketIntoFiles(
 }
 
 type currentTableReader struct {
-	getter kv.Tx
-	bucket string
+	getter       kv.Tx
+	bucket       string
+	canonicalKey func(k []byte) []byte // see TransformArgs.CanonicalKey
 }
 
 func (s *currentTableReader) Get(key []byte) ([]byte, error) {
+	if s.canonicalKey != nil {
+		key = s.canonicalKey(key)
+	}
 	return s.getter.GetOne(s.bucket, key)
 }
 
@@ -171,3 +709,24 @@ var IdentityLoadFunc LoadFunc = func(k []byte, value []byte, _ CurrentTableReade
 func isIdentityLoadFunc(f LoadFunc) bool {
 	return f == nil || reflect.ValueOf(IdentityLoadFunc).Pointer() == reflect.ValueOf(f).Pointer()
 }
+
+// ErrCombineLoadEmit - returned to not-last LoadFunc of CombineLoad if it calls `next`
+var ErrCombineLoadEmit = errors.New("etl: only last LoadFunc of CombineLoad may call next")
+
+func noEmitLoadNextFunc(_, _, _ []byte) error { return ErrCombineLoadEmit }
+
+// CombineLoad - calls funcs in order for every record. Only last func writes: it gets real `next`,
+// others get `next` which returns ErrCombineLoadEmit (use them for side effects: counters, summaries, etc.).
+func CombineLoad(funcs ...LoadFunc) LoadFunc {
+	return func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		for i, f := range funcs {
+			if i == len(funcs)-1 {
+				return f(k, v, table, next)
+			}
+			if err := f(k, v, table, noEmitLoadNextFunc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
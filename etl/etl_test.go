@@ -17,17 +17,30 @@ package etl
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func decodeHex(in string) []byte {
@@ -94,6 +107,140 @@ func TestNextKeyErr(t *testing.T) {
 		_, err := NextKey(input)
 		assert.Error(t, err)
 	}
+	_, err := NextKey(decodeHex("FFFF"))
+	assert.ErrorIs(t, err, ErrNextKeyOverflow)
+	_, err = NextKey(nil)
+	assert.NotErrorIs(t, err, ErrNextKeyOverflow)
+}
+
+func TestNextKeyFixed(t *testing.T) {
+	next, err := NextKeyFixed(decodeHex("00FFFF"), 3)
+	require.NoError(t, err)
+	assert.Equal(t, decodeHex("010000"), next)
+
+	_, err = NextKeyFixed(decodeHex("FFFFFF"), 3)
+	assert.ErrorIs(t, err, ErrNextKeyOverflow)
+	for _, tc := range []struct {
+		key   string
+		width int
+	}{{"00FF", 3}, {"FFFFFF", 2}, {"", 0}, {"", 1}} {
+		_, err = NextKeyFixed(decodeHex(tc.key), tc.width)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrNextKeyOverflow, tc)
+	}
+}
+
+func TestLoadVerifyOrder(t *testing.T) {
+	reverse := func(k1, k2, _, _ []byte) int { return bytes.Compare(k2, k1) }
+	load := func(bufferCmp, mergeCmp kv.CmpFunc) error {
+		_, tx := memdb.NewTestTx(t)
+		buf := NewSortableBuffer(BufferOptimalSize)
+		if bufferCmp != nil {
+			buf.SetComparator(bufferCmp)
+		}
+		c := NewCollector(t.Name(), t.TempDir(), buf)
+		defer c.Close()
+		for i := 0; i < 10; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%02d", i)), []byte("v")))
+		}
+		return c.Load(tx, kv.ChaindataTables[1], func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+			return next(k, k, v) // Put: bucket order is bytewise
+		}, TransformArgs{Comparator: mergeCmp, VerifyOrder: true})
+	}
+	require.NoError(t, load(nil, nil))
+	require.NoError(t, load(reverse, reverse))
+	// buffer sorted by other order than merge
+	err := load(reverse, nil)
+	require.ErrorIs(t, err, ErrOrderViolation)
+	require.Contains(t, err.Error(), fmt.Sprintf("key %x (value 76) is before previous key %x", "key-08", "key-09"))
+}
+
+func TestCheckComparator(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 30; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("%d", i*7)))
+	}
+	samples = append(samples, nil, []byte{0xff}, []byte{0, 0})
+	require.NoError(t, CheckComparator(func(k1, k2, _, _ []byte) int { return bytes.Compare(k1, k2) }, samples))
+	reverse := func(k1, k2, _, _ []byte) int { return bytes.Compare(k2, k1) }
+	require.NoError(t, CheckComparator(reverse, samples))
+
+	// by first byte only: different keys are equal
+	firstByte := func(k []byte) []byte {
+		if len(k) > 1 {
+			return k[:1]
+		}
+		return k
+	}
+	err := CheckComparator(func(k1, k2, _, _ []byte) int { return bytes.Compare(firstByte(k1), firstByte(k2)) }, samples)
+	require.ErrorContains(t, err, "inconsistent with equality")
+	// <= instead of <
+	err = CheckComparator(func(k1, k2, _, _ []byte) int {
+		if bytes.Compare(k1, k2) <= 0 {
+			return -1
+		}
+		return 1
+	}, samples)
+	require.ErrorContains(t, err, "inconsistent with equality")
+	// "rock-paper-scissors": antisymmetric, but cyclic
+	rps := func(k1, k2, _, _ []byte) int {
+		if bytes.Equal(k1, k2) {
+			return 0
+		}
+		if (k1[0]+1)%3 == k2[0]%3 {
+			return -1
+		}
+		if (k2[0]+1)%3 == k1[0]%3 {
+			return 1
+		}
+		return bytes.Compare(k1, k2)
+	}
+	require.ErrorContains(t, CheckComparator(rps, [][]byte{{0}, {1}, {2}}), "not transitive")
+	// sign of cmp(a, b) and cmp(b, a) is same
+	require.ErrorContains(t, CheckComparator(func(k1, k2, _, _ []byte) int {
+		if bytes.Equal(k1, k2) {
+			return 0
+		}
+		return 1
+	}, samples), "not antisymmetric")
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []string{
+		"00000001->00000002",
+		"000000FF->000001",
+		"01FFFF->02",
+		"FEFFFFFF->FF",
+	} {
+		parts := strings.Split(tc, "->")
+		end, unbounded := PrefixEnd(decodeHex(parts[0]))
+		assert.False(t, unbounded)
+		assert.Equal(t, decodeHex(parts[1]), end)
+	}
+	for _, tc := range []string{"", "FF", "FFFFFF"} {
+		end, unbounded := PrefixEnd(decodeHex(tc))
+		assert.True(t, unbounded)
+		assert.Nil(t, end)
+	}
+	input := decodeHex("01FF")
+	_, _ = PrefixEnd(input)
+	assert.Equal(t, decodeHex("01FF"), input) // not modified
+
+	// prefix scan
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	for _, k := range []string{"00FF", "01", "0100", "01FF", "01FFFF", "02", "0200"} {
+		require.NoError(t, tx.Put(sourceBucket, decodeHex(k), []byte{1}))
+	}
+	prefix := decodeHex("01")
+	end, _ := PrefixEnd(prefix)
+	var got []string
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[3], t.TempDir(),
+		func(k, v []byte, next ExtractNextFunc) error {
+			got = append(got, hex.EncodeToString(k))
+			return nil
+		}, IdentityLoadFunc, TransformArgs{ExtractStartKey: prefix, ExtractEndKey: end}))
+	require.Equal(t, []string{"01", "0100", "01ff", "01ffff"}, got)
 }
 
 func TestFileDataProviders(t *testing.T) {
@@ -227,137 +374,2088 @@ func TestTransformThroughFiles(t *testing.T) {
 	compareBuckets(t, tx, sourceBucket, destBucket, nil)
 }
 
-func TestTransformDoubleOnExtract(t *testing.T) {
-	// test invariant when extractFunc multiplies the data 2x
+func TestTransformConsolidateTmpdir(t *testing.T) {
 	_, tx := memdb.NewTestTx(t)
 	sourceBucket := kv.ChaindataTables[0]
 	destBucket := kv.ChaindataTables[1]
 	generateTestData(t, tx, sourceBucket, 10)
-	err := Transform(
-		"logPrefix",
-		tx,
-		sourceBucket,
-		destBucket,
-		"", // temp dir
-		testExtractDoubleToMapFunc,
-		testLoadFromMapFunc,
-		TransformArgs{},
+	spillDir, consolidatedDir := t.TempDir(), t.TempDir()
+	countFiles := func(dir string) int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	maxSpills, loadCalls := 0, 0
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, spillDir,
+		func(k, v []byte, next ExtractNextFunc) error {
+			if n := countFiles(spillDir); n > maxSpills {
+				maxSpills = n
+			}
+			return testExtractToMapFunc(k, v, next)
+		},
+		func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+			if loadCalls == 0 {
+				assert.Equal(t, 0, countFiles(spillDir), "spills are removed after consolidation")
+				assert.Equal(t, 1, countFiles(consolidatedDir))
+			}
+			loadCalls++
+			return testLoadFromMapFunc(k, v, table, next)
+		},
+		TransformArgs{BufferSize: 1, ConsolidateTmpdir: consolidatedDir},
 	)
-	assert.Nil(t, err)
-	compareBucketsDouble(t, tx, sourceBucket, destBucket)
+	require.NoError(t, err)
+	assert.Greater(t, maxSpills, 1)
+	assert.Equal(t, 10, loadCalls)
+	assert.Equal(t, 0, countFiles(consolidatedDir))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
 }
 
-func TestTransformDoubleOnLoad(t *testing.T) {
-	// test invariant when loadFunc multiplies the data 2x
+func TestTransformRecordSizes(t *testing.T) {
 	_, tx := memdb.NewTestTx(t)
 	sourceBucket := kv.ChaindataTables[0]
 	destBucket := kv.ChaindataTables[1]
 	generateTestData(t, tx, sourceBucket, 10)
-	err := Transform(
-		"logPrefix",
-		tx,
-		sourceBucket,
-		destBucket,
-		"", // temp dir
-		testExtractToMapFunc,
-		testLoadFromMapDoubleFunc,
-		TransformArgs{},
-	)
-	assert.Nil(t, err)
-	compareBucketsDouble(t, tx, sourceBucket, destBucket)
+	keyLen := len(fmt.Sprintf("%10d-key-%010d", 0, 0))
+	identity := func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) }
+
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, "", identity, IdentityLoadFunc,
+		TransformArgs{KeySizeExact: keyLen})
+	require.NoError(t, err)
+
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, "",
+		func(k, v []byte, next ExtractNextFunc) error { return next(k, k[:keyLen-1], v) }, IdentityLoadFunc,
+		TransformArgs{KeySizeExact: keyLen})
+	var sizeErr *RecordSizeError
+	require.ErrorAs(t, err, &sizeErr)
+	assert.Equal(t, "key", sizeErr.Field)
+	assert.Equal(t, keyLen, sizeErr.Expected)
+	assert.Equal(t, keyLen-1, sizeErr.Actual)
+
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, "", identity, IdentityLoadFunc,
+		TransformArgs{ValueSizeExact: 3})
+	require.ErrorAs(t, err, &sizeErr)
+	assert.Equal(t, "value", sizeErr.Field)
 }
 
-func generateTestData(t *testing.T, db kv.Putter, bucket string, count int) {
-	t.Helper()
-	for i := 0; i < count; i++ {
-		k := []byte(fmt.Sprintf("%10d-key-%010d", i, i))
-		v := []byte(fmt.Sprintf("val-%099d", i))
-		err := db.Put(bucket, k, v)
-		assert.NoError(t, err)
+func TestTransformMaxExtractRecords(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	generateTestData(t, tx, sourceBucket, 100)
+	for i, limit := range []int{1, 30, 100, 500} {
+		destBucket := kv.ChaindataTables[1+i]
+		extracted := 0
+		err := Transform("logPrefix", tx, sourceBucket, destBucket, "",
+			func(k, v []byte, next ExtractNextFunc) error {
+				extracted++
+				return next(k, k, v)
+			}, IdentityLoadFunc, TransformArgs{MaxExtractRecords: limit, BufferSize: 1})
+		require.NoError(t, err)
+		expect := limit
+		if expect > 100 {
+			expect = 100
+		}
+		require.Equal(t, expect, extracted)
+		loaded := 0
+		require.NoError(t, tx.ForEach(destBucket, nil, func(k, _ []byte) error {
+			require.Equal(t, fmt.Sprintf("%10d-key-%010d", loaded, loaded), string(k)) // first records of bucket
+			loaded++
+			return nil
+		}))
+		require.Equal(t, expect, loaded)
 	}
 }
 
-func testExtractToMapFunc(k, v []byte, next ExtractNextFunc) error {
-	valueMap := make(map[string][]byte)
-	valueMap["value"] = v
-	out, _ := json.Marshal(valueMap)
-	return next(k, k, out)
+func TestTransformPreflightSpaceCheck(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	generateTestData(t, tx, sourceBucket, 10)
+	defer func(f func(string) (uint64, error)) { diskFreeSpace = f }(diskFreeSpace)
+	var free uint64
+	diskFreeSpace = func(string) (uint64, error) { return free, nil }
+	transform := func(args TransformArgs) error {
+		args.PreflightSpaceCheck = true
+		return Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[1], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc, args)
+	}
+
+	free = 1000
+	err := transform(TransformArgs{SpillSizeEstimate: 5000})
+	require.ErrorIs(t, err, ErrInsufficientTmpSpace)
+	require.ErrorContains(t, err, "short by 3.9KB")
+
+	err = transform(TransformArgs{}) // estimate by bucket size
+	require.ErrorIs(t, err, ErrInsufficientTmpSpace)
+
+	free = 1 << 40
+	require.NoError(t, transform(TransformArgs{}))
+	compareBuckets(t, tx, sourceBucket, kv.ChaindataTables[1], nil)
+
+	free, err = freeSpace(t.TempDir()) // real implementation
+	require.NoError(t, err)
+	require.Greater(t, free, uint64(0))
 }
 
-func testExtractDoubleToMapFunc(k, v []byte, next ExtractNextFunc) error {
-	valueMap := make(map[string][]byte)
-	valueMap["value"] = append(v, 0xAA)
-	k1 := append(k, 0xAA)
-	out, _ := json.Marshal(valueMap)
+func TestTransformLoadDeadline(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	sourceBucket, destBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		generateTestData(t, tx, sourceBucket, 100)
+		return nil
+	}))
 
-	err := next(k, k1, out)
-	if err != nil {
-		return err
+	var deadlineErr *LoadDeadlineError
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		loaded := 0
+		err := Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(),
+			func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) },
+			func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+				if loaded++; loaded == 10 {
+					time.Sleep(300 * time.Millisecond)
+				}
+				return next(k, k, v)
+			},
+			TransformArgs{LoadDeadline: time.Now().Add(200 * time.Millisecond)})
+		require.ErrorAs(t, err, &deadlineErr)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		return nil // commit partial load
+	}))
+	require.Equal(t, fmt.Sprintf("%10d-key-%010d", 9, 9), string(deadlineErr.LastKey))
+
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		n := 0
+		require.NoError(t, tx.ForEach(destBucket, nil, func(k, _ []byte) error {
+			require.Equal(t, fmt.Sprintf("%10d-key-%010d", n, n), string(k))
+			n++
+			return nil
+		}))
+		require.Equal(t, 10, n)
+		return nil
+	}))
+}
+
+func TestTransformRetry(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	tmpdir := filepath.Join(t.TempDir(), "spills")
+	require.NoError(t, os.WriteFile(tmpdir, nil, 0600)) // first spill fails: tmpdir is not a directory
+
+	calls := 0
+	isRetryable := func(err error) bool {
+		calls++
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) {
+			return false
+		}
+		require.NoError(t, os.Remove(tmpdir)) // transient failure is gone
+		return true
 	}
+	err := TransformRetry(3, isRetryable, "logPrefix", tx, sourceBucket, destBucket, tmpdir, testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{BufferSize: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
 
-	valueMap = make(map[string][]byte)
-	valueMap["value"] = append(v, 0xBB)
-	k2 := append(k, 0xBB)
-	out, _ = json.Marshal(valueMap)
-	return next(k, k2, out)
+	failErr := errors.New("not retryable")
+	calls = 0
+	err = TransformRetry(3, isRetryable, "logPrefix", tx, sourceBucket, destBucket, tmpdir,
+		func(k, v []byte, next ExtractNextFunc) error { return failErr }, testLoadFromMapFunc, TransformArgs{})
+	require.ErrorIs(t, err, failErr)
+	require.Equal(t, 1, calls)
 }
 
-func testLoadFromMapFunc(k []byte, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
-	valueMap := make(map[string][]byte)
-	err := json.Unmarshal(v, &valueMap)
-	if err != nil {
-		return err
+func TestTransformRetryPolicy(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 100)
+	errFlaky, errFatal := errors.New("flaky"), errors.New("fatal")
+	extractAttempts, loadAttempts := map[string]int{}, map[string]int{}
+	// every 10th record fails twice - after emitting
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		if err := next(k, k, v); err != nil {
+			return err
+		}
+		if extractAttempts[string(k)]++; bytes.HasSuffix(k, []byte("0")) && extractAttempts[string(k)] <= 2 {
+			return errFlaky
+		}
+		return nil
 	}
-	realValue := valueMap["value"]
-	return next(k, k, realValue)
+	load := func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		if err := next(k, k, v); err != nil {
+			return err
+		}
+		if loadAttempts[string(k)]++; bytes.HasSuffix(k, []byte("5")) && loadAttempts[string(k)] <= 2 {
+			return errFlaky
+		}
+		return nil
+	}
+	policy := RetryPolicy{MaxAttempts: 3, Retryable: func(err error) bool { return errors.Is(err, errFlaky) }, Backoff: time.Microsecond}
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract, load, TransformArgs{RetryPolicy: policy}))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+	require.Equal(t, 3, extractAttempts[fmt.Sprintf("%10d-key-%010d", 10, 10)])
+	require.Equal(t, 3, loadAttempts[fmt.Sprintf("%10d-key-%010d", 15, 15)])
+	require.Equal(t, 1, loadAttempts[fmt.Sprintf("%10d-key-%010d", 10, 10)]) // emitted once
+	var loaded int
+	require.NoError(t, tx.ForEach(destBucket, nil, func(_, _ []byte) error {
+		loaded++
+		return nil
+	}))
+	require.Equal(t, 100, loaded)
+
+	// attempts are over
+	extractAttempts = map[string]int{}
+	policy.MaxAttempts = 2
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract, IdentityLoadFunc, TransformArgs{RetryPolicy: policy})
+	require.ErrorIs(t, err, errFlaky)
+	require.Equal(t, 2, extractAttempts[fmt.Sprintf("%10d-key-%010d", 0, 0)])
+
+	// not retryable
+	calls := 0
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), func(k, v []byte, next ExtractNextFunc) error {
+		calls++
+		return errFatal
+	}, IdentityLoadFunc, TransformArgs{RetryPolicy: policy})
+	require.ErrorIs(t, err, errFatal)
+	require.Equal(t, 1, calls)
 }
 
-func testLoadFromMapDoubleFunc(k []byte, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
-	valueMap := make(map[string][]byte)
-	err := json.Unmarshal(v, &valueMap)
-	if err != nil {
-		return err
+func TestTransformCtx(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10_000)
+	slowExtract := func(k, v []byte, next ExtractNextFunc) error {
+		time.Sleep(time.Millisecond) // whole extract takes > 10s
+		return next(k, k, v)
 	}
-	realValue := valueMap["value"]
 
-	err = next(k, append(k, 0xAA), append(realValue, 0xAA))
-	if err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := TransformCtx(ctx, "logPrefix", tx, sourceBucket, destBucket, "", slowExtract, IdentityLoadFunc, TransformArgs{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// load is interrupted too
+	ctx, cancel = context.WithCancel(context.Background())
+	loaded := 0
+	err = TransformCtx(ctx, "logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc,
+		func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+			if loaded++; loaded == 100 {
+				cancel()
+			}
+			return testLoadFromMapFunc(k, v, table, next)
+		}, TransformArgs{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 100, loaded)
+
+	// Quit keeps working
+	quit := make(chan struct{})
+	close(quit)
+	err = TransformCtx(context.Background(), "logPrefix", tx, sourceBucket, destBucket, "", slowExtract, IdentityLoadFunc, TransformArgs{Quit: quit})
+	require.ErrorIs(t, err, common.ErrStopped)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	collector := NewCollector("logPrefix", "", NewSortableBuffer(BufferOptimalSize))
+	defer collector.Close()
+	require.ErrorIs(t, ExtractBucketCtx(ctx, "logPrefix", tx, sourceBucket, collector, slowExtract, TransformArgs{}), context.Canceled)
+}
+
+func TestDirectCopySorted(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3] // not dup-sorted
+	generateTestData(t, tx, sourceBucket, 100)
+	var commits []string
+	var done bool
+	err := DirectCopySorted(tx, sourceBucket, destBucket, TransformArgs{
+		CommitEvery: 30,
+		OnLoadCommit: func(_ kv.Putter, key []byte, isDone bool) error {
+			commits = append(commits, string(key))
+			done = isDone
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+	require.Equal(t, []string{
+		fmt.Sprintf("%10d-key-%010d", 29, 29),
+		fmt.Sprintf("%10d-key-%010d", 59, 59),
+		fmt.Sprintf("%10d-key-%010d", 89, 89),
+		fmt.Sprintf("%10d-key-%010d", 99, 99),
+	}, commits)
+	require.True(t, done)
+}
+
+func TestDirectCopySortedSlowCommit(t *testing.T) {
+	defer func(h log.Handler) { log.Root().SetHandler(h) }(log.Root().GetHandler())
+	var warnings []string
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Lvl == log.LvlWarn {
+			warnings = append(warnings, r.Msg)
+		}
+		return nil
+	}))
+
+	const slow = 20 * time.Millisecond
+	// commit of each record: 200 commits, `slowCommits` of them are slow
+	copyWith := func(slowCommits int, args TransformArgs) (*TransformStats, error) {
+		_, tx := memdb.NewTestTx(t)
+		sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+		generateTestData(t, tx, sourceBucket, 199)
+		commits := 0
+		args.Stats, args.CommitEvery = &TransformStats{}, 1
+		args.OnLoadCommit = func(kv.Putter, []byte, bool) error {
+			if commits++; commits%50 == 0 && commits/50 <= slowCommits {
+				time.Sleep(slow)
+			}
+			return nil
+		}
+		return args.Stats, DirectCopySorted(tx, sourceBucket, destBucket, args)
 	}
-	return next(k, append(k, 0xBB), append(realValue, 0xBB))
+
+	stats, err := copyWith(1, TransformArgs{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), stats.Commits)
+	require.GreaterOrEqual(t, stats.CommitMax, slow)
+	require.Less(t, stats.CommitP99, slow) // 1 of 200 is not p99
+	stats, err = copyWith(3, TransformArgs{})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, stats.CommitP99, slow)
+	require.Empty(t, warnings)
+
+	stats, err = copyWith(3, TransformArgs{MaxCommitDuration: slow / 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"[DirectCopySorted] etl: slow commit", "[DirectCopySorted] etl: slow commit", "[DirectCopySorted] etl: slow commit"}, warnings)
+	stats, err = copyWith(3, TransformArgs{MaxCommitDuration: slow / 2, FailOnSlowCommit: true})
+	require.ErrorIs(t, err, ErrSlowCommit)
+	require.Equal(t, uint64(50), stats.Commits) // stops on first slow commit
+	require.GreaterOrEqual(t, stats.CommitMax, slow)
+
+	// commits of Collector.Load and LoadReverse are timed too
+	collect := func() *Collector {
+		c := NewCollector("slow", t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+		for i := 0; i < 200; i++ {
+			require.NoError(t, c.Collect([]byte(fmt.Sprintf("key-%04d", i)), []byte("v")))
+		}
+		return c
+	}
+	_, tx := memdb.NewTestTx(t)
+	warnings = nil
+	stats = &TransformStats{}
+	require.NoError(t, collect().Load(tx, kv.ChaindataTables[3], IdentityLoadFunc, TransformArgs{
+		Stats: stats, CommitEvery: 50, MaxCommitDuration: slow / 2,
+		OnLoadCommitTx: func(tx kv.RwTx, _ []byte, isDone bool) (kv.RwTx, error) {
+			if isDone {
+				time.Sleep(slow)
+			}
+			return tx, nil
+		}}))
+	require.Equal(t, uint64(4), stats.Commits)
+	require.GreaterOrEqual(t, stats.CommitMax, slow)
+	require.Equal(t, []string{"[slow] etl: slow commit"}, warnings)
+
+	stats = &TransformStats{}
+	err = collect().LoadReverse(tx, kv.ChaindataTables[1], IdentityLoadFunc, TransformArgs{
+		Stats: stats, CommitEvery: 50, MaxCommitDuration: slow / 2, FailOnSlowCommit: true,
+		OnLoadCommit: func(kv.Putter, []byte, bool) error {
+			time.Sleep(slow)
+			return nil
+		}})
+	require.ErrorIs(t, err, ErrSlowCommit)
+	require.Equal(t, uint64(1), stats.Commits)
 }
 
-func compareBuckets(t *testing.T, db kv.Tx, b1, b2 string, startKey []byte) {
-	t.Helper()
-	b1Map := make(map[string]string)
-	err := db.ForEach(b1, startKey, func(k, v []byte) error {
-		b1Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+func TestDirectCopySortedIncompatibleOrder(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3] // not dup-sorted
+	generateTestData(t, tx, sourceBucket, 10)
+
+	reverse := func(k1, k2, _, _ []byte) int { return bytes.Compare(k2, k1) }
+	require.ErrorIs(t, DirectCopySorted(tx, sourceBucket, destBucket, TransformArgs{Comparator: reverse}), ErrIncompatibleOrder)
+	require.ErrorIs(t, DirectCopySorted(tx, kv.ChaindataTables[0], destBucket, TransformArgs{}), ErrIncompatibleOrder) // dup-sorted
+
+	require.NoError(t, tx.Put(destBucket, []byte(fmt.Sprintf("%10d", 5)), []byte("v"))) // Append is not possible
+	require.ErrorIs(t, DirectCopySorted(tx, sourceBucket, destBucket, TransformArgs{}), ErrIncompatibleOrder)
+}
+
+func TestTransformDeltaDryRun(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	for i := 0; i < 10; i++ {
+		require.NoError(t, tx.Put(sourceBucket, []byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, tx.Put(destBucket, []byte("k0"), []byte("v0")))    // unchanged
+	require.NoError(t, tx.Put(destBucket, []byte("k1"), []byte("old1")))  // overwritten
+	require.NoError(t, tx.Put(destBucket, []byte("k2"), []byte("vvvv2"))) // overwritten
+	var stats TransformStats
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, "", func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) },
+		IdentityLoadFunc, TransformArgs{DeltaDryRun: true, Stats: &stats})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7*4), stats.DeltaNewBytes)
+	assert.Equal(t, uint64(2*2), stats.DeltaOverwrittenBytes)
+	assert.Equal(t, uint64(2), stats.DeltaUnchangedBytes)
+
+	v, err := tx.GetOne(destBucket, []byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, "old1", string(v), "dry run doesn't write")
+	v, err = tx.GetOne(destBucket, []byte("k5"))
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
+
+func TestTransformReverseExtract(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 100)
+	startKey, endKey := []byte(fmt.Sprintf("%10d", 20)), []byte(fmt.Sprintf("%10d", 70))
+	var seen [][]byte
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(),
+		func(k, v []byte, next ExtractNextFunc) error {
+			seen = append(seen, common.Copy(k))
+			return next(k, k, v)
+		},
+		IdentityLoadFunc,
+		TransformArgs{ExtractStartKey: startKey, ExtractEndKey: endKey, Reverse: true, BufferSize: 1024},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 50, len(seen))
+	require.Equal(t, []byte(fmt.Sprintf("%10d-key-%010d", 69, 69)), seen[0])
+	require.Equal(t, []byte(fmt.Sprintf("%10d-key-%010d", 20, 20)), seen[49])
+	for i := 1; i < len(seen); i++ {
+		require.Equal(t, 1, bytes.Compare(seen[i-1], seen[i]))
+	}
+
+	// destination is sorted as after forward extract: Append of Load would fail otherwise
+	var loaded [][]byte
+	require.NoError(t, tx.ForEach(destBucket, nil, func(k, v []byte) error {
+		loaded = append(loaded, common.Copy(k))
 		return nil
-	})
-	assert.NoError(t, err)
-	b2Map := make(map[string]string)
-	err = db.ForEach(b2, nil, func(k, v []byte) error {
-		b2Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+	}))
+	require.Equal(t, 50, len(loaded))
+	for i := range loaded {
+		require.Equal(t, seen[len(seen)-1-i], loaded[i])
+	}
+
+	// without endKey: from last key of bucket
+	seen = seen[:0]
+	require.NoError(t, extractIntoFiles("logPrefix", tx, sourceBucket, NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize)),
+		func(k, v []byte, next ExtractNextFunc) error { seen = append(seen, common.Copy(k)); return nil },
+		TransformArgs{ExtractStartKey: []byte(fmt.Sprintf("%10d", 95)), Reverse: true}))
+	require.Equal(t, 5, len(seen))
+	require.Equal(t, []byte(fmt.Sprintf("%10d-key-%010d", 99, 99)), seen[0])
+
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, IdentityLoadFunc,
+		TransformArgs{Reverse: true, ExtractMaxPerPrefix: 1, ExtractPrefixLen: 1})
+	require.Error(t, err)
+}
+
+func TestTransformLogInterval(t *testing.T) {
+	defer func(h log.Handler) { log.Root().SetHandler(h) }(log.Root().GetHandler())
+	var mu sync.Mutex
+	progressLines := map[string]log.Lvl{}
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(r.Msg, "Extracting") || strings.Contains(r.Msg, "Loading") {
+			progressLines[r.Msg] = r.Lvl
+		}
 		return nil
-	})
-	assert.NoError(t, err)
-	assert.Equal(t, b1Map, b2Map)
+	}))
+
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 10)
+	slow := func(k, v []byte, next ExtractNextFunc) error {
+		time.Sleep(2 * time.Millisecond)
+		return next(k, k, v)
+	}
+	slowLoad := func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		time.Sleep(2 * time.Millisecond)
+		return next(k, k, v)
+	}
+	transform := func(args TransformArgs) map[string]log.Lvl {
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), slow, slowLoad, args))
+		mu.Lock()
+		defer mu.Unlock()
+		lines := progressLines
+		progressLines = map[string]log.Lvl{}
+		return lines
+	}
+	interval := func(d time.Duration) *time.Duration { return &d }
+	require.Equal(t, map[string]log.Lvl{"[logPrefix] ETL [1/2] Extracting": log.LvlDebug, "[logPrefix] ETL [2/2] Loading": log.LvlDebug},
+		transform(TransformArgs{LogInterval: interval(time.Millisecond), LogLevel: log.LvlDebug}))
+	require.Equal(t, map[string]log.Lvl{"[logPrefix] ETL [1/2] Extracting": log.LvlInfo, "[logPrefix] ETL [2/2] Loading": log.LvlInfo},
+		transform(TransformArgs{LogInterval: interval(time.Millisecond)}))
+	require.Empty(t, transform(TransformArgs{LogInterval: interval(0)}))
+	require.Empty(t, transform(TransformArgs{LogInterval: interval(-1)}))
+	require.Empty(t, transform(TransformArgs{})) // default interval is longer than transform
 }
 
-func compareBucketsDouble(t *testing.T, db kv.Tx, b1, b2 string) {
-	t.Helper()
-	b1Map := make(map[string]string)
-	err := db.ForEach(b1, nil, func(k, v []byte) error {
-		b1Map[fmt.Sprintf("%x", append(k, 0xAA))] = fmt.Sprintf("%x", append(v, 0xAA))
-		b1Map[fmt.Sprintf("%x", append(k, 0xBB))] = fmt.Sprintf("%x", append(v, 0xBB))
+func TestTransformLogUnified(t *testing.T) {
+	defer func(interval time.Duration, h log.Handler) {
+		logInterval = interval
+		log.Root().SetHandler(h)
+	}(logInterval, log.Root().GetHandler())
+	logInterval = time.Millisecond
+	var mu sync.Mutex
+	var lines []*log.Record
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, r)
 		return nil
-	})
-	assert.NoError(t, err)
-	b2Map := make(map[string]string)
-	err = db.ForEach(b2, nil, func(k, v []byte) error {
-		b2Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+	}))
+
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 10)
+	slow := func(k, v []byte, next ExtractNextFunc) error {
+		time.Sleep(2 * time.Millisecond)
+		return next(k, k, v)
+	}
+	slowLoad := func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		time.Sleep(2 * time.Millisecond)
+		return next(k, k, v)
+	}
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), slow, slowLoad, TransformArgs{LogUnified: true}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	stages := map[string]bool{}
+	for _, r := range lines {
+		require.NotContains(t, r.Msg, "Extracting")
+		require.NotContains(t, r.Msg, "Loading")
+		if r.Msg != "[logPrefix] ETL" {
+			continue
+		}
+		ctx := map[string]interface{}{}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			ctx[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		require.Equal(t, sourceBucket, ctx["from"])
+		require.Equal(t, destBucket, ctx["into"])
+		stage := ctx["stage"].(string)
+		stages[stage] = true
+		if stage == "done" {
+			require.Equal(t, "100.0%", ctx["progress"])
+		}
+	}
+	require.True(t, stages["1/2 extract"])
+	require.True(t, stages["2/2 load"])
+	require.True(t, stages["done"])
+}
+
+func TestTransformSmall(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 50)
+	// extract emits records out of order and several values of one key - order must be same as of general path
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		if err := next(k, k[len(k)-3:], v); err != nil {
+			return err
+		}
+		return next(k, k[:10], v[len(v)-2:])
+	}
+	var generalStats, smallStats TransformStats
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[3], t.TempDir(), extract, IdentityLoadFunc,
+		TransformArgs{Stats: &generalStats}))
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[4], "", extract, IdentityLoadFunc,
+		TransformArgs{Stats: &smallStats, SmallTransformThreshold: 100}))
+	compareBuckets(t, tx, kv.ChaindataTables[3], kv.ChaindataTables[4], nil)
+	require.Equal(t, uint64(100), smallStats.EntriesCollected)
+	require.Equal(t, generalStats.EntriesLoaded, smallStats.EntriesLoaded)
+
+	small, err := useSmallTransform(tx, sourceBucket, TransformArgs{SmallTransformThreshold: 50})
+	require.NoError(t, err)
+	require.False(t, small)
+	small, err = useSmallTransform(tx, sourceBucket, TransformArgs{SmallTransformThreshold: 51, Comparator: func(k1, k2, v1, v2 []byte) int { return bytes.Compare(k1, k2) }})
+	require.NoError(t, err)
+	require.False(t, small)
+}
+
+func BenchmarkTransformSmall(b *testing.B) {
+	sourceBucket := kv.ChaindataTables[1]
+	extract := func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) }
+	for _, threshold := range []int{0, 10} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			_, tx := memdb.NewTestTx(b) // tx is bound to goroutine of sub-benchmark
+			for i := 0; i < 8; i++ {
+				require.NoError(b, tx.Put(sourceBucket, []byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte("value")))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[3], "", extract, IdentityLoadFunc,
+					TransformArgs{SmallTransformThreshold: threshold}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformMulti(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	index, reverseIndex := kv.ChaindataTables[3], kv.ChaindataTables[4]
+	const n = 1000
+	generateTestData(t, tx, sourceBucket, n)
+	// index: k -> v, reverse index: v -> k. Small buffer: both buckets spill many files
+	err := TransformMulti("logPrefix", tx, sourceBucket, t.TempDir(),
+		func(k, v []byte, next MultiExtractNextFunc) error {
+			if err := next(index, k, v); err != nil {
+				return err
+			}
+			return next(reverseIndex, v, k)
+		},
+		map[string]LoadFunc{index: IdentityLoadFunc, reverseIndex: IdentityLoadFunc},
+		TransformArgs{BufferSize: 4 * 1024},
+	)
+	require.NoError(t, err)
+	compareBuckets(t, tx, sourceBucket, index, nil)
+	count := 0
+	require.NoError(t, tx.ForEach(reverseIndex, nil, func(k, v []byte) error {
+		expected, err := tx.GetOne(sourceBucket, v)
+		require.NoError(t, err)
+		require.Equal(t, expected, k)
+		count++
 		return nil
-	})
-	assert.NoError(t, err)
-	assert.Equal(t, b1Map, b2Map)
+	}))
+	require.Equal(t, n, count)
+
+	err = TransformMulti("logPrefix", tx, sourceBucket, t.TempDir(),
+		func(k, v []byte, next MultiExtractNextFunc) error { return next(kv.ChaindataTables[5], k, v) },
+		map[string]LoadFunc{index: IdentityLoadFunc}, TransformArgs{})
+	require.Error(t, err) // no LoadFunc
+}
+
+func TestBackfillWindows(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	const n, concurrency = 1000, 3
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		generateTestData(t, tx, sourceBucket, n)
+		return nil
+	}))
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%10d", i)) }
+	var windows [][2][]byte
+	for i := 0; i < n; i += 100 {
+		windows = append(windows, [2][]byte{key(i), key(i + 100)})
+	}
+	windows[0][0], windows[len(windows)-1][1] = nil, nil
+
+	var active, maxActive int32
+	var stats TransformStats
+	err := BackfillWindows(context.Background(), "logPrefix", db, sourceBucket, destBucket, t.TempDir(), windows, concurrency,
+		func(k, v []byte, next ExtractNextFunc) error {
+			cur := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for old := atomic.LoadInt32(&maxActive); cur > old && !atomic.CompareAndSwapInt32(&maxActive, old, cur); old = atomic.LoadInt32(&maxActive) {
+			}
+			time.Sleep(50 * time.Microsecond)
+			return next(k, k, v)
+		},
+		IdentityLoadFunc, TransformArgs{BufferSize: 3 * 8 * 1024, Stats: &stats})
+	require.NoError(t, err)
+	require.LessOrEqual(t, maxActive, int32(concurrency))
+	require.Greater(t, maxActive, int32(1))
+	require.Equal(t, uint64(n), stats.EntriesCollected)
+	require.Equal(t, uint64(n), stats.EntriesLoaded)
+	require.GreaterOrEqual(t, stats.FilesSpilled, len(windows))
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		compareBuckets(t, tx, sourceBucket, destBucket, nil)
+		return nil
+	}))
+
+	// first error cancels the rest
+	failed := errors.New("failed")
+	var extracted int32
+	err = BackfillWindows(context.Background(), "logPrefix", db, sourceBucket, kv.ChaindataTables[4], t.TempDir(), windows, concurrency,
+		func(k, v []byte, next ExtractNextFunc) error {
+			if atomic.AddInt32(&extracted, 1) == 150 {
+				return failed
+			}
+			time.Sleep(50 * time.Microsecond)
+			return next(k, k, v)
+		},
+		IdentityLoadFunc, TransformArgs{})
+	require.ErrorIs(t, err, failed)
+	require.Less(t, atomic.LoadInt32(&extracted), int32(n))
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		count := 0
+		require.NoError(t, tx.ForEach(kv.ChaindataTables[4], nil, func(k, v []byte) error { count++; return nil }))
+		require.Zero(t, count)
+		return nil
+	}))
+}
+
+func TestTransformCanonicalKey(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	for _, k := range []string{"KEY-AB", "Key-Cd", "key-ab", "key-ef"} {
+		require.NoError(t, tx.Put(sourceBucket, []byte(k), []byte(k)))
+	}
+	require.NoError(t, tx.Put(destBucket, []byte("key-zz"), []byte("existing")))
+	var found []byte
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(),
+		func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) },
+		func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+			if found == nil {
+				var err error
+				if found, err = table.Get([]byte("KEY-ZZ")); err != nil {
+					return err
+				}
+			}
+			return next(k, k, v)
+		},
+		TransformArgs{BufferType: SortableOldestAppearedBuffer, CanonicalKey: bytes.ToLower},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("existing"), found)
+	got := map[string]string{}
+	require.NoError(t, tx.ForEach(destBucket, nil, func(k, v []byte) error {
+		got[string(k)] = string(v)
+		return nil
+	}))
+	// "KEY-AB" and "key-ab" collapse into one key, oldest value wins
+	require.Equal(t, map[string]string{"key-ab": "KEY-AB", "key-cd": "Key-Cd", "key-ef": "key-ef", "key-zz": "existing"}, got)
+}
+
+type testCheckpoint struct {
+	saved map[string][]byte
+	saves []string
+}
+
+func (c *testCheckpoint) Save(stage string, key []byte) error {
+	if key == nil {
+		delete(c.saved, stage)
+	} else {
+		c.saved[stage] = common.Copy(key)
+	}
+	c.saves = append(c.saves, string(key))
+	return nil
+}
+
+func (c *testCheckpoint) Load(stage string) ([]byte, error) { return c.saved[stage], nil }
+
+func TestTransformCheckpoint(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 10)
+	key := func(i int) string { return fmt.Sprintf("%10d-key-%010d", i, i) }
+	checkpoint := &testCheckpoint{saved: map[string][]byte{}}
+	var extracted []string
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		extracted = append(extracted, string(k))
+		return next(k, k, v)
+	}
+
+	// each call is one batch - as after restart of node
+	for i := 0; i < 4; i++ {
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, "", extract, IdentityLoadFunc, TransformArgs{
+			Checkpoint:        checkpoint,
+			MaxExtractRecords: 3,
+		}))
+	}
+	require.Equal(t, []string{key(2), key(5), key(8), ""}, checkpoint.saves)
+	require.Empty(t, checkpoint.saved)
+	require.Len(t, extracted, 10) // nothing extracted twice
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+
+	// saved key was deleted from source: resume from next existing key
+	extracted = extracted[:0]
+	checkpoint.saved["stage"] = []byte(key(4))
+	require.NoError(t, tx.Delete(sourceBucket, []byte(key(4))))
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[4], "", extract, IdentityLoadFunc, TransformArgs{
+		Checkpoint:      checkpoint,
+		CheckpointStage: "stage",
+	}))
+	require.Equal(t, []string{key(5), key(6), key(7), key(8), key(9)}, extracted)
+	require.Empty(t, checkpoint.saved)
+
+	// DirectCopySorted saves checkpoint on each commit
+	checkpoint = &testCheckpoint{saved: map[string][]byte{sourceBucket: []byte(key(1))}}
+	var commits int
+	require.NoError(t, DirectCopySorted(tx, sourceBucket, kv.ChaindataTables[5], TransformArgs{
+		Checkpoint:   checkpoint,
+		CommitEvery:  3,
+		OnLoadCommit: func(kv.Putter, []byte, bool) error { commits++; return nil },
+	}))
+	require.Equal(t, []string{key(5), key(8), ""}, checkpoint.saves) // 2, 3, 5 (4 is deleted) | 6, 7, 8 | 9
+	require.Equal(t, 3, commits)
+	require.Empty(t, checkpoint.saved)
+}
+
+type uint64Codec struct{}
+
+func (uint64Codec) EncodeKey(k uint64) ([]byte, error) { return uint64Codec{}.EncodeValue(k) }
+func (uint64Codec) EncodeValue(v uint64) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b, nil
+}
+func (uint64Codec) DecodeKey(b []byte) (uint64, error) { return uint64Codec{}.DecodeValue(b) }
+func (uint64Codec) DecodeValue(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("expected 8 bytes, got %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func TestTypedTransform(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	codec := uint64Codec{}
+	for i := uint64(0); i < 100; i++ {
+		k, _ := codec.EncodeKey(i)
+		v, _ := codec.EncodeValue(i * 3)
+		require.NoError(t, tx.Put(sourceBucket, k, v))
+	}
+	k, _ := codec.EncodeKey(30)
+	require.NoError(t, tx.Put(destBucket, k, []byte{0, 0, 0, 0, 0, 0, 0, 7}))
+
+	// index: value -> key, added to existing value of destination
+	err := TypedTransform[uint64, uint64]("logPrefix", tx, sourceBucket, destBucket, "", codec,
+		func(k, v uint64, next TypedExtractNextFunc[uint64, uint64]) error { return next(v, k) },
+		func(k, v uint64, table TypedTableReader[uint64, uint64], next TypedLoadNextFunc[uint64, uint64]) error {
+			existing, _, err := table.Get(k)
+			if err != nil {
+				return err
+			}
+			return next(k, v+existing)
+		},
+		TransformArgs{},
+	)
+	require.NoError(t, err)
+	count := 0
+	require.NoError(t, tx.ForEach(destBucket, nil, func(k, v []byte) error {
+		tk, err := codec.DecodeKey(k)
+		require.NoError(t, err)
+		tv, err := codec.DecodeValue(v)
+		require.NoError(t, err)
+		expected := tk / 3
+		if tk == 30 {
+			expected += 7
+		}
+		require.Equal(t, expected, tv, tk)
+		count++
+		return nil
+	}))
+	require.Equal(t, 100, count)
+
+	// source record which codec can't decode
+	require.NoError(t, tx.Put(sourceBucket, []byte("short"), []byte("v")))
+	err = TypedTransform[uint64, uint64]("logPrefix", tx, sourceBucket, kv.ChaindataTables[4], "", codec,
+		func(k, v uint64, next TypedExtractNextFunc[uint64, uint64]) error { return next(k, v) },
+		func(k, v uint64, _ TypedTableReader[uint64, uint64], next TypedLoadNextFunc[uint64, uint64]) error {
+			return next(k, v)
+		},
+		TransformArgs{},
+	)
+	require.ErrorContains(t, err, "expected 8 bytes")
+}
+
+// countingBuffer - custom buffer type of TestRegisterBuffer
+type countingBuffer struct {
+	Buffer
+	puts *int
+}
+
+func (b countingBuffer) Put(k, v []byte) {
+	*b.puts++
+	b.Buffer.Put(k, v)
+}
+
+var countingBufferPuts int
+var countingBufferType = RegisterBuffer("test-counting", func(size datasize.ByteSize) Buffer {
+	return countingBuffer{Buffer: NewSortableBuffer(size), puts: &countingBufferPuts}
+})
+
+func TestRegisterBuffer(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 100)
+	for i, args := range []TransformArgs{{BufferName: "test-counting"}, {BufferType: countingBufferType}} {
+		countingBufferPuts = 0
+		destBucket := kv.ChaindataTables[3+i]
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc, args))
+		require.Equal(t, 100, countingBufferPuts)
+		compareBuckets(t, tx, sourceBucket, destBucket, nil)
+	}
+	// built-in types have names
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[5], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{BufferName: "oldest"}))
+	compareBuckets(t, tx, sourceBucket, kv.ChaindataTables[5], nil)
+
+	require.Panics(t, func() { RegisterBuffer("slice", func(datasize.ByteSize) Buffer { return nil }) })
+	err := Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[5], "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{BufferName: "no-such"})
+	require.ErrorIs(t, err, ErrUnknownBufferName)
+	err = Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[5], "", testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{BufferName: "no-such", SmallTransformThreshold: 1000})
+	require.ErrorIs(t, err, ErrUnknownBufferName)
+	err = Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[5], "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{BufferType: SortableTopNBuffer})
+	require.ErrorIs(t, err, ErrTopNBufferType)
+	require.Error(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[5], "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{BufferType: 1 << 20}))
+}
+
+type recordingMetrics struct {
+	lock            sync.Mutex
+	extracted       uint64
+	loaded          uint64
+	extractObserved int
+	loadObserved    int
+	spilled         int
+	batches         []int
+}
+
+func (m *recordingMetrics) ObserveExtractDuration(_ string, _ time.Duration, records uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.extracted, m.extractObserved = records, m.extractObserved+1
+}
+
+func (m *recordingMetrics) ObserveLoadDuration(_ string, _ time.Duration, records uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.loaded, m.loadObserved = records, m.loadObserved+1
+}
+
+func (m *recordingMetrics) IncSpilledFiles(string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.spilled++
+}
+
+func (m *recordingMetrics) ObserveBatchSize(_ string, records int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.batches = append(m.batches, records)
+}
+
+func TestTransformMetrics(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 1000)
+	m := &recordingMetrics{}
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{BufferSize: 16 * 1024, Metrics: m}))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+	require.Equal(t, 1, m.extractObserved)
+	require.Equal(t, 1, m.loadObserved)
+	require.Equal(t, uint64(1000), m.extracted)
+	require.Equal(t, uint64(1000), m.loaded)
+	require.Greater(t, m.spilled, 1)
+	require.Equal(t, m.spilled, len(m.batches))
+	total := 0
+	for _, n := range m.batches {
+		total += n
+	}
+	require.Equal(t, 1000, total)
+
+	// without Metrics
+	_, tx = memdb.NewTestTx(t)
+	generateTestData(t, tx, sourceBucket, 10)
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{}))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+}
+
+func TestExtractBucketsMerged(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	accounts, storage := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	for _, k := range []string{"a1", "a3", "a5", "a7"} {
+		require.NoError(t, tx.Put(accounts, []byte(k), []byte("acc")))
+	}
+	for _, k := range []string{"a0", "a3", "a4", "a7", "a9"} {
+		require.NoError(t, tx.Put(storage, []byte(k), []byte("st")))
+	}
+	collect := func(buckets []string, from, to []byte) (got []string) {
+		require.NoError(t, ExtractBucketsMerged(tx, buckets, from, to, func(bucket string, k, v []byte) error {
+			got = append(got, bucket+":"+string(k)+"="+string(v))
+			return nil
+		}, nil))
+		return got
+	}
+	require.Equal(t, []string{
+		storage + ":a0=st", accounts + ":a1=acc", accounts + ":a3=acc", storage + ":a3=st", storage + ":a4=st",
+		accounts + ":a5=acc", accounts + ":a7=acc", storage + ":a7=st", storage + ":a9=st",
+	}, collect([]string{accounts, storage}, nil, nil))
+	// identical keys follow order of buckets
+	require.Equal(t, []string{
+		storage + ":a3=st", accounts + ":a3=acc", storage + ":a4=st", accounts + ":a5=acc",
+	}, collect([]string{storage, accounts}, []byte("a2"), []byte("a7")))
+
+	require.Error(t, ExtractBucketsMerged(tx, []string{accounts, accounts}, nil, nil, func(string, []byte, []byte) error { return nil }, nil))
+	errStop := errors.New("stop")
+	calls := 0
+	require.ErrorIs(t, ExtractBucketsMerged(tx, []string{accounts, storage}, nil, nil, func(string, []byte, []byte) error {
+		calls++
+		return errStop
+	}, nil), errStop)
+	require.Equal(t, 1, calls)
+}
+
+func TestTransformWithProgress(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 100)
+	lastKey, err := TransformWithProgress("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{ExtractEndKey: []byte(fmt.Sprintf("%10d-key-%010d", 50, 0))})
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%10d-key-%010d", 49, 49), string(lastKey))
+
+	// next run starts after it
+	start, err := NextKey(lastKey)
+	require.NoError(t, err)
+	lastKey, err = TransformWithProgress("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{ExtractStartKey: start})
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%10d-key-%010d", 99, 99), string(lastKey))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+
+	// nothing loaded
+	lastKey, err = TransformWithProgress("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{ExtractStartKey: []byte{0xFF}})
+	require.NoError(t, err)
+	require.Nil(t, lastKey)
+}
+
+func TestTransformExtractFilter(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 100)
+	var filtered, extracted int
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), func(k, v []byte, next ExtractNextFunc) error {
+		extracted++
+		return next(k, k, v)
+	}, IdentityLoadFunc, TransformArgs{
+		MaxExtractRecords: 5,
+		ExtractFilter: func(k []byte) bool {
+			filtered++
+			return bytes.HasSuffix(k, []byte("0"))
+		},
+	}))
+	require.Equal(t, 5, extracted)
+	require.Equal(t, 51, filtered) // keys 0..50: extract stops at 6th accepted key
+	var loaded []string
+	require.NoError(t, tx.ForEach(destBucket, nil, func(k, _ []byte) error {
+		loaded = append(loaded, string(k))
+		return nil
+	}))
+	require.Equal(t, []string{
+		fmt.Sprintf("%10d-key-%010d", 0, 0), fmt.Sprintf("%10d-key-%010d", 10, 10), fmt.Sprintf("%10d-key-%010d", 20, 20),
+		fmt.Sprintf("%10d-key-%010d", 30, 30), fmt.Sprintf("%10d-key-%010d", 40, 40),
+	}, loaded)
+}
+
+func TestTransformNoTempFiles(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket, destBucket := kv.ChaindataTables[1], kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 100)
+	tmpdir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(tmpdir, nil, 0600)) // any spill would fail: tmpdir is not a directory
+
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, tmpdir, testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{NoTempFiles: true}))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+
+	err := Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[4], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{NoTempFiles: true, BufferSize: 1024})
+	require.ErrorIs(t, err, ErrTempFilesDisabled)
+	c, err := tx.Cursor(kv.ChaindataTables[4])
+	require.NoError(t, err)
+	defer c.Close()
+	count, err := c.Count()
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestTransformKeepTempOnError(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 1000)
+	errLoad := errors.New("load failed")
+	transform := func(keep bool, failAt int) (string, error) {
+		tmpdir := t.TempDir()
+		loaded := 0
+		err := Transform("logPrefix", tx, sourceBucket, destBucket, tmpdir, testExtractToMapFunc,
+			func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+				if loaded++; loaded == failAt {
+					return errLoad
+				}
+				return testLoadFromMapFunc(k, v, table, next)
+			}, TransformArgs{BufferSize: 16 * 1024, KeepTempOnError: keep})
+		return tmpdir, err
+	}
+	files := func(dir string) int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	dir, err := transform(true, 500)
+	require.ErrorIs(t, err, errLoad)
+	require.Greater(t, files(dir), 1)
+	// kept files are spill files of collector
+	c, err := NewCollectorFromFiles("logPrefix", dir)
+	require.NoError(t, err)
+	it, err := c.Iter(TransformArgs{})
+	require.NoError(t, err)
+	records := 0
+	for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+		records++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 1000, records)
+	c.Close()
+
+	dir, err = transform(false, 500)
+	require.ErrorIs(t, err, errLoad)
+	require.Zero(t, files(dir))
+	dir, err = transform(true, -1)
+	require.NoError(t, err)
+	require.Zero(t, files(dir))
+}
+
+type closeCountingCursor struct {
+	kv.Cursor
+	closed  int
+	nextErr error
+}
+
+func (c *closeCountingCursor) Next() ([]byte, []byte, error) {
+	if c.nextErr != nil {
+		return nil, nil, c.nextErr
+	}
+	return c.Cursor.Next()
+}
+
+func (c *closeCountingCursor) Close() { c.closed++; c.Cursor.Close() }
+
+func TestPairs(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	cursor := func() *closeCountingCursor {
+		c, err := tx.Cursor(sourceBucket)
+		require.NoError(t, err)
+		return &closeCountingCursor{Cursor: c}
+	}
+	collect := func(seq func(yield func(k, v []byte) bool), limit int) (keys []string) {
+		seq(func(k, v []byte) bool {
+			keys = append(keys, string(k[:10]))
+			return len(keys) < limit
+		})
+		return keys
+	}
+
+	c := cursor()
+	require.Equal(t, []string{fmt.Sprintf("%10d", 3), fmt.Sprintf("%10d", 4), fmt.Sprintf("%10d", 5)},
+		collect(Pairs(c, []byte(fmt.Sprintf("%10d", 3)), []byte(fmt.Sprintf("%10d", 6))), 100))
+	require.Equal(t, 1, c.closed)
+
+	c = cursor()
+	require.Equal(t, 10, len(collect(Pairs(c, nil, nil), 100)))
+	require.Equal(t, 1, c.closed)
+
+	// abandoned early
+	c = cursor()
+	require.Equal(t, 2, len(collect(Pairs(c, nil, nil), 2)))
+	require.Equal(t, 1, c.closed)
+
+	c = cursor()
+	c.nextErr = errors.New("cursor failed")
+	seq, errFn := PairsErr(c, nil, nil)
+	require.Equal(t, 1, len(collect(seq, 100)))
+	require.ErrorIs(t, errFn(), c.nextErr)
+	require.Equal(t, 1, c.closed)
+}
+
+func TestTransformWithPrefix(t *testing.T) {
+	args := TransformArgs{BufferSize: 1024}.WithPrefix(decodeHex("01FF"))
+	assert.Equal(t, decodeHex("01FF"), args.ExtractStartKey)
+	assert.Equal(t, decodeHex("02"), args.ExtractEndKey)
+	assert.Equal(t, 1024, args.BufferSize)
+	args = args.WithPrefix(decodeHex("FFFF"))
+	assert.Equal(t, decodeHex("FFFF"), args.ExtractStartKey)
+	assert.Nil(t, args.ExtractEndKey)
+
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 100)
+	for _, k := range [][]byte{decodeHex("FFFF"), decodeHex("FFFF00"), decodeHex("FFFE01")} {
+		require.NoError(t, tx.Put(sourceBucket, k, k))
+	}
+	transform := func(prefix []byte) (keys [][]byte) {
+		require.NoError(t, tx.ClearBucket(destBucket))
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+			TransformArgs{}.WithPrefix(prefix)))
+		require.NoError(t, tx.ForEach(destBucket, nil, func(k, _ []byte) error {
+			keys = append(keys, common.Copy(k))
+			return nil
+		}))
+		return keys
+	}
+	keys := transform([]byte(fmt.Sprintf("%9d", 4)))
+	require.Equal(t, 10, len(keys))
+	require.Equal(t, []byte(fmt.Sprintf("%10d-key-%010d", 40, 40)), keys[0])
+	require.Equal(t, []byte(fmt.Sprintf("%10d-key-%010d", 49, 49)), keys[9])
+	require.Equal(t, [][]byte{decodeHex("FFFF"), decodeHex("FFFF00")}, transform(decodeHex("FFFF")))
+	require.Equal(t, 103, len(transform(nil)))
+}
+
+func TestTransformExtractWorkers(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 3000)
+	// equal keys from all over source: order of their values after merge is order of extraction
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		var i, j int
+		if _, err := fmt.Sscanf(string(k), "%10d-key-%010d", &i, &j); err != nil {
+			return err
+		}
+		return next(k, []byte(fmt.Sprintf("key-%03d", i%97)), v)
+	}
+	transform := func(args TransformArgs) (loaded []string) {
+		args.BufferSize = 8 * 1024
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract,
+			func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+				loaded = append(loaded, string(k)+" "+string(v))
+				return nil
+			}, args))
+		return loaded
+	}
+	single := transform(TransformArgs{})
+	require.Equal(t, 3000, len(single))
+	ranges, err := splitExtractRange(tx, sourceBucket, TransformArgs{ExtractWorkers: 4})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(ranges))
+	require.Equal(t, single, transform(TransformArgs{ExtractWorkers: 4}))
+	require.Equal(t, single, transform(TransformArgs{ExtractWorkers: 3, ExtractSplitPoints: [][]byte{
+		[]byte(fmt.Sprintf("%10d", 10)), []byte(fmt.Sprintf("%10d", 2000))}}))
+	bounded := transform(TransformArgs{ExtractStartKey: []byte(fmt.Sprintf("%10d", 100)), ExtractEndKey: []byte(fmt.Sprintf("%10d", 2500))})
+	require.Equal(t, 2400, len(bounded))
+	require.Equal(t, bounded, transform(TransformArgs{ExtractWorkers: 8,
+		ExtractStartKey: []byte(fmt.Sprintf("%10d", 100)), ExtractEndKey: []byte(fmt.Sprintf("%10d", 2500))}))
+
+	errExtract := errors.New("extract failed")
+	tmpdir := t.TempDir()
+	var calls int32
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, tmpdir, func(k, v []byte, next ExtractNextFunc) error {
+		if atomic.AddInt32(&calls, 1) == 1500 {
+			return errExtract
+		}
+		return next(k, k, v)
+	}, IdentityLoadFunc, TransformArgs{ExtractWorkers: 4, BufferSize: 8 * 1024})
+	require.ErrorIs(t, err, errExtract)
+	entries, err := os.ReadDir(tmpdir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	for _, args := range []TransformArgs{
+		{ExtractWorkers: 2, ExtractSplitPoints: [][]byte{[]byte(fmt.Sprintf("%10d", 20)), []byte(fmt.Sprintf("%10d", 10))}},
+		{ExtractWorkers: 2, ExtractEndKey: []byte(fmt.Sprintf("%10d", 20)), ExtractSplitPoints: [][]byte{[]byte(fmt.Sprintf("%10d", 30))}},
+		{ExtractWorkers: 2, Reverse: true},
+		{ExtractWorkers: 2, BufferType: SortableAppendBuffer},
+	} {
+		require.Error(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract, IdentityLoadFunc, args))
+	}
+}
+
+func TestTransformKeyDecoder(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[1]
+	destBucket := kv.ChaindataTables[3]
+	generateTestData(t, tx, sourceBucket, 3000)
+	// unpadded decimal keys: bytewise "10" < "9", decoded order is numeric
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		var i, j int
+		if _, err := fmt.Sscanf(string(k), "%10d-key-%010d", &i, &j); err != nil {
+			return err
+		}
+		return next(k, []byte(fmt.Sprintf("%d", 3000-i)), v)
+	}
+	decode := func(k, _ []byte) interface{} {
+		var n int
+		_, _ = fmt.Sscanf(string(k), "%d", &n)
+		return n
+	}
+	cmp := func(a, b interface{}) int { return a.(int) - b.(int) }
+	var loaded []int
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract,
+		func(k, _ []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+			loaded = append(loaded, decode(k, nil).(int))
+			return nil
+		}, TransformArgs{BufferSize: 8 * 1024, KeyDecoder: decode, DecodedComparator: cmp}))
+	require.Equal(t, 3000, len(loaded))
+	for i, n := range loaded {
+		require.Equal(t, i+1, n)
+	}
+
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract, IdentityLoadFunc,
+		TransformArgs{BufferSize: 8 * 1024, KeyDecoder: decode})
+	require.ErrorIs(t, err, ErrKeyDecoderComparator)
+	// runs sorted by Comparator can't be merged by DecodedComparator
+	bytewise := func(k1, k2, _, _ []byte) int { return bytes.Compare(k1, k2) }
+	err = Transform("logPrefix", tx, sourceBucket, destBucket, t.TempDir(), extract, IdentityLoadFunc,
+		TransformArgs{BufferSize: 8 * 1024, KeyDecoder: decode, DecodedComparator: cmp, Comparator: bytewise})
+	require.ErrorIs(t, err, ErrComparatorAndKeyDecoder)
+	c := NewCollector(t.Name(), t.TempDir(), NewSortableBuffer(BufferOptimalSize))
+	defer c.Close()
+	require.NoError(t, c.Collect([]byte("1"), nil))
+	err = c.Load(nil, "", IdentityLoadFunc, TransformArgs{KeyDecoder: decode, DecodedComparator: cmp, Comparator: bytewise})
+	require.ErrorIs(t, err, ErrComparatorAndKeyDecoder)
+}
+
+func TestTransformDoubleOnExtract(t *testing.T) {
+	// test invariant when extractFunc multiplies the data 2x
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		testExtractDoubleToMapFunc,
+		testLoadFromMapFunc,
+		TransformArgs{},
+	)
+	assert.Nil(t, err)
+	compareBucketsDouble(t, tx, sourceBucket, destBucket)
+}
+
+func TestTransformDoubleOnLoad(t *testing.T) {
+	// test invariant when loadFunc multiplies the data 2x
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		testExtractToMapFunc,
+		testLoadFromMapDoubleFunc,
+		TransformArgs{},
+	)
+	assert.Nil(t, err)
+	compareBucketsDouble(t, tx, sourceBucket, destBucket)
+}
+
+func generateTestData(t *testing.T, db kv.Putter, bucket string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		k := []byte(fmt.Sprintf("%10d-key-%010d", i, i))
+		v := []byte(fmt.Sprintf("val-%099d", i))
+		err := db.Put(bucket, k, v)
+		assert.NoError(t, err)
+	}
+}
+
+func testExtractToMapFunc(k, v []byte, next ExtractNextFunc) error {
+	valueMap := make(map[string][]byte)
+	valueMap["value"] = v
+	out, _ := json.Marshal(valueMap)
+	return next(k, k, out)
+}
+
+func testExtractDoubleToMapFunc(k, v []byte, next ExtractNextFunc) error {
+	valueMap := make(map[string][]byte)
+	valueMap["value"] = append(v, 0xAA)
+	k1 := append(k, 0xAA)
+	out, _ := json.Marshal(valueMap)
+
+	err := next(k, k1, out)
+	if err != nil {
+		return err
+	}
+
+	valueMap = make(map[string][]byte)
+	valueMap["value"] = append(v, 0xBB)
+	k2 := append(k, 0xBB)
+	out, _ = json.Marshal(valueMap)
+	return next(k, k2, out)
+}
+
+func testLoadFromMapFunc(k []byte, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+	valueMap := make(map[string][]byte)
+	err := json.Unmarshal(v, &valueMap)
+	if err != nil {
+		return err
+	}
+	realValue := valueMap["value"]
+	return next(k, k, realValue)
+}
+
+func testLoadFromMapDoubleFunc(k []byte, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+	valueMap := make(map[string][]byte)
+	err := json.Unmarshal(v, &valueMap)
+	if err != nil {
+		return err
+	}
+	realValue := valueMap["value"]
+
+	err = next(k, append(k, 0xAA), append(realValue, 0xAA))
+	if err != nil {
+		return err
+	}
+	return next(k, append(k, 0xBB), append(realValue, 0xBB))
+}
+
+func compareBuckets(t *testing.T, db kv.Tx, b1, b2 string, startKey []byte) {
+	t.Helper()
+	b1Map := make(map[string]string)
+	err := db.ForEach(b1, startKey, func(k, v []byte) error {
+		b1Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+		return nil
+	})
+	assert.NoError(t, err)
+	b2Map := make(map[string]string)
+	err = db.ForEach(b2, nil, func(k, v []byte) error {
+		b2Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, b1Map, b2Map)
+}
+
+func compareBucketsDouble(t *testing.T, db kv.Tx, b1, b2 string) {
+	t.Helper()
+	b1Map := make(map[string]string)
+	err := db.ForEach(b1, nil, func(k, v []byte) error {
+		b1Map[fmt.Sprintf("%x", append(k, 0xAA))] = fmt.Sprintf("%x", append(v, 0xAA))
+		b1Map[fmt.Sprintf("%x", append(k, 0xBB))] = fmt.Sprintf("%x", append(v, 0xBB))
+		return nil
+	})
+	assert.NoError(t, err)
+	b2Map := make(map[string]string)
+	err = db.ForEach(b2, nil, func(k, v []byte) error {
+		b2Map[fmt.Sprintf("%x", k)] = fmt.Sprintf("%x", v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, b1Map, b2Map)
+}
+
+func TestExtractBucketsProvenance(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	b1, b2 := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	generateTestData(t, tx, b1, 5)
+	generateTestData(t, tx, b2, 3)
+
+	collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	defer collector.Close()
+	collector.WithProvenance(true)
+	extractFunc := func(k, v []byte, next ExtractNextFunc) error {
+		return next(k, k, v)
+	}
+	// both buckets have same keys: stable sort keeps records of b1 before b2
+	err := ExtractBuckets("logPrefix", tx, []string{b1, b2}, collector, extractFunc, TransformArgs{})
+	assert.NoError(t, err)
+
+	got := map[string][]uint64{}
+	err = collector.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		p, val, err := SplitProvenance(v)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, []byte(fmt.Sprintf("val-%099d", p.Offset)), val)
+		got[p.Bucket] = append(got[p.Bucket], p.Offset)
+		return nil
+	}, TransformArgs{})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4}, got[b1])
+	assert.Equal(t, []uint64{0, 1, 2}, got[b2])
+}
+
+func TestVerifyTransform(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	err := Transform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{})
+	require.NoError(t, err)
+
+	err = VerifyTransform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{BufferSize: 1})
+	require.NoError(t, err)
+
+	corruptedKey := []byte(fmt.Sprintf("%10d-key-%010d", 5, 5))
+	require.NoError(t, tx.Put(destBucket, corruptedKey, []byte("corrupted")))
+	err = VerifyTransform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{})
+	var mismatch *MismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, corruptedKey, mismatch.Key)
+	assert.Equal(t, []byte("corrupted"), mismatch.Actual)
+	assert.Equal(t, []byte(fmt.Sprintf("val-%099d", 5)), mismatch.Expected)
+
+	require.NoError(t, tx.Delete(destBucket, corruptedKey))
+	err = VerifyTransform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{})
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, corruptedKey, mismatch.Key)
+	assert.Nil(t, mismatch.Actual)
+
+	require.NoError(t, tx.Put(destBucket, corruptedKey, []byte(fmt.Sprintf("val-%099d", 5))))
+	require.NoError(t, tx.Put(destBucket, []byte("extra"), []byte("v")))
+	err = VerifyTransform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{})
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, []byte("extra"), mismatch.Key)
+	assert.Nil(t, mismatch.Expected)
+}
+
+func TestTransformWAL(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	var wal bytes.Buffer
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		testExtractToMapFunc,
+		testLoadFromMapFunc,
+		TransformArgs{WALWriter: &wal},
+	)
+	require.NoError(t, err)
+	require.NotZero(t, wal.Len())
+
+	// replay into fresh DB
+	_, replayTx := memdb.NewTestTx(t)
+	require.NoError(t, LoadFromWAL("logPrefix", bytes.NewReader(wal.Bytes()), replayTx, destBucket, TransformArgs{}))
+	generateTestData(t, replayTx, sourceBucket, 10)
+	compareBuckets(t, replayTx, sourceBucket, destBucket, nil)
+
+	// corrupted WAL must not be applied silently
+	corrupted := append([]byte{0x7f}, wal.Bytes()...)
+	_, replayTx = memdb.NewTestTx(t)
+	require.Error(t, LoadFromWAL("logPrefix", bytes.NewReader(corrupted), replayTx, destBucket, TransformArgs{}))
+}
+
+func TestLoadFromWALResume(t *testing.T) {
+	destBucket := kv.ChaindataTables[1]
+	var wal bytes.Buffer
+	var batchEnds []int
+	_, tx := memdb.NewTestTx(t)
+	for _, batch := range [][][2]string{
+		{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+		{{"b", ""}}, // delete
+		{{"b", "4"}, {"d", "5"}},
+	} {
+		collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+		for _, r := range batch {
+			require.NoError(t, collector.Collect([]byte(r[0]), []byte(r[1])))
+		}
+		require.NoError(t, collector.Load(tx, destBucket, IdentityLoadFunc, TransformArgs{WALWriter: &wal}))
+		batchEnds = append(batchEnds, wal.Len())
+	}
+
+	// replay is interrupted in the middle of batch 3
+	errInterrupted := errors.New("interrupted")
+	_, replayTx := memdb.NewTestTx(t)
+	interrupted := io.MultiReader(bytes.NewReader(wal.Bytes()[:batchEnds[1]+3]), iotest.ErrReader(errInterrupted))
+	require.ErrorIs(t, LoadFromWAL("logPrefix", interrupted, replayTx, destBucket, TransformArgs{}), errInterrupted)
+	marker, err := replayTx.GetOne(kv.DatabaseInfo, walAppliedKey(destBucket))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), binary.BigEndian.Uint64(marker))
+
+	// resume applies only batch 3
+	var loaded uint64
+	require.NoError(t, LoadFromWAL("logPrefix", bytes.NewReader(wal.Bytes()), replayTx, destBucket, TransformArgs{
+		LoadProgress: func(loadedKeys, _ uint64) { loaded = loadedKeys },
+	}))
+	require.Equal(t, uint64(2), loaded)
+	got := map[string]string{}
+	require.NoError(t, replayTx.ForEach(destBucket, nil, func(k, v []byte) error {
+		got[string(k)] = string(v)
+		return nil
+	}))
+	require.Equal(t, map[string]string{"a": "1", "b": "4", "c": "3", "d": "5"}, got)
+	marker, err = replayTx.GetOne(kv.DatabaseInfo, walAppliedKey(destBucket))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+
+	// marker from longer WAL
+	require.NoError(t, replayTx.Put(kv.DatabaseInfo, walAppliedKey(destBucket), []byte{0, 0, 0, 0, 0, 0, 0, 4}))
+	require.Error(t, LoadFromWAL("logPrefix", bytes.NewReader(wal.Bytes()), replayTx, destBucket, TransformArgs{}))
+
+	// writer crashed in batch 3: it's not committed and is discarded, truncated record included
+	const recordLen = 1 + 1 + len("b") + 1 + len("4")
+	for name, size := range map[string]int{
+		"between records": batchEnds[1] + recordLen,
+		"in record":       batchEnds[1] + 3,
+		"in end marker":   batchEnds[2] - 1,
+	} {
+		_, replayTx := memdb.NewTestTx(t)
+		require.NoError(t, LoadFromWAL("logPrefix", bytes.NewReader(wal.Bytes()[:size]), replayTx, destBucket, TransformArgs{}), name)
+		got := map[string]string{}
+		require.NoError(t, replayTx.ForEach(destBucket, nil, func(k, v []byte) error {
+			got[string(k)] = string(v)
+			return nil
+		}))
+		require.Equal(t, map[string]string{"a": "1", "c": "3"}, got, name)
+	}
+}
+
+func TestTransformWantKeysBloom(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	const n = 10_000
+	generateTestData(t, tx, sourceBucket, n)
+	wanted := map[string]struct{}{}
+	bloom := NewBloom(n/10, 0.01)
+	for i := 0; i < n; i += 10 {
+		k := []byte(fmt.Sprintf("%10d-key-%010d", i, i))
+		wanted[string(k)] = struct{}{}
+		bloom.Add(k)
+	}
+	transform := func(bucket string, args TransformArgs) map[string]struct{} {
+		args.WantKeysBloom = bloom
+		require.NoError(t, Transform("logPrefix", tx, sourceBucket, bucket, "", func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) }, IdentityLoadFunc, args))
+		loaded := map[string]struct{}{}
+		require.NoError(t, tx.ForEach(bucket, nil, func(k, _ []byte) error {
+			loaded[string(k)] = struct{}{}
+			return nil
+		}))
+		return loaded
+	}
+
+	loaded := transform(destBucket, TransformArgs{})
+	for k := range wanted {
+		assert.Contains(t, loaded, k)
+	}
+	assert.Less(t, len(loaded)-len(wanted), n/20, "too many false positives")
+
+	exact := transform(kv.ChaindataTables[2], TransformArgs{WantKeysExact: func(k []byte) bool {
+		_, ok := wanted[string(k)]
+		return ok
+	}})
+	assert.Equal(t, wanted, exact)
+}
+
+type mapSeenSet map[string]struct{}
+
+func (s mapSeenSet) Has(k []byte) (bool, error) { _, ok := s[string(k)]; return ok, nil }
+func (s mapSeenSet) Add(k []byte) error         { s[string(k)] = struct{}{}; return nil }
+
+func TestTransformSeenSet(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	firstBucket, secondBucket := kv.ChaindataTables[1], kv.ChaindataTables[2]
+	generateTestData(t, tx, sourceBucket, 10)
+	seen := mapSeenSet{}
+	identity := func(k, v []byte, next ExtractNextFunc) error { return next(k, k, v) }
+	count := func(bucket string) (n int) {
+		require.NoError(t, tx.ForEach(bucket, nil, func(_, _ []byte) error { n++; return nil }))
+		return n
+	}
+
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, firstBucket, "", identity, IdentityLoadFunc, TransformArgs{SeenSet: seen}))
+	require.Equal(t, 10, count(firstBucket))
+	require.Equal(t, 10, len(seen))
+
+	for i := 10; i < 15; i++ { // new data of incremental run
+		require.NoError(t, tx.Put(sourceBucket, []byte(fmt.Sprintf("%10d-key-%010d", i, i)), []byte("new")))
+	}
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, secondBucket, "", identity, IdentityLoadFunc, TransformArgs{SeenSet: seen}))
+	require.Equal(t, 5, count(secondBucket))
+	require.NoError(t, tx.ForEach(secondBucket, nil, func(_, v []byte) error {
+		require.Equal(t, "new", string(v))
+		return nil
+	}))
+	require.Equal(t, 15, len(seen))
+}
+
+func TestTransformStatsGC(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 100)
+	stats := &TransformStats{}
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		func(k, v []byte, next ExtractNextFunc) error {
+			runtime.GC() // make sure at least 1 cycle happens during transform
+			return next(k, k, v)
+		},
+		IdentityLoadFunc,
+		TransformArgs{Stats: stats},
+	)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stats.GCCountDelta, uint32(100))
+	assert.Greater(t, stats.GCPauseDelta, time.Duration(0))
+	assert.Less(t, stats.GCPauseDelta, time.Minute)
+}
+
+// highLatencyTx - emulates remote kv: each cursor call is a round-trip
+type highLatencyTx struct {
+	kv.Tx
+	roundTrips int
+}
+
+func (tx *highLatencyTx) Cursor(bucket string) (kv.Cursor, error) {
+	c, err := tx.Tx.Cursor(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &highLatencyCursor{Cursor: c, tx: tx}, nil
+}
+
+type highLatencyCursor struct {
+	kv.Cursor
+	tx *highLatencyTx
+}
+
+func (c *highLatencyCursor) roundTrip() {
+	c.tx.roundTrips++
+	time.Sleep(100 * time.Microsecond)
+}
+
+func (c *highLatencyCursor) Next() ([]byte, []byte, error) {
+	c.roundTrip()
+	return c.Cursor.Next()
+}
+
+func (c *highLatencyCursor) batch(k, v []byte, err error, limit int) (keys, vals [][]byte, _ error) {
+	for ; k != nil && err == nil && len(keys) < limit; k, v, err = c.Cursor.Next() {
+		keys, vals = append(keys, k), append(vals, v)
+	}
+	if len(keys) == limit && err == nil {
+		_, _, err = c.Cursor.Prev() // NextBatch continues after last returned record
+	}
+	return keys, vals, err
+}
+
+func (c *highLatencyCursor) SeekBatch(seek []byte, limit int) ([][]byte, [][]byte, error) {
+	c.roundTrip()
+	k, v, err := c.Cursor.Seek(seek)
+	return c.batch(k, v, err, limit)
+}
+
+func (c *highLatencyCursor) NextBatch(limit int) ([][]byte, [][]byte, error) {
+	c.roundTrip()
+	k, v, err := c.Cursor.Next()
+	return c.batch(k, v, err, limit)
+}
+
+func TestTransformComparatorCalls(t *testing.T) {
+	calls := func(n int) uint64 {
+		_, tx := memdb.NewTestTx(t)
+		sourceBucket := kv.ChaindataTables[0]
+		generateTestData(t, tx, sourceBucket, n)
+		var stats TransformStats
+		err := Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[1], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+			TransformArgs{
+				Comparator:           func(k1, k2, _, _ []byte) int { return bytes.Compare(k1, k2) },
+				CountComparatorCalls: true,
+				Stats:                &stats,
+				BufferSize:           64 * 1024, // sort and merge both
+			})
+		require.NoError(t, err)
+		compareBuckets(t, tx, sourceBucket, kv.ChaindataTables[1], nil)
+		return stats.ComparatorCalls
+	}
+	small, big := calls(100), calls(2000)
+	require.Greater(t, small, uint64(0))
+	require.Greater(t, big, 20*small) // n*log(n)
+}
+
+func TestTransformProgressCh(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	const n = 5 * progressEventEvery
+	generateTestData(t, tx, sourceBucket, n)
+	ch := make(chan ProgressEvent, 100)
+	err := Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[1], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{ProgressCh: ch, BufferSize: 256 * 1024})
+	require.NoError(t, err)
+	close(ch)
+
+	last := map[string]ProgressEvent{}
+	for ev := range ch {
+		prev := last[ev.Stage]
+		require.GreaterOrEqual(t, ev.Keys, prev.Keys)
+		require.GreaterOrEqual(t, ev.Bytes, prev.Bytes)
+		require.GreaterOrEqual(t, ev.Spills, prev.Spills)
+		if ev.Stage == ProgressLoad {
+			require.Equal(t, uint64(n), last[ProgressExtract].Keys, "load events after extract")
+		}
+		last[ev.Stage] = ev
+	}
+	for _, stage := range []string{ProgressExtract, ProgressLoad} {
+		require.Equal(t, uint64(n), last[stage].Keys)
+		require.Greater(t, last[stage].Bytes, uint64(n))
+		require.Greater(t, last[stage].Spills, 1)
+	}
+
+	// full channel doesn't block
+	full := make(chan ProgressEvent)
+	require.NoError(t, Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[2], t.TempDir(), testExtractToMapFunc, testLoadFromMapFunc,
+		TransformArgs{ProgressCh: full}))
+}
+
+func TestTransformBatchCursor(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	const n = 5000
+	generateTestData(t, tx, sourceBucket, n)
+	remote := &highLatencyTx{Tx: tx}
+	collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	defer collector.Close()
+	err := extractBucketIntoFiles("logPrefix", remote, sourceBucket, nil, nil, collector, testExtractToMapFunc, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, n/CursorBatchSize+1, remote.roundTrips)
+	require.NoError(t, collector.Load(tx, destBucket, testLoadFromMapFunc, TransformArgs{}))
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+}
+
+func TestCombineLoad(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	count := 0
+	counter := func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		count++
+		return nil
+	}
+	err := Transform(
+		"logPrefix",
+		tx,
+		sourceBucket,
+		destBucket,
+		"", // temp dir
+		testExtractToMapFunc,
+		CombineLoad(counter, testLoadFromMapFunc),
+		TransformArgs{},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 10, count)
+	compareBuckets(t, tx, sourceBucket, destBucket, nil)
+
+	err = Transform("logPrefix", tx, sourceBucket, kv.ChaindataTables[2], "", testExtractToMapFunc,
+		CombineLoad(testLoadFromMapFunc, counter), TransformArgs{})
+	require.ErrorIs(t, err, ErrCombineLoadEmit)
+}
+
+func TestTransformSameBucket(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.ChaindataTables[0]
+	generateTestData(t, tx, bucket, 10)
+	extractFunc := func(k, v []byte, next ExtractNextFunc) error {
+		return next(k, append([]byte("new-"), k...), v)
+	}
+	err := Transform("logPrefix", tx, bucket, bucket, "", extractFunc, IdentityLoadFunc, TransformArgs{})
+	require.ErrorIs(t, err, ErrSameBucket)
+
+	err = Transform("logPrefix", tx, bucket, bucket, "", extractFunc, IdentityLoadFunc, TransformArgs{InPlaceTempBucket: kv.ChaindataTables[1]})
+	require.NoError(t, err)
+	count := 0
+	require.NoError(t, tx.ForEach(bucket, nil, func(k, v []byte) error {
+		assert.True(t, bytes.HasPrefix(k, []byte("new-")))
+		count++
+		return nil
+	}))
+	assert.Equal(t, 10, count)
+	empty, err := tx.Cursor(kv.ChaindataTables[1])
+	require.NoError(t, err)
+	defer empty.Close()
+	k, _, err := empty.First()
+	require.NoError(t, err)
+	assert.Nil(t, k, "temp bucket must be cleared")
+}
+
+func TestExtractMaxPerPrefix(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	for _, prefix := range []byte{0x01, 0x02, 0x05, 0xff} {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, tx.Put(sourceBucket, []byte{prefix, byte(i)}, []byte{byte(i)}))
+		}
+	}
+	require.NoError(t, tx.Put(sourceBucket, []byte{0x03}, []byte{1})) // prefix with less records than cap
+
+	collector := NewCollector(t.Name(), "", NewSortableBuffer(BufferOptimalSize))
+	defer collector.Close()
+	args := TransformArgs{ExtractMaxPerPrefix: 3, ExtractPrefixLen: 1}
+	err := extractIntoFiles("logPrefix", tx, sourceBucket, collector, func(k, v []byte, next ExtractNextFunc) error {
+		return next(k, k, v)
+	}, args)
+	require.NoError(t, err)
+	perPrefix := map[byte]int{}
+	require.NoError(t, collector.Load(nil, "", func(k, v []byte, _ CurrentTableReader, _ LoadNextFunc) error {
+		perPrefix[k[0]]++
+		if len(k) > 1 {
+			assert.Less(t, int(k[1]), 3, "must collect first records of prefix")
+		}
+		return nil
+	}, TransformArgs{}))
+	assert.Equal(t, map[byte]int{0x01: 3, 0x02: 3, 0x03: 1, 0x05: 3, 0xff: 3}, perPrefix)
+}
+
+func TestProfileRange(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.ChaindataTables[0]
+	put := func(from, n int) {
+		for i := 0; i < n; i++ {
+			k := []byte{byte(from + i%64), byte(i), byte(i >> 8)}
+			require.NoError(t, tx.Put(bucket, k, []byte{1}))
+		}
+	}
+	put(0x00, 100) // quarter 0
+	put(0x80, 300) // quarter 2
+
+	stats, err := ProfileRange(tx, bucket, nil, nil, 4)
+	require.NoError(t, err)
+	require.Len(t, stats, 4)
+	var keys []uint64
+	for _, s := range stats {
+		keys = append(keys, s.Keys)
+	}
+	assert.Equal(t, []uint64{100, 0, 300, 0}, keys)
+	assert.Equal(t, uint64(300*4), stats[2].Bytes)
+	assert.Equal(t, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, stats[2].From)
+	assert.Equal(t, stats[3].From, stats[2].To)
+	assert.Nil(t, stats[3].To)
+
+	// sub-range: halves of quarter 2. first bytes are 0x80+i%64, i < 300: residues < 44 appear 5 times, others 4 times
+	stats, err = ProfileRange(tx, bucket, []byte{0x80}, []byte{0xc0}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(32*5), stats[0].Keys)
+	assert.Equal(t, uint64(12*5+20*4), stats[1].Keys)
+
+	// 1 bucket of whole key space
+	put(0xff, 1)
+	require.NoError(t, tx.Put(bucket, bytes.Repeat([]byte{0xff}, 9), []byte{1}))
+	stats, err = ProfileRange(tx, bucket, nil, nil, 1)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(402), stats[0].Keys)
+	assert.Nil(t, stats[0].To)
+	for _, buckets := range []int{0, -1} {
+		_, err = ProfileRange(tx, bucket, nil, nil, buckets)
+		require.Error(t, err)
+	}
+}
+
+func TestTransformAsync(t *testing.T) {
+	db := memdb.NewTestDB(t)
+	sourceBucket := kv.ChaindataTables[0]
+	require.NoError(t, db.Update(context.Background(), func(tx kv.RwTx) error {
+		generateTestData(t, tx, sourceBucket, 100)
+		return nil
+	}))
+	destBuckets := kv.ChaindataTables[1:4]
+	var results []<-chan TransformResult
+	for _, bucket := range destBuckets {
+		results = append(results, TransformAsync(context.Background(), "logPrefix", db, sourceBucket, bucket, t.TempDir(),
+			testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{}))
+	}
+	for _, resCh := range results {
+		res := <-resCh
+		require.NoError(t, res.Err)
+	}
+	require.NoError(t, db.View(context.Background(), func(tx kv.Tx) error {
+		for _, bucket := range destBuckets {
+			compareBuckets(t, tx, sourceBucket, bucket, nil)
+		}
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := <-TransformAsync(ctx, "logPrefix", db, sourceBucket, kv.ChaindataTables[5], t.TempDir(),
+		testExtractToMapFunc, testLoadFromMapFunc, TransformArgs{})
+	require.Error(t, res.Err)
+
+	// ctx stops transform when args.Quit is set too
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	extracted := 0
+	res = <-TransformAsync(ctx, "logPrefix", db, sourceBucket, kv.ChaindataTables[5], t.TempDir(),
+		func(k, v []byte, next ExtractNextFunc) error {
+			if extracted++; extracted == 50 {
+				cancel()
+			}
+			return testExtractToMapFunc(k, v, next)
+		}, testLoadFromMapFunc, TransformArgs{Quit: make(chan struct{})})
+	require.ErrorIs(t, res.Err, context.Canceled)
+	require.Less(t, extracted, 100)
+}
+
+func TestMergeCursors(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	b1, b2 := kv.ChaindataTables[0], kv.ChaindataTables[1]
+	for i := 0; i < 100; i++ {
+		bucket := b1
+		if i%3 == 0 {
+			bucket = b2
+		}
+		require.NoError(t, tx.Put(bucket, []byte(fmt.Sprintf("key-%03d", i)), []byte(bucket)))
+	}
+	require.NoError(t, tx.Put(b1, []byte("key-000"), []byte(b1))) // same key in both: b1 goes first
+
+	c1, err := tx.Cursor(b1)
+	require.NoError(t, err)
+	defer c1.Close()
+	c2, err := tx.Cursor(b2)
+	require.NoError(t, err)
+	defer c2.Close()
+	var keys []string
+	err = MergeCursors([]kv.Cursor{c1, c2}, nil, func(k, v []byte) error {
+		keys = append(keys, string(k)+"="+string(v))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 101)
+	assert.Equal(t, "key-000="+b1, keys[0])
+	assert.Equal(t, "key-000="+b2, keys[1])
+	for i := 1; i < 100; i++ {
+		assert.True(t, strings.HasPrefix(keys[i+1], fmt.Sprintf("key-%03d=", i)))
+	}
+}
+
+func TestTransformVerifyAgainst(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	sourceBucket := kv.ChaindataTables[0]
+	destBucket := kv.ChaindataTables[1]
+	generateTestData(t, tx, sourceBucket, 10)
+	_, replica := memdb.NewTestTx(t)
+	generateTestData(t, replica, destBucket, 10)
+
+	verify := func() error {
+		return Transform("logPrefix", tx, sourceBucket, destBucket, "", testExtractToMapFunc, testLoadFromMapFunc,
+			TransformArgs{VerifyAgainst: replica})
+	}
+	require.NoError(t, verify())
+	empty, err := tx.Cursor(destBucket)
+	require.NoError(t, err)
+	defer empty.Close()
+	k, _, err := empty.First()
+	require.NoError(t, err)
+	require.Nil(t, k, "audit mode must not write")
+
+	badKey := []byte(fmt.Sprintf("%10d-key-%010d", 5, 5))
+	require.NoError(t, replica.Put(destBucket, badKey, []byte("corrupted")))
+	var mismatch *MismatchError
+	require.ErrorAs(t, verify(), &mismatch)
+	assert.Equal(t, badKey, mismatch.Key)
+	assert.Equal(t, []byte("corrupted"), mismatch.Actual)
 }
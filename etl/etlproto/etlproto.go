@@ -0,0 +1,44 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package etlproto - feeds etl collectors from streams of protobuf messages
+package etlproto
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"google.golang.org/protobuf/proto"
+)
+
+// CollectProto - collects key/value bytes taken directly from fields of messages, without intermediate decode.
+// `recv` is source of messages with semantic of gRPC stream's Recv (pass stream.Recv): io.EOF means end of stream.
+// Collector copies bytes, so messages can be reused by `recv`.
+func CollectProto[M proto.Message](c *etl.Collector, recv func() (M, error), keyOf func(M) []byte, valOf func(M) []byte) error {
+	for {
+		msg, err := recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.Collect(keyOf(msg), valOf(msg)); err != nil {
+			return err
+		}
+	}
+}
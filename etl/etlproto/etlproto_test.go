@@ -0,0 +1,66 @@
+/*
+Copyright 2022 Erigon contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etlproto
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCollectProto(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	bucket := kv.ChaindataTables[0]
+	// stream of serialized messages, as received from network
+	var wire [][]byte
+	for i := 9; i >= 0; i-- {
+		b, err := proto.Marshal(&remote.Pair{K: []byte(fmt.Sprintf("key-%d", i)), V: []byte(fmt.Sprintf("value-%d", i))})
+		require.NoError(t, err)
+		wire = append(wire, b)
+	}
+	msg := &remote.Pair{}
+	recv := func() (*remote.Pair, error) {
+		if len(wire) == 0 {
+			return nil, io.EOF
+		}
+		msg.Reset() // message is reused, as gRPC's RecvMsg allows
+		err := proto.Unmarshal(wire[0], msg)
+		wire = wire[1:]
+		return msg, err
+	}
+
+	c := etl.NewCollector(t.Name(), t.TempDir(), etl.NewSortableBuffer(etl.BufferOptimalSize))
+	defer c.Close()
+	require.NoError(t, CollectProto(c, recv, func(m *remote.Pair) []byte { return m.K }, func(m *remote.Pair) []byte { return m.V }))
+	require.NoError(t, c.Load(tx, bucket, etl.IdentityLoadFunc, etl.TransformArgs{}))
+
+	i := 0
+	require.NoError(t, tx.ForEach(bucket, nil, func(k, v []byte) error {
+		assert.Equal(t, fmt.Sprintf("key-%d", i), string(k))
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(v))
+		i++
+		return nil
+	}))
+	assert.Equal(t, 10, i)
+}
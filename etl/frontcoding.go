@@ -0,0 +1,158 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Front-coded bucket (see TransformArgs.FrontCodeKeys): records are stored in groups of up to FrontCodeKeys records,
+// one group per db record. Key of db record is first key of group - so groups are ordered and Seek works by groups.
+// Value of db record is sequence of entries (integers are uvarint):
+//
+//	shared prefix len (with previous key of group), suffix len, suffix, value len, value
+//
+// First entry of group has shared == len(key). Empty value is stored as is - it's not deletion.
+
+type frontCoder struct {
+	groupSize int
+	put       func(k, v []byte) error
+
+	groupKey, prevKey []byte
+	group             []byte
+	count             int
+	numBuf            [binary.MaxVarintLen64]byte
+}
+
+func (fc *frontCoder) appendUvarint(x uint64) {
+	n := binary.PutUvarint(fc.numBuf[:], x)
+	fc.group = append(fc.group, fc.numBuf[:n]...)
+}
+
+func (fc *frontCoder) add(k, v []byte) error {
+	if fc.prevKey != nil && bytes.Compare(k, fc.prevKey) <= 0 {
+		return fmt.Errorf("front coding requires strictly increasing keys, and after keys of bucket: %x after %x", k, fc.prevKey)
+	}
+	if fc.count == fc.groupSize {
+		if err := fc.flush(); err != nil {
+			return err
+		}
+	}
+	shared := 0
+	if fc.count == 0 {
+		fc.groupKey = append(fc.groupKey[:0], k...)
+		shared = len(k)
+	} else {
+		for shared < len(k) && shared < len(fc.prevKey) && k[shared] == fc.prevKey[shared] {
+			shared++
+		}
+	}
+	fc.appendUvarint(uint64(shared))
+	fc.appendUvarint(uint64(len(k) - shared))
+	fc.group = append(fc.group, k[shared:]...)
+	fc.appendUvarint(uint64(len(v)))
+	fc.group = append(fc.group, v...)
+	fc.prevKey = append(fc.prevKey[:0], k...)
+	fc.count++
+	return nil
+}
+
+func (fc *frontCoder) flush() error {
+	if fc.count == 0 {
+		return nil
+	}
+	if err := fc.put(fc.groupKey, fc.group); err != nil {
+		return err
+	}
+	fc.group, fc.count = fc.group[:0], 0
+	return nil
+}
+
+// DecodeFrontCoded - calls walker for each record of group (db record of front-coded bucket), see TransformArgs.FrontCodeKeys.
+// `k` and `v` passed to walker are valid only during call.
+func DecodeFrontCoded(groupKey, group []byte, walker func(k, v []byte) error) error {
+	var k []byte
+	uvarint := func() (uint64, error) {
+		x, n := binary.Uvarint(group)
+		if n <= 0 {
+			return 0, fmt.Errorf("front-coded group %x: bad varint", groupKey)
+		}
+		group = group[n:]
+		return x, nil
+	}
+	for first := true; len(group) > 0; first = false {
+		shared, err := uvarint()
+		if err != nil {
+			return err
+		}
+		suffixLen, err := uvarint()
+		if err != nil {
+			return err
+		}
+		if first && (shared != uint64(len(groupKey)) || suffixLen != 0) {
+			return fmt.Errorf("front-coded group %x: first key isn't group key", groupKey)
+		}
+		if (!first && shared > uint64(len(k))) || suffixLen > uint64(len(group)) {
+			return fmt.Errorf("front-coded group %x: corrupted entry", groupKey)
+		}
+		if first {
+			k = append(k[:0], groupKey...)
+		} else {
+			k = append(k[:shared], group[:suffixLen]...)
+		}
+		group = group[suffixLen:]
+		valLen, err := uvarint()
+		if err != nil {
+			return err
+		}
+		if valLen > uint64(len(group)) {
+			return fmt.Errorf("front-coded group %x: corrupted entry", groupKey)
+		}
+		if err := walker(k, group[:valLen]); err != nil {
+			return err
+		}
+		group = group[valLen:]
+	}
+	return nil
+}
+
+// ForEachFrontCoded - walks records of front-coded bucket in key order, reconstructing full keys
+func ForEachFrontCoded(tx kv.Tx, bucket string, walker func(k, v []byte) error) error {
+	return tx.ForEach(bucket, nil, func(groupKey, group []byte) error {
+		return DecodeFrontCoded(groupKey, group, walker)
+	})
+}
+
+// lastFrontCodedKey - last key stored in front-coded bucket: load may only continue after it
+func lastFrontCodedKey(c kv.Cursor) ([]byte, error) {
+	groupKey, group, err := c.Last()
+	if err != nil || groupKey == nil {
+		return nil, err
+	}
+	var last []byte
+	if err := DecodeFrontCoded(groupKey, group, func(k, _ []byte) error {
+		last = append(last[:0], k...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return last, nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Codec - encoding of keys and values of TypedTransform. Collector sorts encoded keys (bytewise, or by args.Comparator):
+// for numbers it's big-endian encoding. Empty encoded value means delete - as in LoadNextFunc.
+// Decode must not retain `b`: it's valid only during callback.
+type Codec[K, V any] interface {
+	EncodeKey(k K) ([]byte, error)
+	DecodeKey(b []byte) (K, error)
+	EncodeValue(v V) ([]byte, error)
+	DecodeValue(b []byte) (V, error)
+}
+
+type TypedExtractNextFunc[K, V any] func(k K, v V) error
+type TypedExtractFunc[K, V any] func(k K, v V, next TypedExtractNextFunc[K, V]) error
+
+type TypedLoadNextFunc[K, V any] func(k K, v V) error
+type TypedLoadFunc[K, V any] func(k K, v V, table TypedTableReader[K, V], next TypedLoadNextFunc[K, V]) error
+
+// TypedTableReader - CurrentTableReader with decoded values
+type TypedTableReader[K, V any] struct {
+	table CurrentTableReader
+	codec Codec[K, V]
+}
+
+// Get - ok is false if key is not in table
+func (r TypedTableReader[K, V]) Get(k K) (v V, ok bool, err error) {
+	kb, err := r.codec.EncodeKey(k)
+	if err != nil {
+		return v, false, err
+	}
+	vb, err := r.table.Get(kb)
+	if err != nil || vb == nil {
+		return v, false, err
+	}
+	v, err = r.codec.DecodeValue(vb)
+	return v, err == nil, err
+}
+
+// TypedTransform - Transform of records of `fromBucket` decoded by `codec`: extractFunc and loadFunc get decoded keys and values,
+// emitted ones are encoded by `codec` for sort and merge of Transform.
+func TypedTransform[K, V any](
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	codec Codec[K, V],
+	extractFunc TypedExtractFunc[K, V],
+	loadFunc TypedLoadFunc[K, V],
+	args TransformArgs,
+) error {
+	extract := func(k, v []byte, next ExtractNextFunc) error {
+		tk, tv, err := decodeRecord(codec, k, v)
+		if err != nil {
+			return fmt.Errorf("%s: etl: decoding %s record %x: %w", logPrefix, fromBucket, k, err)
+		}
+		return extractFunc(tk, tv, func(ek K, ev V) error {
+			kb, vb, err := encodeRecord(codec, ek, ev)
+			if err != nil {
+				return fmt.Errorf("%s: etl: encoding record extracted from %x: %w", logPrefix, k, err)
+			}
+			return next(k, kb, vb)
+		})
+	}
+	load := func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		tk, tv, err := decodeRecord(codec, k, v)
+		if err != nil {
+			return fmt.Errorf("%s: etl: decoding collected record %x: %w", logPrefix, k, err)
+		}
+		return loadFunc(tk, tv, TypedTableReader[K, V]{table: table, codec: codec}, func(lk K, lv V) error {
+			kb, vb, err := encodeRecord(codec, lk, lv)
+			if err != nil {
+				return fmt.Errorf("%s: etl: encoding record loaded from %x: %w", logPrefix, k, err)
+			}
+			return next(k, kb, vb)
+		})
+	}
+	return Transform(logPrefix, db, fromBucket, toBucket, tmpdir, extract, load, args)
+}
+
+func decodeRecord[K, V any](codec Codec[K, V], k, v []byte) (K, V, error) {
+	tk, err := codec.DecodeKey(k)
+	if err != nil {
+		var tv V
+		return tk, tv, err
+	}
+	tv, err := codec.DecodeValue(v)
+	return tk, tv, err
+}
+
+func encodeRecord[K, V any](codec Codec[K, V], k K, v V) ([]byte, []byte, error) {
+	kb, err := codec.EncodeKey(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	vb, err := codec.EncodeValue(v)
+	return kb, vb, err
+}
@@ -18,6 +18,13 @@ package etl
 
 import (
 	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ledgerwatch/log/v3"
 
 	"github.com/ledgerwatch/erigon-lib/kv"
 )
@@ -28,27 +35,62 @@ type HeapElem struct {
 	TimeIdx int
 }
 
+// KeyDecoder - decodes key once, when run advances to it. Result is compared by DecodedCmpFunc.
+// Useful when comparator must parse keys (varints, etc.) - heap operations compare same front keys many times.
+type KeyDecoder func(k, v []byte) interface{}
+type DecodedCmpFunc func(a, b interface{}) int
+
 type Heap struct {
 	comparator kv.CmpFunc
 	elems      []HeapElem
+
+	decode     KeyDecoder
+	decodedCmp DecodedCmpFunc
+	decoded    []interface{} // by run index (TimeIdx): each run has at most 1 element in heap
+}
+
+// MergeQueue - priority structure of merge phase (binary heap by default, see TransformArgs.NewMergeQueue).
+// PopMin returns smallest element by `less` the queue was created with.
+type MergeQueue interface {
+	Push(e HeapElem)
+	PopMin() HeapElem
+	Len() int
 }
 
+// heapQueue - default MergeQueue: container/heap over Heap
+type heapQueue struct{ h *Heap }
+
+func (q heapQueue) Push(e HeapElem)  { heap.Push(q.h, e) }
+func (q heapQueue) PopMin() HeapElem { return heap.Pop(q.h).(HeapElem) }
+func (q heapQueue) Len() int         { return q.h.Len() }
+
 func (h Heap) Len() int {
 	return len(h.elems)
 }
 
 func (h Heap) Less(i, j int) bool {
+	return h.lessElems(h.elems[i], h.elems[j])
+}
+
+// lessElems - merge order: by key (comparator or decoded key), then by run index
+func (h *Heap) lessElems(a, b HeapElem) bool {
+	if h.decode != nil {
+		if c := h.decodedCmp(h.decoded[a.TimeIdx], h.decoded[b.TimeIdx]); c != 0 {
+			return c < 0
+		}
+		return a.TimeIdx < b.TimeIdx
+	}
 	if h.comparator != nil {
-		if c := h.comparator(h.elems[i].Key, h.elems[j].Key, h.elems[i].Value, h.elems[j].Value); c != 0 {
+		if c := h.comparator(a.Key, b.Key, a.Value, b.Value); c != 0 {
 			return c < 0
 		}
-		return h.elems[i].TimeIdx < h.elems[j].TimeIdx
+		return a.TimeIdx < b.TimeIdx
 	}
 
-	if c := bytes.Compare(h.elems[i].Key, h.elems[j].Key); c != 0 {
+	if c := bytes.Compare(a.Key, b.Key); c != 0 {
 		return c < 0
 	}
-	return h.elems[i].TimeIdx < h.elems[j].TimeIdx
+	return a.TimeIdx < b.TimeIdx
 }
 
 func (h Heap) Swap(i, j int) {
@@ -69,3 +111,165 @@ func (h *Heap) Pop() interface{} {
 	h.elems = old[0 : n-1]
 	return x
 }
+
+// SpillCorruptionPolicy - what merge does when record of spill file can't be decoded (truncated or corrupted file)
+type SpillCorruptionPolicy int
+
+const (
+	SpillCorruptionAbort      SpillCorruptionPolicy = iota // return error
+	SpillCorruptionSkipRecord                              // skip bad bytes and continue reading same file (rest of file after bad length or of compressed file, see ErrSpillRecordLength and ErrSpillStream)
+	SpillCorruptionSkipFile                                // skip rest of file
+)
+
+// offsetProvider - optional extension of dataProvider, used to report position of skipped region
+type offsetProvider interface {
+	offset() int64
+}
+
+// providerSize - bytes on disk or in memory, -1 if unknown
+func providerSize(p dataProvider) int64 {
+	switch p := p.(type) {
+	case *fileDataProvider:
+		if info, err := p.file.Stat(); err == nil {
+			return info.Size()
+		}
+	case *memoryDataProvider:
+		if b, ok := p.buffer.(interface{ Size() int }); ok {
+			return int64(b.Size())
+		}
+	}
+	return -1
+}
+
+// mergeIter - k-way merge of sorted providers. Returned key/value are valid until next call of `next`.
+type mergeIter struct {
+	logPrefix string
+	providers []dataProvider
+	policy    SpillCorruptionPolicy
+	h         *Heap // merge order and decoded-key cache
+	q         MergeQueue
+	cur       HeapElem
+	hasCur    bool
+	err       error
+}
+
+func newMergeIter(logPrefix string, providers []dataProvider, args TransformArgs) *mergeIter {
+	h := &Heap{comparator: args.Comparator}
+	if err := args.checkMergeOrder(); err != nil {
+		return &mergeIter{logPrefix: logPrefix, err: fmt.Errorf("%s: %w", logPrefix, err)}
+	}
+	if args.KeyDecoder != nil {
+		h.decode, h.decodedCmp, h.decoded = args.KeyDecoder, args.DecodedComparator, make([]interface{}, len(providers))
+	}
+	heap.Init(h)
+	var q MergeQueue = heapQueue{h}
+	if args.NewMergeQueue != nil {
+		q = args.NewMergeQueue(h.lessElems)
+	}
+	it := &mergeIter{logPrefix: logPrefix, providers: providers, policy: args.SpillCorruptionPolicy, h: h, q: q}
+	order := make([]int, len(providers))
+	for i := range order {
+		order[i] = i
+	}
+	if args.SizeOrderedMerge {
+		sort.SliceStable(order, func(i, j int) bool { return providerSize(providers[order[i]]) > providerSize(providers[order[j]]) })
+	}
+	for _, i := range order {
+		if err := it.fill(i, nil, nil); err != nil {
+			it.err = fmt.Errorf("%s: error reading first readers: n=%d current=%d provider=%s err=%w",
+				logPrefix, len(providers), i, providers[i], err)
+			break
+		}
+	}
+	return it
+}
+
+// push - fills decoded-key cache and pushes into queue
+func (it *mergeIter) push(e HeapElem) {
+	if it.h.decode != nil {
+		it.h.decoded[e.TimeIdx] = it.h.decode(e.Key, e.Value)
+	}
+	it.q.Push(e)
+}
+
+// fill - reads next element of i-th provider into heap. EOF is not an error: provider just leaves the merge.
+func (it *mergeIter) fill(i int, keyBuf, valBuf []byte) error {
+	provider := it.providers[i]
+	lastErrOffset := int64(-1)
+	for {
+		k, v, err := provider.Next(keyBuf, valBuf)
+		if err == nil {
+			it.push(HeapElem{k, v, i})
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if it.policy == SpillCorruptionAbort || errors.Is(err, ErrSpillOpen) {
+			return err
+		}
+		logArgs := []interface{}{"provider", provider, "err", err}
+		stuck := false // reader made no progress since previous error: skipping records would loop forever
+		if p, ok := provider.(offsetProvider); ok {
+			off := p.offset()
+			stuck, lastErrOffset = off >= 0 && off == lastErrOffset, off
+			logArgs = append(logArgs, "offset", off)
+		}
+		if it.policy == SpillCorruptionSkipFile || stuck || errors.Is(err, ErrSpillRecordLength) || errors.Is(err, ErrSpillStream) {
+			log.Warn(fmt.Sprintf("[%s] etl: skipping rest of corrupted file", it.logPrefix), logArgs...)
+			return nil
+		}
+		log.Warn(fmt.Sprintf("[%s] etl: skipping corrupted record", it.logPrefix), logArgs...)
+	}
+}
+
+// next - returns ok=false when all providers reached EOF
+func (it *mergeIter) next() (k, v []byte, ok bool, err error) {
+	if it.err != nil {
+		return nil, nil, false, it.err
+	}
+	if it.hasCur { // ask provider of previous element for it's next item - re-using buffers
+		it.hasCur = false
+		if err = it.fill(it.cur.TimeIdx, it.cur.Key[:0], it.cur.Value[:0]); err != nil {
+			return nil, nil, false, fmt.Errorf("%s: error while reading next element from disk: %w", it.logPrefix, err)
+		}
+	}
+	if it.q.Len() == 0 {
+		return nil, nil, false, nil
+	}
+	it.cur = it.q.PopMin()
+	it.hasCur = true
+	return it.cur.Key, it.cur.Value, true, nil
+}
+
+// PeekIter - merged stream of collector with lookahead.
+// Record returned by Next is valid until next call of Next, record returned by Peek - until next call of Peek after Next.
+type PeekIter struct {
+	it     *mergeIter
+	peeked bool
+	pk, pv []byte
+	pok    bool
+	k, v   []byte
+	err    error
+}
+
+// Peek - returns record which next call of Next will return, doesn't consume it
+func (p *PeekIter) Peek() (k, v []byte, ok bool) {
+	if !p.peeked && p.err == nil {
+		p.pk, p.pv, p.pok, p.err = p.it.next()
+		p.peeked = true
+	}
+	return p.pk, p.pv, p.pok && p.err == nil
+}
+
+func (p *PeekIter) Next() (k, v []byte, ok bool) {
+	if k, v, ok = p.Peek(); !ok {
+		return nil, nil, false
+	}
+	p.peeked = false
+	p.k, p.v = append(p.k[:0], k...), append(p.v[:0], v...) // next Peek will re-use merge buffers
+	return p.k, p.v, true
+}
+
+// Err - error which stopped iteration
+func (p *PeekIter) Err() error { return p.err }
@@ -0,0 +1,208 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// SortableHeapBuffer (replacement selection): when full, only lower half of sorted records is spilled, high keys stay in
+// min-heap for next spill. If spilled half starts at or after last key of previous spill file, it's appended to that file -
+// sorted run continues, so nearly-sorted input gives few long spill files instead of one file per buffer.
+// Records below last spilled key stay in buffer until they are half of it: then new run (file) is started.
+// Runs are continued only in spill files without compression and encryption. Load is as of SortableSliceBuffer.
+// Measured by BenchmarkHeapBufferSpills (200k nearly-sorted keys, 256KB buffer): 2 spill files instead of 39,
+// collect is ~1.5x slower - each spill sorts whole buffer to write half of it.
+
+type heapBufferEntry struct {
+	key, value []byte
+	seq        uint64 // order of Put: equal keys keep it
+}
+
+type heapBuffer struct {
+	comparator  kv.CmpFunc
+	entries     []heapBufferEntry // min-heap, sorted after Sort
+	sorted      []heapBufferEntry // spare slice of Sort
+	seq         uint64
+	size        int
+	optimalSize int
+
+	from, to int    // spill window of Write and Reset, set by prepareSpill. to == 0: all records
+	runLast  []byte // last key of current run, nil - no run
+}
+
+func NewHeapBuffer(bufferOptimalSize datasize.ByteSize) *heapBuffer {
+	return &heapBuffer{optimalSize: int(bufferOptimalSize.Bytes())}
+}
+
+func (b *heapBuffer) cmp(x, y *heapBufferEntry) int {
+	var c int
+	if b.comparator != nil {
+		c = b.comparator(x.key, y.key, x.value, y.value)
+	} else {
+		c = bytes.Compare(x.key, y.key)
+	}
+	if c != 0 {
+		return c
+	}
+	if x.seq < y.seq {
+		return -1
+	}
+	return 1
+}
+
+// heapBufferHeap - heap.Interface of heapBuffer
+type heapBufferHeap struct{ *heapBuffer }
+
+func (h heapBufferHeap) Len() int           { return len(h.entries) }
+func (h heapBufferHeap) Less(i, j int) bool { return h.cmp(&h.entries[i], &h.entries[j]) < 0 }
+func (h heapBufferHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h heapBufferHeap) Push(x interface{}) { h.entries = append(h.entries, x.(heapBufferEntry)) }
+func (h heapBufferHeap) Pop() interface{} {
+	x := h.entries[len(h.entries)-1]
+	h.entries[len(h.entries)-1] = heapBufferEntry{}
+	h.entries = h.entries[:len(h.entries)-1]
+	return x
+}
+
+func (b *heapBuffer) Put(k, v []byte) {
+	b.seq++
+	heap.Push(heapBufferHeap{b}, heapBufferEntry{key: common.Copy(k), value: common.Copy(v), seq: b.seq})
+	b.size += len(k) + len(v)
+}
+
+func (b *heapBuffer) Get(i int, keyBuf, valBuf []byte) ([]byte, []byte) {
+	return append(keyBuf, b.entries[i].key...), append(valBuf, b.entries[i].value...)
+}
+
+func (b *heapBuffer) Len() int                     { return len(b.entries) }
+func (b *heapBuffer) Size() int                    { return b.size }
+func (b *heapBuffer) SetComparator(cmp kv.CmpFunc) { b.comparator = cmp }
+func (b *heapBuffer) CheckFlushSize() bool         { return b.size >= b.optimalSize }
+
+// Sort - pops heap into sorted slice. Sorted slice is valid min-heap: records kept after spill need no re-heapify.
+func (b *heapBuffer) Sort() {
+	sorted := b.sorted[:0]
+	for len(b.entries) > 0 {
+		sorted = append(sorted, heap.Pop(heapBufferHeap{b}).(heapBufferEntry))
+	}
+	b.entries, b.sorted = sorted, b.entries[:0]
+	b.from, b.to = 0, 0
+}
+
+// prepareSpill - selects records of Write and Reset (buffer must be sorted). `all` - for last flush: everything is spilled.
+// Returns true if selected records continue current run - they must be appended to its file (canContinue - file allows it).
+func (b *heapBuffer) prepareSpill(canContinue, all bool) bool {
+	n := len(b.entries)
+	p := 0 // first record >= runLast
+	if canContinue && b.runLast != nil {
+		last := heapBufferEntry{key: b.runLast, seq: ^uint64(0)} // after records of same key
+		p = sort.Search(n, func(i int) bool { return b.cmp(&b.entries[i], &last) > 0 })
+		if all && p > 0 || p > n/2 { // too many records below run: start new one
+			p, canContinue = 0, false
+		}
+	} else {
+		canContinue = false
+	}
+	b.from, b.to = p, p+n/2
+	if all || b.to == p {
+		b.to = n
+	}
+	b.runLast = common.Copy(b.entries[b.to-1].key)
+	return canContinue
+}
+
+// spillWindow - records [from, to) are written by Write (and writeBuffer)
+func (b *heapBuffer) spillWindow() (from, to int) {
+	if b.to == 0 {
+		return 0, len(b.entries)
+	}
+	return b.from, b.to
+}
+
+func (b *heapBuffer) Write(w io.Writer) error {
+	var numBuf [binary.MaxVarintLen64]byte
+	from, to := b.spillWindow()
+	for _, e := range b.entries[from:to] {
+		if err := writeElement(w, numBuf[:], e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset - removes spilled records (all, if spill wasn't prepared: then current run is finished too)
+func (b *heapBuffer) Reset() {
+	if b.to == 0 {
+		for i := range b.entries {
+			b.entries[i] = heapBufferEntry{}
+		}
+		b.entries, b.size, b.runLast = b.entries[:0], 0, nil
+		return
+	}
+	for _, e := range b.entries[b.from:b.to] {
+		b.size -= len(e.key) + len(e.value)
+	}
+	// records before and after window are sorted and before < after: still a heap
+	kept := append(b.entries[:b.from], b.entries[b.to:]...)
+	for i := len(kept); i < len(b.entries); i++ {
+		b.entries[i] = heapBufferEntry{}
+	}
+	b.entries, b.from, b.to = kept, 0, 0
+}
+
+// spillRun - flush of heapBuffer: appends spilled records to file of current run, or writes new spill file (returned)
+func (c *Collector) spillRun(b *heapBuffer, tmpdir string, final bool) (provider dataProvider, spilled int, err error) {
+	canContinue := c.run != nil && c.compression == CompressionNone && c.keyring == nil
+	continues := b.prepareSpill(canContinue, final)
+	from, to := b.spillWindow()
+	spilled = to - from
+	if !continues {
+		provider, err = flushToDisk(c.logPrefix, b, tmpdir, !c.autoClean, c.logLvl, c.compression, c.keyring, c.codec)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.run, _ = provider.(*fileDataProvider)
+		return provider, spilled, nil
+	}
+	before := providerSize(c.run)
+	if _, err = c.run.file.Seek(0, io.SeekEnd); err != nil {
+		return nil, 0, err
+	}
+	w := bufio.NewWriterSize(c.run.file, BufIOSize)
+	if err = writeBuffer(b, w, c.codec); err != nil {
+		return nil, 0, fmt.Errorf("error appending entries to %s: %w", c.run, err)
+	}
+	if err = w.Flush(); err != nil {
+		return nil, 0, err
+	}
+	b.Reset()
+	if after := providerSize(c.run); after > before && before >= 0 {
+		c.stats.BytesOnDisk += uint64(after - before)
+	}
+	return nil, spilled, nil
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// LoadReverse - as Load, but loadFunc gets records from highest key to lowest: merge order reversed (equal keys - in reverse
+// order of collection). Records emitted by loadFunc are written by db.Put, empty value deletes key if db is kv.Deleter.
+// Put into mdbx bucket in descending order is much slower than Append of Load: it's for non-db sinks (kv.Putter adapters)
+// and tables appended in reverse. CurrentTableReader reads db, if it's kv.Getter.
+// args.OnLoadCommit is called after every args.CommitEvery records and at the end - with lowest key loaded so far.
+// Merged stream of spill files is written into temp file (in tmpdir of collector) and read backwards, buffer kept
+// in RAM is read backwards directly. Temp file is not compressed and is counted by MaxTempBytes, collector with
+// SpillEncryption fails with ErrReverseEncrypted (temp file would be plaintext). Of other load options only args.Quit is supported.
+// Collector is cleaned up after it as after Load.
+func (c *Collector) LoadReverse(db kv.Putter, bucket string, loadFunc LoadFunc, args TransformArgs) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	if args.Quit != nil {
+		c.quit = args.Quit
+	}
+	if loadFunc == nil {
+		loadFunc = IdentityLoadFunc
+	}
+	if args.OnLoadCommit != nil && args.needsCommitTimer() {
+		args.OnLoadCommit = timedCommitHandler(c.logPrefix, bucket, args.OnLoadCommit, args)
+	}
+	if !c.allFlushed {
+		if err := c.flushBuffer(nil, true); err != nil {
+			return err
+		}
+	}
+	next, err := c.reverseStream()
+	if err != nil {
+		return err
+	}
+	defer next.close()
+
+	table := &putterTableReader{db: db, bucket: bucket}
+	emit := func(_, k, v []byte) error {
+		if len(v) == 0 {
+			if d, ok := db.(kv.Deleter); ok {
+				return d.Delete(bucket, k)
+			}
+		}
+		if err := db.Put(bucket, k, v); err != nil {
+			return fmt.Errorf("%s: put: k=%x, %w", c.logPrefix, k, err)
+		}
+		return nil
+	}
+	var lastKey []byte
+	records := 0
+	for {
+		if err := common.Stopped(c.quit); err != nil {
+			return err
+		}
+		k, v, ok, err := next.next()
+		if err != nil {
+			return fmt.Errorf("%s: etl: LoadReverse: %w", c.logPrefix, err)
+		}
+		if !ok {
+			break
+		}
+		c.stats.EntriesLoaded++
+		if err := loadFunc(k, v, table, emit); err != nil {
+			return err
+		}
+		lastKey = append(lastKey[:0], k...)
+		if records++; args.OnLoadCommit != nil && args.CommitEvery > 0 && records%args.CommitEvery == 0 {
+			if err := args.OnLoadCommit(db, lastKey, false); err != nil {
+				return err
+			}
+		}
+	}
+	if args.OnLoadCommit != nil {
+		return args.OnLoadCommit(db, lastKey, true)
+	}
+	return nil
+}
+
+type putterTableReader struct {
+	db     kv.Putter
+	bucket string
+}
+
+func (r *putterTableReader) Get(k []byte) ([]byte, error) {
+	g, ok := r.db.(kv.Getter)
+	if !ok {
+		return nil, fmt.Errorf("etl: LoadReverse: %T doesn't support reads", r.db)
+	}
+	return g.GetOne(r.bucket, k)
+}
+
+// ErrReverseEncrypted - LoadReverse of collector with spill files which needs temp file, see SpillEncryption
+var ErrReverseEncrypted = errors.New("etl: LoadReverse doesn't support encrypted spill files")
+
+// reverseReader - records of collector from last to first
+type reverseReader struct {
+	next  func() (k, v []byte, ok bool, err error)
+	close func()
+}
+
+func (c *Collector) reverseStream() (*reverseReader, error) {
+	if len(c.dataProviders) == 0 {
+		return &reverseReader{close: func() {}, next: func() ([]byte, []byte, bool, error) { return nil, nil, false, nil }}, nil
+	}
+	if len(c.dataProviders) == 1 {
+		if p, ok := c.dataProviders[0].(*memoryDataProvider); ok {
+			i := p.buffer.Len()
+			var k, v []byte
+			return &reverseReader{close: func() {}, next: func() ([]byte, []byte, bool, error) {
+				if i == 0 {
+					return nil, nil, false, nil
+				}
+				i--
+				k, v = p.buffer.Get(i, k[:0], v[:0])
+				return k, v, true, nil
+			}}, nil
+		}
+	}
+
+	if c.keyring != nil {
+		return nil, fmt.Errorf("%s: %w", c.logPrefix, ErrReverseEncrypted)
+	}
+	// reverse-readable file: records k, v, uint32(len(k)), uint32(len(v))
+	f, err := os.CreateTemp(c.tmpdir, spillFilePattern(c.logPrefix))
+	if err != nil {
+		return nil, err
+	}
+	r := &reverseReader{close: func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}}
+	w := bufio.NewWriterSize(f, BufIOSize)
+	var lens [8]byte
+	var written uint64
+	if err := c.forEachMerged(c.quit, c.bufType == SortableOldestAppearedBuffer, nil, func(k, v []byte) error {
+		if written += uint64(len(k) + len(v) + len(lens)); c.maxTempBytes > 0 && c.stats.BytesOnDisk+written > c.maxTempBytes {
+			return fmt.Errorf("%s: %w: spill files use %s, reversed copy needs more than %s, max %s", c.logPrefix, ErrTempSpaceExceeded,
+				common.ByteCount(c.stats.BytesOnDisk), common.ByteCount(written), common.ByteCount(c.maxTempBytes))
+		}
+		binary.BigEndian.PutUint32(lens[:4], uint32(len(k)))
+		binary.BigEndian.PutUint32(lens[4:], uint32(len(v)))
+		for _, b := range [][]byte{k, v, lens[:]} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		r.close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		r.close()
+		return nil, err
+	}
+	pos, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	// window of file [bufStart, bufStart+len(buf)), moves backwards
+	var buf []byte
+	bufStart := pos
+	read := func(off int64, n int) ([]byte, error) {
+		if off < bufStart || off+int64(n) > bufStart+int64(len(buf)) {
+			size := BufIOSize
+			if n > size {
+				size = n
+			}
+			end := off + int64(n)
+			start := end - int64(size)
+			if start < 0 {
+				start = 0
+			}
+			if cap(buf) < int(end-start) {
+				buf = make([]byte, end-start)
+			}
+			buf = buf[:end-start]
+			if _, err := f.ReadAt(buf, start); err != nil {
+				return nil, err
+			}
+			bufStart = start
+		}
+		return buf[off-bufStart : off-bufStart+int64(n)], nil
+	}
+	var k, v []byte
+	r.next = func() ([]byte, []byte, bool, error) {
+		if pos == 0 {
+			return nil, nil, false, nil
+		}
+		if pos < 8 {
+			return nil, nil, false, io.ErrUnexpectedEOF
+		}
+		l, err := read(pos-8, 8)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		kLen, vLen := int(binary.BigEndian.Uint32(l[:4])), int(binary.BigEndian.Uint32(l[4:]))
+		start := pos - 8 - int64(kLen) - int64(vLen)
+		if start < 0 {
+			return nil, nil, false, io.ErrUnexpectedEOF
+		}
+		rec, err := read(start, kLen+vLen)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		k, v = append(k[:0], rec[:kLen]...), append(v[:0], rec[kLen:]...)
+		pos = start
+		return k, v, true, nil
+	}
+	return r, nil
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// cursorDataProvider - reads already sorted table from `start` (nil - from the beginning) until `end` (exclusive, nil - until the end),
+// cursor is owned by caller
+type cursorDataProvider struct {
+	c          kv.Cursor
+	start, end []byte
+	started    bool
+}
+
+func (p *cursorDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
+	var k, v []byte
+	var err error
+	if !p.started {
+		p.started = true
+		if p.start != nil {
+			k, v, err = p.c.Seek(p.start)
+		} else {
+			k, v, err = p.c.First()
+		}
+	} else {
+		k, v, err = p.c.Next()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if k == nil || (p.end != nil && bytes.Compare(k, p.end) >= 0) {
+		return nil, nil, io.EOF
+	}
+	// copy: other cursors move while record waits in heap
+	return append(keyBuf, k...), append(valBuf, v...), nil
+}
+
+func (p *cursorDataProvider) Dispose() uint64 { return 0 }
+
+func (p *cursorDataProvider) String() string { return fmt.Sprintf("%T", p) }
+
+// MergeCursors - k-way merge of already sorted cursors, without collector and temp files.
+// Equal keys are emitted in order of cursors. `emit` args are valid only until it returns.
+func MergeCursors(cursors []kv.Cursor, cmp kv.CmpFunc, emit func(k, v []byte) error) error {
+	providers := make([]dataProvider, len(cursors))
+	for i, c := range cursors {
+		providers[i] = &cursorDataProvider{c: c}
+	}
+	it := newMergeIter("merge cursors", providers, TransformArgs{Comparator: cmp})
+	for {
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := emit(k, v); err != nil {
+			return err
+		}
+	}
+}
+
+// ExtractFuncWithBucket - receives records of ExtractBucketsMerged with name of their bucket. Args are valid only until it returns.
+type ExtractFuncWithBucket func(bucket string, k, v []byte) error
+
+// ExtractBucketsMerged - walks `buckets` in lockstep: records of all buckets in range [startkey, endkey) are passed
+// to extractFunc in global key order (bytewise), so related tables (accounts and storage of same address prefix)
+// can be fused without intermediate collector. Identical keys present in several buckets are all emitted,
+// in order of `buckets`; records of DupSort bucket with same key - in order of their values.
+func ExtractBucketsMerged(db kv.Tx, buckets []string, startkey, endkey []byte, extractFunc ExtractFuncWithBucket, quit <-chan struct{}) error {
+	providers := make([]dataProvider, len(buckets))
+	for i, bucket := range buckets {
+		for _, prev := range buckets[:i] {
+			if prev == bucket {
+				return fmt.Errorf("etl: ExtractBucketsMerged: bucket %s is listed twice", bucket)
+			}
+		}
+		c, err := db.Cursor(bucket)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		providers[i] = &cursorDataProvider{c: c, start: startkey, end: endkey}
+	}
+	it := newMergeIter("extract merged", providers, TransformArgs{})
+	for {
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		if err := extractFunc(buckets[it.cur.TimeIdx], k, v); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import "time"
+
+// Metrics - hooks for metrics registry (Prometheus etc.), see TransformArgs.Metrics and Collector.Metrics.
+// `stage` is logPrefix of transform/collector. Must be safe for concurrent use: stages can run in parallel.
+type Metrics interface {
+	// ObserveExtractDuration - extract phase of Transform, `records` - collected by it
+	ObserveExtractDuration(stage string, d time.Duration, records uint64)
+	// ObserveLoadDuration - merge and load of Transform, `records` - passed to LoadFunc
+	ObserveLoadDuration(stage string, d time.Duration, records uint64)
+	// IncSpilledFiles - collector flushed buffer into temp file
+	IncSpilledFiles(stage string)
+	// ObserveBatchSize - amount of records in flushed buffer (spilled or kept in RAM for Load)
+	ObserveBatchSize(stage string, records int)
+}
+
+// NoopMetrics - default Metrics
+type NoopMetrics struct{}
+
+func (NoopMetrics) ObserveExtractDuration(string, time.Duration, uint64) {}
+func (NoopMetrics) ObserveLoadDuration(string, time.Duration, uint64)    {}
+func (NoopMetrics) IncSpilledFiles(string)                               {}
+func (NoopMetrics) ObserveBatchSize(string, int)                         {}
+
+func (args TransformArgs) metrics() Metrics {
+	if args.Metrics == nil {
+		return NoopMetrics{}
+	}
+	return args.Metrics
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// MultiExtractNextFunc - emits pair into destination `bucket`
+type MultiExtractNextFunc func(bucket string, k, v []byte) error
+type MultiExtractFunc func(k, v []byte, next MultiExtractNextFunc) error
+
+// MultiCollector - one Collector per destination bucket (created on first Collect into bucket).
+// Each bucket has own buffer and set of spill files, so it's sorted and loaded independently of other buckets.
+type MultiCollector struct {
+	logPrefix, tmpdir string
+	newBuffer         func() Buffer
+	collectors        map[string]*Collector
+	quit              <-chan struct{}
+}
+
+func NewMultiCollector(logPrefix, tmpdir string, newBuffer func() Buffer) *MultiCollector {
+	return &MultiCollector{logPrefix: logPrefix, tmpdir: tmpdir, newBuffer: newBuffer, collectors: map[string]*Collector{}}
+}
+
+func (m *MultiCollector) Collect(bucket string, k, v []byte) error {
+	c, ok := m.collectors[bucket]
+	if !ok {
+		c = NewCollector(m.logPrefix, m.tmpdir, m.newBuffer())
+		c.quit = m.quit
+		m.collectors[bucket] = c
+	}
+	return c.Collect(k, v)
+}
+
+// Buckets - which got at least one record, sorted
+func (m *MultiCollector) Buckets() []string {
+	buckets := make([]string, 0, len(m.collectors))
+	for bucket := range m.collectors {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// Load - loads buckets one-by-one (in order of Buckets), each by its LoadFunc. Bucket without LoadFunc is an error.
+func (m *MultiCollector) Load(db kv.RwTx, loadFuncs map[string]LoadFunc, args TransformArgs) error {
+	for _, bucket := range m.Buckets() {
+		loadFunc, ok := loadFuncs[bucket]
+		if !ok {
+			return fmt.Errorf("%s: etl: no LoadFunc for bucket %s", m.logPrefix, bucket)
+		}
+		if err := m.collectors[bucket].Load(db, bucket, loadFunc, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiCollector) Close() {
+	for _, c := range m.collectors {
+		c.Close()
+	}
+}
+
+// TransformMulti - as Transform, but extractFunc chooses destination bucket of each emitted pair,
+// and each destination bucket is loaded by own LoadFunc. Each destination gets own sort buffer of args.BufferSize.
+func TransformMulti(
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	tmpdir string,
+	extractFunc MultiExtractFunc,
+	loadFuncs map[string]LoadFunc,
+	args TransformArgs,
+) error {
+	if _, ok := loadFuncs[fromBucket]; ok {
+		return fmt.Errorf("%s: %w: %s", logPrefix, ErrSameBucket, fromBucket)
+	}
+	bufferSize := BufferOptimalSize
+	if args.BufferSize > 0 {
+		bufferSize = datasize.ByteSize(args.BufferSize)
+	}
+	bufType, err := args.bufferType()
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	m := NewMultiCollector(logPrefix, tmpdir, func() Buffer {
+		b := getBufferByType(bufType, bufferSize)
+		if cmp := args.sortComparator(); cmp != nil {
+			b.SetComparator(cmp)
+		}
+		return b
+	})
+	defer m.Close()
+	m.quit = args.Quit
+
+	// routing is done by extractFunc: collector of extractBucket isn't used
+	route := &Collector{logPrefix: logPrefix, flushBuffer: func([]byte, bool) error { return nil }}
+	collect := MultiExtractNextFunc(m.Collect)
+	if err := extractBucket(logPrefix, db, fromBucket, route, func(k, v []byte, _ ExtractNextFunc) error {
+		return extractFunc(k, v, collect)
+	}, args); err != nil {
+		return err
+	}
+	return m.Load(db, loadFuncs, args)
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"encoding/binary"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// OrderedCollector - append-log instead of sorted index: Load replays Puts and Deletes (empty value)
+// exactly in collect order. Order survives spills: each record is collected under 8-bytes sequence number prefix.
+type OrderedCollector struct {
+	c      *Collector
+	seq    uint64
+	keyBuf []byte
+}
+
+func NewOrderedCollector(logPrefix, tmpdir string, bufferSize datasize.ByteSize) *OrderedCollector {
+	return &OrderedCollector{c: NewCollector(logPrefix, tmpdir, NewSortableBuffer(bufferSize))}
+}
+
+func (o *OrderedCollector) Collect(k, v []byte) error {
+	o.keyBuf = append(o.keyBuf[:0], 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(o.keyBuf, o.seq)
+	o.keyBuf = append(o.keyBuf, k...)
+	o.seq++
+	return o.c.Collect(o.keyBuf, v)
+}
+
+func (o *OrderedCollector) Load(db kv.RwTx, toBucket string, args TransformArgs) error {
+	return o.c.Load(db, toBucket, func(k, v []byte, _ CurrentTableReader, next LoadNextFunc) error {
+		return next(k[8:], k[8:], v)
+	}, args)
+}
+
+func (o *OrderedCollector) Close() { o.c.Close() }
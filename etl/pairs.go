@@ -0,0 +1,57 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Pairs - records of cursor in [startkey, endkey) (nil endkey - till end of table) as push iterator: result is
+// assignable to iter.Seq2[[]byte, []byte] and usable by range-over-func. Cursor is read as by extract (by batches if it
+// implements BatchCursor) and is closed when iteration ends - also if it's abandoned early - so it can be iterated once.
+// Yielded key/value are valid until next one. Error of cursor stops iteration silently, see PairsErr.
+func Pairs(c kv.Cursor, startkey, endkey []byte) func(yield func(k, v []byte) bool) {
+	seq, _ := PairsErr(c, startkey, endkey)
+	return seq
+}
+
+// PairsErr - Pairs and error of cursor which stopped iteration, to be checked after it
+func PairsErr(c kv.Cursor, startkey, endkey []byte) (seq func(yield func(k, v []byte) bool), err func() error) {
+	var iterErr error
+	seq = func(yield func(k, v []byte) bool) {
+		defer c.Close()
+		var it keyValueIter = c
+		if bc, ok := c.(BatchCursor); ok {
+			it = &batchedCursor{c: bc}
+		}
+		for k, v, e := it.Seek(startkey); k != nil || e != nil; k, v, e = it.Next() {
+			if e != nil {
+				iterErr = e
+				return
+			}
+			if endkey != nil && bytes.Compare(k, endkey) >= 0 {
+				return
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return iterErr }
+}
@@ -0,0 +1,186 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// partitionBatchSize - records are passed to partition loaders in batches of this size (spill-file format)
+const partitionBatchSize = 1024 * 1024
+
+// chanDataProvider - reads batches routed to one partition of LoadParallel
+type chanDataProvider struct {
+	ch <-chan []byte
+	r  *bytes.Reader
+}
+
+func (p *chanDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
+	for p.r == nil || p.r.Len() == 0 {
+		batch, ok := <-p.ch
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		p.r = bytes.NewReader(batch)
+	}
+	return readElementFromDisk(p.r, p.r, keyBuf, valBuf)
+}
+
+func (p *chanDataProvider) Dispose() uint64 { return 0 }
+
+func (p *chanDataProvider) String() string { return fmt.Sprintf("%T", p) }
+
+// LoadParallel - splits merged stream by `boundaries` into len(boundaries)+1 disjoint key ranges and loads them concurrently:
+// partition i gets keys [boundaries[i-1], boundaries[i]) and is loaded into own tx returned by beginTx(i).
+// For backends which support concurrent writers into disjoint key ranges of one bucket.
+// Boundaries must be strictly increasing (bytewise), loadFunc must not move keys out of their partition.
+// beginTx, Commit and Rollback of partition are called from its loader goroutine (MDBX txs are bound to thread).
+// Txs are committed only when all partitions are loaded, on error all of them are rolled back -
+// but commit itself is not atomic across partitions. WALWriter is not supported, SeenSet must be safe for concurrent use.
+func (c *Collector) LoadParallel(beginTx func(partition int) (kv.RwTx, error), toBucket string, boundaries [][]byte, loadFunc LoadFunc, args TransformArgs) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	if args.WALWriter != nil {
+		return fmt.Errorf("%s: etl: LoadParallel doesn't support WALWriter", c.logPrefix)
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if bytes.Compare(boundaries[i-1], boundaries[i]) >= 0 {
+			return fmt.Errorf("%s: etl: LoadParallel boundaries must be strictly increasing: %x, %x", c.logPrefix, boundaries[i-1], boundaries[i])
+		}
+	}
+	if args.Quit != nil {
+		c.quit = args.Quit
+	}
+	if !c.allFlushed {
+		if e := c.flushBuffer(nil, true); e != nil {
+			return e
+		}
+	}
+
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g, ctx := errgroup.WithContext(abort)
+	chans := make([]chan []byte, len(boundaries)+1)
+	commit := make(chan struct{})
+	var loaded sync.WaitGroup
+	loaded.Add(len(chans))
+	for i := range chans {
+		i := i
+		chans[i] = make(chan []byte, 2)
+		g.Go(func() error {
+			tx, err := beginTx(i)
+			if err != nil {
+				loaded.Done()
+				return err
+			}
+			defer tx.Rollback()
+			err = loadFilesIntoBucket(c.logPrefix, tx, toBucket, c.bufType, []dataProvider{&chanDataProvider{ch: chans[i]}}, loadFunc, args)
+			loaded.Done()
+			if err != nil {
+				return err
+			}
+			select {
+			case <-commit:
+			case <-ctx.Done():
+				return nil // other partition failed
+			}
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("%s: etl: commit of partition %d: %w", c.logPrefix, i, err)
+			}
+			return nil
+		})
+	}
+
+	routeErr := c.routePartitions(ctx, boundaries, chans, args)
+	for _, ch := range chans {
+		close(ch)
+	}
+	loaded.Wait()
+	if routeErr != nil {
+		cancel()
+	} else if ctx.Err() == nil {
+		close(commit)
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return routeErr
+}
+
+// routePartitions - merges providers of collector and sends records to partition of key
+func (c *Collector) routePartitions(ctx context.Context, boundaries [][]byte, chans []chan []byte, args TransformArgs) error {
+	batches := make([]*bytes.Buffer, len(chans))
+	for i := range batches {
+		batches[i] = &bytes.Buffer{}
+	}
+	send := func(i int) error {
+		select {
+		case chans[i] <- batches[i].Bytes():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		batches[i] = &bytes.Buffer{} // sent one is owned by loader now
+		return nil
+	}
+
+	var numBuf [binary.MaxVarintLen64]byte
+	it := newMergeIter(c.logPrefix, c.dataProviders, args)
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		// not assuming bytewise order of merged stream: args.Comparator may be set
+		partition := sort.Search(len(boundaries), func(i int) bool { return bytes.Compare(k, boundaries[i]) < 0 })
+		if err := writeElement(batches[partition], numBuf[:], k, v); err != nil {
+			return err
+		}
+		if batches[partition].Len() >= partitionBatchSize {
+			if err := send(partition); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range batches {
+		if batches[i].Len() > 0 {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// samplesPerWorker - subranges of ProfileRange per worker, to balance split points of extractParallel
+const samplesPerWorker = 16
+
+type keyRange struct{ from, to []byte } // [from, to), nil to - till end of table
+
+// extractParallel - see TransformArgs.ExtractWorkers. Tx is bound to thread (MDBX), so source is read by caller's goroutine:
+// cursor per subrange, batches of subranges round-robin. Worker of subrange runs ExtractFunc into own collector, runs of
+// workers join `collector` in order of subranges - so merge keeps extraction order of equal keys, as single-threaded extract.
+func extractParallel(logPrefix string, db kv.Tx, bucket string, collector *Collector, extractFunc ExtractFunc, args TransformArgs) error {
+	if args.Reverse || args.ExtractMaxPerPrefix > 0 || args.MaxExtractRecords > 0 || args.unified != nil || args.ProgressCh != nil {
+		return fmt.Errorf("%s: etl: ExtractWorkers is not compatible with Reverse, ExtractMaxPerPrefix, MaxExtractRecords, LogUnified and ProgressCh", logPrefix)
+	}
+	if collector.bufType != SortableSliceBuffer || collector.provenance {
+		return fmt.Errorf("%s: etl: ExtractWorkers requires SortableSliceBuffer", logPrefix)
+	}
+	ranges, err := splitExtractRange(db, bucket, args)
+	if err != nil {
+		return fmt.Errorf("%s: etl: %w", logPrefix, err)
+	}
+
+	workers := make([]*Collector, len(ranges))
+	chans := make([]chan []byte, len(ranges))
+	g, ctx := errgroup.WithContext(context.Background())
+	for i := range workers {
+		w, ch := collector.forkWorker(len(ranges)), make(chan []byte, 4)
+		workers[i], chans[i] = w, ch
+		g.Go(func() error { return w.extractBatches(ctx, ch, extractFunc, args) })
+	}
+	readErr := readRanges(ctx, logPrefix, db, bucket, ranges, chans, args)
+	for _, ch := range chans {
+		close(ch)
+	}
+	err = g.Wait()
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		for _, w := range workers {
+			w.Close()
+		}
+		return err
+	}
+	for _, w := range workers {
+		collector.dataProviders = append(collector.dataProviders, w.dataProviders...)
+		collector.stats.add(w.stats)
+		collector.reserved += w.reserved // of same budget: buffers of workers kept in RAM are released by Close of collector
+	}
+	return nil
+}
+
+// splitExtractRange - [ExtractStartKey, ExtractEndKey) by ExtractSplitPoints, or by density of keys (ProfileRange)
+func splitExtractRange(db kv.Tx, bucket string, args TransformArgs) ([]keyRange, error) {
+	start, end := args.ExtractStartKey, args.ExtractEndKey
+	points := args.ExtractSplitPoints
+	if points == nil {
+		stats, err := ProfileRange(db, bucket, start, end, args.ExtractWorkers*samplesPerWorker)
+		if err != nil {
+			return nil, err
+		}
+		var total, sum uint64
+		for _, s := range stats {
+			total += s.Keys
+		}
+		prev := start
+		for _, s := range stats[:len(stats)-1] {
+			sum += s.Keys
+			// subranges of ProfileRange are by 8-byte prefixes: boundary may be not inside of extract range
+			inside := (prev == nil || bytes.Compare(s.To, prev) > 0) && (end == nil || bytes.Compare(s.To, end) < 0)
+			if want := total * uint64(len(points)+1) / uint64(args.ExtractWorkers); inside && sum >= want && sum > 0 && len(points) < args.ExtractWorkers-1 {
+				points, prev = append(points, s.To), s.To
+			}
+		}
+	}
+	ranges := make([]keyRange, 0, len(points)+1)
+	from := start
+	for _, p := range points {
+		if (from != nil && bytes.Compare(p, from) <= 0) || (end != nil && bytes.Compare(p, end) >= 0) {
+			return nil, fmt.Errorf("split point %x is out of order or of range [%x, %x)", p, start, end)
+		}
+		ranges = append(ranges, keyRange{from: from, to: p})
+		from = p
+	}
+	return append(ranges, keyRange{from: from, to: end}), nil
+}
+
+// forkWorker - collector with settings of `c` and 1/n of its buffer size, for worker of extractParallel
+func (c *Collector) forkWorker(n int) *Collector {
+	size := BufferOptimalSize
+	if b, ok := c.buf.(growableBuffer); ok {
+		size = datasize.ByteSize(b.flushSize() / n)
+	}
+	buf := getBufferByType(c.bufType, size)
+	if cmp := c.bufferComparator(); cmp != nil {
+		buf.SetComparator(cmp)
+	}
+	w := NewCollector(c.logPrefix, c.tmpdir, buf)
+	w.autoClean, w.logLvl, w.quit, w.metrics, w.budget = c.autoClean, c.logLvl, c.quit, c.metrics, c.budget
+	w.compression, w.keyring, w.codec, w.noTempFiles = c.compression, c.keyring, c.codec, c.noTempFiles
+	w.maxTempBytes = c.maxTempBytes / uint64(n)
+	return w
+}
+
+// extractBatches - worker of extractParallel: runs ExtractFunc on records of batches, sorts buffer at the end
+func (c *Collector) extractBatches(ctx context.Context, batches <-chan []byte, extractFunc ExtractFunc, args TransformArgs) error {
+	next := canonicalizeKeys(checkRecordSizes(c.extractNextFunc, args), args)
+	if args.RetryPolicy.MaxAttempts > 1 {
+		extractFunc = args.RetryPolicy.wrapExtract(c.logPrefix, extractFunc, args.Quit)
+	}
+	var k, v []byte
+	for batch := range batches {
+		if ctx.Err() != nil {
+			continue // reader stops soon, channel must be drained
+		}
+		r := bytes.NewReader(batch)
+		for r.Len() > 0 {
+			var err error
+			if k, v, err = readElementFromDisk(r, r, k[:0], v[:0]); err != nil {
+				return err
+			}
+			if err = extractFunc(k, v, next); err != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return c.flushBuffer(nil, true)
+}
+
+// readRanges - reads subranges by cursor per each, and sends batches of records of subrange i to chans[i]
+func readRanges(ctx context.Context, logPrefix string, db kv.Tx, bucket string, ranges []keyRange, chans []chan []byte, args TransformArgs) error {
+	logEvery, stopLog := args.logTicker()
+	defer stopLog()
+	iters := make([]keyValueIter, len(ranges))
+	keys, vals := make([][]byte, len(ranges)), make([][]byte, len(ranges))
+	for i, r := range ranges {
+		c, err := db.Cursor(bucket)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		iters[i] = c
+		if bc, ok := c.(BatchCursor); ok {
+			iters[i] = &batchedCursor{c: bc}
+		}
+		if keys[i], vals[i], err = iters[i].Seek(r.from); err != nil {
+			return err
+		}
+	}
+
+	var numBuf [binary.MaxVarintLen64]byte
+	for active := len(ranges); active > 0; {
+		active = 0
+		for i, r := range ranges {
+			if keys[i] == nil {
+				continue
+			}
+			if err := common.Stopped(args.Quit); err != nil {
+				return err
+			}
+			batch := &bytes.Buffer{}
+			for k, v := keys[i], vals[i]; ; {
+				if k == nil || (r.to != nil && bytes.Compare(k, r.to) >= 0) {
+					keys[i] = nil
+					break
+				}
+				if batch.Len() >= partitionBatchSize {
+					keys[i], vals[i] = k, v
+					active++
+					break
+				}
+				if args.ExtractFilter == nil || args.ExtractFilter(k) {
+					if err := writeElement(batch, numBuf[:], k, v); err != nil {
+						return err
+					}
+				}
+				var err error
+				if k, v, err = iters[i].Next(); err != nil {
+					return err
+				}
+			}
+			if batch.Len() > 0 {
+				select {
+				case chans[i] <- batch.Bytes():
+				case <-ctx.Done():
+					return nil // error of worker is returned by worker
+				}
+			}
+			select {
+			default:
+			case <-logEvery:
+				log.Log(args.logLevel(), fmt.Sprintf("[%s] ETL [1/2] Extracting", logPrefix), "from", bucket,
+					"workers", len(ranges), "active", active, "current_prefix", makeCurrentKeyStr(keys[i]))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Parallel merge (TransformArgs.MergeConcurrency): providers are split into groups of adjacent providers, each group is
+// merged by own goroutine into pipe, final merge reads pipes. Merge order is by key, then by provider index - groups
+// keep order of providers inside group and group index keeps order between groups, so output is same as of serial merge.
+// Each pipe has 2 batches of up to mergePipeBatchBytes: memory doesn't depend on amount of records.
+const mergePipeBatchBytes = 256 * 1024
+
+type mergeBatch struct {
+	data []byte
+	lens []int // len of key, len of value, ...
+	err  error // last batch of pipe
+}
+
+func (b *mergeBatch) reset() {
+	b.data, b.lens, b.err = b.data[:0], b.lens[:0], nil
+}
+
+// mergePipe - dataProvider of records merged by goroutine
+type mergePipe struct {
+	ch   chan *mergeBatch
+	free chan *mergeBatch
+	done <-chan struct{}
+
+	cur    *mergeBatch
+	pos, i int // in cur.data, in cur.lens
+}
+
+func (p *mergePipe) run(logPrefix string, providers []dataProvider, args TransformArgs) {
+	defer close(p.ch)
+	it := newMergeIter(logPrefix, providers, args)
+	for more := true; more; {
+		var b *mergeBatch
+		select {
+		case b = <-p.free:
+		case <-p.done:
+			return
+		}
+		b.reset()
+		for len(b.data) < mergePipeBatchBytes {
+			k, v, ok, err := it.next()
+			if err != nil {
+				b.err, more = err, false
+				break
+			}
+			if !ok {
+				more = false
+				break
+			}
+			b.data = append(append(b.data, k...), v...)
+			b.lens = append(b.lens, len(k), len(v))
+		}
+		if len(b.lens) == 0 && b.err == nil {
+			return
+		}
+		select {
+		case p.ch <- b:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *mergePipe) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
+	if p.cur != nil && p.i == len(p.cur.lens) {
+		if p.cur.err != nil {
+			return nil, nil, p.cur.err
+		}
+		p.free <- p.cur // never blocks: batch came from free
+		p.cur = nil
+	}
+	if p.cur == nil {
+		b, ok := <-p.ch
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		p.cur, p.pos, p.i = b, 0, 0
+		if len(b.lens) == 0 {
+			return nil, nil, b.err
+		}
+	}
+	kLen, vLen := p.cur.lens[p.i], p.cur.lens[p.i+1]
+	k := append(keyBuf, p.cur.data[p.pos:p.pos+kLen]...)
+	v := append(valBuf, p.cur.data[p.pos+kLen:p.pos+kLen+vLen]...)
+	p.pos, p.i = p.pos+kLen+vLen, p.i+2
+	return k, v, nil
+}
+
+func (p *mergePipe) Dispose() uint64 { return 0 /* providers of group are disposed by their owner */ }
+
+func (p *mergePipe) String() string { return fmt.Sprintf("%T", p) }
+
+// parallelMerge - replaces providers by up to `concurrency` pipes (at least 2 providers per group).
+// stop must be called before providers are disposed: it stops goroutines and waits for them.
+func parallelMerge(logPrefix string, providers []dataProvider, concurrency int, args TransformArgs) (pipes []dataProvider, stop func()) {
+	groups := concurrency
+	if groups > len(providers)/2 {
+		groups = len(providers) / 2
+	}
+	if groups < 2 {
+		return providers, func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < groups; g++ {
+		from, to := g*len(providers)/groups, (g+1)*len(providers)/groups
+		p := &mergePipe{ch: make(chan *mergeBatch, 1), free: make(chan *mergeBatch, 2), done: done}
+		p.free <- &mergeBatch{}
+		p.free <- &mergeBatch{}
+		pipes = append(pipes, p)
+		wg.Add(1)
+		go func(group []dataProvider) {
+			defer wg.Done()
+			p.run(logPrefix, group, args)
+		}(providers[from:to])
+	}
+	return pipes, func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// RangeStat - density of records in [From, To) subrange of key space. To == nil means end of key space.
+type RangeStat struct {
+	From, To []byte
+	Keys     uint64
+	Bytes    uint64 // len(k) + len(v) of all records
+}
+
+// ProfileRange - histogram of records of bucket in [start, end) by one scan: key space is split into `buckets`
+// uniform subranges by first 8 bytes of key (big-endian, shorter keys are zero-padded). Helps to plan splits and spills.
+func ProfileRange(db kv.Tx, bucket string, start, end []byte, buckets int) ([]RangeStat, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("etl: ProfileRange requires buckets > 0, got %d", buckets)
+	}
+	lo, hi := keyPrefix64(start), uint64(math.MaxUint64)
+	if end != nil {
+		hi = keyPrefix64(end)
+	}
+	if hi < lo {
+		return nil, fmt.Errorf("etl: ProfileRange: end %x is before start %x", end, start)
+	}
+	width := (hi - lo) / uint64(buckets)
+	if width < math.MaxUint64 { // 1 bucket of whole key space: +1 overflows, last prefix is clamped below
+		width++
+	}
+
+	stats := make([]RangeStat, buckets)
+	for i := range stats {
+		stats[i].From = make([]byte, 8)
+		binary.BigEndian.PutUint64(stats[i].From, lo+uint64(i)*width)
+		if i > 0 {
+			stats[i-1].To = stats[i].From
+		}
+	}
+	if start != nil {
+		stats[0].From = start
+	}
+	stats[buckets-1].To = end
+
+	c, err := db.Cursor(bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	for k, v, err := c.Seek(start); k != nil || err != nil; k, v, err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+		if end != nil && bytes.Compare(k, end) >= 0 {
+			break
+		}
+		i := (keyPrefix64(k) - lo) / width
+		if i >= uint64(buckets) {
+			i = uint64(buckets) - 1
+		}
+		stats[i].Keys++
+		stats[i].Bytes += uint64(len(k) + len(v))
+	}
+	return stats, nil
+}
+
+func keyPrefix64(k []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], k)
+	return binary.BigEndian.Uint64(buf[:])
+}
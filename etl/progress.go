@@ -16,9 +16,151 @@
 
 package etl
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
 func ProgressFromKey(k []byte) int {
 	if len(k) < 1 {
 		return 0
 	}
 	return int(float64(k[0]>>4) * 3.3)
 }
+
+// Stages of ProgressEvent
+const (
+	ProgressExtract = "extract"
+	ProgressLoad    = "load"
+)
+
+// ProgressEvent - sent to TransformArgs.ProgressCh every progressEventEvery records of stage and at the end of stage.
+// Counters are cumulative within stage: Keys and Bytes (len(k)+len(v)) of processed records, Spills - amount of sorted runs.
+type ProgressEvent struct {
+	Stage  string
+	Keys   uint64
+	Bytes  uint64
+	Spills int
+}
+
+const progressEventEvery = 4096
+
+// progressReporter - nil-safe: nil means TransformArgs.ProgressCh is not set
+type progressReporter struct {
+	ch chan<- ProgressEvent
+	ev ProgressEvent
+}
+
+func newProgressReporter(ch chan<- ProgressEvent, stage string) *progressReporter {
+	if ch == nil {
+		return nil
+	}
+	return &progressReporter{ch: ch, ev: ProgressEvent{Stage: stage}}
+}
+
+func (p *progressReporter) add(k, v []byte, spills int) {
+	if p == nil {
+		return
+	}
+	p.ev.Keys++
+	p.ev.Bytes += uint64(len(k) + len(v))
+	if p.ev.Keys%progressEventEvery == 0 {
+		p.ev.Spills = spills
+		p.send()
+	}
+}
+
+func (p *progressReporter) done(spills int) {
+	if p == nil {
+		return
+	}
+	p.ev.Spills = spills
+	p.send()
+}
+
+// send - doesn't block: event is dropped if consumer is slow
+func (p *progressReporter) send() {
+	select {
+	case p.ch <- p.ev:
+	default:
+	}
+}
+
+// logInterval - of progress lines of extract and load, default of TransformArgs.LogInterval
+var logInterval = 30 * time.Second
+
+// logTicker - of progress lines by args.LogInterval: returned channel is nil (never fires) if they are disabled
+func (args TransformArgs) logTicker() (<-chan time.Time, func()) {
+	interval := logInterval
+	if args.LogInterval != nil {
+		interval = *args.LogInterval
+	}
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
+
+func (args TransformArgs) logLevel() log.Lvl {
+	if args.LogLevel == log.LvlCrit {
+		return log.LvlInfo
+	}
+	return args.LogLevel
+}
+
+// unifiedProgress - see TransformArgs.LogUnified. Overall percent is mean of stage percents, by estimates:
+// extract - amount of records in source bucket, load - amount of collected records.
+type unifiedProgress struct {
+	from, to                string
+	stage                   string
+	extractTotal, loadTotal uint64
+	extracted, loaded       uint64
+}
+
+func newUnifiedProgress(db kv.Tx, from, to string) (*unifiedProgress, error) {
+	c, err := db.Cursor(from)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	total, err := c.Count()
+	if err != nil {
+		return nil, err
+	}
+	return &unifiedProgress{from: from, to: to, stage: ProgressExtract, extractTotal: total}, nil
+}
+
+func (u *unifiedProgress) percent() float64 {
+	frac := func(done, total uint64) float64 {
+		if total == 0 || done >= total {
+			return 1
+		}
+		return float64(done) / float64(total)
+	}
+	switch u.stage {
+	case ProgressExtract:
+		return 50 * frac(u.extracted, u.extractTotal)
+	case ProgressLoad:
+		return 50 + 50*frac(u.loaded, u.loadTotal)
+	default:
+		return 100
+	}
+}
+
+// log - stage "" is end of Transform
+func (u *unifiedProgress) log(logPrefix string, lvl log.Lvl, k []byte) {
+	step := "done"
+	switch u.stage {
+	case ProgressExtract:
+		step = "1/2 extract"
+	case ProgressLoad:
+		step = "2/2 load"
+	}
+	log.Log(lvl, fmt.Sprintf("[%s] ETL", logPrefix), "from", u.from, "into", u.to, "stage", step,
+		"progress", fmt.Sprintf("%.1f%%", u.percent()), "current_prefix", makeCurrentKeyStr(k))
+}
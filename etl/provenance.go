@@ -0,0 +1,67 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Provenance - where collected record came from
+type Provenance struct {
+	Bucket string // source bucket
+	Offset uint64 // ordinal of source record within extraction of Bucket
+}
+
+// header format: uvarint(len(bucket)), bucket, uvarint(offset)
+func appendProvenance(buf []byte, bucket string, offset uint64, v []byte) []byte {
+	var numBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(numBuf[:], uint64(len(bucket)))
+	buf = append(buf, numBuf[:n]...)
+	buf = append(buf, bucket...)
+	n = binary.PutUvarint(numBuf[:], offset)
+	buf = append(buf, numBuf[:n]...)
+	return append(buf, v...)
+}
+
+func withProvenance(bucket string, extractFunc ExtractFunc) ExtractFunc {
+	var offset uint64
+	var buf []byte
+	return func(k, v []byte, next ExtractNextFunc) error {
+		off := offset
+		offset++
+		return extractFunc(k, v, func(originalK, k, v []byte) error {
+			buf = appendProvenance(buf[:0], bucket, off, v) // buffers copy value - safe to re-use
+			return next(originalK, k, buf)
+		})
+	}
+}
+
+// SplitProvenance - to use inside LoadFunc when collector was in provenance mode. Returns original value.
+func SplitProvenance(v []byte) (Provenance, []byte, error) {
+	l, n := binary.Uvarint(v)
+	if n <= 0 || uint64(len(v)-n) < l {
+		return Provenance{}, nil, fmt.Errorf("etl: bad provenance header: %x", v)
+	}
+	v = v[n:]
+	p := Provenance{Bucket: string(v[:l])}
+	v = v[l:]
+	if p.Offset, n = binary.Uvarint(v); n <= 0 {
+		return Provenance{}, nil, fmt.Errorf("etl: bad provenance offset: %x", v)
+	}
+	return p, v[n:], nil
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// TransformRetry - runs Transform up to `attempts` times while it fails with error for which isRetryable returns true
+// (transient spill failures, etc.). Each attempt starts from scratch: spill files of failed attempt are already removed
+// by Transform, records it has written into toBucket are overwritten by next attempt.
+func TransformRetry(
+	attempts int,
+	isRetryable func(error) bool,
+	logPrefix string,
+	db kv.RwTx,
+	fromBucket string,
+	toBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	loadFunc LoadFunc,
+	args TransformArgs,
+) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = Transform(logPrefix, db, fromBucket, toBucket, tmpdir, extractFunc, loadFunc, args)
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			break
+		}
+		if stopErr := common.Stopped(args.Quit); stopErr != nil {
+			return stopErr
+		}
+		log.Warn(fmt.Sprintf("[%s] etl: transform failed, retrying", logPrefix), "attempt", attempt, "err", err)
+	}
+	return err
+}
+
+// RetryPolicy - retry of single record when ExtractFunc or LoadFunc fails with transient error (flaky external resource),
+// see TransformArgs.RetryPolicy. Records emitted by callback are passed to `next` only when callback succeeded:
+// failed attempt emits nothing, so retry doesn't duplicate records (LoadFunc doesn't see own writes of this record
+// by CurrentTableReader). Errors of `next` itself (collector, db) are not retried.
+type RetryPolicy struct {
+	MaxAttempts int              // including first one, <= 1 - no retries
+	Retryable   func(error) bool // nil - every error is retryable
+	Backoff     time.Duration    // before first retry, doubled for each next one (default 10ms)
+}
+
+type pendingEmit struct {
+	originalK, k, v []byte
+}
+
+// retry - runs attempt until it succeeds, fails by not retryable error or attempts are over. Sleep is interrupted by quit.
+func (p RetryPolicy) retry(logPrefix string, k []byte, quit <-chan struct{}, attempt func() error) error {
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || i >= p.MaxAttempts || (p.Retryable != nil && !p.Retryable(err)) {
+			return err
+		}
+		log.Debug(fmt.Sprintf("[%s] etl: callback failed, retrying", logPrefix), "key", fmt.Sprintf("%x", k), "attempt", i, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-quit:
+			timer.Stop()
+			return common.ErrStopped
+		}
+		backoff *= 2
+	}
+}
+
+// buffered - calls `f` with `next` which keeps emitted records, passes them to `next` if `f` succeeded
+func (p RetryPolicy) buffered(logPrefix string, k []byte, quit <-chan struct{}, next func(originalK, k, v []byte) error, f func(emit func(originalK, k, v []byte) error) error) error {
+	var pending []pendingEmit
+	emit := func(originalK, k, v []byte) error {
+		pending = append(pending, pendingEmit{common.Copy(originalK), common.Copy(k), common.Copy(v)})
+		return nil
+	}
+	if err := p.retry(logPrefix, k, quit, func() error {
+		pending = pending[:0]
+		return f(emit)
+	}); err != nil {
+		return err
+	}
+	for _, e := range pending {
+		if err := next(e.originalK, e.k, e.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p RetryPolicy) wrapExtract(logPrefix string, f ExtractFunc, quit <-chan struct{}) ExtractFunc {
+	return func(k, v []byte, next ExtractNextFunc) error {
+		return p.buffered(logPrefix, k, quit, next, func(emit func(originalK, k, v []byte) error) error {
+			return f(k, v, emit)
+		})
+	}
+}
+
+func (p RetryPolicy) wrapLoad(logPrefix string, f LoadFunc, quit <-chan struct{}) LoadFunc {
+	return func(k, v []byte, table CurrentTableReader, next LoadNextFunc) error {
+		return p.buffered(logPrefix, k, quit, next, func(emit func(originalK, k, v []byte) error) error {
+			return f(k, v, table, emit)
+		})
+	}
+}
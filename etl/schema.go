@@ -0,0 +1,61 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// RecordSizeError - collected record doesn't match TransformArgs.KeySizeExact/ValueSizeExact
+type RecordSizeError struct {
+	Key      []byte
+	Field    string // "key" or "value"
+	Expected int
+	Actual   int
+}
+
+func (e *RecordSizeError) Error() string {
+	return fmt.Sprintf("etl: key %x: %s size %d, expected %d", e.Key, e.Field, e.Actual, e.Expected)
+}
+
+// checkRecordSizes - wraps `next` by validation of TransformArgs.KeySizeExact/ValueSizeExact, if any of them is set
+func checkRecordSizes(next ExtractNextFunc, args TransformArgs) ExtractNextFunc {
+	if args.KeySizeExact <= 0 && args.ValueSizeExact <= 0 {
+		return next
+	}
+	return func(originalK, k, v []byte) error {
+		if args.KeySizeExact > 0 && len(k) != args.KeySizeExact {
+			return &RecordSizeError{Key: common.Copy(k), Field: "key", Expected: args.KeySizeExact, Actual: len(k)}
+		}
+		if args.ValueSizeExact > 0 && len(v) != args.ValueSizeExact {
+			return &RecordSizeError{Key: common.Copy(k), Field: "value", Expected: args.ValueSizeExact, Actual: len(v)}
+		}
+		return next(originalK, k, v)
+	}
+}
+
+// canonicalizeKeys - wraps `next` by TransformArgs.CanonicalKey, if set
+func canonicalizeKeys(next ExtractNextFunc, args TransformArgs) ExtractNextFunc {
+	if args.CanonicalKey == nil {
+		return next
+	}
+	return func(originalK, k, v []byte) error {
+		return next(originalK, args.CanonicalKey(k), v)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// HashPartitioner - spreads keys over numShards by hash of the key (FNV-1a with murmur3 finalizer - raw FNV has weak low bits).
+// Unlike range partitioning it balances arbitrary key distributions, but shards are not ordered relative to each other.
+func HashPartitioner(numShards int) func(k []byte) int {
+	if numShards <= 0 {
+		panic(fmt.Sprintf("etl: HashPartitioner requires numShards > 0, got %d", numShards))
+	}
+	return func(k []byte) int {
+		return int(hashKey(k) % uint64(numShards))
+	}
+}
+
+func hashKey(k []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range k {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// ShardedCollector - pre-shards collected entries by `partition` function.
+// Each shard has own Collector (own buffer and set of spill files) and is sorted independently.
+// Same key always lands in same shard - so dedup semantics of buffers are preserved within shard.
+type ShardedCollector struct {
+	partition func(k []byte) int
+	shards    []*Collector
+}
+
+// NewShardedCollector - `partition` must return value in [0, numShards), nil means HashPartitioner(numShards)
+func NewShardedCollector(logPrefix, tmpdir string, numShards int, partition func(k []byte) int, newBuffer func() Buffer) *ShardedCollector {
+	if partition == nil {
+		partition = HashPartitioner(numShards)
+	}
+	s := &ShardedCollector{partition: partition, shards: make([]*Collector, numShards)}
+	for i := range s.shards {
+		s.shards[i] = NewCollector(logPrefix, tmpdir, newBuffer())
+	}
+	return s
+}
+
+func (s *ShardedCollector) Collect(k, v []byte) error {
+	i := s.partition(k)
+	if i < 0 || i >= len(s.shards) {
+		return fmt.Errorf("etl: partition returned shard %d, have %d shards", i, len(s.shards))
+	}
+	return s.shards[i].Collect(k, v)
+}
+
+// Shards - allows loading each shard separately (for example in parallel into different destinations)
+func (s *ShardedCollector) Shards() []*Collector { return s.shards }
+
+// Load - loads shards one-by-one into same bucket
+func (s *ShardedCollector) Load(db kv.RwTx, toBucket string, loadFunc LoadFunc, args TransformArgs) error {
+	for _, c := range s.shards {
+		if err := c.Load(db, toBucket, loadFunc, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedCollector) Close() {
+	for _, c := range s.shards {
+		c.Close()
+	}
+}
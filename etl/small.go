@@ -0,0 +1,98 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ledgerwatch/log/v3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+type sliceRecord struct{ k, v []byte }
+
+// sliceDataProvider - sorted records of transformSmall
+type sliceDataProvider struct {
+	records []sliceRecord
+	i       int
+}
+
+func (p *sliceDataProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
+	if p.i >= len(p.records) {
+		return nil, nil, io.EOF
+	}
+	r := p.records[p.i]
+	p.i++
+	return append(keyBuf, r.k...), append(valBuf, r.v...), nil
+}
+
+func (p *sliceDataProvider) Dispose() uint64 { return 0 }
+
+func (p *sliceDataProvider) String() string { return fmt.Sprintf("%T(records: %d)", p, len(p.records)) }
+
+// useSmallTransform - fast path is taken only for options which don't need buffer machinery,
+// and only if source bucket has less than SmallTransformThreshold records (cursor Count is cheap in MDBX)
+func useSmallTransform(db kv.Tx, fromBucket string, args TransformArgs) (bool, error) {
+	tp, err := args.bufferType()
+	if err != nil {
+		return false, err
+	}
+	if args.SmallTransformThreshold <= 0 || tp != SortableSliceBuffer || args.Comparator != nil ||
+		args.KeyDecoder != nil || args.ConsolidateTmpdir != "" {
+		return false, nil
+	}
+	c, err := db.Cursor(fromBucket)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	count, err := c.Count()
+	if err != nil {
+		return false, err
+	}
+	return count < uint64(args.SmallTransformThreshold), nil
+}
+
+// transformSmall - Transform without collector: extracted records are sorted as plain slice and loaded from it
+func transformSmall(logPrefix string, db kv.RwTx, fromBucket, toBucket string, extractFunc ExtractFunc, loadFunc LoadFunc, args TransformArgs) error {
+	provider := &sliceDataProvider{}
+	c := &Collector{logPrefix: logPrefix, logLvl: log.LvlInfo, bufType: SortableSliceBuffer, flushBuffer: func([]byte, bool) error { return nil }}
+	c.extractNextFunc = func(_, k, v []byte) error {
+		provider.records = append(provider.records, sliceRecord{k: common.Copy(k), v: common.Copy(v)})
+		return nil
+	}
+	if err := extractBucket(logPrefix, db, fromBucket, c, extractFunc, args); err != nil {
+		return err
+	}
+	// same order as SortableSliceBuffer: by key, equal keys in order of extraction
+	sort.SliceStable(provider.records, func(i, j int) bool { return bytes.Compare(provider.records[i].k, provider.records[j].k) < 0 })
+
+	var loaded uint64
+	args.loadedRecords = &loaded
+	if err := loadFilesIntoBucket(logPrefix, db, toBucket, SortableSliceBuffer, []dataProvider{provider}, loadFunc, args); err != nil {
+		return err
+	}
+	if args.Stats != nil {
+		args.Stats.EntriesCollected, args.Stats.EntriesLoaded = uint64(len(provider.records)), loaded
+	}
+	return nil
+}
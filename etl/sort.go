@@ -0,0 +1,190 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// cancellableSorter - optional extension of Buffer: Sort which can be interrupted by `quit`
+type cancellableSorter interface {
+	SortCancel(quit <-chan struct{}) error
+}
+
+func sortBuffer(b Buffer, quit <-chan struct{}) error {
+	if s, ok := b.(cancellableSorter); ok {
+		return s.SortCancel(quit)
+	}
+	b.Sort()
+	return nil
+}
+
+const sortCheckQuitEvery = 1 << 16 // element moves between checks of quit channel
+
+// stableSort - same algorithm as sort.Stable (insertion sort of blocks, then bottom-up SymMerge),
+// but checks `quit` periodically, merges included: sort of huge buffer can take seconds. Returns common.ErrStopped if interrupted.
+func stableSort(data sort.Interface, quit <-chan struct{}) error {
+	s := &stableSorter{data: data, quit: quit}
+	n := data.Len()
+
+	blockSize := 20
+	a, b := 0, blockSize
+	for b <= n {
+		insertionSort(data, a, b)
+		if !s.moved(blockSize) {
+			return s.err
+		}
+		a = b
+		b += blockSize
+	}
+	insertionSort(data, a, n)
+
+	for blockSize < n {
+		a, b = 0, 2*blockSize
+		for b <= n {
+			s.symMerge(a, a+blockSize, b)
+			a = b
+			b += 2 * blockSize
+		}
+		if m := a + blockSize; m < n {
+			s.symMerge(a, m, n)
+		}
+		if s.err != nil {
+			return s.err
+		}
+		blockSize *= 2
+	}
+	return nil
+}
+
+// stableSorter - merge phase of stableSort, stops moving elements once quit is closed
+type stableSorter struct {
+	data sort.Interface
+	quit <-chan struct{}
+	work int
+	err  error
+}
+
+// moved - accounts `n` element moves, returns false if sort is interrupted
+func (s *stableSorter) moved(n int) bool {
+	if s.err != nil {
+		return false
+	}
+	if s.work += n; s.work >= sortCheckQuitEvery {
+		s.work = 0
+		s.err = common.Stopped(s.quit)
+	}
+	return s.err == nil
+}
+
+func insertionSort(data sort.Interface, a, b int) {
+	for i := a + 1; i < b; i++ {
+		for j := i; j > a && data.Less(j, j-1); j-- {
+			data.Swap(j, j-1)
+		}
+	}
+}
+
+// symMerge - merges sorted data[a:m] and data[m:b] in place (SymMerge algorithm by Kim and Kutzner)
+func (s *stableSorter) symMerge(a, m, b int) {
+	if s.err != nil {
+		return
+	}
+	data := s.data
+	if m-a == 1 {
+		i, j := m, b
+		for i < j {
+			h := int(uint(i+j) >> 1)
+			if data.Less(h, a) {
+				i = h + 1
+			} else {
+				j = h
+			}
+		}
+		for k := a; k < i-1 && s.moved(1); k++ {
+			data.Swap(k, k+1)
+		}
+		return
+	}
+	if b-m == 1 {
+		i, j := a, m
+		for i < j {
+			h := int(uint(i+j) >> 1)
+			if !data.Less(m, h) {
+				i = h + 1
+			} else {
+				j = h
+			}
+		}
+		for k := m; k > i && s.moved(1); k-- {
+			data.Swap(k, k-1)
+		}
+		return
+	}
+
+	mid := int(uint(a+b) >> 1)
+	n := mid + m
+	var start, r int
+	if m > mid {
+		start, r = n-b, mid
+	} else {
+		start, r = a, m
+	}
+	p := n - 1
+	for start < r {
+		c := int(uint(start+r) >> 1)
+		if !data.Less(p-c, c) {
+			start = c + 1
+		} else {
+			r = c
+		}
+	}
+
+	end := n - start
+	if start < m && m < end {
+		s.rotate(start, m, end)
+	}
+	if a < start && start < mid {
+		s.symMerge(a, start, mid)
+	}
+	if mid < end && end < b {
+		s.symMerge(mid, end, b)
+	}
+}
+
+func (s *stableSorter) swapRange(a, b, n int) {
+	for i := 0; i < n && s.moved(1); i++ {
+		s.data.Swap(a+i, b+i)
+	}
+}
+
+// rotate - swaps data[a:m] and data[m:b]
+func (s *stableSorter) rotate(a, m, b int) {
+	i, j := m-a, b-m
+	for i != j && s.err == nil {
+		if i > j {
+			s.swapRange(m-i, m, j)
+			i -= j
+		} else {
+			s.swapRange(m-i, m+j-i, i)
+			j -= i
+		}
+	}
+	s.swapRange(m-i, m, i)
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// AddSortedFile - registers file of records in spill-file format (or format of SpillEntryCodec), sorted by order of
+// collector's buffer, as one more run of final merge: Load returns its records merged with collected ones.
+// File may be compressed by snappy (framed), zstd or gzip - compression is detected by magic bytes.
+// Whole file is read once to validate its order, ErrOrderViolation is returned if it's not sorted.
+// Records with equal keys are merged in order of registration: after data spilled before call, before data spilled after.
+// File is not removed by Load or Close, only closed.
+func (c *Collector) AddSortedFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: add sorted file: %w", c.logPrefix, err)
+	}
+	head := make([]byte, len(snappyMagic))
+	n, err := file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = file.Close()
+		return fmt.Errorf("%s: add sorted file %s: %w", c.logPrefix, path, err)
+	}
+	provider := &fileDataProvider{file: file, compression: detectCompression(head[:n]), codec: c.codec, keep: true}
+	if err = c.verifySortedFile(provider); err != nil {
+		provider.Dispose()
+		return fmt.Errorf("%s: add sorted file %s (%s): %w", c.logPrefix, path, provider.compression, err)
+	}
+	provider.rewind()
+	// next spill of SortableHeapBuffer must not continue run which is before this file
+	c.run = nil
+	c.dataProviders = append(c.dataProviders, provider)
+	return nil
+}
+
+func (c *Collector) verifySortedFile(p *fileDataProvider) error {
+	order := newOrderVerifier(TransformArgs{Comparator: c.bufferComparator()})
+	var k, v []byte
+	for {
+		var err error
+		if k, v, err = p.Next(k[:0], v[:0]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err = order.check(k, v); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// TransformStats - filled by Transform if TransformArgs.Stats is set.
+// GC stats are process-wide: concurrent goroutines contribute to them too.
+type TransformStats struct {
+	CollectorStats               // of collector used by Transform
+	GCPauseDelta   time.Duration // total stop-the-world pause during transform
+	GCCountDelta   uint32        // amount of GC cycles during transform
+	// ComparatorCalls - calls of TransformArgs.Comparator during sort and merge, if TransformArgs.CountComparatorCalls is set
+	ComparatorCalls uint64
+	// Delta* - bytes of load relative to existing content of bucket, if TransformArgs.DeltaDryRun is set (see deltaLoad)
+	DeltaNewBytes         uint64
+	DeltaOverwrittenBytes uint64
+	DeltaUnchangedBytes   uint64
+	// Commit* - of TransformArgs.OnLoadCommit (OnLoadCommitTx) calls. CommitP99 is nearest-rank percentile, set when load ends
+	Commits   uint64
+	CommitMax time.Duration
+	CommitP99 time.Duration
+}
+
+// gcSnapshot - runtime.ReadMemStats is stop-the-world, call it only when stats are requested
+type gcSnapshot struct {
+	pauseTotalNs uint64
+	numGC        uint32
+}
+
+func readGCSnapshot() gcSnapshot {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return gcSnapshot{pauseTotalNs: m.PauseTotalNs, numGC: m.NumGC}
+}
+
+func (s *TransformStats) addGCDelta(from, to gcSnapshot) {
+	s.GCPauseDelta += time.Duration(to.pauseTotalNs - from.pauseTotalNs)
+	s.GCCountDelta += to.numGC - from.numGC
+}
+
+// countingComparator - debug wrapper of TransformArgs.CountComparatorCalls
+func countingComparator(cmp kv.CmpFunc, calls *uint64) kv.CmpFunc {
+	return func(k1, k2, v1, v2 []byte) int {
+		atomic.AddUint64(calls, 1)
+		return cmp(k1, k2, v1, v2)
+	}
+}
+
+// ErrSlowCommit - see TransformArgs.MaxCommitDuration
+var ErrSlowCommit = errors.New("etl: commit took longer than MaxCommitDuration")
+
+// needsCommitTimer - args.Stats or args.MaxCommitDuration are set: commit handlers are wrapped by timed*Handler
+func (args TransformArgs) needsCommitTimer() bool {
+	return args.Stats != nil || args.MaxCommitDuration > 0
+}
+
+// commitTimer - records durations of commits into args.Stats, checks args.MaxCommitDuration
+type commitTimer struct {
+	logPrefix, bucket string
+	args              TransformArgs
+	durations         []time.Duration
+}
+
+// observe - accounts commit started at `t`, returns `err` or ErrSlowCommit
+func (ct *commitTimer) observe(t time.Time, isDone bool, err error) error {
+	took := time.Since(t)
+	args := ct.args
+	if args.MaxCommitDuration > 0 && took > args.MaxCommitDuration && err == nil {
+		if args.FailOnSlowCommit {
+			err = fmt.Errorf("%s: %w: bucket %s, took %s, max %s", ct.logPrefix, ErrSlowCommit, ct.bucket, took, args.MaxCommitDuration)
+		} else {
+			log.Warn(fmt.Sprintf("[%s] etl: slow commit", ct.logPrefix), "bucket", ct.bucket, "took", took, "max", args.MaxCommitDuration)
+		}
+	}
+	if s := args.Stats; s != nil {
+		ct.durations = append(ct.durations, took)
+		s.Commits++
+		if took > s.CommitMax {
+			s.CommitMax = took
+		}
+		if isDone || err != nil {
+			s.CommitP99 = percentile(ct.durations, 99)
+		}
+	}
+	return err
+}
+
+// timedCommitHandler - commitTimer of LoadCommitHandler (DirectCopySorted, LoadReverse)
+func timedCommitHandler(logPrefix, bucket string, commit LoadCommitHandler, args TransformArgs) LoadCommitHandler {
+	ct := &commitTimer{logPrefix: logPrefix, bucket: bucket, args: args}
+	return func(db kv.Putter, key []byte, isDone bool) error {
+		t := time.Now()
+		return ct.observe(t, isDone, commit(db, key, isDone))
+	}
+}
+
+// timedCommitTxHandler - commitTimer of LoadCommitTxHandler (Collector.Load)
+func timedCommitTxHandler(logPrefix, bucket string, commit LoadCommitTxHandler, args TransformArgs) LoadCommitTxHandler {
+	ct := &commitTimer{logPrefix: logPrefix, bucket: bucket, args: args}
+	return func(tx kv.RwTx, key []byte, isDone bool) (kv.RwTx, error) {
+		t := time.Now()
+		tx, err := commit(tx, key, isDone)
+		return tx, ct.observe(t, isDone, err)
+	}
+}
+
+// percentile - nearest-rank, sorts `durations`
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	rank := (len(durations)*p + 99) / 100 // ceil
+	if rank < 1 {
+		rank = 1
+	}
+	return durations[rank-1]
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+type KV struct {
+	K, V []byte
+}
+
+// StreamBatches - delivers merged stream in batches of `batchSize` records (last one may be smaller), records and order
+// are same as of Load.
+// Batches are owned by receiver. Channel is closed at the end of stream, on error or cancellation of ctx -
+// check StreamErr after that. Collector must be closed after channel is closed.
+func (c *Collector) StreamBatches(ctx context.Context, batchSize int) <-chan []KV {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	ch := make(chan []KV, 1)
+	go func() {
+		defer close(ch)
+		c.streamErr = c.streamBatches(ctx, batchSize, ch)
+	}()
+	return ch
+}
+
+// StreamErr - error which stopped StreamBatches, valid after its channel is closed
+func (c *Collector) StreamErr() error { return c.streamErr }
+
+// streamBatches - stops on quit of collector or cancellation of ctx
+func (c *Collector) streamBatches(ctx context.Context, batchSize int, ch chan<- []KV) error {
+	args, stop := quitOnDone(ctx, TransformArgs{Quit: c.quit})
+	defer stop()
+	send := func(batch []KV) error {
+		select {
+		case ch <- batch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	batch := make([]KV, 0, batchSize)
+	if err := c.forEachMerged(args.Quit, c.bufType == SortableOldestAppearedBuffer, nil, func(k, v []byte) error {
+		batch = append(batch, KV{K: common.Copy(k), V: common.Copy(v)})
+		if len(batch) < batchSize {
+			return nil
+		}
+		err := send(batch)
+		batch = make([]KV, 0, batchSize)
+		return err
+	}); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
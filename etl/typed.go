@@ -0,0 +1,98 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// TypedLoad - handler of one record type of LoadTyped
+type TypedLoad struct {
+	Bucket   string
+	LoadFunc LoadFunc
+}
+
+// CollectTyped - collects record of type `typ`, to be loaded by LoadTyped. Type is stored as first byte of key:
+// records are sorted by (type, key), so dedup of SortableOldestAppearedBuffer is per (type, key) too.
+func (c *Collector) CollectTyped(typ byte, k, v []byte) error {
+	typedK := make([]byte, 1+len(k))
+	typedK[0] = typ
+	copy(typedK[1:], k)
+	return c.Collect(typedK, v)
+}
+
+// LoadTyped - loads records collected by CollectTyped: each type by its handler, into handler's bucket.
+// Types are loaded one after another, in order of type byte. Record of type without handler is an error.
+func (c *Collector) LoadTyped(db kv.RwTx, handlers map[byte]TypedLoad, args TransformArgs) error {
+	defer func() {
+		if c.autoClean {
+			c.Close()
+		}
+	}()
+	if args.Quit != nil {
+		c.quit = args.Quit
+	}
+	it, err := c.Iter(args)
+	if err != nil {
+		return err
+	}
+	for {
+		k, _, ok := it.Peek()
+		if !ok {
+			return it.Err()
+		}
+		if len(k) == 0 {
+			return fmt.Errorf("%s: etl: LoadTyped: record without type", c.logPrefix)
+		}
+		h, ok := handlers[k[0]]
+		if !ok {
+			return fmt.Errorf("%s: etl: LoadTyped: no handler for record type %d", c.logPrefix, k[0])
+		}
+		segment := &typeSegmentProvider{it: it, typ: k[0]}
+		if err := loadFilesIntoBucket(c.logPrefix, db, h.Bucket, c.bufType, []dataProvider{segment}, h.LoadFunc, args); err != nil {
+			return err
+		}
+	}
+}
+
+// typeSegmentProvider - records of one type from merged stream (they are adjacent), without type byte
+type typeSegmentProvider struct {
+	it  *PeekIter
+	typ byte
+}
+
+func (p *typeSegmentProvider) Next(keyBuf, valBuf []byte) ([]byte, []byte, error) {
+	k, _, ok := p.it.Peek()
+	if !ok {
+		if err := p.it.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, io.EOF
+	}
+	if len(k) == 0 || k[0] != p.typ {
+		return nil, nil, io.EOF
+	}
+	k, v, _ := p.it.Next()
+	return append(keyBuf, k[1:]...), append(valBuf, v...), nil
+}
+
+func (p *typeSegmentProvider) Dispose() uint64 { return 0 }
+
+func (p *typeSegmentProvider) String() string { return fmt.Sprintf("%T(type: %d)", p, p.typ) }
@@ -0,0 +1,256 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// MismatchError - first difference found between expected and stored data.
+// Expected == nil means key must not exist, Actual == nil means key is missing.
+type MismatchError struct {
+	Bucket   string
+	Key      []byte
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *MismatchError) Error() string {
+	switch {
+	case e.Actual == nil:
+		return fmt.Sprintf("etl: bucket %s: missing key %x, expected value %x", e.Bucket, e.Key, e.Expected)
+	case e.Expected == nil:
+		return fmt.Sprintf("etl: bucket %s: unexpected key %x, value %x", e.Bucket, e.Key, e.Actual)
+	default:
+		return fmt.Sprintf("etl: bucket %s: key %x: expected value %x, got %x", e.Bucket, e.Key, e.Expected, e.Actual)
+	}
+}
+
+// VerifyTransform - re-extracts sourceBucket, recomputes expected entries by `expectFn` (usually the LoadFunc used for build)
+// and compares them with content of builtBucket. Returns *MismatchError on first difference.
+// Whole builtBucket is compared: keys which are not expected are reported too.
+// `expectFn` must emit keys in builtBucket order - same as required for Append by Load.
+func VerifyTransform(
+	logPrefix string,
+	db kv.Tx,
+	sourceBucket string,
+	builtBucket string,
+	tmpdir string,
+	extractFunc ExtractFunc,
+	expectFn LoadFunc,
+	args TransformArgs,
+) error {
+	bufferSize := BufferOptimalSize
+	if args.BufferSize > 0 {
+		bufferSize = datasize.ByteSize(args.BufferSize)
+	}
+	bufType, err := args.bufferType()
+	if err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	collector := NewCollector(logPrefix, tmpdir, getBufferByType(bufType, bufferSize))
+	defer collector.Close()
+	if err := extractIntoFiles(logPrefix, db, sourceBucket, collector, extractFunc, args); err != nil {
+		return err
+	}
+	if expectFn == nil {
+		expectFn = IdentityLoadFunc
+	}
+
+	c, err := db.Cursor(builtBucket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	builtK, builtV, err := c.First()
+	if err != nil {
+		return err
+	}
+	// walks builtBucket in lockstep with expected entries
+	compareNext := func(_, k, v []byte) error {
+		if builtK != nil && bytes.Compare(builtK, k) < 0 {
+			return &MismatchError{Bucket: builtBucket, Key: common.Copy(builtK), Actual: common.Copy(builtV)}
+		}
+		if len(v) == 0 { // expected deletion
+			if builtK != nil && bytes.Equal(builtK, k) {
+				return &MismatchError{Bucket: builtBucket, Key: common.Copy(k), Actual: common.Copy(builtV)}
+			}
+			return nil
+		}
+		if builtK == nil || !bytes.Equal(builtK, k) {
+			return &MismatchError{Bucket: builtBucket, Key: common.Copy(k), Expected: common.Copy(v)}
+		}
+		if !bytes.Equal(builtV, v) {
+			return &MismatchError{Bucket: builtBucket, Key: common.Copy(k), Expected: common.Copy(v), Actual: common.Copy(builtV)}
+		}
+		builtK, builtV, err = c.Next()
+		return err
+	}
+
+	currentTable := &currentTableReader{getter: db, bucket: builtBucket, canonicalKey: args.CanonicalKey}
+	it := newMergeIter(logPrefix, collector.dataProviders, args)
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := expectFn(k, v, currentTable, compareNext); err != nil {
+			return err
+		}
+	}
+	if builtK != nil {
+		return &MismatchError{Bucket: builtBucket, Key: common.Copy(builtK), Actual: common.Copy(builtV)}
+	}
+	return nil
+}
+
+// verifyLoad - Load in audit mode (TransformArgs.VerifyAgainst): every record emitted by loadFunc is compared with
+// content of replica instead of writing. Keys which exist only in replica are not detected - use VerifyTransform for full compare.
+func verifyLoad(logPrefix string, replica kv.Tx, bucket string, bufType int, providers []dataProvider, loadFunc LoadFunc, args TransformArgs) error {
+	var prevK []byte
+	compareNext := func(_, k, v []byte) error {
+		if bufType == SortableOldestAppearedBuffer { // see loadFilesIntoBucket
+			if bytes.Equal(prevK, k) {
+				return nil
+			}
+			prevK = common.Copy(k)
+		}
+		actual, err := replica.GetOne(bucket, k)
+		if err != nil {
+			return err
+		}
+		if len(v) == 0 {
+			if actual != nil {
+				return &MismatchError{Bucket: bucket, Key: common.Copy(k), Actual: common.Copy(actual)}
+			}
+			return nil
+		}
+		if actual == nil {
+			return &MismatchError{Bucket: bucket, Key: common.Copy(k), Expected: common.Copy(v)}
+		}
+		if !bytes.Equal(actual, v) {
+			return &MismatchError{Bucket: bucket, Key: common.Copy(k), Expected: common.Copy(v), Actual: common.Copy(actual)}
+		}
+		return nil
+	}
+
+	currentTable := &currentTableReader{getter: replica, bucket: bucket, canonicalKey: args.CanonicalKey}
+	it, err := newLoadStream(logPrefix, providers, bufType, args)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := common.Stopped(args.Quit); err != nil {
+			return err
+		}
+		k, v, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := loadFunc(k, v, currentTable, compareNext); err != nil {
+			return err
+		}
+	}
+}
+
+// CheckComparator - checks on `samples` that `cmp` (called with nil values) is a total order consistent with bytes.Equal:
+// cmp(a, b) == 0 only for equal keys, antisymmetry and transitivity. Broken comparator silently breaks sort and merge.
+// Checks all triples of samples: O(n^3), keep samples small (~100).
+func CheckComparator(cmp kv.CmpFunc, samples [][]byte) error {
+	sign := func(a, b []byte) int {
+		c := cmp(a, b, nil, nil)
+		switch {
+		case c < 0:
+			return -1
+		case c > 0:
+			return 1
+		}
+		return 0
+	}
+	for _, a := range samples {
+		for _, b := range samples {
+			ab := sign(a, b)
+			if eq := bytes.Equal(a, b); eq != (ab == 0) {
+				return fmt.Errorf("etl: comparator is inconsistent with equality: cmp(%x, %x) = %d", a, b, ab)
+			}
+			if ba := sign(b, a); ab != -ba {
+				return fmt.Errorf("etl: comparator is not antisymmetric: cmp(%x, %x) = %d, cmp(%x, %x) = %d", a, b, ab, b, a, ba)
+			}
+		}
+	}
+	for _, a := range samples {
+		for _, b := range samples {
+			if sign(a, b) >= 0 {
+				continue
+			}
+			for _, c := range samples {
+				if sign(b, c) < 0 && sign(a, c) >= 0 {
+					return fmt.Errorf("etl: comparator is not transitive: %x < %x < %x, but not %x < %x", a, b, c, a, c)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ErrOrderViolation - see TransformArgs.VerifyOrder
+var ErrOrderViolation = errors.New("etl: merged keys out of order")
+
+// orderVerifier - checks that merged records don't go backwards by order of merge (see TransformArgs.VerifyOrder)
+type orderVerifier struct {
+	cmp          func(k1, v1, k2, v2 []byte) int
+	prevK, prevV []byte
+	records      uint64
+}
+
+func newOrderVerifier(args TransformArgs) *orderVerifier {
+	o := &orderVerifier{cmp: func(k1, _, k2, _ []byte) int { return bytes.Compare(k1, k2) }}
+	switch {
+	case args.KeyDecoder != nil && args.DecodedComparator != nil:
+		o.cmp = func(k1, v1, k2, v2 []byte) int {
+			return args.DecodedComparator(args.KeyDecoder(k1, v1), args.KeyDecoder(k2, v2))
+		}
+	case args.Comparator != nil:
+		o.cmp = func(k1, v1, k2, v2 []byte) int { return args.Comparator(k1, k2, v1, v2) }
+	}
+	return o
+}
+
+func (o *orderVerifier) check(k, v []byte) error {
+	o.records++
+	if o.records > 1 && o.cmp(o.prevK, o.prevV, k, v) > 0 {
+		return fmt.Errorf("%w: record %d: key %x (value %x) is before previous key %x (value %x)",
+			ErrOrderViolation, o.records, k, v, o.prevK, o.prevV)
+	}
+	o.prevK, o.prevV = append(o.prevK[:0], k...), append(o.prevV[:0], v...)
+	return nil
+}
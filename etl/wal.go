@@ -0,0 +1,167 @@
+/*
+   Copyright 2022 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package etl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// WAL format: sequence of frames, each frame starts with 1 byte of type:
+//
+//	walRecord:   followed by record in spill-file format: uvarint(len(k)), k, uvarint(len(v)), v. Empty v means delete.
+//	walBatchEnd: followed by uvarint(amount of records in batch). Written at the end of each Load.
+const (
+	walRecord   byte = 0x01
+	walBatchEnd byte = 0x02
+)
+
+type walWriter struct {
+	w       *bufio.Writer
+	records uint64
+	numBuf  [binary.MaxVarintLen64]byte
+}
+
+func newWALWriter(w io.Writer) *walWriter {
+	return &walWriter{w: bufio.NewWriterSize(w, BufIOSize)}
+}
+
+func (w *walWriter) record(k, v []byte) error {
+	if err := w.w.WriteByte(walRecord); err != nil {
+		return err
+	}
+	if err := writeElement(w.w, w.numBuf[:], k, v); err != nil {
+		return err
+	}
+	w.records++
+	return nil
+}
+
+func (w *walWriter) endBatch() error {
+	if err := w.w.WriteByte(walBatchEnd); err != nil {
+		return err
+	}
+	n := binary.PutUvarint(w.numBuf[:], w.records)
+	if _, err := w.w.Write(w.numBuf[:n]); err != nil {
+		return err
+	}
+	w.records = 0
+	return w.w.Flush()
+}
+
+// walReader - reads WAL batch by batch
+type walReader struct {
+	r *bufio.Reader
+}
+
+// readBatch - records of next batch. ok=false at end of WAL, or if trailing batch has no end marker (writer crashed
+// in the middle of Load, last record may be truncated): such batch was not committed and is discarded.
+func (w *walReader) readBatch() (batch *sliceDataProvider, ok bool, err error) {
+	batch = &sliceDataProvider{}
+	for {
+		frame, err := w.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		switch frame {
+		case walRecord:
+			k, v, err := readElementFromDisk(w.r, w.r, nil, nil)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, false, nil
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			batch.records = append(batch.records, sliceRecord{k, v})
+		case walBatchEnd:
+			n, err := binary.ReadUvarint(w.r)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, false, nil
+			}
+			if err != nil {
+				return nil, false, fmt.Errorf("reading batch end marker: %w", err)
+			}
+			if n != uint64(len(batch.records)) {
+				return nil, false, fmt.Errorf("batch end marker: expected %d records, read %d", n, len(batch.records))
+			}
+			return batch, true, nil
+		default:
+			return nil, false, fmt.Errorf("unknown WAL frame type: %x", frame)
+		}
+	}
+}
+
+// walAppliedKey - key in kv.DatabaseInfo: amount of WAL batches LoadFromWAL already applied to bucket
+func walAppliedKey(bucket string) []byte { return []byte("etl.walApplied." + bucket) }
+
+// LoadFromWAL - replays WAL written by TransformArgs.WALWriter into `toBucket`, batch by batch. Batch is read into
+// memory and applied only if it's terminated by end marker: trailing batch without it (writer crashed in the middle
+// of Load) is discarded.
+// Replay is resumable: after each batch, amount of applied batches is written into kv.DatabaseInfo in same tx,
+// so if tx with part of replay was committed - re-run with same WAL skips batches already applied.
+// Marker is deleted when whole WAL is applied.
+func LoadFromWAL(logPrefix string, r io.Reader, db kv.RwTx, toBucket string, args TransformArgs) error {
+	args.WALWriter = nil // don't log replay into itself
+	markerKey := walAppliedKey(toBucket)
+	marker, err := db.GetOne(kv.DatabaseInfo, markerKey)
+	if err != nil {
+		return err
+	}
+	var applied uint64
+	switch len(marker) {
+	case 0:
+	case 8:
+		applied = binary.BigEndian.Uint64(marker)
+	default:
+		return fmt.Errorf("%s: etl: bad WAL applied-marker of %s: %x", logPrefix, toBucket, marker)
+	}
+
+	w := &walReader{r: bufio.NewReaderSize(r, BufIOSize)}
+	var batch uint64
+	var markerBuf [8]byte
+	for ; ; batch++ {
+		p, ok, err := w.readBatch()
+		if err != nil {
+			return fmt.Errorf("%s: etl: WAL batch %d: %w", logPrefix, batch, err)
+		}
+		if !ok {
+			break
+		}
+		if batch < applied {
+			continue
+		}
+		if err := loadFilesIntoBucket(logPrefix, db, toBucket, SortableSliceBuffer, []dataProvider{p}, IdentityLoadFunc, args); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(markerBuf[:], batch+1)
+		if err := db.Put(kv.DatabaseInfo, markerKey, markerBuf[:]); err != nil {
+			return err
+		}
+	}
+	if batch < applied {
+		return fmt.Errorf("%s: etl: WAL has %d batches, but %d are marked as applied to %s - different WAL?", logPrefix, batch, applied, toBucket)
+	}
+	return db.Delete(kv.DatabaseInfo, markerKey)
+}
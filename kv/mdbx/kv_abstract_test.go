@@ -206,6 +206,66 @@ func TestRemoteKvVersion(t *testing.T) {
 	require.True(t, a.EnsureVersionCompatibility())
 }
 
+func TestRemoteCursorBatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fix me on win please")
+	}
+	bucket := kv.ChaindataTables[1]
+	writeDBs, readDBs := setupDatabases(t, log.New(), func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return defaultBuckets
+	})
+	ctx := context.Background()
+	require.NoError(t, writeDBs[1].Update(ctx, func(tx kv.RwTx) error {
+		for i := 0; i < 2500; i++ {
+			if err := tx.Put(bucket, []byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("val-%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	require.NoError(t, readDBs[2].View(ctx, func(tx kv.Tx) error {
+		c, err := tx.Cursor(bucket)
+		require.NoError(t, err)
+		defer c.Close()
+		bc, ok := c.(interface {
+			SeekBatch(seek []byte, limit int) ([][]byte, [][]byte, error)
+			NextBatch(limit int) ([][]byte, [][]byte, error)
+		})
+		require.True(t, ok)
+
+		keys, vals, err := bc.SeekBatch([]byte("key-00100"), 1000)
+		require.NoError(t, err)
+		require.Equal(t, 1000, len(keys))
+		require.Equal(t, "key-00100", string(keys[0]))
+		require.Equal(t, "val-1099", string(vals[999]))
+		keys, _, err = bc.NextBatch(1000)
+		require.NoError(t, err)
+		require.Equal(t, 1000, len(keys))
+		require.Equal(t, "key-01100", string(keys[0]))
+		keys, vals, err = bc.NextBatch(1000)
+		require.NoError(t, err)
+		require.Equal(t, 400, len(keys))
+		require.Equal(t, "key-02499", string(keys[399]))
+		require.Equal(t, "val-2499", string(vals[399]))
+
+		// stream is in sync after batch which ran past end of table
+		k, v, err := c.Seek([]byte("key-00007"))
+		require.NoError(t, err)
+		require.Equal(t, "key-00007", string(k))
+		require.Equal(t, "val-7", string(v))
+
+		// end of table stops requests: limit much bigger than rest of table
+		keys, _, err = bc.SeekBatch([]byte("key-02490"), 1_000_000)
+		require.NoError(t, err)
+		require.Equal(t, 10, len(keys))
+		k, _, err = c.Seek([]byte("key-00008"))
+		require.NoError(t, err)
+		require.Equal(t, "key-00008", string(k))
+		return nil
+	}))
+}
+
 func setupDatabases(t *testing.T, logger log.Logger, f mdbx.TableCfgFunc) (writeDBs []kv.RwDB, readDBs []kv.RwDB) {
 	t.Helper()
 	ctx := context.Background()
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"sync/atomic"
 
 	"github.com/ledgerwatch/log/v3"
 	"golang.org/x/sync/semaphore"
@@ -507,6 +508,88 @@ func (c *remoteCursor) Last() ([]byte, []byte, error) {
 	return c.last()
 }
 
+// SeekBatch, NextBatch - batched reading (etl.BatchCursor): requests of batch are pipelined - sent without waiting
+// for responses, so batch of `limit` records costs one round-trip instead of `limit`.
+// Batch shorter than `limit` means end of table, cursor is left at last record of batch.
+func (c *remoteCursor) SeekBatch(seek []byte, limit int) (keys, vals [][]byte, err error) {
+	return c.batch(&remote.Cursor{Cursor: c.id, Op: remote.Op_SEEK, K: seek}, limit)
+}
+
+func (c *remoteCursor) NextBatch(limit int) (keys, vals [][]byte, err error) {
+	return c.batch(&remote.Cursor{Cursor: c.id, Op: remote.Op_NEXT}, limit)
+}
+
+func (c *remoteCursor) batch(first *remote.Cursor, limit int) (keys, vals [][]byte, err error) {
+	if limit <= 0 {
+		return nil, nil, nil
+	}
+	stream := c.stream
+	stop := make(chan struct{}) // end of table (or error): no more requests
+	var queued int64            // requests which are sent or being sent
+	sent := make(chan error, 1)
+	// sending from own goroutine: server blocked on sending responses which are not read yet stops reading requests
+	go func() {
+		req := first
+		for i := 0; i < limit; i++ {
+			select {
+			case <-stop:
+				sent <- nil
+				return
+			default:
+			}
+			atomic.AddInt64(&queued, 1)
+			if err := stream.Send(req); err != nil {
+				sent <- err
+				return
+			}
+			req = &remote.Cursor{Cursor: c.id, Op: remote.Op_NEXT}
+		}
+		sent <- nil
+	}()
+	// stream can't be used until sender is done: every return waits for it
+	stopped, senderDone := false, false
+	stopSender := func() error {
+		if !stopped {
+			stopped = true
+			close(stop)
+		}
+		if senderDone {
+			return nil
+		}
+		senderDone = true
+		return <-sent
+	}
+	capacity := limit // limit may be far beyond end of table
+	if capacity > 4096 {
+		capacity = 4096
+	}
+	keys, vals = make([][]byte, 0, capacity), make([][]byte, 0, capacity)
+	for received := int64(0); ; received++ {
+		// all responses to queued requests are read: once sender is done, queued is final
+		if received == atomic.LoadInt64(&queued) && (stopped || received == int64(limit)) {
+			if err := stopSender(); err != nil {
+				return nil, nil, err
+			}
+			if received == atomic.LoadInt64(&queued) {
+				return keys, vals, nil
+			}
+		}
+		pair, err := stream.Recv()
+		if err != nil {
+			_ = stopSender()
+			return nil, nil, err
+		}
+		// responses to requests sent before end of table was seen are read anyway: stream must stay in sync with requests
+		if pair.K == nil && !stopped {
+			stopped = true
+			close(stop)
+		}
+		if !stopped {
+			keys, vals = append(keys, pair.K), append(vals, pair.V)
+		}
+	}
+}
+
 func (tx *remoteTx) closeGrpcStream() {
 	if tx.stream == nil {
 		return